@@ -1,19 +1,34 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math/rand"
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	goruntime "runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+	"wechatDataBackup/pkg/apierr"
 	"wechatDataBackup/pkg/utils"
 	"wechatDataBackup/pkg/wechat"
 
@@ -22,11 +37,34 @@ import (
 )
 
 const (
-	defaultConfig        = "config"
-	configDefaultUserKey = "userConfig.defaultUser"
-	configUsersKey       = "userConfig.users"
-	configExportPathKey  = "exportPath"
-	appVersion           = "v1.2.4"
+	defaultConfig             = "config"
+	configDefaultUserKey      = "userConfig.defaultUser"
+	configUsersKey            = "userConfig.users"
+	configExportPathKey       = "exportPath"
+	configScheduleAccountKey  = "exportSchedule.account"
+	configScheduleIntervalKey = "exportSchedule.interval"
+	configThrottleMBpsKey     = "exportThrottle.mbps"
+	configIdlePriorityKey     = "exportThrottle.idlePriority"
+	configKeepSnapshotKey     = "exportSnapshot.keep"
+	configSnapshotRetainKey   = "exportSnapshot.retention"
+	configExportWorkersKey    = "exportWorkers.media"
+	configExportDBWorkersKey  = "exportWorkers.database"
+	configSaveProgressKey     = "saveFile.progressThresholdMB"
+	configPathStatTimeoutKey  = "pathStat.timeoutSeconds"
+	defaultPathStatTimeout    = 5
+	configProviderTimeoutKey  = "provider.openTimeoutSeconds"
+	defaultProviderTimeout    = 15
+	configExportRateKey       = "exportCalibration.bytesPerSecond"
+	configBookmarkTagsKey     = "bookmarkTags.allowedTags"
+	incrementalDiffBudget     = 1800 * time.Millisecond
+	defaultExportRate         = 30 << 20
+	defaultSaveProgressMB     = 10
+	defaultSnapshotRetention  = 3
+	exportSnapshotDir         = "Snapshots"
+	appVersion                = "v1.2.4"
+	regexSearchLimit          = 5000
+	defaultBatchWorkers       = 4
+	shutdownExportTimeout     = 30 * time.Second
 )
 
 type FileLoader struct {
@@ -115,18 +153,56 @@ func (h *FileLoader) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// eventsEmit 向前端发送事件，测试时替换为记录事件
+var eventsEmit = runtime.EventsEmit
+
 // App struct
 type App struct {
 	ctx         context.Context
 	infoList    *wechat.WeChatInfoList
+	// 重新扫描微信进程时替换infoList，读取时通过findWeChatInfo
+	infoLock    sync.RWMutex
 	provider    *wechat.WechatDataProvider
 	defaultUser string
 	users       []string
 	firstStart  bool
 	firstInit   bool
+	// 上次WeChatInit打开的账号，账号未变化且数据库已打开时不重复打开
+	lastInitUser string
 	FLoader     *FileLoader
-	// 新消息导出时间变量，默认为2025年10月16日 00:00:00
+	// 上次导出新消息的时间，未导出过时为0
 	NewMessageStartTime int64
+	// 正在进行的导出数量，定时导出在有导出进行时跳过
+	exporting int32
+	// 每次开始导出时加1，后台生成清单时据此判断是否有新的导出开始
+	exportSeq int64
+	// 等待正在进行的导出结束后再关闭数据库
+	exportWG sync.WaitGroup
+	// 后台生成导出清单，不计入exporting，不阻止关闭窗口和定时任务，退出时同样等待
+	manifestWG sync.WaitGroup
+	// 定时增量导出
+	scheduleLock     sync.Mutex
+	scheduleStop     chan struct{}
+	scheduleAccount  string
+	scheduleInterval int
+	// 定时增量备份，与导出无关，按配置中的cron表达式执行
+	backupScheduleLock sync.Mutex
+	backupScheduleStop chan struct{}
+	// backup_history.json 的内存缓存，首次使用时加载
+	backupHistoryLock  sync.RWMutex
+	backupHistory      map[string]*NewDataRecord
+	backupHistoryDirty map[string]bool
+	// 正在进行的单个会话导出，jobId -> 取消函数
+	userExportLock sync.Mutex
+	userExportJobs map[string]context.CancelFunc
+	// 当前以只读方式打开的快照目录，为空时打开的是账号的导出数据
+	snapshotPath string
+	// 快照目录创建后不再修改，缓存各快照占用的空间，路径 -> 字节数
+	snapshotSizeLock sync.Mutex
+	snapshotSizes    map[string]int64
+	// 正在进行的备份巡检，账号 -> 取消函数
+	scrubLock sync.Mutex
+	scrubJobs map[string]context.CancelFunc
 }
 
 type WeChatInfo struct {
@@ -136,6 +212,8 @@ type WeChatInfo struct {
 	Version    string `json:"Version"`
 	Is64Bits   bool   `json:"Is64Bits"`
 	DBKey      string `json:"DBkey"`
+	// 数据目录格式，3为3.x，4为4.0
+	DataVersion int `json:"DataVersion"`
 }
 
 type WeChatInfoList struct {
@@ -149,8 +227,197 @@ type WeChatAccountInfos struct {
 	Total          int                        `json:"Total"`
 }
 
-type ErrorMessage struct {
-	ErrorStr string `json:"error"`
+// 列表接口出错时仍返回空列表字段，避免前端直接遍历Rows出错
+var (
+	emptyTotalFields = map[string]interface{}{"Total": 0}
+	emptyRowsFields  = map[string]interface{}{"Total": 0, "Rows": []interface{}{}}
+)
+
+const (
+	Export_ErrorCode_AccountNotFound = "account_not_found"
+	Export_ErrorCode_ExportFailed    = "export_failed"
+	Export_ErrorCode_InvalidOptions  = "invalid_options"
+	Export_ErrorCode_NoSpace         = "insufficient_space"
+	Export_ErrorCode_InvalidKey      = "key_invalid"
+	Export_ErrorCode_CachedKeyStale  = "cached_key_invalid"
+	Export_ErrorCode_Unsupported     = "unsupported_version"
+)
+
+// exportErrorCode 导出失败时返回给前端的错误码
+func exportErrorCode(err error) string {
+	if errors.Is(err, wechat.ErrUnsupportedDataVersion) {
+		return Export_ErrorCode_Unsupported
+	}
+	return Export_ErrorCode_ExportFailed
+}
+
+const (
+	Export_Stage_NewMessage = "newMessage"
+	Export_Stage_Done       = "done"
+)
+
+// 导出事件，统一通过json序列化后发送给前端
+type ExportEvent struct {
+	Account   string `json:"account,omitempty"`
+	Status    string `json:"status"`
+	Stage     string `json:"stage,omitempty"`
+	Result    string `json:"result"`
+	Progress  int    `json:"progress,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Required  uint64 `json:"required,omitempty"`
+	Available uint64 `json:"available,omitempty"`
+	// 导出完成后的校验摘要
+	Verify *wechat.ExportVerifySummary `json:"verify,omitempty"`
+}
+
+// 批量导出中单个账号的结果
+type AccountExportResult struct {
+	Account string `json:"account"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchExportSummary struct {
+	Results   []AccountExportResult `json:"results"`
+	Succeeded int                   `json:"succeeded"`
+	Failed    int                   `json:"failed"`
+}
+
+// 导出所需空间估算
+type ExportSizeEstimate struct {
+	Required  uint64 `json:"required"`
+	Available uint64 `json:"available"`
+	Enough    bool   `json:"enough"`
+}
+
+const (
+	// 流式读取消息时每批的消息数
+	messageChunkSize          = 100
+	Message_Chunk_Status_Done = "done"
+)
+
+// MessageChunkEvent 流式读取的一批消息，Status为done时表示读取结束
+type MessageChunkEvent struct {
+	StreamId  string                 `json:"streamId"`
+	Status    string                 `json:"status,omitempty"`
+	Batch     int                    `json:"batch"`
+	Total     int                    `json:"total"`
+	Rows      []wechat.WeChatMessage `json:"rows,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorCode apierr.Code            `json:"errorCode,omitempty"`
+}
+
+const User_Export_Status_Canceled = "canceled"
+
+// UserExportEvent 单个会话导出的进度和结果，失败时Error为错误信息，ErrorCode为apierr错误码
+type UserExportEvent struct {
+	JobId     string                    `json:"jobId"`
+	UserNames []string                  `json:"userNames"`
+	Status    string                    `json:"status"`
+	Progress  wechat.UserExportProgress `json:"progress"`
+	Path      string                    `json:"path,omitempty"`
+	Result    *UserExportResult         `json:"result,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+	ErrorCode apierr.Code               `json:"errorCode,omitempty"`
+}
+
+// UserExportResult 会话导出的结果，Verified表示导出目录已能按账号正常读取
+type UserExportResult struct {
+	Path     string                    `json:"path"`
+	Account  string                    `json:"account"`
+	Verified bool                      `json:"verified"`
+	Progress wechat.UserExportProgress `json:"progress"`
+}
+
+// MergeExportsEvent 合并导出目录结束时发送给前端，Report中包含冲突列表
+type MergeExportsEvent struct {
+	Status    string              `json:"status"`
+	Report    *wechat.MergeReport `json:"report,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	ErrorCode apierr.Code         `json:"errorCode,omitempty"`
+}
+
+// 缓存的数据库密钥，Key为DPAPI加密后的base64，微信未运行时用于从磁盘导出
+type CachedWeChatKey struct {
+	FilePath    string `json:"filePath"`
+	Key         string `json:"key"`
+	Version     string `json:"version"`
+	DataVersion int    `json:"dataVersion"`
+}
+
+// 每次导出写入账号导出目录的报告，文件名为export_report_<时间戳>.json
+const exportReportPrefix = "export_report_"
+
+type ExportRunReport struct {
+	Account       string               `json:"account"`
+	WeChatVersion string               `json:"wechatVersion"`
+	DataVersion   int                  `json:"dataVersion"`
+	Full          bool                 `json:"full"`
+	Archive       bool                 `json:"archive"`
+	StartTime     int64                `json:"startTime"`
+	EndTime       int64                `json:"endTime"`
+	Success       bool                 `json:"success"`
+	Error         string               `json:"error,omitempty"`
+	Report        *wechat.ExportReport `json:"report"`
+}
+
+type ExportRunReportList struct {
+	Reports []ExportRunReport `json:"reports"`
+	Total   int               `json:"total"`
+}
+
+// 导出预估结果，通过exportEstimate事件发送
+type ExportEstimateEvent struct {
+	Account  string                 `json:"account"`
+	Estimate *wechat.ExportEstimate `json:"estimate,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// ExportDryRun 的结果，EstimatedDurationSecs按最近一次导出的复制速度估算
+type ExportEstimate struct {
+	MessageCount          int64 `json:"messageCount"`
+	MediaFileCount        int64 `json:"mediaFileCount"`
+	TotalSizeBytes        int64 `json:"totalSizeBytes"`
+	EstimatedDurationSecs int   `json:"estimatedDurationSecs"`
+}
+
+// GetIncrementalDiff 的结果，按源数据目录中上次成功导出后修改的文件统计
+type IncrementalDiff struct {
+	// 源数据库是加密的，不解密无法统计消息数，始终为0，可参考ModifiedDBs
+	NewMessages        int64    `json:"newMessages"`
+	NewImages          int64    `json:"newImages"`
+	NewVideos          int64    `json:"newVideos"`
+	NewFiles           int64    `json:"newFiles"`
+	ModifiedDBs        []string `json:"modifiedDBs"`
+	EstimatedSizeBytes int64    `json:"estimatedSizeBytes"`
+	// 上次成功导出的开始时间，没有导出过时为0，此时所有文件都计入
+	Since int64 `json:"since"`
+	// 文件太多时在时间限制内只统计了一部分
+	Partial bool `json:"partial"`
+}
+
+// 定时导出每次执行的结果，通过scheduledExport事件发送
+type ScheduledExportEvent struct {
+	Account string `json:"account"`
+	Status  string `json:"status"`
+	Result  string `json:"result"`
+	Time    int64  `json:"time"`
+}
+
+const (
+	Schedule_Status_Success = "success"
+	Schedule_Status_Skipped = "skipped"
+	Schedule_Status_Error   = "error"
+)
+
+// 扫描导出目录中的账号时，每发现一个账号通过scanProgress事件发送
+type ScanProgressEvent struct {
+	Found  int    `json:"found"`
+	Latest string `json:"latest"`
+}
+
+type RefreshEvent struct {
+	Action string `json:"action"`
 }
 
 // 增量备份配置
@@ -159,8 +426,69 @@ type IncrementalBackupConfig struct {
 	BackupPath      string `json:"backupPath"`
 	LastBackupTime  int64  `json:"lastBackupTime"`
 	MaxBackupVersions int  `json:"maxBackupVersions"`
+	// 备份版本的压缩方式，为空时按原目录结构复制文件
+	Compression string `json:"compression"`
+	// 加密备份版本，加密时总是压缩为一个文件
+	Encrypt bool `json:"encrypt"`
+	// 只在设置时传入，保存前转换为ProtectedPassphrase，不写入配置文件
+	Passphrase string `json:"passphrase,omitempty"`
+	// DPAPI加密后的口令，只有当前Windows用户可以解密
+	ProtectedPassphrase string `json:"protectedPassphrase,omitempty"`
+	// 扫描时对所有文件重新计算哈希，不使用备份记录中大小和修改时间一致的哈希
+	ForceFullHash bool `json:"forceFullHash"`
+	// 相对导出目录的glob，支持**，如 FileStorage/Video/**、**/*.mp4；
+	// Include不为空时只备份匹配的文件，匹配Exclude的文件不备份
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// 不为空时备份版本直接写入远程目标，不写入BackupPath
+	Remote *BackupRemoteConfig `json:"remote,omitempty"`
+	// 未压缩的本地备份按内容哈希保存在账号目录的blobs下，内容相同的文件只保存一份
+	ContentAddressed bool `json:"contentAddressed"`
+	// 定时备份的cron表达式（分 时 日 月 周），如 0 2 * * * 为每天2点，为空时不定时备份
+	Schedule string `json:"schedule,omitempty"`
+	// 每个账号的本地备份最多占用的字节数，超出时从最旧的版本开始删除，0为不限制
+	MaxBackupBytes int64 `json:"maxBackupBytes"`
+	// 巡检时随机抽查的文件比例，0或100及以上时检查全部文件
+	ScrubSamplePercent int `json:"scrubSamplePercent"`
+	// 每个账号最近一次完成巡检的时间
+	LastScrubTime map[string]int64 `json:"lastScrubTime,omitempty"`
+}
+
+// BackupRemoteConfig 远程备份目标，Type为webdav或s3；
+// S3时Username/Password为AccessKey/SecretKey，Bucket和Region只用于S3
+type BackupRemoteConfig struct {
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Bucket   string `json:"bucket,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Username string `json:"username"`
+	// 只在设置时传入，保存前转换为ProtectedPassword，不写入配置文件
+	Password string `json:"password,omitempty"`
+	// DPAPI加密后的密码
+	ProtectedPassword string `json:"protectedPassword,omitempty"`
+}
+
+func backupRemoteEnabled(config IncrementalBackupConfig) bool {
+	return config.Remote != nil && config.Remote.Type != ""
 }
 
+// 备份压缩方式，压缩时每个备份版本写入一个backup.zip
+const (
+	Backup_Compression_None = ""
+	Backup_Compression_Zip  = "zip"
+)
+
+const (
+	backupArchiveName          = "backup.zip"
+	backupEncryptedArchiveName = "backup.zip.enc"
+)
+
+var errBackupPassphraseRequired = errors.New("backup is encrypted, passphrase required")
+
+// 压缩备份中NewDataRecord.BackupPath为 压缩包路径!/包内路径
+const backupArchiveSep = "!/"
+
 // 新增数据记录
 type NewDataRecord struct {
 	FilePath    string `json:"filePath"`
@@ -169,25 +497,269 @@ type NewDataRecord struct {
 	FileHash    string `json:"fileHash"`
 	DataType    string `json:"dataType"` // "database", "image", "video", "voice", etc.
 	BackupPath  string `json:"backupPath"`
+	// 本次备份时为新增还是修改的文件，只在备份结果中使用
+	ChangeType  string `json:"changeType,omitempty"`
+}
+
+// 备份中文件的变化类型
+const (
+	Backup_Change_Added    = "added"
+	Backup_Change_Modified = "modified"
+)
+
+// 按数据类型和目录汇总的一次备份的变化，Directory为Msg或FileStorage下的第一级目录，如 FileStorage/Video
+type BackupChangeGroup struct {
+	DataType     string `json:"dataType"`
+	Directory    string `json:"directory"`
+	Added        int    `json:"added"`
+	AddedSize    int64  `json:"addedSize"`
+	Modified     int    `json:"modified"`
+	ModifiedSize int64  `json:"modifiedSize"`
 }
 
 // 增量备份结果
 type IncrementalBackupResult struct {
 	TotalFiles     int             `json:"totalFiles"`
+	// 备份记录中没有的文件，BackupFiles为新增和修改的文件之和
 	NewFiles       int             `json:"newFiles"`
+	ModifiedFiles  int             `json:"modifiedFiles"`
 	BackupFiles    int             `json:"backupFiles"`
 	BackupSize     int64           `json:"backupSize"`
+	// 压缩后备份版本占用的大小，未压缩时为0
+	CompressedSize int64           `json:"compressedSize"`
+	// 内容寻址存储中已有相同内容，没有再次写入的文件
+	DedupedFiles   int             `json:"dedupedFiles"`
+	DedupedSize    int64           `json:"dedupedSize"`
+	// 被Include/Exclude过滤掉的文件
+	ExcludedFiles  int             `json:"excludedFiles"`
+	ExcludedSize   int64           `json:"excludedSize"`
 	BackupPath     string          `json:"backupPath"`
+	Error          string          `json:"error,omitempty"`
+	// 定时备份跳过的原因，跳过时没有创建备份版本
+	Skipped        string          `json:"skipped,omitempty"`
+	// 超出MaxBackupBytes而删除的旧备份版本
+	EvictedVersions []string       `json:"evictedVersions,omitempty"`
+	EvictedBytes    int64          `json:"evictedBytes,omitempty"`
+	Changes        []BackupChangeGroup `json:"changes"`
 	NewDataRecords []NewDataRecord `json:"newDataRecords"`
 }
 
+// FileCopyProgress 大文件复制进度，通过backupFileProgress和saveFileProgress事件发送
+type FileCopyProgress struct {
+	File    string `json:"file"`
+	Written int64  `json:"written"`
+	Total   int64  `json:"total"`
+}
+
+// emitFileCopyProgress lastEmit不为nil时与emitBackupProgress一样限制发送频率，
+// 多个文件共用lastEmit，大量小文件时不会每个文件都发送事件
+func (a *App) emitFileCopyProgress(event, file string, lastEmit *time.Time) func(written, total int64) {
+	return func(written, total int64) {
+		if lastEmit != nil {
+			if time.Since(*lastEmit) < backupProgressInterval {
+				return
+			}
+			*lastEmit = time.Now()
+		}
+		progressStr, _ := json.Marshal(FileCopyProgress{File: file, Written: written, Total: total})
+		eventsEmit(a.ctx, event, string(progressStr))
+	}
+}
+
+// 备份清单文件，保存在每次备份的目录下
+const backupManifestName = "backup_manifest.json"
+
+// VerifyBackup 全部通过时写入的标记文件
+const backupVerifiedName = "verified.json"
+
+// 备份快照信息
+type BackupSnapshot struct {
+	Account    string `json:"account"`
+	Timestamp  int64  `json:"timestamp"`
+	FileCount  int    `json:"fileCount"`
+	TotalSize  int64  `json:"totalSize"`
+	Path       string `json:"path"`
+	IsVerified bool   `json:"isVerified"`
+}
+
+// 单个账号的一个备份版本，由GetIncrementalBackupVersions返回
+type BackupVersion struct {
+	Version   string `json:"version"`
+	Timestamp int64  `json:"timestamp"`
+	FileCount int    `json:"fileCount"`
+	TotalSize int64  `json:"totalSize"`
+	// 压缩包的大小，未压缩的备份为0
+	CompressedSize int64 `json:"compressedSize"`
+	Encrypted      bool  `json:"encrypted"`
+	// 没有备份清单的旧备份无法校验，按目录统计文件
+	HasManifest bool `json:"hasManifest"`
+	// VerifyBackup是否全部通过
+	Verified bool   `json:"verified"`
+	Path     string `json:"path"`
+}
+
+type BackupSnapshotList struct {
+	Snapshots []BackupSnapshot `json:"snapshots"`
+	Total     int              `json:"total"`
+}
+
+// 备份清单中的单个文件，Hash为复制时源文件的哈希
+type BackupManifestEntry struct {
+	SourcePath string `json:"sourcePath"`
+	BackupPath string `json:"backupPath"`
+	FileSize   int64  `json:"fileSize"`
+	FileHash   string `json:"fileHash"`
+	DataType   string `json:"dataType,omitempty"`
+	ChangeType string `json:"changeType,omitempty"`
+}
+
+type BackupManifest struct {
+	CreateTime int64                 `json:"createTime"`
+	// 不为空时备份文件在该压缩包中，BackupPath为包内路径
+	Archive    string                `json:"archive,omitempty"`
+	// 压缩包加密时的密钥派生参数和校验值
+	Encryption *utils.EncryptionInfo `json:"encryption,omitempty"`
+	// 不为空时文件按FileHash保存在与备份版本同级的该目录中，BackupPath为恢复时的相对路径
+	BlobStore  string                `json:"blobStore,omitempty"`
+	// 压缩包的大小，用于统计备份占用的空间
+	ArchiveSize int64                `json:"archiveSize,omitempty"`
+	Files      []BackupManifestEntry `json:"files"`
+}
+
+// 备份校验结果
+type BackupVerificationResult struct {
+	TotalFiles    int      `json:"totalFiles"`
+	PassedFiles   int      `json:"passedFiles"`
+	FailedFiles   []string `json:"failedFiles"`
+	MissingFiles  []string `json:"missingFiles"`
+	RepairedFiles []string `json:"repairedFiles"`
+}
+
+// 清理旧备份结果
+type PruneResult struct {
+	Deleted    []string `json:"deleted"`
+	Failed     []string `json:"failed"`
+	FreedBytes int64    `json:"freedBytes"`
+	Remaining  int      `json:"remaining"`
+	// 不再被任何备份版本引用而删除的内容寻址文件
+	BlobsRemoved int `json:"blobsRemoved"`
+}
+
+// 两个备份版本清单中的同一个文件，Path为相对导出目录的路径，只在一个版本中时另一个版本的字段为空
+type BackupDiffEntry struct {
+	Path     string `json:"path"`
+	DataType string `json:"dataType"`
+	SizeA    int64  `json:"sizeA"`
+	SizeB    int64  `json:"sizeB"`
+	HashA    string `json:"hashA"`
+	HashB    string `json:"hashB"`
+}
+
+// GetBackupDiff 的结果，Added为只在版本B中的文件，Removed为只在版本A中的文件
+type BackupDiff struct {
+	Account  string            `json:"account"`
+	VersionA string            `json:"versionA"`
+	VersionB string            `json:"versionB"`
+	Added    []BackupDiffEntry `json:"added"`
+	Removed  []BackupDiffEntry `json:"removed"`
+	Changed  []BackupDiffEntry `json:"changed"`
+}
+
+// 包含某个文件的备份版本，由GetFileBackupHistory返回
+type FileBackupVersion struct {
+	Version   string `json:"version"`
+	Timestamp int64  `json:"timestamp"`
+	FileSize  int64  `json:"fileSize"`
+	FileHash  string `json:"fileHash"`
+	// 文件在压缩包中，加密时恢复需要配置中的口令
+	Archived  bool   `json:"archived"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// RestoreSingleFile 的结果
+type RestoreSingleFileResult struct {
+	Path     string `json:"path"`
+	FileSize int64  `json:"fileSize"`
+	FileHash string `json:"fileHash"`
+}
+
+// 巡检发现的损坏或缺失的文件
+type BackupScrubError struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Error   string `json:"error"`
+}
+
+// 备份巡检的进度和结果，通过backupScrub事件发送，Status为processing时只是进度
+type BackupScrubReport struct {
+	Account   string             `json:"account"`
+	Status    string             `json:"status"`
+	Versions  int                `json:"versions"`
+	Checked   int                `json:"checked"`
+	Corrupt   []BackupScrubError `json:"corrupt"`
+	// 没有备份清单或无法打开压缩包而跳过的版本
+	Skipped   []string           `json:"skipped"`
+	StartTime int64              `json:"startTime"`
+	EndTime   int64              `json:"endTime"`
+	Error     string             `json:"error,omitempty"`
+}
+
+const Scrub_Status_Canceled = "canceled"
+
+// 手动删除单个备份版本的结果，通过backupVersionDeleted事件发送
+type DeleteBackupVersionResult struct {
+	Account    string `json:"account"`
+	Version    string `json:"version"`
+	FreedBytes int64  `json:"freedBytes"`
+	// 不再被任何备份版本引用而删除的内容寻址文件
+	BlobsRemoved int `json:"blobsRemoved"`
+}
+
+// 压缩备份进度和结果，通过compressBackup事件发送
+type CompressBackupEvent struct {
+	Status           string  `json:"status"`
+	File             string  `json:"file,omitempty"`
+	Done             int     `json:"done"`
+	Total            int     `json:"total"`
+	Error            string  `json:"error,omitempty"`
+	OriginalSize     int64   `json:"originalSize"`
+	CompressedSize   int64   `json:"compressedSize"`
+	CompressionRatio float64 `json:"compressionRatio"`
+}
+
+// 恢复备份时目标文件已存在的处理方式
+const (
+	Restore_Conflict_Overwrite = "overwrite"
+	Restore_Conflict_Skip      = "skip"
+	Restore_Conflict_Rename    = "rename"
+)
+
+// 恢复备份结果
+type RestoreResult struct {
+	TotalFiles    int      `json:"totalFiles"`
+	RestoredFiles int      `json:"restoredFiles"`
+	SkippedFiles  int      `json:"skippedFiles"`
+	FailedFiles   int      `json:"failedFiles"`
+	Failed        []string `json:"failed"`
+}
+
+// 备份校验进度，通过verifyBackup事件发送
+type BackupVerifyProgress struct {
+	File  string `json:"file"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
 // 新消息导出配置
 type NewMessageExportConfig struct {
 	EnableExport    bool  `json:"enableExport"`
-	StartTime       int64 `json:"startTime"`       // 开始时间戳（2025-10-16 00:00:00）
+	StartTime       int64 `json:"startTime"`       // 账号首次导出新消息的开始时间戳，之后从LastExportTime继续
 	SavePath        string `json:"savePath"`       // 保存路径
 	IncludeMedia    bool  `json:"includeMedia"`    // 是否包含媒体文件
 	GroupByContact  bool  `json:"groupByContact"`  // 按联系人分组
+	Concurrency     int   `json:"concurrency"`     // 批量导出时同时处理的联系人数
+	// 每个账号上次成功导出新消息时所在导出的开始时间，下次从该时间继续
+	LastExportTime map[string]int64 `json:"lastExportTime,omitempty"`
 }
 
 // 对话消息结构
@@ -206,11 +778,15 @@ type DialogueGroup struct {
 
 // 新消息导出结果
 type NewMessageExportResult struct {
+	// 有新消息的联系人数
 	TotalContacts    int                    `json:"totalContacts"`
+	// 扫描过的联系人和会话数
+	ScannedContacts  int                    `json:"scannedContacts"`
 	TotalMessages    int                    `json:"totalMessages"`
 	SavePath         string                 `json:"savePath"`
-	UserBackupPath   string                 `json:"userBackupPath"`
-	BackupFilesCount int                    `json:"backupFilesCount"`
+	// 复制到 savePath\\media 下的媒体文件数和字节数
+	MediaFilesCount  int                    `json:"mediaFilesCount"`
+	MediaBytes       int64                  `json:"mediaBytes"`
 	Contacts         []ContactMessageData   `json:"contacts"`
 	ExportTime       string                 `json:"exportTime"`
 }
@@ -221,6 +797,37 @@ type ContactMessageData struct {
 	MessageCount int           `json:"messageCount"`
 	FilePath    string         `json:"filePath"`
 	Dialogue    []DialogueGroup `json:"dialogue"`
+	// 分页读取消息中途失败或同一秒的消息超过一页时为true，只导出了部分消息
+	Truncated   bool           `json:"truncated,omitempty"`
+}
+
+// 批量导出时单个联系人的结果
+type ContactExportResult struct {
+	Contact      string `json:"contact"`
+	UserName     string `json:"userName"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	MessageCount int    `json:"messageCount"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// 批量导出进度，通过batchExport事件发送
+type BatchExportProgress struct {
+	Contact string `json:"contact"`
+	Done    int    `json:"done"`
+	Total   int    `json:"total"`
+}
+
+// 批量导出结果，通过batchExportResult事件发送
+type BatchExportResult struct {
+	OutputDir  string                `json:"outputDir"`
+	StartTime  int64                 `json:"startTime"`
+	EndTime    int64                 `json:"endTime"`
+	Total      int                   `json:"total"`
+	Succeeded  int                   `json:"succeeded"`
+	Failed     int                   `json:"failed"`
+	TotalBytes int64                 `json:"totalBytes"`
+	Contacts   []ContactExportResult `json:"contacts"`
 }
 
 // NewApp creates a new App application struct
@@ -229,8 +836,6 @@ func NewApp() *App {
 	log.Println("App version:", appVersion)
 	a.firstInit = true
 	a.FLoader = NewFileLoader(".\\")
-	// 初始化新消息导出时间，默认为2025年10月16日 00:00:00
-	a.NewMessageStartTime = time.Date(2025, 10, 16, 0, 0, 0, 0, time.Local).Unix()
 	viper.SetConfigName(defaultConfig)
 	viper.SetConfigType("json")
 	viper.AddConfigPath(".")
@@ -247,6 +852,8 @@ func NewApp() *App {
 			a.NewMessageStartTime = startTime
 			log.Printf("从配置文件读取新消息开始时间: %s", time.Unix(a.NewMessageStartTime, 0).Format("2006-01-02 15:04:05"))
 		}
+		a.scheduleAccount = viper.GetString(configScheduleAccountKey)
+		a.scheduleInterval = viper.GetInt(configScheduleIntervalKey)
 	} else {
 		log.Println("not config exist")
 	}
@@ -262,13 +869,61 @@ func NewApp() *App {
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+	// 恢复上次设置的定时导出
+	if a.scheduleAccount != "" && a.scheduleInterval > 0 {
+		log.Printf("resume export schedule: %s every %d minutes", a.scheduleAccount, a.scheduleInterval)
+		a.startExportSchedule(a.scheduleAccount, a.scheduleInterval)
+	}
+	// 恢复定时备份
+	var backupConfig IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &backupConfig); err == nil && backupConfig.Schedule != "" {
+		if schedule, err := utils.ParseCron(backupConfig.Schedule); err == nil {
+			a.startBackupSchedule(backupConfig.Schedule, schedule)
+		} else {
+			log.Println("invalid backup schedule:", err)
+		}
+	}
 }
 
+// beforeClose 有导出正在进行时阻止关闭窗口，并发送closeBlocked事件提示用户等待
 func (a *App) beforeClose(ctx context.Context) (prevent bool) {
+	if count := atomic.LoadInt32(&a.exporting); count > 0 {
+		log.Println("close blocked, exporting:", count)
+		eventsEmit(a.ctx, "closeBlocked", fmt.Sprintf("{\"exporting\":%d}", count))
+		return true
+	}
 	return false
 }
 
+// beginExport 记录一个正在进行的导出，需要在启动导出协程前调用，返回的函数在导出结束时调用
+func (a *App) beginExport() func() {
+	a.exportWG.Add(1)
+	atomic.AddInt32(&a.exporting, 1)
+	atomic.AddInt64(&a.exportSeq, 1)
+	return func() {
+		atomic.AddInt32(&a.exporting, -1)
+		a.exportWG.Done()
+	}
+}
+
 func (a *App) shutdown(ctx context.Context) {
+	a.stopExportSchedule()
+	a.stopBackupSchedule()
+	// 放弃后台正在生成的清单
+	atomic.AddInt64(&a.exportSeq, 1)
+
+	waitChan := make(chan struct{})
+	go func() {
+		a.exportWG.Wait()
+		a.manifestWG.Wait()
+		close(waitChan)
+	}()
+	select {
+	case <-waitChan:
+	case <-time.After(shutdownExportTimeout):
+		log.Println("wait export timeout, exporting:", atomic.LoadInt32(&a.exporting))
+	}
+
 	if a.provider != nil {
 		a.provider.WechatWechatDataProviderClose()
 		a.provider = nil
@@ -286,950 +941,5925 @@ func (a *App) GetWeChatAllInfo() string {
 		a.provider = nil
 	}
 
-	a.infoList = wechat.GetWeChatAllInfo()
-	for i := range a.infoList.Info {
+	allInfo := a.rescanWeChatInfo()
+	for i := range allInfo.Info {
 		var info WeChatInfo
-		info.ProcessID = a.infoList.Info[i].ProcessID
-		info.FilePath = a.infoList.Info[i].FilePath
-		info.AcountName = a.infoList.Info[i].AcountName
-		info.Version = a.infoList.Info[i].Version
-		info.Is64Bits = a.infoList.Info[i].Is64Bits
-		info.DBKey = a.infoList.Info[i].DBKey
+		info.ProcessID = allInfo.Info[i].ProcessID
+		info.FilePath = allInfo.Info[i].FilePath
+		info.AcountName = allInfo.Info[i].AcountName
+		info.Version = allInfo.Info[i].Version
+		info.Is64Bits = allInfo.Info[i].Is64Bits
+		info.DBKey = allInfo.Info[i].DBKey
+		info.DataVersion = allInfo.Info[i].DataVersion
 		infoList.Info = append(infoList.Info, info)
 		infoList.Total += 1
 		log.Printf("ProcessID %d, FilePath %s, AcountName %s, Version %s, Is64Bits %t", info.ProcessID, info.FilePath, info.AcountName, info.Version, info.Is64Bits)
 	}
+	a.cacheWeChatKeys(allInfo)
 	infoStr, _ := json.Marshal(infoList)
 	// log.Println(string(infoStr))
 
 	return string(infoStr)
 }
 
-func (a *App) ExportWeChatAllData(full bool, acountName string) {
+// rescanWeChatInfo 重新获取微信进程信息并替换infoList
+func (a *App) rescanWeChatInfo() *wechat.WeChatInfoList {
+	infoList := wechat.GetWeChatAllInfo()
+	a.infoLock.Lock()
+	a.infoList = infoList
+	a.infoLock.Unlock()
+	return infoList
+}
 
-	if a.provider != nil {
-		a.provider.WechatWechatDataProviderClose()
-		a.provider = nil
+// findWeChatInfo 返回正在运行的微信中acountName的账号信息副本，没有时返回nil
+func (a *App) findWeChatInfo(acountName string) *wechat.WeChatInfo {
+	a.infoLock.RLock()
+	defer a.infoLock.RUnlock()
+	if a.infoList == nil {
+		return nil
 	}
-
-	progress := make(chan string)
-	go func() {
-		var pInfo *wechat.WeChatInfo
-		for i := range a.infoList.Info {
-			if a.infoList.Info[i].AcountName == acountName {
-				pInfo = &a.infoList.Info[i]
-				break
-			}
-		}
-
-		if pInfo == nil {
-			close(progress)
-			runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", acountName))
-			return
+	for i := range a.infoList.Info {
+		if a.infoList.Info[i].AcountName == acountName {
+			info := a.infoList.Info[i]
+			return &info
 		}
+	}
+	return nil
+}
 
-		prefixExportPath := a.FLoader.FilePrefix + "\\User\\"
-		_, err := os.Stat(prefixExportPath)
-		if err != nil {
-			os.Mkdir(prefixExportPath, os.ModeDir)
-		}
+func (a *App) ExportWeChatAllData(full bool, acountName string) {
+	a.ExportWeChatAllDataWithOptions(full, acountName, "", false)
+}
 
-		expPath := prefixExportPath + pInfo.AcountName
-		_, err = os.Stat(expPath)
-		if err == nil {
-			if !full {
-				os.RemoveAll(expPath + "\\Msg")
-			} else {
-				os.RemoveAll(expPath)
-			}
+// ExportWeChatAllDataWithOptions 按options导出，force为true时跳过导出前的空间检查
+func (a *App) ExportWeChatAllDataWithOptions(full bool, acountName string, options string, force bool) {
+	// options为json，未设置的类型默认导出
+	exportOptions := a.defaultExportOptions()
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &exportOptions); err != nil {
+			log.Println("json.Unmarshal options failed:", err)
+			a.emitExportEvent(ExportEvent{
+				Status:    wechat.Export_Status_Error,
+				Result:    fmt.Sprintf("invalid options: %v", err),
+				ErrorCode: Export_ErrorCode_InvalidOptions,
+			})
+			return
 		}
+		a.saveExportThrottle(exportOptions)
+		a.saveExportSnapshot(exportOptions)
+	}
 
-		_, err = os.Stat(expPath)
-		if err != nil {
-			os.Mkdir(expPath, os.ModeDir)
-		}
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
 
-		go wechat.ExportWeChatAllData(*pInfo, expPath, progress)
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
 
-		for p := range progress {
-			log.Println(p)
-			runtime.EventsEmit(a.ctx, "exportData", p)
-		}
+		pInfo := a.findWeChatInfo(acountName)
 
-		// 导出完成后，执行新消息导出（仅增量导出时）
-		log.Println("开始检查是否需要导出新消息，full=", full)
-		if !full {
-			log.Println("执行新消息导出，账号名=", pInfo.AcountName, "导出路径=", expPath)
-			newMessageResult := a.exportNewMessages(pInfo.AcountName, expPath)
-			if newMessageResult != nil {
-				log.Println("新消息导出完成，结果=", newMessageResult)
-				// 发送新消息导出结果
-				resultJson, _ := json.Marshal(newMessageResult)
-				runtime.EventsEmit(a.ctx, "newMessageExport", string(resultJson))
-			} else {
-				log.Println("新消息导出返回nil结果")
+		// 微信未运行时使用缓存的密钥从磁盘导出
+		if pInfo == nil {
+			info, err := a.getCachedWeChatInfo(acountName)
+			if err != nil {
+				log.Println("getCachedWeChatInfo:", err)
+				if errors.Is(err, wechat.ErrInvalidKey) {
+					a.emitExportEvent(ExportEvent{
+						Status:    wechat.Export_Status_Error,
+						Result:    "缓存的密钥已失效，请先打开并登录一次微信",
+						ErrorCode: Export_ErrorCode_CachedKeyStale,
+					})
+					return
+				}
 			}
-		} else {
-			log.Println("跳过新消息导出，因为这是全量导出")
+			pInfo = info
 		}
 
-		// 导出后重建数据提供者并通知前端刷新，避免主界面空白
-		prefixPath := "\\User\\" + pInfo.AcountName
-		if a.createWechatDataProvider(expPath, prefixPath) == nil {
-			if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
-				runtime.EventsEmit(a.ctx, "selfInfo", string(infoJson))
-			}
+		if pInfo == nil {
+			a.emitExportEvent(ExportEvent{
+				Status:    wechat.Export_Status_Error,
+				Result:    fmt.Sprintf("%s error", acountName),
+				ErrorCode: Export_ErrorCode_AccountNotFound,
+			})
+			return
 		}
-		runtime.EventsEmit(a.ctx, "refreshMessageList", "{\"action\":\"refresh\"}")
 
-		a.defaultUser = pInfo.AcountName
-		hasUser := false
-		for _, user := range a.users {
-			if user == pInfo.AcountName {
-				hasUser = true
-				break
-			}
-		}
-		if !hasUser {
-			a.users = append(a.users, pInfo.AcountName)
-		}
-		a.setCurrentConfig()
+		a.exportWeChatInfo(pInfo, full, exportOptions, force)
 	}()
 }
 
-func (a *App) createWechatDataProvider(resPath string, prefix string) error {
-	if a.provider != nil && a.provider.SelfInfo != nil && filepath.Base(resPath) == a.provider.SelfInfo.UserName {
-		log.Println("WechatDataProvider not need create:", a.provider.SelfInfo.UserName)
-		return nil
+// ExportWithManualKey 使用已知的数据库密钥从微信数据目录导出，不需要微信进程；
+// 密钥无效时在修改已有导出数据前返回错误
+func (a *App) ExportWithManualKey(dataDir string, key string, accountName string) {
+	info, err := wechat.GetWeChatInfoFromDir(dataDir, key)
+	if err != nil {
+		log.Println("GetWeChatInfoFromDir failed:", err)
+		errorCode := Export_ErrorCode_ExportFailed
+		if errors.Is(err, wechat.ErrInvalidKey) {
+			errorCode = Export_ErrorCode_InvalidKey
+		}
+		a.emitExportEvent(ExportEvent{
+			Status:    wechat.Export_Status_Error,
+			Result:    fmt.Sprintf("%v", err),
+			ErrorCode: errorCode,
+		})
+		return
+	}
+	if accountName != "" {
+		info.AcountName = accountName
 	}
 
 	if a.provider != nil {
 		a.provider.WechatWechatDataProviderClose()
 		a.provider = nil
-		log.Println("createWechatDataProvider WechatWechatDataProviderClose")
 	}
 
-	provider, err := wechat.CreateWechatDataProvider(resPath, prefix)
-	if err != nil {
-		log.Println("CreateWechatDataProvider failed:", resPath)
-		return err
-	}
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
 
-	a.provider = provider
-	// infoJson, _ := json.Marshal(a.provider.SelfInfo)
-	// runtime.EventsEmit(a.ctx, "selfInfo", string(infoJson))
-	return nil
+		a.exportWeChatInfo(info, false, a.defaultExportOptions(), false)
+	}()
 }
 
-func (a *App) WeChatInit() {
+func (a *App) keyCachePath() string {
+	return fmt.Sprintf("%s\\key_cache.json", a.FLoader.FilePrefix)
+}
 
-	if a.firstInit {
-		a.firstInit = false
-		a.scanAccountByPath(a.FLoader.FilePrefix)
-		log.Println("scanAccountByPath:", a.FLoader.FilePrefix)
+func (a *App) loadKeyCache() map[string]CachedWeChatKey {
+	cache := make(map[string]CachedWeChatKey)
+	if data, err := os.ReadFile(a.keyCachePath()); err == nil {
+		if err := json.Unmarshal(data, &cache); err != nil {
+			log.Println("parse key cache failed:", err)
+		}
 	}
+	return cache
+}
 
-	if len(a.defaultUser) == 0 {
-		log.Println("not defaultUser")
+// cacheWeChatKeys 保存获取到的密钥，密钥使用DPAPI加密后再写入
+func (a *App) cacheWeChatKeys(list *wechat.WeChatInfoList) {
+	if list == nil || len(list.Info) == 0 {
 		return
 	}
 
-	expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
-	prefixPath := "\\User\\" + a.defaultUser
-	wechat.ExportWeChatHeadImage(expPath)
-	if a.createWechatDataProvider(expPath, prefixPath) == nil {
-		infoJson, _ := json.Marshal(a.provider.SelfInfo)
-		runtime.EventsEmit(a.ctx, "selfInfo", string(infoJson))
+	cache := a.loadKeyCache()
+	changed := false
+	for _, info := range list.Info {
+		if info.DBKey == "" {
+			continue
+		}
+		protected, err := utils.ProtectData([]byte(info.DBKey))
+		if err != nil {
+			log.Println("ProtectData failed:", err)
+			continue
+		}
+		cache[info.AcountName] = CachedWeChatKey{
+			FilePath:    info.FilePath,
+			Key:         base64.StdEncoding.EncodeToString(protected),
+			Version:     info.Version,
+			DataVersion: info.DataVersion,
+		}
+		changed = true
 	}
-}
-
-func (a *App) GetWechatSessionList(pageIndex int, pageSize int) string {
-	if a.provider == nil {
-		log.Println("provider not init")
-		return "{\"Total\":0}"
+	if !changed {
+		return
 	}
-	log.Printf("pageIndex: %d\n", pageIndex)
-	list, err := a.provider.WeChatGetSessionList(pageIndex, pageSize)
+
+	data, err := json.MarshalIndent(cache, "", "  ")
 	if err != nil {
-		return "{\"Total\":0}"
+		return
+	}
+	if err := os.WriteFile(a.keyCachePath(), data, os.ModePerm); err != nil {
+		log.Println("write key cache failed:", err)
 	}
-
-	listStr, _ := json.Marshal(list)
-	log.Println("GetWechatSessionList:", list.Total)
-	return string(listStr)
 }
 
-func (a *App) GetWechatContactList(pageIndex int, pageSize int) string {
-	if a.provider == nil {
-		log.Println("provider not init")
-		return "{\"Total\":0}"
+// getCachedWeChatInfo 根据缓存的密钥和数据目录构造账号信息，并校验密钥是否仍然有效
+func (a *App) getCachedWeChatInfo(acountName string) (*wechat.WeChatInfo, error) {
+	cached, ok := a.loadKeyCache()[acountName]
+	if !ok {
+		return nil, fmt.Errorf("%s has no cached key", acountName)
 	}
-	log.Printf("pageIndex: %d\n", pageIndex)
-	list, err := a.provider.WeChatGetContactList(pageIndex, pageSize)
+
+	protected, err := base64.StdEncoding.DecodeString(cached.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := utils.UnprotectData(protected)
 	if err != nil {
-		return "{\"Total\":0}"
+		return nil, err
 	}
 
-	listStr, _ := json.Marshal(list)
+	info, err := wechat.GetWeChatInfoFromDir(cached.FilePath, string(key))
+	if err != nil {
+		return nil, err
+	}
+	info.AcountName = acountName
+	info.Version = cached.Version
+	log.Println("export from disk with cached key:", acountName, cached.FilePath)
+
+	return info, nil
+}
+
+// exportWeChatInfo 导出单个账号并在完成后重建数据提供者、更新配置
+func (a *App) exportWeChatInfo(pInfo *wechat.WeChatInfo, full bool, exportOptions wechat.ExportOptions, force bool) {
+	prefixExportPath := a.FLoader.FilePrefix + "\\User\\"
+	_, err := os.Stat(prefixExportPath)
+	if err != nil {
+		os.Mkdir(prefixExportPath, os.ModeDir)
+	}
+
+	expPath := prefixExportPath + pInfo.AcountName
+	prefixPath := "\\User\\" + pInfo.AcountName
+	if !force && !a.checkExportSpace(*pInfo, expPath, full || exportOptions.Archive, exportOptions) {
+		if _, err := os.Stat(expPath); err == nil && a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+			if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+				eventsEmit(a.ctx, "selfInfo", string(infoJson))
+			}
+		}
+		return
+	}
+
+	// 导出为zip时不替换原导出目录，查看前需要先调用ExtractExportArchive解压
+	if exportOptions.Archive {
+		zipPath, err := a.exportWeChatDataToArchive(*pInfo, expPath, exportOptions)
+		if err != nil {
+			log.Println("exportWeChatDataToArchive failed:", err)
+			a.emitExportEvent(ExportEvent{
+				Status:    wechat.Export_Status_Error,
+				Stage:     wechat.Export_Stage_Archive,
+				Result:    fmt.Sprintf("%v", err),
+				ErrorCode: exportErrorCode(err),
+			})
+		} else {
+			a.emitExportEvent(ExportEvent{
+				Status:   wechat.Export_Status_Completed,
+				Stage:    Export_Stage_Done,
+				Result:   zipPath,
+				Progress: 100,
+			})
+		}
+		if _, err := os.Stat(expPath); err == nil && a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+			if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+				eventsEmit(a.ctx, "selfInfo", string(infoJson))
+			}
+		}
+		return
+	}
+	// 导出开始前的时间作为下次新消息导出的起点，导出期间收到的消息不在本次导出的数据库中
+	exportStart := time.Now().Unix()
+	newMessageConfig, newMessageErr := a.loadNewMessageExportConfig(pInfo.AcountName)
+	if err := a.exportWeChatDataToTemp(*pInfo, expPath, full, exportOptions); err != nil {
+		log.Println("exportWeChatDataToTemp failed:", err)
+		event := ExportEvent{
+			Status:    wechat.Export_Status_Error,
+			Result:    fmt.Sprintf("%v, 原导出数据已保留", err),
+			ErrorCode: exportErrorCode(err),
+		}
+		var diskErr *wechat.DiskFullError
+		if errors.As(err, &diskErr) {
+			event.Result = fmt.Sprintf("导出磁盘空间不足，还需要 %d 字节，原导出数据已保留", diskErr.Required)
+			event.ErrorCode = Export_ErrorCode_NoSpace
+			event.Required = diskErr.Required
+			event.Available = diskErr.Available
+		}
+		a.emitExportEvent(event)
+		if _, err := os.Stat(expPath); err == nil && a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+			if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+				eventsEmit(a.ctx, "selfInfo", string(infoJson))
+			}
+		}
+		return
+	}
+	verify := a.verifyExport(expPath)
+
+	// 导出完成后，执行新消息导出（仅增量导出时）
+	log.Println("开始检查是否需要导出新消息，full=", full)
+	if newMessageErr != nil {
+		log.Println("跳过新消息导出:", newMessageErr)
+	} else if !full && newMessageConfig.EnableExport {
+		log.Println("执行新消息导出，账号名=", pInfo.AcountName, "导出路径=", expPath)
+		newMessageResult := a.exportNewMessages(pInfo.AcountName, expPath, newMessageConfig, exportStart)
+		if newMessageResult != nil {
+			log.Println("新消息导出完成，结果=", newMessageResult)
+			// 发送新消息导出结果
+			resultJson, _ := json.Marshal(newMessageResult)
+			eventsEmit(a.ctx, "newMessageExport", string(resultJson))
+		} else {
+			log.Println("新消息导出返回nil结果")
+		}
+	} else {
+		log.Println("跳过新消息导出，全量导出或未启用")
+	}
+
+	// 导出后重建数据提供者并通知前端刷新，避免主界面空白
+	if a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+		if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+			eventsEmit(a.ctx, "selfInfo", string(infoJson))
+		}
+	}
+	a.emitExportEvent(ExportEvent{
+		Status:   wechat.Export_Status_Completed,
+		Stage:    Export_Stage_Done,
+		Result:   "导出完成",
+		Progress: 100,
+		Verify:   verify,
+	})
+	a.emitRefreshEvent()
+
+	a.defaultUser = pInfo.AcountName
+	hasUser := false
+	for _, user := range a.users {
+		if user == pInfo.AcountName {
+			hasUser = true
+			break
+		}
+	}
+	if !hasUser {
+		a.users = append(a.users, pInfo.AcountName)
+	}
+	a.setCurrentConfig()
+}
+
+// ExportWeChatAccounts 依次导出多个账号，单个账号失败时继续导出其余账号，
+// 结束后发送exportSummary事件并统一更新配置
+func (a *App) ExportWeChatAccounts(accounts []string, full bool) {
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
+
+		summary := BatchExportSummary{}
+		summary.Results = make([]AccountExportResult, 0)
+		exported := make([]string, 0)
+		for _, acountName := range accounts {
+			result := AccountExportResult{Account: acountName}
+			if err := a.exportWeChatAccount(acountName, full); err != nil {
+				log.Println("exportWeChatAccount failed:", acountName, err)
+				result.Error = err.Error()
+				summary.Failed += 1
+				a.emitExportEvent(ExportEvent{
+					Account:   acountName,
+					Status:    wechat.Export_Status_Error,
+					Result:    fmt.Sprintf("%v", err),
+					ErrorCode: exportErrorCode(err),
+				})
+			} else {
+				result.Success = true
+				summary.Succeeded += 1
+				exported = append(exported, acountName)
+			}
+			summary.Results = append(summary.Results, result)
+		}
+
+		if len(exported) > 0 {
+			a.defaultUser = exported[len(exported)-1]
+			for _, acountName := range exported {
+				hasUser := false
+				for _, user := range a.users {
+					if user == acountName {
+						hasUser = true
+						break
+					}
+				}
+				if !hasUser {
+					a.users = append(a.users, acountName)
+				}
+			}
+			a.setCurrentConfig()
+		}
+
+		if a.defaultUser != "" {
+			expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+			prefixPath := "\\User\\" + a.defaultUser
+			if _, err := os.Stat(expPath); err == nil && a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+				if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+					eventsEmit(a.ctx, "selfInfo", string(infoJson))
+				}
+			}
+		}
+
+		summaryStr, _ := json.Marshal(summary)
+		log.Println("ExportWeChatAccounts:", string(summaryStr))
+		eventsEmit(a.ctx, "exportSummary", string(summaryStr))
+		a.emitExportEvent(ExportEvent{
+			Status:   wechat.Export_Status_Completed,
+			Stage:    Export_Stage_Done,
+			Result:   fmt.Sprintf("导出完成，成功 %d 个，失败 %d 个", summary.Succeeded, summary.Failed),
+			Progress: 100,
+		})
+		a.emitRefreshEvent()
+	}()
+}
+
+// exportWeChatAccount 导出单个账号，增量导出时同时导出新消息
+func (a *App) exportWeChatAccount(acountName string, full bool) error {
+	pInfo := a.findWeChatInfo(acountName)
+	if pInfo == nil {
+		return fmt.Errorf("%s not found", acountName)
+	}
+
+	prefixExportPath := a.FLoader.FilePrefix + "\\User\\"
+	if _, err := os.Stat(prefixExportPath); err != nil {
+		os.Mkdir(prefixExportPath, os.ModeDir)
+	}
+	expPath := prefixExportPath + pInfo.AcountName
+
+	options := a.defaultExportOptions()
+	if estimate, err := a.estimateExportSize(*pInfo, expPath, full, options); err == nil && !estimate.Enough {
+		return fmt.Errorf("导出空间不足，需要 %d 字节，可用 %d 字节", estimate.Required, estimate.Available)
+	}
+
+	exportStart := time.Now().Unix()
+	newMessageConfig, newMessageErr := a.loadNewMessageExportConfig(pInfo.AcountName)
+	if err := a.exportWeChatDataToTemp(*pInfo, expPath, full, options); err != nil {
+		return err
+	}
+
+	if newMessageErr != nil {
+		log.Println("跳过新消息导出:", newMessageErr)
+	} else if !full && newMessageConfig.EnableExport {
+		newMessageResult := a.exportNewMessages(pInfo.AcountName, expPath, newMessageConfig, exportStart)
+		if newMessageResult != nil {
+			resultJson, _ := json.Marshal(newMessageResult)
+			eventsEmit(a.ctx, "newMessageExport", string(resultJson))
+		}
+	}
+
+	return nil
+}
+
+// StartExportSchedule 每隔intervalMinutes分钟对accountName执行一次增量导出，设置保存到配置中
+func (a *App) StartExportSchedule(accountName string, intervalMinutes int) string {
+	if accountName == "" || intervalMinutes <= 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid schedule: account %q, interval %d", accountName, intervalMinutes))
+	}
+
+	a.startExportSchedule(accountName, intervalMinutes)
+	viper.Set(configScheduleAccountKey, accountName)
+	viper.Set(configScheduleIntervalKey, intervalMinutes)
+	a.setCurrentConfig()
+
+	return ""
+}
+
+// StopExportSchedule 停止定时导出，下次启动时不再恢复
+func (a *App) StopExportSchedule() {
+	a.stopExportSchedule()
+	viper.Set(configScheduleAccountKey, "")
+	viper.Set(configScheduleIntervalKey, 0)
+	a.setCurrentConfig()
+}
+
+func (a *App) startExportSchedule(accountName string, intervalMinutes int) {
+	a.stopExportSchedule()
+
+	a.scheduleLock.Lock()
+	defer a.scheduleLock.Unlock()
+	a.scheduleAccount = accountName
+	a.scheduleInterval = intervalMinutes
+	quitChan := make(chan struct{})
+	a.scheduleStop = quitChan
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalMinutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quitChan:
+				return
+			case <-ticker.C:
+				a.runScheduledExport(accountName)
+			}
+		}
+	}()
+	log.Printf("StartExportSchedule: %s every %d minutes", accountName, intervalMinutes)
+}
+
+func (a *App) stopExportSchedule() {
+	a.scheduleLock.Lock()
+	defer a.scheduleLock.Unlock()
+	if a.scheduleStop != nil {
+		close(a.scheduleStop)
+		a.scheduleStop = nil
+		log.Println("StopExportSchedule:", a.scheduleAccount)
+	}
+	a.scheduleAccount = ""
+	a.scheduleInterval = 0
+}
+
+// runScheduledExport 执行一次定时增量导出，已有导出进行中或微信未运行时跳过
+func (a *App) runScheduledExport(accountName string) {
+	event := ScheduledExportEvent{Account: accountName, Time: time.Now().Unix()}
+	defer func() {
+		log.Printf("scheduledExport %s: %s %s", accountName, event.Status, event.Result)
+		eventStr, _ := json.Marshal(event)
+		eventsEmit(a.ctx, "scheduledExport", string(eventStr))
+	}()
+
+	if !atomic.CompareAndSwapInt32(&a.exporting, 0, 1) {
+		event.Status = Schedule_Status_Skipped
+		event.Result = "export in progress"
+		return
+	}
+	a.exportWG.Add(1)
+	defer a.exportWG.Done()
+	defer atomic.AddInt32(&a.exporting, -1)
+
+	// 重新获取微信进程信息，微信未运行或账号未登录时跳过
+	a.rescanWeChatInfo()
+	if a.findWeChatInfo(accountName) == nil {
+		event.Status = Schedule_Status_Skipped
+		event.Result = "wechat not running"
+		return
+	}
+
+	// 导出会替换导出目录，需要先关闭数据库
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+
+	if err := a.exportWeChatAccount(accountName, false); err != nil {
+		event.Status = Schedule_Status_Error
+		event.Result = err.Error()
+	} else {
+		event.Status = Schedule_Status_Success
+	}
+
+	if a.defaultUser != "" {
+		expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+		prefixPath := "\\User\\" + a.defaultUser
+		if _, err := os.Stat(expPath); err == nil && a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+			if infoJson, err := json.Marshal(a.provider.SelfInfo); err == nil {
+				eventsEmit(a.ctx, "selfInfo", string(infoJson))
+			}
+		}
+	}
+	a.emitRefreshEvent()
+}
+
+// StartBackupSchedule 按cron表达式（分 时 日 月 周）定时备份当前账号的导出数据，不执行导出；
+// 表达式保存到增量备份配置中，下次启动时恢复
+func (a *App) StartBackupSchedule(schedule string) string {
+	cron, err := utils.ParseCron(schedule)
+	if err != nil {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid backup schedule %q: %v", schedule, err))
+	}
+
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil {
+		return apierr.JSON(apierr.Wrap(apierr.CodeInternal, err))
+	}
+	if config.BackupPath == "" && !backupRemoteEnabled(config) {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path is empty"))
+	}
+	config.Schedule = schedule
+	if !a.SetIncrementalBackupConfig(config) {
+		return apierr.JSON(apierr.New(apierr.CodeInternal, "save backup config failed"))
+	}
+
+	a.startBackupSchedule(schedule, cron)
+	return ""
+}
+
+// StopBackupSchedule 停止定时备份，并清除配置中的表达式
+func (a *App) StopBackupSchedule() {
+	a.stopBackupSchedule()
+
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.Schedule == "" {
+		return
+	}
+	config.Schedule = ""
+	a.SetIncrementalBackupConfig(config)
+}
+
+func (a *App) startBackupSchedule(spec string, schedule *utils.CronSchedule) {
+	a.stopBackupSchedule()
+
+	a.backupScheduleLock.Lock()
+	defer a.backupScheduleLock.Unlock()
+	quitChan := make(chan struct{})
+	a.backupScheduleStop = quitChan
+
+	go func() {
+		for {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				log.Println("backup schedule has no next run:", spec)
+				return
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-quitChan:
+				timer.Stop()
+				return
+			case <-timer.C:
+				a.runScheduledBackup()
+			}
+		}
+	}()
+	log.Println("StartBackupSchedule:", spec)
+}
+
+func (a *App) stopBackupSchedule() {
+	a.backupScheduleLock.Lock()
+	defer a.backupScheduleLock.Unlock()
+	if a.backupScheduleStop != nil {
+		close(a.backupScheduleStop)
+		a.backupScheduleStop = nil
+		log.Println("StopBackupSchedule")
+	}
+}
+
+// runScheduledBackup 备份当前账号导出目录中新增和修改的文件，有导出或备份进行中时跳过；
+// 结果通过incrementalBackup事件发送
+func (a *App) runScheduledBackup() {
+	result := &IncrementalBackupResult{Changes: make([]BackupChangeGroup, 0), NewDataRecords: make([]NewDataRecord, 0)}
+	defer func() {
+		log.Printf("scheduledBackup %s: files %d, skipped %q, error %q", result.BackupPath, result.BackupFiles, result.Skipped, result.Error)
+		resultJson, _ := json.Marshal(result)
+		eventsEmit(a.ctx, "incrementalBackup", string(resultJson))
+	}()
+
+	// 备份也占用导出计数，避免与导出或另一个备份同时进行
+	if !atomic.CompareAndSwapInt32(&a.exporting, 0, 1) {
+		result.Skipped = "export or backup in progress"
+		return
+	}
+	a.exportWG.Add(1)
+	defer a.exportWG.Done()
+	defer atomic.AddInt32(&a.exporting, -1)
+
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil {
+		result.Error = err.Error()
+		return
+	}
+	if config.BackupPath == "" && !backupRemoteEnabled(config) {
+		result.Skipped = "backup path is empty"
+		return
+	}
+	if a.defaultUser == "" {
+		result.Skipped = "no account"
+		return
+	}
+	expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+	if _, err := os.Stat(expPath); err != nil {
+		result.Skipped = "export data not found"
+		return
+	}
+
+	result = a.scanExistingFiles(expPath, config.BackupPath, config)
+	result = a.backupNewData(expPath, result, config)
+	if result.Error != "" {
+		return
+	}
+
+	if !backupRemoteEnabled(config) {
+		// 没有新增数据时不保留空的备份版本，避免占用保留数量
+		if result.BackupFiles == 0 {
+			os.RemoveAll(result.BackupPath)
+		}
+		a.applyBackupRetention(filepath.Dir(result.BackupPath), config.MaxBackupVersions)
+		applyBackupQuota(result, config.MaxBackupBytes)
+	}
+	a.updateLastBackupTime()
+}
+
+// updateLastBackupTime 备份成功后记录备份时间
+func (a *App) updateLastBackupTime() {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil {
+		log.Printf("Error parsing backup config: %v", err)
+		return
+	}
+	config.LastBackupTime = time.Now().Unix()
+	a.SetIncrementalBackupConfig(config)
+}
+
+// exportWeChatDataToTemp 先导出到 expPath.tmp，成功后再替换原导出目录；
+// 失败时将移入临时目录的原导出数据移回，原导出目录保持可用，临时目录和断点保留用于继续导出
+func (a *App) exportWeChatDataToTemp(info wechat.WeChatInfo, expPath string, full bool, options wechat.ExportOptions) (err error) {
+	// 不支持的版本在移动原导出数据前返回
+	if info.DataVersion == wechat.WeChat_Data_Version4 {
+		return wechat.ErrUnsupportedDataVersion
+	}
+	startTime := time.Now()
+	var report *wechat.ExportReport
+	defer func() {
+		a.writeExportRunReport(expPath, info, full, false, startTime, report, err)
+		if err == nil {
+			a.buildExportManifest(expPath)
+		}
+	}()
+
+	tmpPath := expPath + ".tmp"
+	bakPath := expPath + ".bak"
+
+	// 上次导出中断时临时目录中留有断点，继续导出时保留已导出的数据
+	moved := make([]string, 0)
+	checkpoint, cpErr := wechat.LoadExportCheckpoint(tmpPath)
+	resume := cpErr == nil && checkpoint.Matches(info) && checkpoint.Full == full && (options.Resume == nil || *options.Resume)
+	if resume {
+		log.Printf("resume export %s from checkpoint, stages %v\n", info.AcountName, checkpoint.Stages)
+		moved = checkpoint.Moved
+		// 上次导出失败时移回原导出目录的数据重新移入临时目录
+		for _, name := range moved {
+			if _, err := os.Stat(tmpPath + "\\" + name); err == nil {
+				continue
+			}
+			if err := os.Rename(expPath+"\\"+name, tmpPath+"\\"+name); err != nil {
+				log.Println("Rename:", name, err)
+			}
+		}
+	} else {
+		a.discardExportTemp(tmpPath, expPath)
+		if err := os.MkdirAll(tmpPath, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	// 增量导出时，将Msg以外的已有数据移入临时目录，导出时跳过已存在的文件；
+	// 不导出数据库时保留原有的Msg，历史导出报告始终保留
+	if entries, err := os.ReadDir(expPath); err == nil && !resume {
+		for _, entry := range entries {
+			move := !full || strings.HasPrefix(entry.Name(), exportReportPrefix)
+			if entry.Name() == "Msg" {
+				move = !options.DataBase
+			}
+			if !move {
+				continue
+			}
+			if err := os.Rename(expPath+"\\"+entry.Name(), tmpPath+"\\"+entry.Name()); err != nil {
+				log.Println("Rename:", entry.Name(), err)
+				continue
+			}
+			moved = append(moved, entry.Name())
+		}
+	}
+	if !resume {
+		checkpoint = wechat.NewExportCheckpoint(info, tmpPath, full)
+		checkpoint.Moved = moved
+		if err := checkpoint.Save(); err != nil {
+			log.Println("save export checkpoint:", err)
+		}
+	}
+
+	restore := func() {
+		for _, name := range moved {
+			if err := os.Rename(tmpPath+"\\"+name, expPath+"\\"+name); err != nil {
+				log.Println("Rename back:", name, err)
+			}
+		}
+	}
+
+	report, err = a.runWeChatExport(info, tmpPath, options)
+	if err != nil {
+		restore()
+		return err
+	}
+
+	os.RemoveAll(bakPath)
+	if _, err := os.Stat(expPath); err == nil {
+		if err := os.Rename(expPath, bakPath); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpPath, expPath); err != nil {
+		os.Rename(bakPath, expPath)
+		restore()
+		return err
+	}
+	if full && options.KeepSnapshot {
+		a.saveExportSnapshotDir(info.AcountName, bakPath, options.SnapshotRetention)
+	}
+	os.RemoveAll(bakPath)
+
+	return nil
+}
+
+// buildExportManifest 在后台为导出目录生成manifest.json，不阻塞导出完成事件，
+// 开始和结束时发送manifestBuilding事件；生成期间不计入正在进行的导出，有新的导出开始或程序退出时放弃本次生成
+func (a *App) buildExportManifest(expPath string) {
+	a.manifestWG.Add(1)
+	seq := atomic.LoadInt64(&a.exportSeq)
+	go func() {
+		defer a.manifestWG.Done()
+		eventsEmit(a.ctx, "manifestBuilding", fmt.Sprintf("{\"status\":\"%s\"}", wechat.Export_Status_Processing))
+
+		entries, err := wechat.BuildExportManifest(expPath, func() bool {
+			return atomic.LoadInt64(&a.exportSeq) != seq
+		})
+		if err != nil {
+			log.Println("BuildExportManifest failed:", err)
+			errStr, _ := json.Marshal(err.Error())
+			eventsEmit(a.ctx, "manifestBuilding", fmt.Sprintf("{\"status\":\"%s\",\"error\":%s}", wechat.Export_Status_Error, errStr))
+			return
+		}
+		log.Printf("BuildExportManifest %s: %d files\n", expPath, len(entries))
+		eventsEmit(a.ctx, "manifestBuilding", fmt.Sprintf("{\"status\":\"%s\",\"files\":%d}", wechat.Export_Status_Completed, len(entries)))
+	}()
+}
+
+// discardExportTemp 删除上次中断的临时导出目录，删除前将断点中记录的从原导出目录移入的数据移回
+func (a *App) discardExportTemp(tmpPath, expPath string) {
+	if checkpoint, err := wechat.LoadExportCheckpoint(tmpPath); err == nil {
+		for _, name := range checkpoint.Moved {
+			if _, err := os.Stat(expPath + "\\" + name); err == nil {
+				continue
+			}
+			if err := os.Rename(tmpPath+"\\"+name, expPath+"\\"+name); err != nil {
+				log.Println("Rename back:", name, err)
+			}
+		}
+	}
+	os.RemoveAll(tmpPath)
+}
+
+// ExportCheckpointInfo 账号上次中断的导出，Resumable为false时下次导出会重新开始
+type ExportCheckpointInfo struct {
+	Resumable  bool                     `json:"resumable"`
+	Checkpoint *wechat.ExportCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// GetExportCheckpoint 查询账号是否有可以继续的中断导出，供前端在导出前询问是否继续
+func (a *App) GetExportCheckpoint(acountName string) string {
+	tmpPath := a.FLoader.FilePrefix + "\\User\\" + acountName + ".tmp"
+	result := ExportCheckpointInfo{}
+	checkpoint, err := wechat.LoadExportCheckpoint(tmpPath)
+	if err == nil {
+		result.Checkpoint = checkpoint
+		info, _ := a.getCachedWeChatInfo(acountName)
+		if running := a.findWeChatInfo(acountName); running != nil {
+			info = running
+		}
+		result.Resumable = info != nil && checkpoint.Matches(*info)
+	}
+
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
+}
+
+// ExportSnapshot 全量导出前保留的旧导出目录，Name为创建时的时间戳
+type ExportSnapshot struct {
+	Account    string `json:"account"`
+	Name       string `json:"name"`
+	CreateTime int64  `json:"createTime"`
+	Size       int64  `json:"size"`
+	Path       string `json:"path"`
+	Opened     bool   `json:"opened"`
+}
+
+type ExportSnapshotList struct {
+	Account   string           `json:"account"`
+	Total     int              `json:"total"`
+	Snapshots []ExportSnapshot `json:"snapshots"`
+}
+
+func (a *App) snapshotRoot(account string) string {
+	return filepath.Join(a.FLoader.FilePrefix, exportSnapshotDir, account)
+}
+
+// snapshotPathByName 快照名只能是时间戳，避免通过名称访问快照目录以外的路径
+func (a *App) snapshotPathByName(account, name string) (string, error) {
+	if account == "" || account != filepath.Base(account) {
+		return "", apierr.New(apierr.CodeInvalidParam, "invalid account: %s", account)
+	}
+	if _, err := strconv.ParseInt(name, 10, 64); err != nil {
+		return "", apierr.New(apierr.CodeInvalidParam, "invalid snapshot: %s", name)
+	}
+	path := filepath.Join(a.snapshotRoot(account), name)
+	if _, err := os.Stat(path); err != nil {
+		return "", apierr.Wrapf(apierr.CodeNotFound, err, "%s", path)
+	}
+	return path, nil
+}
+
+// listExportSnapshots 按创建时间从新到旧返回账号的快照
+func (a *App) listExportSnapshots(account string) []ExportSnapshot {
+	snapshots := make([]ExportSnapshot, 0)
+	root := a.snapshotRoot(account)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return snapshots
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		ts, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		snapshots = append(snapshots, ExportSnapshot{
+			Account:    account,
+			Name:       entry.Name(),
+			CreateTime: ts,
+			Size:       a.snapshotSize(path),
+			Path:       path,
+			Opened:     a.snapshotPath != "" && strings.EqualFold(a.snapshotPath, path),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreateTime > snapshots[j].CreateTime })
+	return snapshots
+}
+
+// snapshotSize 返回快照占用的空间，每个快照只遍历一次目录
+func (a *App) snapshotSize(path string) int64 {
+	a.snapshotSizeLock.Lock()
+	size, ok := a.snapshotSizes[path]
+	a.snapshotSizeLock.Unlock()
+	if ok {
+		return size
+	}
+
+	size = backupDirSize(path)
+	a.snapshotSizeLock.Lock()
+	if a.snapshotSizes == nil {
+		a.snapshotSizes = make(map[string]int64)
+	}
+	a.snapshotSizes[path] = size
+	a.snapshotSizeLock.Unlock()
+	return size
+}
+
+func (a *App) removeSnapshotDir(path string) error {
+	a.snapshotSizeLock.Lock()
+	delete(a.snapshotSizes, path)
+	a.snapshotSizeLock.Unlock()
+	return os.RemoveAll(path)
+}
+
+// saveExportSnapshotDir 将全量导出替换下来的旧导出目录移入快照目录，超出保留数量的旧快照被删除
+func (a *App) saveExportSnapshotDir(account, bakPath string, retention int) {
+	if _, err := os.Stat(bakPath); err != nil {
+		return
+	}
+	if retention <= 0 {
+		retention = defaultSnapshotRetention
+	}
+
+	root := a.snapshotRoot(account)
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		log.Println("MkdirAll:", root, err)
+		return
+	}
+	path := filepath.Join(root, strconv.FormatInt(time.Now().Unix(), 10))
+	if err := os.Rename(bakPath, path); err != nil {
+		log.Println("save export snapshot failed:", bakPath, err)
+		return
+	}
+	log.Println("save export snapshot:", path)
+
+	snapshots := a.listExportSnapshots(account)
+	for _, snapshot := range snapshots[min(retention, len(snapshots)):] {
+		if snapshot.Opened {
+			continue
+		}
+		if err := a.removeSnapshotDir(snapshot.Path); err != nil {
+			log.Printf("remove snapshot %s failed: %v\n", snapshot.Path, err)
+		}
+	}
+}
+
+// ListSnapshots 返回账号保留的导出快照及各自占用的空间
+func (a *App) ListSnapshots(account string) string {
+	if account == "" || account != filepath.Base(account) {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "invalid account: %s", account), map[string]interface{}{"total": 0, "snapshots": []ExportSnapshot{}})
+	}
+
+	snapshots := a.listExportSnapshots(account)
+	resultStr, _ := json.Marshal(ExportSnapshotList{Account: account, Total: len(snapshots), Snapshots: snapshots})
+	return string(resultStr)
+}
+
+func (a *App) DeleteSnapshot(account, name string) string {
+	path, err := a.snapshotPathByName(account, name)
+	if err != nil {
+		return apierr.JSON(err)
+	}
+
+	if a.snapshotPath != "" && strings.EqualFold(a.snapshotPath, path) {
+		a.CloseSnapshot()
+	}
+	if err := a.removeSnapshotDir(path); err != nil {
+		log.Println("DeleteSnapshot failed:", path, err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", path))
+	}
+
+	return ""
+}
+
+// OpenSnapshot 以只读方式在查看器中打开快照，CloseSnapshot后恢复为当前账号的导出数据
+func (a *App) OpenSnapshot(account, name string) string {
+	path, err := a.snapshotPathByName(account, name)
+	if err != nil {
+		return apierr.JSON(err)
+	}
+
+	provider, err := wechat.CreateWechatDataProviderReadOnly(path, "\\"+exportSnapshotDir+"\\"+account+"\\"+name, account)
+	if err != nil {
+		log.Println("CreateWechatDataProviderReadOnly failed:", path, err)
+		if provider != nil {
+			provider.WechatWechatDataProviderClose()
+		}
+		return apierr.JSON(apierr.Wrapf(apierr.CodeDBFailure, err, "%s", path))
+	}
+
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+	}
+	a.provider = provider
+	a.snapshotPath = path
+
+	infoJson, _ := json.Marshal(a.provider.SelfInfo)
+	eventsEmit(a.ctx, "selfInfo", string(infoJson))
+	a.emitRefreshEvent()
+	return ""
+}
+
+func (a *App) CloseSnapshot() string {
+	if a.snapshotPath == "" {
+		return ""
+	}
+	a.closeSnapshot()
+	a.WeChatInit()
+	a.emitRefreshEvent()
+	return ""
+}
+
+func (a *App) closeSnapshot() {
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+	a.snapshotPath = ""
+}
+
+// estimateExportSize 增量导出时已有的数据移入临时目录，只需要将要复制的文件的空间
+func (a *App) estimateExportSize(info wechat.WeChatInfo, expPath string, full bool, options wechat.ExportOptions) (*ExportSizeEstimate, error) {
+	// utils.GetPathStat 在windows下通过GetDiskFreeSpaceEx获取剩余空间
+	stat, err := utils.GetPathStat(a.FLoader.FilePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &ExportSizeEstimate{}
+	estimate.Required = uint64(wechat.EstimateExport(info, expPath, full, options).BytesToCopy)
+	estimate.Available = stat.Free
+	estimate.Enough = estimate.Required < estimate.Available
+
+	return estimate, nil
+}
+
+// checkExportSpace 空间不足时发送错误事件并返回false
+func (a *App) checkExportSpace(info wechat.WeChatInfo, expPath string, full bool, options wechat.ExportOptions) bool {
+	estimate, err := a.estimateExportSize(info, expPath, full, options)
+	if err != nil {
+		log.Println("estimateExportSize failed:", err)
+		return true
+	}
+	log.Printf("export need %d bytes, free %d bytes\n", estimate.Required, estimate.Available)
+	if estimate.Enough {
+		return true
+	}
+
+	a.emitExportEvent(ExportEvent{
+		Status:    wechat.Export_Status_Error,
+		Result:    fmt.Sprintf("导出空间不足，需要 %d 字节，可用 %d 字节", estimate.Required, estimate.Available),
+		ErrorCode: Export_ErrorCode_NoSpace,
+		Required:  estimate.Required,
+		Available: estimate.Available,
+	})
+	return false
+}
+
+// runWeChatExport 执行导出并将进度转发给前端
+func (a *App) runWeChatExport(info wechat.WeChatInfo, expPath string, options wechat.ExportOptions) (*wechat.ExportReport, error) {
+	progress := make(chan wechat.ExportProgress)
+	errChan := make(chan error, 1)
+	var report *wechat.ExportReport
+	go func() {
+		var err error
+		report, err = wechat.ExportWeChatAllData(info, expPath, options, progress)
+		errChan <- err
+	}()
+
+	for p := range progress {
+		p.Account = info.AcountName
+		pStr, err := json.Marshal(p)
+		if err != nil {
+			log.Println("json.Marshal:", err)
+			continue
+		}
+		log.Println(string(pStr))
+		eventsEmit(a.ctx, "exportData", string(pStr))
+	}
+
+	exportErr := <-errChan
+	// 单个文件的错误不会中断导出，导出结束后汇总发送给前端
+	if report != nil {
+		log.Printf("export file errors %d, copied %d (%d bytes), skipped %d (%d bytes)\n", report.Total, report.FilesCopied, report.BytesCopied, report.FilesSkipped, report.BytesSkipped)
+		if reportStr, err := json.Marshal(report); err == nil {
+			eventsEmit(a.ctx, "exportReport", string(reportStr))
+		}
+	}
+
+	return report, exportErr
+}
+
+// writeExportRunReport 将本次导出的报告写入账号导出目录，目录不存在时不写入
+func (a *App) writeExportRunReport(expPath string, info wechat.WeChatInfo, full bool, archive bool, startTime time.Time, report *wechat.ExportReport, exportErr error) {
+	if _, err := os.Stat(expPath); err != nil {
+		return
+	}
+
+	runReport := ExportRunReport{
+		Account:       info.AcountName,
+		WeChatVersion: info.Version,
+		DataVersion:   info.DataVersion,
+		Full:          full,
+		Archive:       archive,
+		StartTime:     startTime.Unix(),
+		EndTime:       time.Now().Unix(),
+		Success:       exportErr == nil,
+		Report:        report,
+	}
+	if exportErr != nil {
+		runReport.Error = exportErr.Error()
+	}
+	a.updateExportRate(report, startTime)
+
+	reportJson, err := json.MarshalIndent(runReport, "", "  ")
+	if err != nil {
+		log.Println("json.MarshalIndent:", err)
+		return
+	}
+	reportPath := fmt.Sprintf("%s\\%s%d.json", expPath, exportReportPrefix, runReport.StartTime)
+	if err := os.WriteFile(reportPath, reportJson, os.ModePerm); err != nil {
+		log.Println("write export report failed:", err)
+	}
+}
+
+// updateExportRate 记录导出的复制速度，供ExportDryRun估算时间；复制的数据太少时速度不准确，不更新
+func (a *App) updateExportRate(report *wechat.ExportReport, startTime time.Time) {
+	if report == nil || report.BytesCopied < 100<<20 {
+		return
+	}
+	seconds := time.Since(startTime).Seconds()
+	if seconds < 1 {
+		return
+	}
+	rate := int64(float64(report.BytesCopied) / seconds)
+	viper.Set(configExportRateKey, rate)
+	a.setCurrentConfig()
+	log.Printf("export rate: %d bytes/s\n", rate)
+}
+
+// ExportDryRun 统计acountName的源数据中将要导出的文件数和大小，不创建或修改任何文件；
+// 源数据库是加密的，消息数取自已有的导出数据，没有导出过时为0
+func (a *App) ExportDryRun(acountName string) string {
+	pInfo := a.findWeChatInfo(acountName)
+	if pInfo == nil {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "%s not found", acountName))
+	}
+
+	expPath := a.FLoader.FilePrefix + "\\User\\" + acountName
+	estimate := ExportEstimate{}
+	stages := wechat.EstimateExport(*pInfo, expPath, true, a.defaultExportOptions())
+	for _, stage := range stages.Stages {
+		estimate.TotalSizeBytes += stage.BytesTotal
+		if stage.Stage != wechat.Export_Stage_DataBase {
+			estimate.MediaFileCount += stage.FilesTotal
+		}
+	}
+	if _, err := os.Stat(expPath); err == nil {
+		estimate.MessageCount = wechat.WechatGetAccountMessageCount(expPath)
+	}
+
+	rate := viper.GetInt64(configExportRateKey)
+	if rate <= 0 {
+		rate = defaultExportRate
+	}
+	estimate.EstimatedDurationSecs = int((estimate.TotalSizeBytes + rate - 1) / rate)
+
+	log.Printf("ExportDryRun %s: %d messages, %d media files, %d bytes, %ds\n", acountName,
+		estimate.MessageCount, estimate.MediaFileCount, estimate.TotalSizeBytes, estimate.EstimatedDurationSecs)
+	estimateStr, _ := json.Marshal(estimate)
+	return string(estimateStr)
+}
+
+// GetIncrementalDiff 统计accountName的源数据目录中上次成功导出之后修改的文件，不复制任何文件；
+// 只比较修改时间，超过incrementalDiffBudget时返回部分结果
+func (a *App) GetIncrementalDiff(accountName string) string {
+	pInfo := a.findWeChatInfo(accountName)
+	if pInfo == nil {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "%s not found", accountName))
+	}
+
+	diff := IncrementalDiff{Since: a.lastExportTime(accountName)}
+	since := time.Time{}
+	if diff.Since > 0 {
+		since = time.Unix(diff.Since, 0)
+	}
+	changes := wechat.CollectChangesSince(*pInfo, since, time.Now().Add(incrementalDiffBudget))
+	diff.NewImages = changes.NewImages
+	diff.NewVideos = changes.NewVideos
+	diff.NewFiles = changes.NewFiles
+	diff.ModifiedDBs = changes.ModifiedDBs
+	diff.EstimatedSizeBytes = changes.Bytes
+	diff.Partial = changes.Partial
+
+	log.Printf("GetIncrementalDiff %s since %d: %d dbs, %d images, %d videos, %d files, %d bytes, partial %v\n", accountName, diff.Since,
+		len(diff.ModifiedDBs), diff.NewImages, diff.NewVideos, diff.NewFiles, diff.EstimatedSizeBytes, diff.Partial)
+	diffStr, _ := json.Marshal(diff)
+	return string(diffStr)
+}
+
+// lastExportTime 返回最近一次成功导出的开始时间，导出开始后修改的文件不一定已导出
+func (a *App) lastExportTime(account string) int64 {
+	expPath := a.FLoader.FilePrefix + "\\User\\" + account
+	files, err := filepath.Glob(filepath.Join(expPath, exportReportPrefix+"*.json"))
+	if err != nil {
+		return 0
+	}
+
+	var last int64
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var runReport ExportRunReport
+		if err := json.Unmarshal(data, &runReport); err != nil {
+			continue
+		}
+		if runReport.Success && runReport.StartTime > last {
+			last = runReport.StartTime
+		}
+	}
+	return last
+}
+
+// GetExportReports 返回账号的历史导出报告，最新的在前
+func (a *App) GetExportReports(account string) string {
+	list := ExportRunReportList{Reports: make([]ExportRunReport, 0)}
+	expPath := a.FLoader.FilePrefix + "\\User\\" + account
+	files, err := filepath.Glob(filepath.Join(expPath, exportReportPrefix+"*.json"))
+	if err != nil {
+		log.Println("filepath.Glob:", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Println("ReadFile:", err)
+			continue
+		}
+		var runReport ExportRunReport
+		if err := json.Unmarshal(data, &runReport); err != nil {
+			log.Println("json.Unmarshal:", file, err)
+			continue
+		}
+		list.Reports = append(list.Reports, runReport)
+	}
+	sort.Slice(list.Reports, func(i, j int) bool { return list.Reports[i].StartTime > list.Reports[j].StartTime })
+	list.Total = len(list.Reports)
+
+	listStr, _ := json.Marshal(list)
+	return string(listStr)
+}
+
+// EstimateExport 在后台统计导出将要复制的文件数和大小，不写入任何文件，结果通过exportEstimate事件发送
+func (a *App) EstimateExport(account string, full bool) {
+	go func() {
+		event := ExportEstimateEvent{Account: account}
+		pInfo := a.findWeChatInfo(account)
+
+		if pInfo == nil {
+			event.Error = fmt.Sprintf("%s not found", account)
+		} else {
+			expPath := a.FLoader.FilePrefix + "\\User\\" + account
+			event.Estimate = wechat.EstimateExport(*pInfo, expPath, full, a.defaultExportOptions())
+			log.Printf("EstimateExport %s: copy %d files (%d bytes), skip %d files (%d bytes)\n", account,
+				event.Estimate.FilesToCopy, event.Estimate.BytesToCopy, event.Estimate.FilesSkipped, event.Estimate.BytesSkipped)
+		}
+
+		eventStr, _ := json.Marshal(event)
+		eventsEmit(a.ctx, "exportEstimate", string(eventStr))
+	}()
+}
+
+// verifyExport 校验导出目录，校验本身失败时返回nil，不影响导出结果
+func (a *App) verifyExport(expPath string) *wechat.ExportVerifySummary {
+	report, err := wechat.VerifyExport(expPath)
+	if report == nil {
+		log.Println("VerifyExport failed:", err)
+		return nil
+	}
+	if err != nil {
+		log.Println("write verify report failed:", err)
+	}
+	log.Printf("VerifyExport %s: ok %t, db %d/%d failed, media %d/%d failed\n", expPath, report.Summary.OK,
+		report.Summary.DBFailed, report.Summary.DBTotal, report.Summary.MediaFailed, report.Summary.MediaSampled)
+
+	return &report.Summary
+}
+
+// VerifyExport 校验账号的导出数据，返回完整的校验报告
+func (a *App) VerifyExport(account string) string {
+	expPath := a.FLoader.FilePrefix + "\\User\\" + account
+	report, err := wechat.VerifyExport(expPath)
+	if report == nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", expPath))
+	}
+	if err != nil {
+		log.Println("write verify report failed:", err)
+	}
+
+	reportStr, _ := json.Marshal(report)
+	return string(reportStr)
+}
+
+// exportWeChatDataToArchive 导出为 expPath.zip，原导出目录保持不变；
+// 数据库、语音和头像需要先导出到临时目录再写入zip
+func (a *App) exportWeChatDataToArchive(info wechat.WeChatInfo, expPath string, options wechat.ExportOptions) (zipPath string, err error) {
+	if info.DataVersion == wechat.WeChat_Data_Version4 {
+		return "", wechat.ErrUnsupportedDataVersion
+	}
+	startTime := time.Now()
+	var report *wechat.ExportReport
+	defer func() {
+		a.writeExportRunReport(expPath, info, true, true, startTime, report, err)
+	}()
+
+	tmpPath := expPath + ".tmp"
+	zipPath = expPath + ".zip"
+	zipTmpPath := zipPath + ".tmp"
+	a.discardExportTemp(tmpPath, expPath)
+	os.Remove(zipTmpPath)
+	if err := os.MkdirAll(tmpPath, os.ModePerm); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	options.ArchivePath = zipTmpPath
+	report, err = a.runWeChatExport(info, tmpPath, options)
+	if err != nil {
+		os.Remove(zipTmpPath)
+		return "", err
+	}
+
+	os.Remove(zipPath)
+	if err := os.Rename(zipTmpPath, zipPath); err != nil {
+		os.Remove(zipTmpPath)
+		return "", err
+	}
+
+	return zipPath, nil
+}
+
+func (a *App) emitExportEvent(event ExportEvent) {
+	eventStr, err := json.Marshal(event)
+	if err != nil {
+		log.Println("json.Marshal:", err)
+		return
+	}
+	eventsEmit(a.ctx, "exportData", string(eventStr))
+}
+
+// reopenDefaultProvider 数据提供者已关闭时重新打开默认账号的导出数据并发送selfInfo事件
+func (a *App) reopenDefaultProvider() {
+	if a.provider != nil || a.defaultUser == "" {
+		return
+	}
+	expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+	prefixPath := "\\User\\" + a.defaultUser
+	if _, err := os.Stat(expPath); err != nil {
+		return
+	}
+	if a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+		a.lastInitUser = a.defaultUser
+		infoJson, _ := json.Marshal(a.provider.SelfInfo)
+		eventsEmit(a.ctx, "selfInfo", string(infoJson))
+	}
+}
+
+func (a *App) emitRefreshEvent() {
+	eventStr, _ := json.Marshal(RefreshEvent{Action: "refresh"})
+	eventsEmit(a.ctx, "refreshMessageList", string(eventStr))
+}
+
+// createWechatDataProvider 打开resPath下的数据库，超过provider.openTimeoutSeconds（默认15秒）未完成时
+// 发送providerError事件并返回context.DeadlineExceeded
+func (a *App) createWechatDataProvider(ctx context.Context, resPath string, prefix string) error {
+	if a.provider != nil && a.provider.SelfInfo != nil && a.snapshotPath == "" && filepath.Base(resPath) == a.provider.SelfInfo.UserName {
+		log.Println("WechatDataProvider not need create:", a.provider.SelfInfo.UserName)
+		return nil
+	}
+
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+		log.Println("createWechatDataProvider WechatWechatDataProviderClose")
+	}
+
+	// 数据库被其他进程锁定时打开可能一直阻塞，超时后不再等待，之后打开成功的数据库直接关闭
+	timeout := viper.GetInt(configProviderTimeoutKey)
+	if timeout <= 0 {
+		timeout = defaultProviderTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	type openResult struct {
+		provider *wechat.WechatDataProvider
+		err      error
+	}
+	done := make(chan openResult, 1)
+	go func() {
+		provider, err := wechat.CreateWechatDataProvider(resPath, prefix)
+		done <- openResult{provider, err}
+	}()
+
+	var provider *wechat.WechatDataProvider
+	select {
+	case result := <-done:
+		if result.err != nil {
+			log.Println("CreateWechatDataProvider failed:", resPath)
+			return result.err
+		}
+		provider = result.provider
+	case <-ctx.Done():
+		go func() {
+			if result := <-done; result.provider != nil {
+				result.provider.WechatWechatDataProviderClose()
+			}
+		}()
+		log.Println("CreateWechatDataProvider timeout:", resPath, ctx.Err())
+		if ctx.Err() == context.DeadlineExceeded {
+			eventsEmit(a.ctx, "providerError", "{\"status\":\"error\",\"message\":\"database open timeout\"}")
+		}
+		return ctx.Err()
+	}
+
+	a.provider = provider
+	a.snapshotPath = ""
+	// infoJson, _ := json.Marshal(a.provider.SelfInfo)
+	// eventsEmit(a.ctx, "selfInfo", string(infoJson))
+	return nil
+}
+
+func (a *App) WeChatInit() {
+
+	if a.firstInit {
+		a.firstInit = false
+		a.scanAccountByPath(a.ctx, a.FLoader.FilePrefix)
+		log.Println("scanAccountByPath:", a.FLoader.FilePrefix)
+	}
+
+	if len(a.defaultUser) == 0 {
+		log.Println("not defaultUser")
+		return
+	}
+
+	if a.defaultUser == a.lastInitUser && a.provider != nil {
+		log.Println("WeChatInit: already init", a.defaultUser)
+		return
+	}
+
+	expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+	prefixPath := "\\User\\" + a.defaultUser
+	wechat.ExportWeChatHeadImage(expPath)
+	if a.createWechatDataProvider(a.ctx, expPath, prefixPath) == nil {
+		a.lastInitUser = a.defaultUser
+		infoJson, _ := json.Marshal(a.provider.SelfInfo)
+		eventsEmit(a.ctx, "selfInfo", string(infoJson))
+	}
+}
+
+func (a *App) GetWechatSessionList(pageIndex int, pageSize int) string {
+	return a.GetWechatSessionListSorted(pageIndex, pageSize, "", "")
+}
+
+// GetWechatSessionListSorted sortBy支持time、name、count，filterType支持group、individual、unread，为空时不排序或过滤
+func (a *App) GetWechatSessionListSorted(pageIndex int, pageSize int, sortBy string, filterType string) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	log.Printf("pageIndex: %d, sortBy: %s, filterType: %s\n", pageIndex, sortBy, filterType)
+	list, err := a.provider.WeChatGetSessionList(pageIndex, pageSize, sortBy, filterType)
+	if err != nil {
+		log.Println("WeChatGetSessionList failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatSessionList:", list.Total)
+	return string(listStr)
+}
+
+func (a *App) GetWechatContactList(pageIndex int, pageSize int) string {
+	return a.GetWechatContactListFiltered(pageIndex, pageSize, "")
+}
+
+// GetWechatContactListFiltered filter支持group、individual、subscription，为空时返回全部联系人
+func (a *App) GetWechatContactListFiltered(pageIndex int, pageSize int, filter string) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	log.Printf("pageIndex: %d, filter: %s\n", pageIndex, filter)
+	list, err := a.provider.WeChatGetContactList(pageIndex, pageSize, filter)
+	if err != nil {
+		log.Println("WeChatGetContactList failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	listStr, _ := json.Marshal(list)
 	log.Println("WeChatGetContactList:", list.Total)
 	return string(listStr)
 }
 
-func (a *App) GetWechatMessageListByTime(userName string, time int64, pageSize int, direction string) string {
-	log.Println("GetWechatMessageListByTime:", userName, pageSize, time, direction)
-	if len(userName) == 0 {
-		return "{\"Total\":0, \"Rows\":[]}"
-	}
-	dire := wechat.Message_Search_Forward
-	if direction == "backward" {
-		dire = wechat.Message_Search_Backward
-	} else if direction == "both" {
-		dire = wechat.Message_Search_Both
+func (a *App) GetContactSearchResults(keyword string, pageSize, pageIndex int) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	log.Printf("GetContactSearchResults: %s, pageIndex: %d\n", keyword, pageIndex)
+	list, err := a.provider.WeChatGetContactByKeyword(keyword, pageSize, pageIndex)
+	if err != nil {
+		log.Println("WeChatGetContactByKeyword failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("WeChatGetContactByKeyword:", list.Total, list.FilterTotal)
+	return string(listStr)
+}
+
+// ExportContactsToVCard 将联系人导出为vcf文件，成功时返回文件的绝对路径
+func (a *App) ExportContactsToVCard(outputPath string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		outputPath = filepath.Join(outputPath, a.provider.SelfInfo.UserName+"_contacts.vcf")
+	} else if !strings.HasSuffix(strings.ToLower(outputPath), ".vcf") {
+		outputPath += ".vcf"
+	}
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", outputPath))
+	}
+
+	var builder strings.Builder
+	total := 0
+	pageSize := 500
+	for pageIndex := 0; ; pageIndex++ {
+		list, err := a.provider.WeChatGetContactList(pageIndex, pageSize, "")
+		if err != nil {
+			log.Println("WeChatGetContactList failed:", err)
+			break
+		}
+
+		for _, user := range list.Users {
+			// 群聊不是通讯录联系人，跳过
+			if user.IsGroup || strings.HasSuffix(user.UserName, "@chatroom") {
+				continue
+			}
+			a.writeVCard(&builder, user)
+			total += 1
+		}
+
+		if list.Total < pageSize {
+			break
+		}
+	}
+
+	if err := os.WriteFile(absPath, []byte(builder.String()), 0644); err != nil {
+		log.Println("WriteFile:", absPath, err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", absPath))
+	}
+	log.Println("ExportContactsToVCard:", absPath, total)
+
+	return absPath
+}
+
+func (a *App) writeVCard(builder *strings.Builder, user wechat.WeChatUserInfo) {
+	name := user.ReMark
+	if name == "" {
+		name = user.NickName
+	}
+	if name == "" {
+		name = user.UserName
+	}
+
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:4.0",
+		"FN:" + vcardEscape(name),
+	}
+	if user.NickName != "" {
+		lines = append(lines, "NICKNAME:"+vcardEscape(user.NickName))
+	}
+	lines = append(lines, "NOTE:"+vcardEscape("WeChat:"+user.UserName))
+
+	if user.LocalHeadImgUrl != "" {
+		if buf, err := os.ReadFile(a.FLoader.FilePrefix + user.LocalHeadImgUrl); err == nil && len(buf) > 0 {
+			lines = append(lines, "PHOTO;ENCODING=BASE64;TYPE=JPEG:"+base64.StdEncoding.EncodeToString(buf))
+		}
+	}
+	lines = append(lines, "END:VCARD")
+
+	for _, line := range lines {
+		builder.WriteString(vcardFoldLine(line))
+		builder.WriteString("\r\n")
+	}
+}
+
+// vcardEscape 转义vcf文本值中的特殊字符
+func vcardEscape(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", ",", "\\,", ";", "\\;", "\r\n", "\\n", "\n", "\\n")
+	return replacer.Replace(value)
+}
+
+// vcardFoldLine 按RFC 6350将超过75字节的行折叠，不拆分UTF-8字符
+func vcardFoldLine(line string) string {
+	var builder strings.Builder
+	lineLen := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if lineLen+size > 75 {
+			builder.WriteString("\r\n ")
+			lineLen = 1
+		}
+		builder.WriteRune(r)
+		lineLen += size
+	}
+
+	return builder.String()
+}
+
+func (a *App) GetWechatMessageListByTime(userName string, time int64, pageSize int, direction string) string {
+	log.Println("GetWechatMessageListByTime:", userName, pageSize, time, direction)
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	dire := wechat.Message_Search_Forward
+	if direction == "backward" {
+		dire = wechat.Message_Search_Backward
+	} else if direction == "both" {
+		dire = wechat.Message_Search_Both
+	}
+	list, err := a.provider.WeChatGetMessageListByTime(userName, time, pageSize, dire)
+	if err != nil {
+		log.Println("GetWechatMessageListByTime failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageListByTime:", list.Total)
+
+	return string(listStr)
+}
+
+// StreamWechatMessagesByTime 从startTime开始按direction分批读取userName的全部消息，
+// 立即返回{"streamId":"..."}，每100条通过messageChunk事件发送一次，最后发送status为done的事件
+func (a *App) StreamWechatMessagesByTime(userName string, startTime int64, direction string) string {
+	log.Println("StreamWechatMessagesByTime:", userName, startTime, direction)
+	if len(userName) == 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty userName"))
+	}
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	dire := wechat.Message_Search_Forward
+	if direction == "backward" {
+		dire = wechat.Message_Search_Backward
+	} else if direction != "" && direction != "forward" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid direction %s", direction))
+	}
+
+	provider := a.provider
+	streamId := fmt.Sprintf("%s_%d", userName, time.Now().UnixNano())
+	go func() {
+		emit := func(chunk MessageChunkEvent) {
+			chunk.StreamId = streamId
+			chunkStr, _ := json.Marshal(chunk)
+			eventsEmit(a.ctx, "messageChunk", string(chunkStr))
+		}
+
+		total, err := provider.WeChatGetMessageCountByTime(userName, startTime, dire)
+		if err != nil {
+			e := apierr.Wrap(apierr.CodeDBFailure, err)
+			emit(MessageChunkEvent{Status: wechat.Export_Status_Error, Error: e.Message, ErrorCode: e.Code})
+			return
+		}
+
+		batch := 0
+		cursor := wechat.WechatMessageCursorByTime(startTime, dire)
+		for {
+			list, err := provider.WeChatGetMessageListByCursor(userName, cursor, messageChunkSize)
+			if err != nil {
+				log.Println("WeChatGetMessageListByCursor failed:", err)
+				e := apierr.Wrap(apierr.CodeDBFailure, err)
+				emit(MessageChunkEvent{Status: wechat.Export_Status_Error, Total: total, Error: e.Message, ErrorCode: e.Code})
+				return
+			}
+			if list.Total == 0 {
+				break
+			}
+
+			batch += 1
+			emit(MessageChunkEvent{Batch: batch, Total: total, Rows: list.Rows})
+			if list.Total < messageChunkSize {
+				break
+			}
+			cursor = list.NextCursor
+			if dire == wechat.Message_Search_Backward {
+				cursor = list.PrevCursor
+			}
+		}
+
+		log.Println("StreamWechatMessagesByTime done:", streamId, batch, total)
+		emit(MessageChunkEvent{Status: Message_Chunk_Status_Done, Batch: batch, Total: total})
+	}()
+
+	streamStr, _ := json.Marshal(map[string]string{"streamId": streamId})
+	return string(streamStr)
+}
+
+func (a *App) GetWechatMessageListByCursor(userName string, cursor string, pageSize int) string {
+	log.Println("GetWechatMessageListByCursor:", userName, pageSize, cursor)
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	list, err := a.provider.WeChatGetMessageListByCursor(userName, cursor, pageSize)
+	if err != nil {
+		log.Println("GetWechatMessageListByCursor failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageListByCursor:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageListByDateRange(userName string, startTime, endTime int64, pageIndex, pageSize int) string {
+	log.Println("GetWechatMessageListByDateRange:", userName, startTime, endTime, pageIndex, pageSize)
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	list, err := a.provider.WeChatGetMessageListByDateRange(userName, startTime, endTime, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetMessageListByDateRange failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageListByDateRange:", list.Total, list.TotalInRange)
+
+	return string(listStr)
+}
+
+// WeChatGetMessageListBySender 群聊中只查看某个成员的消息，senderUserName为"me"时表示自己
+func (a *App) WeChatGetMessageListBySender(userName, senderUserName string, pageIndex, pageSize int) string {
+	log.Println("WeChatGetMessageListBySender:", userName, senderUserName, pageIndex, pageSize)
+	if len(userName) == 0 || len(senderUserName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName or senderUserName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	list, err := a.provider.WeChatGetMessageListBySender(userName, senderUserName, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetMessageListBySender failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("WeChatGetMessageListBySender:", list.Total, list.TotalInRange)
+
+	return string(listStr)
+}
+
+// GetWechatMessageAttachmentList 分页返回会话中的图片、视频、语音或文件，用于媒体浏览
+func (a *App) GetWechatMessageAttachmentList(userName, attachType string, pageIndex, pageSize int) string {
+	log.Println("GetWechatMessageAttachmentList:", userName, attachType, pageIndex, pageSize)
+	emptyFields := map[string]interface{}{"Total": 0, "TotalAttachments": 0, "Rows": []interface{}{}}
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyFields)
+	}
+	list, err := a.provider.WeChatGetMessageAttachmentList(userName, attachType, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetMessageAttachmentList failed:", err)
+		if errors.Is(err, wechat.ErrInvalidAttachType) {
+			return apierr.JSONWith(apierr.Wrap(apierr.CodeInvalidParam, err), emptyFields)
+		}
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageAttachmentList:", list.Total, list.TotalAttachments)
+
+	return string(listStr)
+}
+
+// GetWechatForwardedMessages 展开合并转发消息中的完整聊天记录
+func (a *App) GetWechatForwardedMessages(msgSvrId string) string {
+	log.Println("GetWechatForwardedMessages:", msgSvrId)
+	emptyFields := map[string]interface{}{"Total": 0, "Items": []interface{}{}}
+	if len(msgSvrId) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty msgSvrId"), emptyFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyFields)
+	}
+	list, err := a.provider.WeChatGetForwardedMessages(msgSvrId)
+	if err != nil {
+		log.Println("WeChatGetForwardedMessages failed:", err)
+		code := apierr.CodeInvalidParam
+		if errors.Is(err, wechat.ErrMessageNotFound) {
+			code = apierr.CodeNotFound
+		}
+		return apierr.JSONWith(apierr.Wrap(code, err), emptyFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatForwardedMessages:", list.Total)
+
+	return string(listStr)
+}
+
+// ConvertVoiceToMP3 将silk或amr语音转换为mp3，voicePath为相对FilePrefix的路径，成功时返回输出路径
+func (a *App) ConvertVoiceToMP3(voicePath, outputPath string) string {
+	if voicePath == "" || outputPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty voicePath or outputPath"))
+	}
+
+	srcPath := filepath.Join(a.FLoader.FilePrefix, voicePath)
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "%s", srcPath))
+	}
+
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		name := strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath))
+		outputPath = filepath.Join(outputPath, name+".mp3")
+	} else if !strings.HasSuffix(strings.ToLower(outputPath), ".mp3") {
+		outputPath += ".mp3"
+	}
+
+	startTime := time.Now()
+	converter, err := wechat.ConvertVoiceToMp3(srcPath, outputPath)
+	if err != nil {
+		log.Println("ConvertVoiceToMP3 failed:", srcPath, err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", srcPath))
+	}
+	a.logVoiceConvert(srcPath, outputPath, converter, startTime, srcInfo.Size())
+
+	return outputPath
+}
+
+func (a *App) logVoiceConvert(src, dst, converter string, startTime time.Time, inputSize int64) {
+	outputSize := int64(0)
+	if info, err := os.Stat(dst); err == nil {
+		outputSize = info.Size()
+	}
+	log.Printf("convert voice %s -> %s by %s: %d ms, input %d bytes, output %d bytes\n",
+		src, dst, converter, time.Since(startTime).Milliseconds(), inputSize, outputSize)
+}
+
+// VoiceBatchResult 批量转换的结果，Failed为转换失败的消息ID
+type VoiceBatchResult struct {
+	UserName  string   `json:"userName"`
+	OutputDir string   `json:"outputDir"`
+	Total     int      `json:"total"`
+	Converted int      `json:"converted"`
+	Skipped   int      `json:"skipped"`
+	Failed    []string `json:"failed"`
+	Duration  int64    `json:"durationMs"`
+}
+
+// BatchConvertVoices 将联系人的全部语音消息转换为mp3保存到outputDir，已存在的文件跳过
+func (a *App) BatchConvertVoices(userName string, outputDir string) string {
+	log.Println("BatchConvertVoices:", userName, outputDir)
+	if userName == "" || outputDir == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty userName or outputDir"))
+	}
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", outputDir))
+	}
+
+	startTime := time.Now()
+	result := VoiceBatchResult{UserName: userName, OutputDir: outputDir, Failed: make([]string, 0)}
+	pageSize := 500
+	for pageIndex := 0; ; pageIndex++ {
+		list, err := a.provider.WeChatGetMessageAttachmentList(userName, "voice", pageIndex, pageSize)
+		if err != nil {
+			log.Println("WeChatGetMessageAttachmentList failed:", err)
+			return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+		}
+
+		for _, attach := range list.Rows {
+			result.Total += 1
+			name := time.Unix(attach.CreateTime, 0).Format("20060102_150405") + "_" + attach.MessageID + ".mp3"
+			dst := filepath.Join(outputDir, name)
+			if _, err := os.Stat(dst); err == nil {
+				result.Skipped += 1
+				continue
+			}
+
+			buf, err := a.provider.WeChatGetVoiceData(attach.MessageID)
+			if err != nil {
+				log.Println("WeChatGetVoiceData failed:", attach.MessageID, err)
+				result.Failed = append(result.Failed, attach.MessageID)
+				continue
+			}
+			convertTime := time.Now()
+			converter, err := wechat.ConvertVoiceDataToMp3(buf, dst)
+			if err != nil {
+				log.Println("ConvertVoiceDataToMp3 failed:", attach.MessageID, err)
+				result.Failed = append(result.Failed, attach.MessageID)
+				continue
+			}
+			a.logVoiceConvert(attach.MessageID, dst, converter, convertTime, int64(len(buf)))
+			result.Converted += 1
+		}
+
+		if len(list.Rows) < pageSize {
+			break
+		}
+	}
+
+	result.Duration = time.Since(startTime).Milliseconds()
+	log.Printf("BatchConvertVoices %s: %d total, %d converted, %d skipped, %d failed in %d ms\n",
+		userName, result.Total, result.Converted, result.Skipped, len(result.Failed), result.Duration)
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
+}
+
+func (a *App) SearchMessagesWithRegex(userName, pattern string, pageSize, pageIndex int) string {
+	log.Println("SearchMessagesWithRegex:", userName, pattern, pageSize, pageIndex)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println("regexp.Compile failed:", err)
+		return apierr.JSONWith(apierr.Wrapf(apierr.CodeInvalidParam, err, "invalid pattern"), emptyRowsFields)
+	}
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+
+	list, err := a.provider.WeChatSearchMessageListByRegex(userName, re, regexSearchLimit)
+	if err != nil {
+		log.Println("WeChatSearchMessageListByRegex failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+
+	// Total为全部匹配数，Rows只返回当前页
+	if pageSize > 0 && pageIndex >= 0 {
+		start := pageIndex * pageSize
+		if start > len(list.Rows) {
+			start = len(list.Rows)
+		}
+		end := start + pageSize
+		if end > len(list.Rows) {
+			end = len(list.Rows)
+		}
+		list.Rows = list.Rows[start:end]
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("SearchMessagesWithRegex:", list.Total, list.TruncatedAt)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageListByType(userName string, time int64, pageSize int, msgType string, direction string) string {
+	log.Println("GetWechatMessageListByType:", userName, pageSize, time, msgType, direction)
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	dire := wechat.Message_Search_Forward
+	if direction == "backward" {
+		dire = wechat.Message_Search_Backward
+	} else if direction == "both" {
+		dire = wechat.Message_Search_Both
+	}
+	list, err := a.provider.WeChatGetMessageListByType(userName, time, pageSize, msgType, dire)
+	if err != nil {
+		log.Println("WeChatGetMessageListByType failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("WeChatGetMessageListByType:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageListByKeyWord(userName string, time int64, keyword string, msgType string, pageSize int) string {
+	log.Println("GetWechatMessageListByKeyWord:", userName, pageSize, time, msgType)
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyRowsFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyRowsFields)
+	}
+	list, err := a.provider.WeChatGetMessageListByKeyWord(userName, time, keyword, msgType, pageSize)
+	if err != nil {
+		log.Println("WeChatGetMessageListByKeyWord failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyRowsFields)
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("WeChatGetMessageListByKeyWord:", list.Total, list.KeyWord)
+
+	return string(listStr)
+}
+
+// RebuildMessageSearchIndex 为userName的消息建立全文搜索索引，进度通过messageSearchIndex事件发送，返回建立结果
+func (a *App) RebuildMessageSearchIndex(userName string) string {
+	log.Println("RebuildMessageSearchIndex:", userName)
+	if len(userName) == 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty userName"))
+	}
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+
+	progress := make(chan wechat.MessageSearchIndexSummary)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range progress {
+			pStr, _ := json.Marshal(p)
+			eventsEmit(a.ctx, "messageSearchIndex", string(pStr))
+		}
+	}()
+	summary, err := a.provider.RebuildMessageSearchIndexWithProgress(userName, progress)
+	close(progress)
+	<-done
+	if err != nil {
+		log.Println("RebuildMessageSearchIndex failed:", err)
+		if errors.Is(err, wechat.ErrSearchIndexUnsupported) {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeInternal, err, "full-text search unavailable"))
+		}
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	summaryStr, _ := json.Marshal(summary)
+	return string(summaryStr)
+}
+
+func (a *App) GetWechatMessageDate(userName string) string {
+	return a.GetWechatMessageDateByGranularity(userName, "")
+}
+
+// GetWechatMessageDateByGranularity granularity可选day、hour、month，为空时按天
+func (a *App) GetWechatMessageDateByGranularity(userName string, granularity string) string {
+	log.Println("GetWechatMessageDate:", userName, granularity)
+	emptyDateFields := map[string]interface{}{"Total": 0, "Date": []interface{}{}}
+	if len(userName) == 0 {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyDateFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyDateFields)
+	}
+
+	if _, ok := wechat.MessageDateFormat(granularity); !ok {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "invalid granularity: %s", granularity), emptyDateFields)
+	}
+
+	messageData, err := a.provider.WeChatGetMessageDate(userName, granularity)
+	if err != nil {
+		log.Println("GetWechatMessageDate:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyDateFields)
+	}
+
+	messageDataStr, _ := json.Marshal(messageData)
+	log.Println("GetWechatMessageDate:", messageData.Total)
+
+	return string(messageDataStr)
+}
+
+// defaultExportOptions 默认导出全部数据，限速设置使用上次导出时保存的配置
+func (a *App) defaultExportOptions() wechat.ExportOptions {
+	options := wechat.DefaultExportOptions()
+	options.ThrottleMBps = viper.GetInt(configThrottleMBpsKey)
+	options.IdlePriority = viper.GetBool(configIdlePriorityKey)
+	options.KeepSnapshot = viper.GetBool(configKeepSnapshotKey)
+	options.SnapshotRetention = viper.GetInt(configSnapshotRetainKey)
+	// 并发数未配置时使用默认值，可在配置文件中按磁盘和CPU调整
+	if workers := viper.GetInt(configExportWorkersKey); workers > 0 {
+		options.Workers = workers
+	}
+	if workers := viper.GetInt(configExportDBWorkersKey); workers > 0 {
+		options.DBWorkers = workers
+	}
+	return options
+}
+
+// saveExportThrottle 保存限速设置，定时导出等未指定选项的导出也使用该设置
+func (a *App) saveExportThrottle(options wechat.ExportOptions) {
+	if options.ThrottleMBps == viper.GetInt(configThrottleMBpsKey) && options.IdlePriority == viper.GetBool(configIdlePriorityKey) {
+		return
+	}
+	viper.Set(configThrottleMBpsKey, options.ThrottleMBps)
+	viper.Set(configIdlePriorityKey, options.IdlePriority)
+	a.setCurrentConfig()
+}
+
+// saveExportSnapshot 保存快照设置，定时导出的全量导出也按该设置保留快照
+func (a *App) saveExportSnapshot(options wechat.ExportOptions) {
+	if options.KeepSnapshot == viper.GetBool(configKeepSnapshotKey) && options.SnapshotRetention == viper.GetInt(configSnapshotRetainKey) {
+		return
+	}
+	viper.Set(configKeepSnapshotKey, options.KeepSnapshot)
+	viper.Set(configSnapshotRetainKey, options.SnapshotRetention)
+	a.setCurrentConfig()
+}
+
+func (a *App) setCurrentConfig() {
+	viper.Set(configDefaultUserKey, a.defaultUser)
+	viper.Set(configUsersKey, a.users)
+	viper.Set(configExportPathKey, a.FLoader.FilePrefix)
+	err := viper.SafeWriteConfig()
+	if err != nil {
+		log.Println(err)
+		err = viper.WriteConfig()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type userList struct {
+	Users []string `json:"Users"`
+}
+
+func (a *App) GetWeChatUserList() string {
+
+	l := userList{}
+	l.Users = a.users
+
+	usersStr, _ := json.Marshal(l)
+	str := string(usersStr)
+	log.Println("users:", str)
+	return str
+}
+
+func (a *App) OpenFileOrExplorer(filePath string, explorer bool) string {
+	// if root, err := os.Getwd(); err == nil {
+	// 	filePath = root + filePath[1:]
+	// }
+	// log.Println("OpenFileOrExplorer:", filePath)
+
+	path := a.FLoader.FilePrefix + filePath
+	err := utils.OpenFileOrExplorer(path, explorer)
+	if err != nil {
+		log.Println("OpenFileOrExplorer failed:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeIOFailure, err), map[string]interface{}{"result": "OpenFileOrExplorer failed", "status": "failed"})
+	}
+
+	return fmt.Sprintf("{\"result\": \"%s\", \"status\":\"OK\"}", "")
+}
+
+func (a *App) GetWeChatRoomUserList(roomId string) string {
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	userlist, err := a.provider.WeChatGetChatRoomUserList(roomId)
+	if err != nil {
+		log.Println("WeChatGetChatRoomUserList:", err)
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	userListStr, _ := json.Marshal(userlist)
+
+	return string(userListStr)
+}
+
+func (a *App) GetChatRoomMemberHistory(roomId string) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	history, err := a.provider.WeChatGetChatRoomMemberHistory(roomId)
+	if err != nil {
+		log.Println("WeChatGetChatRoomMemberHistory:", err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	historyStr, _ := json.Marshal(history)
+	log.Println("WeChatGetChatRoomMemberHistory:", history.Total)
+
+	return string(historyStr)
+}
+
+func (a *App) GetGroupMessageSenderStats(roomId string) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	stats, err := a.provider.WeChatGetGroupMessageSenderStats(roomId)
+	if err != nil {
+		log.Println("WeChatGetGroupMessageSenderStats:", err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	statsStr, _ := json.Marshal(stats)
+	log.Println("WeChatGetGroupMessageSenderStats:", stats.TotalMessages, stats.MemberCount)
+
+	return string(statsStr)
+}
+
+// 合并后的应用配置，GetAppConfig返回，SetAppConfig只应用传入的字段
+type AppConfig struct {
+	ExportPath              string                  `json:"exportPath"`
+	DefaultUser             string                  `json:"defaultUser"`
+	Users                   []string                `json:"users"`
+	IncrementalBackupConfig IncrementalBackupConfig `json:"incrementalBackupConfig"`
+	NewMessageExportConfig  NewMessageExportConfig  `json:"newMessageExportConfig"`
+	AppVersion              string                  `json:"appVersion"`
+}
+
+// GetAppConfig 返回当前的配置，账号和导出路径读取viper中的值，未写入文件的修改也会返回
+func (a *App) GetAppConfig() string {
+	config := AppConfig{
+		ExportPath:  viper.GetString(configExportPathKey),
+		DefaultUser: viper.GetString(configDefaultUserKey),
+		Users:       viper.GetStringSlice(configUsersKey),
+		AppVersion:  appVersion,
+	}
+	if config.ExportPath == "" {
+		config.ExportPath = a.FLoader.FilePrefix
+	}
+	if config.Users == nil {
+		config.Users = make([]string, 0)
+	}
+	json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config.IncrementalBackupConfig)
+	json.Unmarshal([]byte(a.GetNewMessageExportConfig()), &config.NewMessageExportConfig)
+
+	configStr, _ := json.Marshal(config)
+	return string(configStr)
+}
+
+// SetAppConfig 应用configJSON中出现的字段，两个子配置只覆盖其中出现的字段；users和appVersion只读。
+// 先检查全部字段再依次应用，defaultUser按切换后的导出路径检查，成功时返回更新后的GetAppConfig
+func (a *App) SetAppConfig(configJSON string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(configJSON), &fields); err != nil {
+		return apierr.JSON(apierr.Wrap(apierr.CodeInvalidParam, err))
+	}
+
+	var exportPath, defaultUser string
+	var backupConfig IncrementalBackupConfig
+	var newMessageConfig NewMessageExportConfig
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "exportPath":
+			err = json.Unmarshal(value, &exportPath)
+			if err == nil && (exportPath == "" || !utils.PathIsCanWriteFile(exportPath, 0)) {
+				err = fmt.Errorf("%s can not write", exportPath)
+			}
+		case "defaultUser":
+			err = json.Unmarshal(value, &defaultUser)
+		case "incrementalBackupConfig":
+			err = json.Unmarshal(value, &backupConfig)
+		case "newMessageExportConfig":
+			err = json.Unmarshal(value, &newMessageConfig)
+			if err == nil && newMessageConfig.StartTime < 0 {
+				err = fmt.Errorf("invalid startTime %d", newMessageConfig.StartTime)
+			}
+		case "users", "appVersion":
+			err = fmt.Errorf("read only")
+		default:
+			err = fmt.Errorf("unknown field")
+		}
+		if err != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeInvalidParam, err, "%s", key))
+		}
+	}
+
+	// 同时切换导出路径时，defaultUser必须是新路径下的账号
+	_, pathChanged := fields["exportPath"]
+	pathChanged = pathChanged && exportPath != a.FLoader.FilePrefix
+	if _, ok := fields["defaultUser"]; ok && (pathChanged || defaultUser != a.defaultUser) {
+		users := a.users
+		if pathChanged {
+			infos, err := scanAccountInfos(exportPath, nil)
+			if err != nil {
+				return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", exportPath))
+			}
+			users = make([]string, 0, infos.Total)
+			for _, info := range infos.Info {
+				users = append(users, info.AccountName)
+			}
+		}
+		found := false
+		for _, user := range users {
+			if user == defaultUser {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return apierr.JSON(apierr.New(apierr.CodeNotFound, "user %s not found", defaultUser))
+		}
+	}
+
+	// 两个子配置保存在导出路径下，先切换导出路径，再在新路径的配置上合并
+	if pathChanged {
+		a.FLoader.SetFilePrefix(exportPath)
+		a.scanAccountByPath(a.ctx, exportPath)
+		a.setCurrentConfig()
+	}
+	if _, ok := fields["defaultUser"]; ok && defaultUser != a.defaultUser {
+		if !a.WechatSwitchAccount(defaultUser) {
+			return apierr.JSON(apierr.New(apierr.CodeNotFound, "user %s not found", defaultUser))
+		}
+	}
+	if value, ok := fields["incrementalBackupConfig"]; ok {
+		backupConfig = IncrementalBackupConfig{}
+		json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &backupConfig)
+		json.Unmarshal(value, &backupConfig)
+		if !a.SetIncrementalBackupConfig(backupConfig) {
+			return apierr.JSON(apierr.New(apierr.CodeIOFailure, "save incrementalBackupConfig failed"))
+		}
+	}
+	if value, ok := fields["newMessageExportConfig"]; ok {
+		newMessageConfig = NewMessageExportConfig{}
+		json.Unmarshal([]byte(a.GetNewMessageExportConfig()), &newMessageConfig)
+		json.Unmarshal(value, &newMessageConfig)
+		if !a.SetNewMessageExportConfig(newMessageConfig) {
+			return apierr.JSON(apierr.New(apierr.CodeIOFailure, "save newMessageExportConfig failed"))
+		}
+	}
+
+	return a.GetAppConfig()
+}
+
+// 当前账号的信息，WeChatGetSelfInfo返回
+type SelfInfoResponse struct {
+	*wechat.WeChatUserInfo
+	DefaultUser string `json:"defaultUser"`
+	// 当前打开的数据目录，通常为 导出路径\User\<defaultUser>，打开快照时为快照目录
+	ExportPath string `json:"exportPath"`
+}
+
+// WeChatGetSelfInfo 返回当前账号自己的信息，包含selfInfo事件的内容以及当前账号和其导出目录；
+// 数据提供者未初始化时返回{}
+func (a *App) WeChatGetSelfInfo() string {
+	provider := a.provider
+	if provider == nil || provider.SelfInfo == nil {
+		return "{}"
+	}
+
+	infoStr, _ := json.Marshal(SelfInfoResponse{
+		WeChatUserInfo: provider.SelfInfo,
+		DefaultUser:    a.defaultUser,
+		ExportPath:     provider.ResPath(),
+	})
+	return string(infoStr)
+}
+
+func (a *App) GetAppVersion() string {
+	return appVersion
+}
+
+func (a *App) GetAppIsFirstStart() bool {
+	defer func() { a.firstStart = false }()
+	return a.firstStart
+}
+
+const (
+	Account_Sort_Name         = "name"
+	Account_Sort_LastSync     = "lastSync"
+	Account_Sort_MessageCount = "messageCount"
+)
+
+func (a *App) GetWechatLocalAccountInfo() string {
+	return a.GetWechatLocalAccountInfoSorted("")
+}
+
+// GetWechatLocalAccountInfoSorted sortBy为name、lastSync或messageCount，为空时按目录顺序；
+// 排序是稳定的，相同的账号保持目录顺序，只有按messageCount排序时才统计消息数
+func (a *App) GetWechatLocalAccountInfoSorted(sortBy string) string {
+	infos := WeChatAccountInfos{}
+	infos.Info = make([]wechat.WeChatAccountInfo, 0)
+	infos.Total = 0
+	infos.CurrentAccount = a.defaultUser
+	for i := range a.users {
+		resPath := a.FLoader.FilePrefix + "\\User\\" + a.users[i]
+		if _, err := os.Stat(resPath); err != nil {
+			log.Println("GetWechatLocalAccountInfo:", resPath, err)
+			continue
+		}
+
+		prefixResPath := "\\User\\" + a.users[i]
+		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, a.users[i])
+		if err != nil {
+			log.Println("GetWechatLocalAccountInfo", err)
+			continue
+		}
+
+		if sortBy == Account_Sort_MessageCount {
+			info.MessageCount = wechat.WechatGetAccountMessageCount(resPath)
+		}
+
+		infos.Info = append(infos.Info, *info)
+		infos.Total += 1
+	}
+
+	switch sortBy {
+	case Account_Sort_Name:
+		sort.SliceStable(infos.Info, func(i, j int) bool {
+			return accountDisplayName(infos.Info[i]) < accountDisplayName(infos.Info[j])
+		})
+	case Account_Sort_LastSync:
+		sort.SliceStable(infos.Info, func(i, j int) bool { return infos.Info[i].LastSyncTime > infos.Info[j].LastSyncTime })
+	case Account_Sort_MessageCount:
+		sort.SliceStable(infos.Info, func(i, j int) bool { return infos.Info[i].MessageCount > infos.Info[j].MessageCount })
+	}
+
+	infoString, _ := json.Marshal(infos)
+	log.Println(string(infoString))
+
+	return string(infoString)
+}
+
+// accountDisplayName 排序时使用的名称，依次取备注、昵称和账号
+func accountDisplayName(info wechat.WeChatAccountInfo) string {
+	if info.ReMarkName != "" {
+		return info.ReMarkName
+	}
+	if info.NickName != "" {
+		return info.NickName
+	}
+	return info.AccountName
+}
+
+// AccountSwitchedEvent accountSwitched事件的内容，PrefixPath为头像等资源的路径前缀
+type AccountSwitchedEvent struct {
+	wechat.WeChatAccountInfo
+	PrefixPath string `json:"PrefixPath"`
+}
+
+func (a *App) WechatSwitchAccount(account string) bool {
+	for i := range a.users {
+		if a.users[i] == account {
+			if a.provider != nil {
+				a.provider.WechatWechatDataProviderClose()
+				a.provider = nil
+			}
+			a.defaultUser = account
+			a.setCurrentConfig()
+			a.emitAccountSwitched(account)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *App) emitAccountSwitched(account string) {
+	event := AccountSwitchedEvent{PrefixPath: "\\User\\" + account}
+	event.AccountName = account
+	resPath := a.FLoader.FilePrefix + event.PrefixPath
+	if info, err := wechat.WechatGetAccountInfo(resPath, event.PrefixPath, account); err == nil {
+		event.WeChatAccountInfo = *info
+	} else {
+		log.Println("WechatGetAccountInfo failed:", account, err)
+	}
+
+	accountJSON, _ := json.Marshal(event)
+	eventsEmit(a.ctx, "accountSwitched", string(accountJSON))
+}
+
+// RemoveAccountResult RemoveLocalAccount删除或将要删除的目录
+type RemoveAccountResult struct {
+	Account     string   `json:"account"`
+	Paths       []string `json:"paths"`
+	DryRun      bool     `json:"dryRun"`
+	DefaultUser string   `json:"defaultUser"`
+}
+
+// RemoveLocalAccount 删除账号的导出数据和快照，并从配置中移除该账号；
+// dryRun为true时只返回将要删除的目录
+func (a *App) RemoveLocalAccount(accountName string, dryRun bool) string {
+	index := -1
+	for i := range a.users {
+		if a.users[i] == accountName {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "%s not found", accountName))
+	}
+
+	result := RemoveAccountResult{Account: accountName, Paths: make([]string, 0), DryRun: dryRun}
+	for _, path := range []string{
+		filepath.Join(a.FLoader.FilePrefix, "User", accountName),
+		filepath.Join(a.FLoader.FilePrefix, exportSnapshotDir, accountName),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			result.Paths = append(result.Paths, path)
+		}
+	}
+	if dryRun {
+		result.DefaultUser = a.defaultUser
+		resultStr, _ := json.Marshal(result)
+		return string(resultStr)
+	}
+
+	if atomic.LoadInt32(&a.exporting) > 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "export in progress"))
+	}
+	// 当前打开的账号或快照属于该账号时先关闭，避免数据库文件被占用
+	snapshotDir := filepath.Join(a.FLoader.FilePrefix, exportSnapshotDir, accountName)
+	if accountName == a.defaultUser || (a.snapshotPath != "" && strings.HasPrefix(strings.ToLower(a.snapshotPath), strings.ToLower(snapshotDir+string(os.PathSeparator)))) {
+		a.closeSnapshot()
+	}
+	for _, path := range result.Paths {
+		if err := os.RemoveAll(path); err != nil {
+			log.Println("RemoveLocalAccount failed:", path, err)
+			return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", path))
+		}
+	}
+
+	a.users = append(a.users[:index], a.users[index+1:]...)
+	if accountName == a.defaultUser {
+		a.defaultUser = ""
+		if len(a.users) > 0 {
+			a.defaultUser = a.users[0]
+		}
+	}
+	a.setCurrentConfig()
+	log.Println("RemoveLocalAccount:", accountName, result.Paths)
+
+	result.DefaultUser = a.defaultUser
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
+}
+
+// ExportPathStat 导出目录所在磁盘的使用情况，以及各账号快照占用的空间
+type ExportPathStat struct {
+	utils.PathStat
+	AvailableBytes int64            `json:"availableBytes"`
+	Snapshots      []ExportSnapshot `json:"snapshots"`
+	SnapshotSize   int64            `json:"snapshotSize"`
+}
+
+func (a *App) GetExportPathStat() string {
+	result, err := a.exportPathStat(a.FLoader.FilePrefix)
+	if err != nil {
+		return apierr.JSON(err)
+	}
+
+	statString, _ := json.Marshal(result)
+
+	return string(statString)
+}
+
+const (
+	Path_Stat_Loading = "loading"
+	Path_Stat_Done    = "done"
+	Path_Stat_Error   = "error"
+	Path_Stat_Timeout = "timeout"
+)
+
+// PathStatEvent GetExportPathStatAsync的返回值和pathStat事件的内容
+type PathStatEvent struct {
+	Status    string          `json:"status"`
+	Stat      *ExportPathStat `json:"stat,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode apierr.Code     `json:"errorCode,omitempty"`
+}
+
+// GetExportPathStatAsync 在后台获取导出目录的磁盘状态，立即返回loading，
+// 结果通过pathStat事件发送，超时后发送timeout
+func (a *App) GetExportPathStatAsync() string {
+	path := a.FLoader.FilePrefix
+	timeout := viper.GetInt(configPathStatTimeoutKey)
+	if timeout <= 0 {
+		timeout = defaultPathStatTimeout
+	}
+
+	go func() {
+		// GetPathStat无法中断，超时后丢弃其结果
+		done := make(chan PathStatEvent, 1)
+		go func() {
+			result, err := a.exportPathStat(path)
+			if err != nil {
+				e := apierr.Wrap(apierr.CodeIOFailure, err)
+				done <- PathStatEvent{Status: Path_Stat_Error, Error: e.Message, ErrorCode: e.Code}
+				return
+			}
+			done <- PathStatEvent{Status: Path_Stat_Done, Stat: result}
+		}()
+
+		var event PathStatEvent
+		select {
+		case event = <-done:
+		case <-time.After(time.Duration(timeout) * time.Second):
+			log.Println("GetPathStat timeout:", path)
+			event = PathStatEvent{Status: Path_Stat_Timeout}
+		}
+		eventStr, _ := json.Marshal(event)
+		eventsEmit(a.ctx, "pathStat", string(eventStr))
+	}()
+
+	loading, _ := json.Marshal(PathStatEvent{Status: Path_Stat_Loading})
+	return string(loading)
+}
+
+func (a *App) exportPathStat(path string) (*ExportPathStat, error) {
+	log.Println("utils.GetPathStat ++")
+	stat, err := utils.GetPathStat(path)
+	log.Println("utils.GetPathStat --")
+	if err != nil {
+		log.Println("GetPathStat error:", path, err)
+		return nil, apierr.Wrapf(apierr.CodeIOFailure, err, "%s", path)
+	}
+
+	result := ExportPathStat{PathStat: stat, AvailableBytes: int64(stat.Free), Snapshots: make([]ExportSnapshot, 0)}
+	if accounts, err := os.ReadDir(filepath.Join(path, exportSnapshotDir)); err == nil {
+		for _, account := range accounts {
+			if !account.IsDir() {
+				continue
+			}
+			for _, snapshot := range a.listExportSnapshots(account.Name()) {
+				result.Snapshots = append(result.Snapshots, snapshot)
+				result.SnapshotSize += snapshot.Size
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+func (a *App) GetExportSizeEstimate(acountName string, options string) string {
+	pInfo := a.findWeChatInfo(acountName)
+
+	if pInfo == nil {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "%s not found", acountName))
+	}
+
+	exportOptions := a.defaultExportOptions()
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &exportOptions); err != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeInvalidParam, err, "invalid options"))
+		}
+	}
+
+	// 不区分全量和增量，按全量导出估算
+	estimate, err := a.estimateExportSize(*pInfo, a.FLoader.FilePrefix+"\\User\\"+pInfo.AcountName, true, exportOptions)
+	if err != nil {
+		log.Println("estimateExportSize failed:", err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", a.FLoader.FilePrefix))
+	}
+
+	estimateStr, _ := json.Marshal(estimate)
+	return string(estimateStr)
+}
+
+// ExtractExportArchive 将 User\<acountName>.zip 解压为导出目录，成功时返回目录路径
+func (a *App) ExtractExportArchive(acountName string) string {
+	userPath := a.FLoader.FilePrefix + "\\User\\"
+	expPath := userPath + acountName
+	zipPath := expPath + ".zip"
+	if acountName == "" || filepath.Base(expPath) != acountName {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid account %s", acountName))
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", zipPath))
+	}
+
+	if a.provider != nil && a.provider.SelfInfo != nil && a.provider.SelfInfo.UserName == acountName {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+
+	// 先解压到临时目录，成功后再替换原目录
+	tmpPath := expPath + ".tmp"
+	bakPath := expPath + ".bak"
+	os.RemoveAll(tmpPath)
+	err := wechat.ExtractExportArchive(zipPath, tmpPath)
+	if err == nil {
+		os.RemoveAll(bakPath)
+		if _, statErr := os.Stat(expPath); statErr == nil {
+			err = os.Rename(expPath, bakPath)
+		}
+	}
+	if err == nil {
+		if err = os.Rename(tmpPath, expPath); err != nil {
+			os.Rename(bakPath, expPath)
+		}
+	}
+	os.RemoveAll(tmpPath)
+	os.RemoveAll(bakPath)
+	if err != nil {
+		log.Println("ExtractExportArchive failed:", err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", zipPath))
+	}
+
+	log.Println("ExtractExportArchive:", zipPath, "->", expPath)
+	return expPath
+}
+
+func (a *App) ExportPathIsCanWrite() bool {
+	path := a.FLoader.FilePrefix
+	return utils.PathIsCanWriteFile(path, 0)
+}
+
+func (a *App) OpenExportPath() {
+	path := a.FLoader.FilePrefix
+	runtime.BrowserOpenURL(a.ctx, path)
+}
+
+func (a *App) OpenDirectoryDialog() string {
+	dialogOptions := runtime.OpenDialogOptions{
+		Title: "选择导出路径",
+	}
+	selectedDir, err := runtime.OpenDirectoryDialog(a.ctx, dialogOptions)
+	if err != nil {
+		log.Println("OpenDirectoryDialog:", err)
+		return ""
+	}
+
+	if selectedDir == "" {
+		log.Println("Cancel selectedDir")
+		return ""
+	}
+
+	if selectedDir == a.FLoader.FilePrefix {
+		log.Println("same path No need SetFilePrefix")
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(selectedDir, 0) {
+		log.Println("PathIsCanWriteFile:", selectedDir, "error")
+		return ""
+	}
+
+	a.FLoader.SetFilePrefix(selectedDir)
+	log.Println("OpenDirectoryDialog:", selectedDir)
+	a.scanAccountByPath(a.ctx, selectedDir)
+	return selectedDir
+}
+
+// scanAccountByPath 扫描path下的账号并更新账号列表，每发现一个账号发送一次scanProgress事件，
+// 扫描结束后发送 {"status":"done","total":N}
+func (a *App) scanAccountByPath(ctx context.Context, path string) error {
+	total := 0
+	defer func() {
+		eventsEmit(ctx, "scanProgress", fmt.Sprintf("{\"status\":\"done\",\"total\":%d}", total))
+	}()
+
+	infos, err := scanAccountInfos(path, func(found int, accountName string) {
+		progressStr, _ := json.Marshal(ScanProgressEvent{Found: found, Latest: accountName})
+		eventsEmit(ctx, "scanProgress", string(progressStr))
+	})
+	if err != nil {
+		return err
+	}
+	total = infos.Total
+
+	users := make([]string, 0)
+	for i := 0; i < infos.Total; i++ {
+		users = append(users, infos.Info[i].AccountName)
+	}
+
+	a.users = users
+	found := false
+	for i := range a.users {
+		if a.defaultUser == a.users[i] {
+			found = true
+		}
+	}
+
+	if !found {
+		a.defaultUser = ""
+	}
+	if a.defaultUser == "" && len(a.users) > 0 {
+		a.defaultUser = a.users[0]
+	}
+
+	if len(a.users) > 0 {
+		a.setCurrentConfig()
+	}
+
+	return nil
+}
+
+// scanAccountInfos 读取path\User下每个账号的信息，不修改当前配置，onFound不为nil时每读取一个账号调用一次
+func scanAccountInfos(path string, onFound func(found int, accountName string)) (*WeChatAccountInfos, error) {
+	infos := &WeChatAccountInfos{}
+	infos.Info = make([]wechat.WeChatAccountInfo, 0)
+	infos.Total = 0
+	infos.CurrentAccount = ""
+
+	userPath := path + "\\User\\"
+	if _, err := os.Stat(userPath); err != nil {
+		return nil, err
+	}
+
+	dirs, err := os.ReadDir(userPath)
+	if err != nil {
+		log.Println("ReadDir", err)
+		return nil, err
+	}
+
+	for i := range dirs {
+		if !dirs[i].Type().IsDir() {
+			continue
+		}
+		if strings.HasSuffix(dirs[i].Name(), ".tmp") || strings.HasSuffix(dirs[i].Name(), ".bak") {
+			continue
+		}
+		log.Println("dirs[i].Name():", dirs[i].Name())
+		resPath := path + "\\User\\" + dirs[i].Name()
+		prefixResPath := "\\User\\" + dirs[i].Name()
+		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, dirs[i].Name())
+		if err != nil {
+			log.Println("GetWechatLocalAccountInfo", err)
+			continue
+		}
+
+		infos.Info = append(infos.Info, *info)
+		infos.Total += 1
+		if onFound != nil {
+			onFound(infos.Total, info.AccountName)
+		}
+	}
+
+	return infos, nil
+}
+
+func (a *App) OepnLogFileExplorer() {
+	utils.OpenFileOrExplorer(".\\app.log", true)
+}
+
+func (a *App) SaveFileDialog(file string, alisa string) string {
+	filePath := a.FLoader.FilePrefix + file
+	if _, err := os.Stat(filePath); err != nil {
+		log.Println("SaveFileDialog:", err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeNotFound, err))
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: alisa,
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeInternal, err))
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	var fileSize int64
+	if info, err := os.Stat(filePath); err == nil {
+		fileSize = info.Size()
+	}
+
+	dirPath := filepath.Dir(savePath)
+	if !utils.PathIsCanWriteFile(dirPath, fileSize) {
+		log.Println("Path Is Can't Write File:", dirPath)
+		return apierr.JSON(apierr.New(apierr.CodeIOFailure, "Path Is Can't Write File: %s", dirPath))
+	}
+
+	// 超过阈值的文件发送复制进度，阈值单位MB
+	var progress func(written, total int64)
+	threshold := viper.GetInt64(configSaveProgressKey)
+	if threshold <= 0 {
+		threshold = defaultSaveProgressMB
+	}
+	if fileSize > threshold*1024*1024 {
+		progress = a.emitFileCopyProgress("saveFileProgress", savePath, nil)
+	}
+
+	_, err = utils.CopyFileWithProgress(filePath, savePath, progress)
+	if err != nil {
+		log.Println("Error CopyFile", filePath, savePath, err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeIOFailure, err))
+	}
+
+	return ""
+}
+
+func (a *App) GetSessionLastTime(userName string) string {
+	if a.provider == nil || userName == "" {
+		lastTime := &wechat.WeChatLastTime{}
+		lastTimeString, _ := json.Marshal(lastTime)
+		return string(lastTimeString)
+	}
+
+	lastTime := a.provider.WeChatGetSessionLastTime(userName)
+
+	lastTimeString, _ := json.Marshal(lastTime)
+
+	return string(lastTimeString)
+}
+
+func (a *App) SetSessionLastTime(userName string, stamp int64, messageId string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+
+	lastTime := &wechat.WeChatLastTime{
+		UserName:  userName,
+		Timestamp: stamp,
+		MessageId: messageId,
+	}
+	err := a.provider.WeChatSetSessionLastTime(lastTime)
+	if err != nil {
+		log.Println("WeChatSetSessionLastTime failed:", err.Error())
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	return ""
+}
+
+// 书签标签配置，AllowedTags不为空时书签只能使用其中的标签
+type BookmarkTagConfig struct {
+	AllowedTags []string `json:"allowedTags"`
+}
+
+func (a *App) bookmarkTagConfig() BookmarkTagConfig {
+	config := BookmarkTagConfig{AllowedTags: viper.GetStringSlice(configBookmarkTagsKey)}
+	if config.AllowedTags == nil {
+		config.AllowedTags = make([]string, 0)
+	}
+	return config
+}
+
+// allowedBookmarkTag 返回tag在允许列表中的写法，不区分大小写；列表为空或tag为空时原样返回
+func (c BookmarkTagConfig) allowedBookmarkTag(tag string) (string, bool) {
+	if len(c.AllowedTags) == 0 || tag == "" {
+		return tag, true
+	}
+	for _, allowed := range c.AllowedTags {
+		if strings.EqualFold(allowed, tag) {
+			return allowed, true
+		}
+	}
+	return "", false
+}
+
+func (a *App) SetSessionBookMask(userName, tag, info string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if userName == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty userName"))
+	}
+	tag, ok := a.bookmarkTagConfig().allowedBookmarkTag(tag)
+	if !ok {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "tag not allowed"))
+	}
+	err := a.provider.WeChatSetSessionBookMask(userName, tag, info)
+	if err != nil {
+		log.Println("WeChatSetSessionBookMask failed:", err.Error())
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	return ""
+}
+
+func (a *App) DelSessionBookMask(markId string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if markId == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty markId"))
+	}
+
+	err := a.provider.WeChatDelSessionBookMask(markId)
+	if err != nil {
+		log.Println("WeChatDelSessionBookMask failed:", err.Error())
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	return ""
+}
+
+// GetSessionBookMaskList 返回userName的第一页书签，每页50个
+func (a *App) GetSessionBookMaskList(userName string) string {
+	return a.GetSessionBookMaskListPage(userName, 0, wechat.Default_BookMark_PageSize)
+}
+
+// GetSessionBookMaskListPage 分页返回userName的书签，pageSize不大于0时每页50个
+func (a *App) GetSessionBookMaskListPage(userName string, pageIndex int, pageSize int) string {
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	if userName == "" {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyTotalFields)
+	}
+	markLIst, err := a.provider.WeChatGetSessionBookMaskList(userName, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetSessionBookMaskList failed:", err.Error())
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	markLIstString, _ := json.Marshal(markLIst)
+	return string(markLIstString)
+}
+
+// GetSessionBookMaskByTag 返回userName中标签为tag的书签，tag为空时返回未设置标签的书签
+func (a *App) GetSessionBookMaskByTag(userName, tag string) string {
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyTotalFields)
+	}
+	if userName == "" {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyTotalFields)
+	}
+	markList, err := a.provider.WeChatGetSessionBookMaskByTag(userName, tag)
+	if err != nil {
+		log.Println("WeChatGetSessionBookMaskByTag failed:", err.Error())
+		return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyTotalFields)
+	}
+
+	markListString, _ := json.Marshal(markList)
+	return string(markListString)
+}
+
+// GetAllBookmarkTags 返回userName的书签中用到的标签，供前端按标签筛选
+func (a *App) GetAllBookmarkTags(userName string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if userName == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "empty userName"))
+	}
+	tags, err := a.provider.WeChatGetAllBookmarkTags(userName)
+	if err != nil {
+		log.Println("WeChatGetAllBookmarkTags failed:", err.Error())
+		return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+	}
+
+	// 配置了允许的标签时，不再返回旧书签中已不允许的标签
+	config := a.bookmarkTagConfig()
+	if len(config.AllowedTags) > 0 {
+		allowedTags := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if _, ok := config.allowedBookmarkTag(tag); ok {
+				allowedTags = append(allowedTags, tag)
+			}
+		}
+		tags = allowedTags
+	}
+
+	tagsString, _ := json.Marshal(tags)
+	return string(tagsString)
+}
+
+// ManageBookmarkTags 向允许的书签标签中添加add、删除remove，不区分大小写，返回更新后的BookmarkTagConfig；
+// 删除标签不影响已有的书签
+func (a *App) ManageBookmarkTags(add, remove []string) string {
+	containsTag := func(tags []string, tag string) bool {
+		for _, t := range tags {
+			if strings.EqualFold(strings.TrimSpace(t), tag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	config := a.bookmarkTagConfig()
+	tags := make([]string, 0, len(config.AllowedTags)+len(add))
+	for _, tag := range append(config.AllowedTags, add...) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || containsTag(tags, tag) || containsTag(remove, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	config.AllowedTags = tags
+	viper.Set(configBookmarkTagsKey, config.AllowedTags)
+	a.setCurrentConfig()
+
+	configStr, _ := json.Marshal(config)
+	return string(configStr)
+}
+
+// 导出的书签，Message为书签位置的消息，找不到时为null
+type BookmarkExport struct {
+	BookmarkId string           `json:"bookmarkId"`
+	Tag        string           `json:"tag"`
+	Info       string           `json:"info"`
+	Message    *BookmarkMessage `json:"message"`
+}
+
+type BookmarkMessage struct {
+	CreateTime     int64  `json:"CreateTime"`
+	Content        string `json:"Content"`
+	SenderNickName string `json:"SenderNickName"`
+	Type           int    `json:"Type"`
+}
+
+// ExportBookmarksToJSON 的结果
+type BookmarkExportResult struct {
+	Path    string `json:"path"`
+	Total   int    `json:"total"`
+	Matched int    `json:"matched"`
+}
+
+// 前端保存书签时info中记录的位置
+type bookmarkPosition struct {
+	Timestamp int64  `json:"timestamp"`
+	MessageId string `json:"messageId"`
+}
+
+// ExportBookmarksToJSON 将userName的所有书签及其位置的消息导出到outputPath
+func (a *App) ExportBookmarksToJSON(userName, outputPath string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if userName == "" || outputPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid params: %s, %s", userName, outputPath))
+	}
+
+	marks := make([]wechat.WeChatBookMark, 0)
+	for pageIndex := 0; ; pageIndex++ {
+		markList, err := a.provider.WeChatGetSessionBookMaskList(userName, pageIndex, wechat.Default_BookMark_PageSize)
+		if err != nil {
+			log.Println("WeChatGetSessionBookMaskList failed:", err.Error())
+			return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+		}
+		marks = append(marks, markList.Marks...)
+		if len(markList.Marks) == 0 || len(marks) >= markList.Total {
+			break
+		}
+	}
+
+	result := BookmarkExportResult{Path: outputPath, Total: len(marks)}
+	bookmarks := make([]BookmarkExport, 0, len(marks))
+	for _, mark := range marks {
+		bookmark := BookmarkExport{BookmarkId: mark.MarkId, Tag: mark.Tag, Info: mark.Info}
+		bookmark.Message = a.bookmarkMessage(userName, mark.Info)
+		if bookmark.Message != nil {
+			result.Matched++
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+
+	data, _ := json.MarshalIndent(bookmarks, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", outputPath))
+	}
+	if err := os.WriteFile(outputPath, data, os.ModePerm); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", outputPath))
+	}
+
+	log.Printf("ExportBookmarksToJSON %s: %d bookmarks, %d messages -> %s\n", userName, result.Total, result.Matched, outputPath)
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
+}
+
+// bookmarkMessage 按书签info中的时间戳查找消息，同一秒有多条消息时按messageId匹配，找不到时返回nil
+func (a *App) bookmarkMessage(userName, info string) *BookmarkMessage {
+	var position bookmarkPosition
+	if err := json.Unmarshal([]byte(info), &position); err != nil || position.Timestamp <= 0 {
+		return nil
+	}
+	// 前端的时间戳可能是毫秒
+	if position.Timestamp > 1e12 {
+		position.Timestamp /= 1000
+	}
+
+	list, err := a.provider.WeChatGetMessageListByTime(userName, position.Timestamp, 20, wechat.Message_Search_Forward)
+	if err != nil {
+		log.Println("WeChatGetMessageListByTime failed:", err)
+		return nil
+	}
+
+	var found *wechat.WeChatMessage
+	for i := range list.Rows {
+		msg := &list.Rows[i]
+		if msg.CreateTime != position.Timestamp {
+			continue
+		}
+		if position.MessageId == "" || position.MessageId == msg.MsgSvrId || position.MessageId == strconv.Itoa(msg.LocalId) {
+			found = msg
+			break
+		}
+		if found == nil {
+			found = msg
+		}
+	}
+	if found == nil {
+		return nil
+	}
+
+	sender := found.UserInfo.NickName
+	if found.IsSender == 1 {
+		sender = a.provider.SelfInfo.NickName
+	} else if sender == "" {
+		sender = found.UserInfo.UserName
+	}
+	return &BookmarkMessage{
+		CreateTime:     found.CreateTime,
+		Content:        found.Content,
+		SenderNickName: sender,
+		Type:           found.Type,
+	}
+}
+
+func (a *App) SelectedDirDialog(title string) string {
+	dialogOptions := runtime.OpenDialogOptions{
+		Title: title,
+	}
+	selectedDir, err := runtime.OpenDirectoryDialog(a.ctx, dialogOptions)
+	if err != nil {
+		log.Println("OpenDirectoryDialog:", err)
+		return ""
+	}
+
+	if selectedDir == "" {
+		return ""
+	}
+
+	return selectedDir
+}
+
+// ExportWeChatDataByUserName 在后台导出userName的会话数据，立即返回{"jobId":"..."}，
+// 进度和最终结果通过exportUserData事件发送，可用CancelExportWeChatDataByUserName取消
+func (a *App) ExportWeChatDataByUserName(userName, path string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if userName == "" || path == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invaild params %s", userName))
+	}
+
+	return a.startUserExportJob([]string{userName}, userName, path)
+}
+
+// WeChatExportDataByUserNameWithProgress 与ExportWeChatDataByUserName相同，
+// 导出在后台进行，进度每秒通过exportUserData事件发送一次
+func (a *App) WeChatExportDataByUserNameWithProgress(userName, path string) string {
+	return a.ExportWeChatDataByUserName(userName, path)
+}
+
+// ExportWeChatDataBundle 将多个会话导出到同一个 wechatDataBackup_<label> 目录，
+// 目录中附带程序和配置，可以直接打开查看；进度和结果与ExportWeChatDataByUserName相同
+func (a *App) ExportWeChatDataBundle(userNames []string, label, path string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if label == "" || filepath.Base(label) != label || path == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invaild params %s", label))
+	}
+
+	names := make([]string, 0, len(userNames))
+	seen := make(map[string]bool)
+	for _, userName := range userNames {
+		if userName != "" && !seen[userName] {
+			seen[userName] = true
+			names = append(names, userName)
+		}
+	}
+	if len(names) == 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "no userName"))
+	}
+
+	return a.startUserExportJob(names, label, path)
+}
+
+// startUserExportJob 在后台把userNames导出到 path\wechatDataBackup_<label>，返回jobId
+func (a *App) startUserExportJob(userNames []string, label, path string) string {
+	if !utils.PathIsCanWriteFile(path, 0) {
+		log.Println("PathIsCanWriteFile: " + path)
+		return apierr.JSON(apierr.New(apierr.CodeIOFailure, "PathIsCanWriteFile: %s", path))
+	}
+
+	exPath := path + "\\" + "wechatDataBackup_" + label
+	if _, err := os.Stat(exPath); err != nil {
+		os.MkdirAll(exPath, os.ModePerm)
+	} else {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "path exist:%s", exPath))
+	}
+
+	jobId := fmt.Sprintf("%s_%d", label, time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	a.userExportLock.Lock()
+	if a.userExportJobs == nil {
+		a.userExportJobs = make(map[string]context.CancelFunc)
+	}
+	a.userExportJobs[jobId] = cancel
+	a.userExportLock.Unlock()
+
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
+		defer func() {
+			a.userExportLock.Lock()
+			delete(a.userExportJobs, jobId)
+			a.userExportLock.Unlock()
+			cancel()
+		}()
+
+		log.Println("ExportWeChatDataByUserName:", jobId, userNames, exPath)
+		result, err := a.exportWeChatDataByUserNames(ctx, jobId, userNames, exPath)
+		event := UserExportEvent{JobId: jobId, UserNames: userNames, Status: wechat.Export_Status_Completed, Path: exPath, Result: result}
+		if err != nil {
+			log.Println("exportWeChatDataByUserName failed:", err)
+			event.Status = wechat.Export_Status_Error
+			if errors.Is(err, context.Canceled) {
+				event.Status = User_Export_Status_Canceled
+			}
+			e := apierr.Wrap(apierr.CodeInternal, err)
+			event.Error, event.ErrorCode = e.Message, e.Code
+		}
+		a.emitUserExportEvent(event)
+	}()
+
+	jobStr, _ := json.Marshal(map[string]string{"jobId": jobId})
+	return string(jobStr)
+}
+
+// CancelExportWeChatDataByUserName 取消ExportWeChatDataByUserName启动的导出
+func (a *App) CancelExportWeChatDataByUserName(jobId string) string {
+	a.userExportLock.Lock()
+	cancel, ok := a.userExportJobs[jobId]
+	a.userExportLock.Unlock()
+	if !ok {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "job %s not found", jobId))
+	}
+
+	log.Println("CancelExportWeChatDataByUserName:", jobId)
+	cancel()
+	return ""
+}
+
+func (a *App) emitUserExportEvent(event UserExportEvent) {
+	eventStr, _ := json.Marshal(event)
+	eventsEmit(a.ctx, "exportUserData", string(eventStr))
+}
+
+// exportWeChatDataByUserNames 导出数据并生成可以直接打开的目录：写入指向导出账号的config.json，
+// 复制程序，最后按程序打开时的方式扫描目录确认账号可以读取
+func (a *App) exportWeChatDataByUserNames(ctx context.Context, jobId string, userNames []string, exPath string) (*UserExportResult, error) {
+	result := &UserExportResult{Path: exPath}
+	progress := make(chan wechat.UserExportProgress)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range progress {
+			result.Progress = p
+			a.emitUserExportEvent(UserExportEvent{
+				JobId:     jobId,
+				UserNames: userNames,
+				Status:    wechat.Export_Status_Processing,
+				Progress:  p,
+			})
+		}
+	}()
+	err := a.provider.WeChatExportDataByUserNamesWithProgress(ctx, userNames, exPath, progress)
+	close(progress)
+	<-done
+	if err != nil {
+		return result, apierr.Wrapf(apierr.CodeDBFailure, err, "WeChatExportDataByUserName failed")
+	}
+
+	// 导出的数据保存在 User\<自己的账号> 下，配置中的账号需要与之一致
+	result.Account = a.provider.SelfInfo.UserName
+	config := map[string]interface{}{
+		"exportpath": ".\\",
+		"userconfig": map[string]interface{}{
+			"defaultuser": result.Account,
+			"users":       []string{result.Account},
+		},
+	}
+
+	configJson, err := json.MarshalIndent(config, "", "	")
+	if err != nil {
+		log.Println("MarshalIndent:", err)
+		return result, apierr.Wrapf(apierr.CodeInternal, err, "MarshalIndent")
+	}
+
+	configPath := exPath + "\\" + "config.json"
+	err = os.WriteFile(configPath, configJson, os.ModePerm)
+	if err != nil {
+		log.Println("WriteFile:", err)
+		return result, apierr.Wrapf(apierr.CodeIOFailure, err, "WriteFile")
+	}
+
+	exeSrcPath, err := os.Executable()
+	if err != nil {
+		log.Println("Executable:", exeSrcPath)
+		return result, apierr.Wrapf(apierr.CodeInternal, err, "Executable")
+	}
+
+	exeDstPath := exPath + "\\" + "wechatDataBackup.exe"
+	log.Printf("Copy [%s] -> [%s]\n", exeSrcPath, exeDstPath)
+	_, err = utils.CopyFile(exeSrcPath, exeDstPath)
+	if err != nil {
+		log.Println("CopyFile:", err)
+		return result, apierr.Wrapf(apierr.CodeIOFailure, err, "CopyFile")
+	}
+
+	infos, err := scanAccountInfos(exPath, nil)
+	if err != nil {
+		return result, apierr.Wrapf(apierr.CodeIOFailure, err, "verify bundle")
+	}
+	for _, info := range infos.Info {
+		if info.AccountName == result.Account {
+			result.Verified = true
+			break
+		}
+	}
+	if !result.Verified {
+		return result, apierr.New(apierr.CodeNotFound, "verify bundle: account %s not readable in %s", result.Account, exPath)
+	}
+
+	return result, nil
+}
+
+// MergeExports 将srcPath账号导出目录合并到dstPath，进度通过mergeExports事件发送，结束时发送MergeExportsEvent
+func (a *App) MergeExports(srcPath, dstPath string) string {
+	srcPath = filepath.Clean(srcPath)
+	dstPath = filepath.Clean(dstPath)
+	if srcPath == dstPath {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "srcPath and dstPath are the same: %s", srcPath))
+	}
+	for _, path := range []string{srcPath, dstPath} {
+		if _, err := os.Stat(path); err != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", path))
+		}
+	}
+
+	// 合并会写入目标目录的数据库，正在浏览的账号需要先关闭
+	if a.provider != nil && a.provider.SelfInfo != nil &&
+		strings.EqualFold(dstPath, filepath.Clean(a.FLoader.FilePrefix+"\\User\\"+a.provider.SelfInfo.UserName)) {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+		log.Println("MergeExports WechatWechatDataProviderClose")
+	}
+
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
+		// 合并前关闭了正在浏览的账号时，结束后重新打开
+		defer a.reopenDefaultProvider()
+		progress := make(chan wechat.ExportProgress)
+		errChan := make(chan error, 1)
+		var report *wechat.MergeReport
+		go func() {
+			var err error
+			report, err = wechat.MergeExports(srcPath, dstPath, progress)
+			errChan <- err
+		}()
+
+		for p := range progress {
+			pStr, _ := json.Marshal(p)
+			eventsEmit(a.ctx, "mergeExports", string(pStr))
+		}
+
+		event := MergeExportsEvent{Status: wechat.Export_Status_Completed, Report: report}
+		if err := <-errChan; err != nil {
+			log.Println("MergeExports failed:", err)
+			event.Status = wechat.Export_Status_Error
+			e := apierr.Wrap(apierr.CodeDBFailure, err)
+			event.Error, event.ErrorCode = e.Message, e.Code
+		} else {
+			log.Printf("MergeExports %s -> %s: messages added %d, files added %d, conflicts %d\n", srcPath, dstPath,
+				report.MessagesAdded, report.FilesAdded, len(report.Conflicts))
+		}
+		eventStr, _ := json.Marshal(event)
+		eventsEmit(a.ctx, "mergeExportsResult", string(eventStr))
+	}()
+
+	return ""
+}
+
+func (a *App) GetAppIsShareData() bool {
+	if a.provider != nil {
+		return a.provider.IsShareData
+	}
+	return false
+}
+
+// 增量导出并备份新增数据
+func (a *App) ExportWeChatDataWithIncrementalBackup(full bool, acountName string, enableBackup bool, backupPath string) {
+	a.ExportWeChatDataWithIncrementalBackupForce(full, acountName, enableBackup, backupPath, false)
+}
+
+// ExportWeChatDataWithIncrementalBackupForce force为true时跳过导出前的空间检查
+func (a *App) ExportWeChatDataWithIncrementalBackupForce(full bool, acountName string, enableBackup bool, backupPath string, force bool) {
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+
+	exportDone := a.beginExport()
+	go func() {
+		defer exportDone()
+		// 导出前关闭了数据提供者，任何情况下结束时都重新打开默认账号
+		defer a.reopenDefaultProvider()
+
+		pInfo := a.findWeChatInfo(acountName)
+
+		if pInfo == nil {
+			a.emitExportEvent(ExportEvent{
+				Status:    wechat.Export_Status_Error,
+				Result:    fmt.Sprintf("%s error", acountName),
+				ErrorCode: Export_ErrorCode_AccountNotFound,
+			})
+			return
+		}
+
+		prefixExportPath := a.FLoader.FilePrefix + "\\User\\"
+		_, err := os.Stat(prefixExportPath)
+		if err != nil {
+			os.Mkdir(prefixExportPath, os.ModeDir)
+		}
+
+		expPath := prefixExportPath + pInfo.AcountName
+		if !force && !a.checkExportSpace(*pInfo, expPath, full, a.defaultExportOptions()) {
+			return
+		}
+		
+		var config IncrementalBackupConfig
+		if enableBackup && !full {
+			if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil {
+				log.Printf("Error parsing backup config: %v", err)
+			}
+		}
+
+		exportStart := time.Now().Unix()
+		newMessageConfig, newMessageErr := a.loadNewMessageExportConfig(pInfo.AcountName)
+
+		// 执行增量导出，先导出到临时目录，成功后再替换
+		if err := a.exportWeChatDataToTemp(*pInfo, expPath, full, a.defaultExportOptions()); err != nil {
+			log.Println("exportWeChatDataToTemp failed:", err)
+			a.emitExportEvent(ExportEvent{
+				Status:    wechat.Export_Status_Error,
+				Result:    fmt.Sprintf("%v, 原导出数据已保留", err),
+				ErrorCode: exportErrorCode(err),
+			})
+			return
+		}
+		verify := a.verifyExport(expPath)
+
+		// 导出会删除并重新生成Msg等目录，导出完成后才扫描导出目录，
+		// 与备份记录比较哈希，备份新增和变化的数据
+		if enableBackup && !full {
+			backupResult := a.scanExistingFiles(expPath, backupPath, config)
+			backupResult = a.backupNewData(expPath, backupResult, config)
+			if !backupRemoteEnabled(config) && backupResult.Error == "" {
+				applyBackupQuota(backupResult, config.MaxBackupBytes)
+			}
+			
+			// 发送备份结果
+			resultJson, _ := json.Marshal(backupResult)
+			eventsEmit(a.ctx, "incrementalBackup", string(resultJson))
+			if backupResult.Error == "" {
+				a.updateLastBackupTime()
+			}
+			
+			// 按配置清理超出保留数量的旧备份
+			if !backupRemoteEnabled(config) {
+				a.applyBackupRetention(filepath.Dir(backupResult.BackupPath), config.MaxBackupVersions)
+			}
+		}
+
+		// 导出完成后，执行新消息导出
+		log.Println("开始检查是否需要导出新消息，full=", full)
+		a.emitExportEvent(ExportEvent{
+			Status:   wechat.Export_Status_Processing,
+			Stage:    Export_Stage_NewMessage,
+			Result:   "开始导出新消息",
+			Progress: 95,
+		})
+		if newMessageErr != nil {
+			log.Println("跳过新消息导出:", newMessageErr)
+		} else if !full && newMessageConfig.EnableExport {
+			log.Println("执行新消息导出，账号名=", pInfo.AcountName, "导出路径=", expPath)
+			newMessageResult := a.exportNewMessages(pInfo.AcountName, expPath, newMessageConfig, exportStart)
+			if newMessageResult != nil {
+				log.Println("新消息导出完成，结果=", newMessageResult)
+				// 发送新消息导出结果
+				resultJson, _ := json.Marshal(newMessageResult)
+				eventsEmit(a.ctx, "newMessageExport", string(resultJson))
+			} else {
+				log.Println("新消息导出返回nil结果")
+			}
+		} else {
+			log.Println("跳过新消息导出，全量导出或未启用")
+		}
+		
+		// 发送导出完成事件，通知前端刷新消息列表
+		a.emitExportEvent(ExportEvent{
+			Status:   wechat.Export_Status_Completed,
+			Stage:    Export_Stage_Done,
+			Result:   "导出完成",
+			Progress: 100,
+			Verify:   verify,
+		})
+		a.emitRefreshEvent()
+
+		// 更新用户配置
+		a.defaultUser = pInfo.AcountName
+		hasUser := false
+		for _, user := range a.users {
+			if user == pInfo.AcountName {
+				hasUser = true
+				break
+			}
+		}
+		if !hasUser {
+			a.users = append(a.users, pInfo.AcountName)
+		}
+		a.setCurrentConfig()
+	}()
+}
+
+// BackupScanProgress 备份扫描进度，通过backupScanProgress事件发送
+type BackupScanProgress struct {
+	Scanned int `json:"scanned"`
+	Total   int `json:"total"`
+	Hashed  int `json:"hashed"`
+}
+
+// 扫描进度事件的发送间隔
+const backupScanProgressInterval = time.Second
+
+// BackupProgress 扫描和复制阶段的备份进度，通过backupProgress事件发送，扫描阶段没有字节数
+type BackupProgress struct {
+	Phase       string `json:"phase"`
+	FilesDone   int    `json:"filesDone"`
+	FilesTotal  int    `json:"filesTotal"`
+	BytesDone   int64  `json:"bytesDone"`
+	BytesTotal  int64  `json:"bytesTotal"`
+	CurrentFile string `json:"currentFile"`
+}
+
+const (
+	Backup_Phase_Scan = "scan"
+	Backup_Phase_Copy = "copy"
+)
+
+// backupProgress事件的发送间隔
+const backupProgressInterval = 250 * time.Millisecond
+
+// emitBackupProgress 距上次发送不足backupProgressInterval时跳过，force为true时总是发送
+func (a *App) emitBackupProgress(progress BackupProgress, lastEmit *time.Time, force bool) {
+	if !force && time.Since(*lastEmit) < backupProgressInterval {
+		return
+	}
+	*lastEmit = time.Now()
+	progressStr, _ := json.Marshal(progress)
+	eventsEmit(a.ctx, "backupProgress", string(progressStr))
+}
+
+type backupScanState struct {
+	progress      BackupScanProgress
+	forceFullHash bool
+	root          string
+	include       []string
+	exclude       []string
+	lastEmit      time.Time
+	// 最近扫描的文件和backupProgress事件的发送时间
+	current       string
+	lastProgress  time.Time
+}
+
+func (a *App) emitBackupScanProgress(state *backupScanState, force bool) {
+	current := state.current
+	if rel, err := filepath.Rel(state.root, state.current); err == nil && state.current != "" {
+		current = rel
+	}
+	a.emitBackupProgress(BackupProgress{
+		Phase:       Backup_Phase_Scan,
+		FilesDone:   state.progress.Scanned,
+		FilesTotal:  state.progress.Total,
+		CurrentFile: current,
+	}, &state.lastProgress, force)
+
+	if !force && time.Since(state.lastEmit) < backupScanProgressInterval {
+		return
+	}
+	state.lastEmit = time.Now()
+	progressStr, _ := json.Marshal(state.progress)
+	eventsEmit(a.ctx, "backupScanProgress", string(progressStr))
+}
+
+// 统计目录下的文件数，只读取目录项，用于计算扫描进度
+func countBackupFiles(paths ...string) int {
+	total := 0
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				total++
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+// excluded 按Include/Exclude判断导出目录下的文件是否不需要备份
+func (state *backupScanState) excluded(path string) bool {
+	if len(state.include) == 0 && len(state.exclude) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(state.root, path)
+	if err != nil {
+		return false
+	}
+
+	included := len(state.include) == 0
+	for _, pattern := range state.include {
+		if utils.MatchGlob(pattern, rel) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return true
+	}
+	for _, pattern := range state.exclude {
+		if utils.MatchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// 扫描现有文件状态，config.ForceFullHash为true时对所有文件重新计算哈希
+func (a *App) scanExistingFiles(expPath, backupPath string, config IncrementalBackupConfig) *IncrementalBackupResult {
+	// 每次备份只加载一次备份记录
+	a.loadBackupHistory()
+
+	// 创建备份目录，远程备份时为远程目标中的 账号/时间戳
+	backupDir := fmt.Sprintf("%s\\%s\\%d", backupPath, a.defaultUser, time.Now().Unix())
+	if backupRemoteEnabled(config) {
+		backupDir = fmt.Sprintf("%s/%d", a.defaultUser, time.Now().Unix())
+	} else {
+		os.MkdirAll(backupDir, os.ModePerm)
+	}
+
+	return a.scanBackupFiles(expPath, backupDir, config)
+}
+
+func (a *App) scanBackupFiles(expPath, backupDir string, config IncrementalBackupConfig) *IncrementalBackupResult {
+	result := &IncrementalBackupResult{
+		Changes:        make([]BackupChangeGroup, 0),
+		NewDataRecords: make([]NewDataRecord, 0),
+		BackupPath:     backupDir,
+	}
+
+	msgPath := expPath + "\\Msg"
+	fileStoragePath := expPath + "\\FileStorage"
+	state := &backupScanState{
+		forceFullHash: config.ForceFullHash,
+		root:          expPath,
+		include:       config.Include,
+		exclude:       config.Exclude,
+	}
+	state.progress.Total = countBackupFiles(msgPath, fileStoragePath)
+	a.emitBackupScanProgress(state, true)
+
+	// 扫描Msg目录（数据库文件）
+	if _, err := os.Stat(msgPath); err == nil {
+		a.scanDirectoryForBackup(msgPath, backupDir, "database", result, state)
+	}
+
+	// 扫描FileStorage目录（媒体文件）
+	if _, err := os.Stat(fileStoragePath); err == nil {
+		a.scanDirectoryForBackup(fileStoragePath, backupDir, "media", result, state)
+	}
+
+	a.emitBackupScanProgress(state, true)
+	log.Printf("Backup scan done: %d files, %d hashed, %d excluded\n", state.progress.Scanned, state.progress.Hashed, result.ExcludedFiles)
+	return result
+}
+
+// 扫描目录并记录文件信息
+func (a *App) scanDirectoryForBackup(srcPath, backupDir, dataType string, result *IncrementalBackupResult, state *backupScanState) {
+	// 先遍历目录记录文件信息，需要计算哈希的文件记录下标后交给hashBackupRecords并行计算
+	records := make([]NewDataRecord, 0)
+	pending := make([]int, 0)
+	err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			state.current = path
+			if state.excluded(path) {
+				result.ExcludedFiles++
+				result.ExcludedSize += info.Size()
+				state.progress.Scanned++
+				a.emitBackupScanProgress(state, false)
+				return nil
+			}
+
+			record := NewDataRecord{
+				FilePath:   path,
+				FileSize:   info.Size(),
+				ModifyTime: info.ModTime().Unix(),
+				DataType:   dataType,
+			}
+			
+			// 大小和修改时间与备份记录一致时沿用其哈希，不再重新计算
+			existing := a.findExistingRecord(path)
+			if !state.forceFullHash && existing != nil && existing.FileSize == record.FileSize && existing.ModifyTime == record.ModifyTime {
+				record.FileHash = existing.FileHash
+				state.progress.Scanned++
+				a.emitBackupScanProgress(state, false)
+			} else {
+				pending = append(pending, len(records))
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Error scanning directory %s: %v", srcPath, err)
+	}
+
+	a.hashBackupRecords(records, pending, state, goruntime.NumCPU())
+	result.NewDataRecords = append(result.NewDataRecords, records...)
+	result.TotalFiles += len(records)
+}
+
+// hashBackupRecords 使用workers个worker计算records中pending下标对应文件的哈希，
+// 每个worker只写入自己取到的下标，进度只在当前goroutine中更新
+func (a *App) hashBackupRecords(records []NewDataRecord, pending []int, state *backupScanState, workers int) {
+	if len(pending) == 0 {
+		return
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	jobs := make(chan int, workers*2)
+	done := make(chan int, workers*2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if hash, err := utils.CalculateFileHash(records[i].FilePath); err == nil {
+					records[i].FileHash = hash
+				}
+				done <- i
+			}
+		}()
+	}
+
+	go func() {
+		for _, i := range pending {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	for i := range done {
+		state.current = records[i].FilePath
+		state.progress.Hashed++
+		state.progress.Scanned++
+		a.emitBackupScanProgress(state, false)
+	}
+}
+
+// 备份新增数据
+func (a *App) backupNewData(expPath string, backupResult *IncrementalBackupResult, config IncrementalBackupConfig) *IncrementalBackupResult {
+	log.Println("Starting incremental backup...")
+	
+	manifest := BackupManifest{CreateTime: time.Now().Unix(), Files: make([]BackupManifestEntry, 0)}
+
+	// 加密时不能退回到明文备份，无法加密就不备份
+	compression := config.Compression
+	var key []byte
+	if config.Encrypt {
+		passphrase, err := a.backupPassphrase(config)
+		if err == nil {
+			key, manifest.Encryption, err = utils.NewEncryptionKey(passphrase)
+		}
+		if err != nil {
+			log.Printf("Error preparing backup encryption: %v", err)
+			backupResult.Error = fmt.Sprintf("backup encryption unavailable: %v", err)
+			return backupResult
+		}
+		compression = Backup_Compression_Zip
+	}
+
+	store, err := a.openBackupStore(backupResult.BackupPath, config)
+	if err != nil {
+		log.Printf("Error opening backup target: %v", err)
+		backupResult.Error = err.Error()
+		return backupResult
+	}
+
+	// 压缩时先写入临时压缩包，全部写入成功后再更新备份记录；
+	// 加密时明文压缩包只写在本地临时目录，加密后再写入备份目录
+	var archive *zip.Writer
+	var archiveFile *os.File
+	archiveName := backupArchiveName
+	if key != nil {
+		archiveName = backupEncryptedArchiveName
+	}
+	archivePath := store.Location(archiveName)
+	archiveTmp := store.TempPath(archiveName)
+	if key != nil {
+		archiveTmp = filepath.Join(os.TempDir(), fmt.Sprintf("wechat_backup_%d.zip", time.Now().UnixNano()))
+	}
+	archived := make([]NewDataRecord, 0)
+	switch compression {
+	case Backup_Compression_None:
+	case Backup_Compression_Zip:
+		if f, err := os.Create(archiveTmp); err != nil {
+			if key != nil {
+				log.Printf("Error creating backup archive: %v", err)
+				backupResult.Error = err.Error()
+				return backupResult
+			}
+			log.Printf("Error creating backup archive, fall back to copy: %v", err)
+		} else {
+			archiveFile = f
+			archive = zip.NewWriter(f)
+			manifest.Archive = archiveName
+		}
+	default:
+		log.Printf("Unsupported backup compression %s, fall back to copy", compression)
+	}
+
+	blobRoot := ""
+	if config.ContentAddressed && archive == nil && !backupRemoteEnabled(config) {
+		blobRoot = filepath.Join(filepath.Dir(backupResult.BackupPath), backupBlobDir)
+		manifest.BlobStore = backupBlobDir
+	}
+
+	// 扫描结果中的每个文件都计入复制进度，未变化而跳过的文件同样计为已完成
+	progress := BackupProgress{Phase: Backup_Phase_Copy, FilesTotal: len(backupResult.NewDataRecords)}
+	for _, record := range backupResult.NewDataRecords {
+		progress.BytesTotal += record.FileSize
+	}
+	var lastProgress, lastFileProgress time.Time
+	var bytesDone int64
+	a.emitBackupProgress(progress, &lastProgress, true)
+
+	for i := range backupResult.NewDataRecords {
+		record := &backupResult.NewDataRecords[i]
+		progress.FilesDone = i
+		progress.BytesDone = bytesDone
+		bytesDone += record.FileSize
+		progress.CurrentFile = record.FilePath
+		if rel, err := filepath.Rel(expPath, record.FilePath); err == nil {
+			progress.CurrentFile = rel
+		}
+		a.emitBackupProgress(progress, &lastProgress, false)
+		
+		// 检查文件是否为新文件或已修改
+		if info, err := os.Stat(record.FilePath); err == nil {
+			// 导出过程中文件被修改时重新计算哈希
+			if info.Size() != record.FileSize || info.ModTime().Unix() != record.ModifyTime {
+				record.FileSize = info.Size()
+				record.ModifyTime = info.ModTime().Unix()
+				record.FileHash = ""
+				if hash, err := utils.CalculateFileHash(record.FilePath); err == nil {
+					record.FileHash = hash
+				}
+			}
+
+			// 检查文件是否已存在且未修改
+			existingRecord := a.findExistingRecord(record.FilePath)
+			if existingRecord != nil && record.FileHash != "" &&
+			   existingRecord.FileHash == record.FileHash && 
+			   existingRecord.FileSize == record.FileSize {
+				// 文件未变化，跳过备份；只有修改时间变化时更新记录，下次不再计算哈希
+				if existingRecord.ModifyTime != record.ModifyTime {
+					updated := *existingRecord
+					updated.ModifyTime = record.ModifyTime
+					a.updateBackupHistory(updated)
+				}
+				continue
+			}
+			record.ChangeType = Backup_Change_Added
+			if existingRecord != nil {
+				record.ChangeType = Backup_Change_Modified
+			}
+			
+			// 计算相对路径
+			relPath, err := filepath.Rel(expPath, record.FilePath)
+			if err != nil {
+				log.Printf("Error calculating relative path: %v", err)
+				continue
+			}
+
+			// 清单中记录复制前源文件的哈希，复制出错的文件不会被当作正确的备份
+			if record.FileHash == "" {
+				hash, err := utils.CalculateFileHash(record.FilePath)
+				if err != nil {
+					log.Printf("Error hashing file %s: %v", record.FilePath, err)
+					continue
+				}
+				record.FileHash = hash
+			}
+			
+			if archive != nil {
+				name := filepath.ToSlash(relPath)
+				if err := addFileToZip(archive, name, record.FilePath); err != nil {
+					log.Printf("Error archiving file %s: %v", record.FilePath, err)
+					continue
+				}
+				record.BackupPath = archivePath + backupArchiveSep + name
+				backupResult.BackupFiles++
+				backupResult.BackupSize += record.FileSize
+				archived = append(archived, *record)
+
+				manifest.Files = append(manifest.Files, BackupManifestEntry{SourcePath: record.FilePath, BackupPath: name, FileSize: record.FileSize, FileHash: record.FileHash,
+					DataType: record.DataType, ChangeType: record.ChangeType})
+				continue
+			}
+
+			if blobRoot != "" {
+				hash, copied, err := storeBackupBlob(blobRoot, record.FilePath, record.FileHash)
+				if err != nil {
+					log.Printf("Error backing up file %s: %v", record.FilePath, err)
+					continue
+				}
+				record.FileHash = hash
+				record.BackupPath = backupBlobPath(blobRoot, hash)
+				backupResult.BackupFiles++
+				backupResult.BackupSize += record.FileSize
+				if !copied {
+					backupResult.DedupedFiles++
+					backupResult.DedupedSize += record.FileSize
+				}
+				a.updateBackupHistory(*record)
+				manifest.Files = append(manifest.Files, BackupManifestEntry{SourcePath: record.FilePath, BackupPath: relPath, FileSize: record.FileSize, FileHash: hash,
+					DataType: record.DataType, ChangeType: record.ChangeType})
+				continue
+			}
+
+			// 复制文件到备份目录
+			backupFilePath := store.Location(relPath)
+			err = store.CopyFile(record.FilePath, relPath, a.emitFileCopyProgress("backupFileProgress", relPath, &lastFileProgress))
+			if err == nil {
+				err = store.Verify(relPath, record.FileHash)
+			}
+			if err == nil {
+				record.BackupPath = backupFilePath
+				backupResult.BackupFiles++
+				backupResult.BackupSize += record.FileSize
+				a.updateBackupHistory(*record)
+				log.Printf("Backed up: %s -> %s", record.FilePath, backupFilePath)
+				
+				// 记录复制前源文件的哈希，供VerifyBackup校验
+				manifest.Files = append(manifest.Files, BackupManifestEntry{SourcePath: record.FilePath, BackupPath: relPath, FileSize: record.FileSize, FileHash: record.FileHash,
+					DataType: record.DataType, ChangeType: record.ChangeType})
+			} else {
+				log.Printf("Error backing up file %s: %v", record.FilePath, err)
+			}
+		}
+	}
+	
+	progress.FilesDone = progress.FilesTotal
+	progress.BytesDone = bytesDone
+	progress.CurrentFile = ""
+	a.emitBackupProgress(progress, &lastProgress, true)
+
+	if archive != nil {
+		err := archive.Close()
+		if closeErr := archiveFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && key != nil {
+			encryptedTmp := store.TempPath(archiveName)
+			err = utils.EncryptFile(archiveTmp, encryptedTmp, key)
+			os.Remove(archiveTmp)
+			archiveTmp = encryptedTmp
+		}
+		var compressedSize int64
+		if err == nil {
+			if info, statErr := os.Stat(archiveTmp); statErr == nil {
+				compressedSize = info.Size()
+				manifest.ArchiveSize = compressedSize
+			}
+			err = store.MoveFile(archiveTmp, archiveName)
+		}
+		if err != nil {
+			log.Printf("Error writing backup archive: %v", err)
+			os.Remove(archiveTmp)
+			manifest.Archive = ""
+			manifest.Encryption = nil
+			manifest.Files = make([]BackupManifestEntry, 0)
+			backupResult.BackupFiles = 0
+			backupResult.BackupSize = 0
+			backupResult.Error = err.Error()
+		} else {
+			for _, record := range archived {
+				a.updateBackupHistory(record)
+			}
+			backupResult.CompressedSize = compressedSize
+		}
+	}
+
+	if manifestJson, err := json.MarshalIndent(manifest, "", "  "); err == nil {
+		if err := store.WriteFile(backupManifestName, manifestJson); err != nil {
+			log.Printf("Error writing backup manifest: %v", err)
+		}
+	}
+	
+	if err := a.saveBackupHistory(); err != nil {
+		log.Printf("Error saving backup history: %v", err)
+	}
+	
+	backupResult.NewFiles, backupResult.ModifiedFiles, backupResult.Changes = summarizeBackupChanges(manifest.Files)
+	log.Printf("Incremental backup completed: %d files backed up, %d bytes, compressed %d bytes", 
+		backupResult.BackupFiles, backupResult.BackupSize, backupResult.CompressedSize)
+	
+	return backupResult
+}
+
+// summarizeBackupChanges 统计新增和修改的文件数，并按数据类型和目录分组
+func summarizeBackupChanges(files []BackupManifestEntry) (added, modified int, groups []BackupChangeGroup) {
+	groups = make([]BackupChangeGroup, 0)
+	index := make(map[string]int)
+	for _, entry := range files {
+		dir := backupChangeDirectory(entry.BackupPath)
+		key := entry.DataType + "|" + dir
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, BackupChangeGroup{DataType: entry.DataType, Directory: dir})
+		}
+		if entry.ChangeType == Backup_Change_Modified {
+			modified++
+			groups[i].Modified++
+			groups[i].ModifiedSize += entry.FileSize
+		} else {
+			added++
+			groups[i].Added++
+			groups[i].AddedSize += entry.FileSize
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].DataType != groups[j].DataType {
+			return groups[i].DataType < groups[j].DataType
+		}
+		return groups[i].Directory < groups[j].Directory
+	})
+	return added, modified, groups
+}
+
+// backupChangeDirectory 返回相对导出目录的路径的前两级目录，直接在Msg下的文件返回Msg
+func backupChangeDirectory(relPath string) string {
+	segs := strings.Split(filepath.ToSlash(relPath), "/")
+	if len(segs) > 2 {
+		return segs[0] + "/" + segs[1]
+	}
+	if len(segs) == 2 {
+		return segs[0]
+	}
+	return ""
+}
+
+// backupStore 备份版本的写入位置，rel为备份版本内的相对路径
+type backupStore interface {
+	CopyFile(src, rel string, progress func(written, total int64)) error
+	// WriteFile 写入完成前不会留下不完整的文件
+	WriteFile(rel string, data []byte) error
+	// MoveFile 把TempPath返回的本地临时文件移动到rel
+	MoveFile(tmp, rel string) error
+	TempPath(rel string) string
+	// Location 返回rel的完整位置，用于日志和备份记录
+	Location(rel string) string
+	// Verify 确认rel的内容与复制前源文件的哈希一致，无法读取备份内容时不校验
+	Verify(rel, hash string) error
+}
+
+type localBackupStore struct {
+	dir string
+}
+
+func (s *localBackupStore) CopyFile(src, rel string, progress func(written, total int64)) error {
+	dst := s.Location(rel)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	_, err := utils.CopyFileWithProgress(src, dst, progress)
+	return err
+}
+
+// WriteFile 先写临时文件再重命名
+func (s *localBackupStore) WriteFile(rel string, data []byte) error {
+	tmp := s.TempPath(rel)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := s.MoveFile(tmp, rel); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *localBackupStore) Verify(rel, hash string) error {
+	copied, err := utils.CalculateFileHash(s.Location(rel))
+	if err != nil {
+		return err
+	}
+	if copied != hash {
+		return fmt.Errorf("hash mismatch after copy: %s", rel)
+	}
+	return nil
+}
+
+func (s *localBackupStore) MoveFile(tmp, rel string) error {
+	return os.Rename(tmp, s.Location(rel))
+}
+
+func (s *localBackupStore) TempPath(rel string) string {
+	return s.Location(rel) + ".tmp"
+}
+
+func (s *localBackupStore) Location(rel string) string {
+	return filepath.Join(s.dir, rel)
+}
+
+// remoteBackupStore 直接上传到远程目标，临时文件写在本地临时目录，上传后删除
+type remoteBackupStore struct {
+	target utils.RemoteTarget
+	dir    string
+}
+
+func (s *remoteBackupStore) name(rel string) string {
+	return path.Join(s.dir, filepath.ToSlash(rel))
+}
+
+func (s *remoteBackupStore) CopyFile(src, rel string, progress func(written, total int64)) error {
+	return s.target.Upload(src, s.name(rel), progress)
+}
+
+func (s *remoteBackupStore) WriteFile(rel string, data []byte) error {
+	return s.target.Put(s.name(rel), data)
+}
+
+func (s *remoteBackupStore) MoveFile(tmp, rel string) error {
+	defer os.Remove(tmp)
+	return s.target.Upload(tmp, s.name(rel), nil)
+}
+
+func (s *remoteBackupStore) Verify(rel, hash string) error {
+	return nil
+}
+
+func (s *remoteBackupStore) TempPath(rel string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("wechat_backup_%d_%s", time.Now().UnixNano(), filepath.Base(rel)))
+}
+
+func (s *remoteBackupStore) Location(rel string) string {
+	return s.target.URL(s.name(rel))
+}
+
+// openBackupStore versionPath为本地备份版本目录，远程备份时为远程目标中的相对路径
+func (a *App) openBackupStore(versionPath string, config IncrementalBackupConfig) (backupStore, error) {
+	if !backupRemoteEnabled(config) {
+		return &localBackupStore{dir: versionPath}, nil
 	}
-	list, err := a.provider.WeChatGetMessageListByTime(userName, time, pageSize, dire)
+	target, err := a.openRemoteTarget(*config.Remote)
 	if err != nil {
-		log.Println("GetWechatMessageListByTime failed:", err)
+		return nil, err
+	}
+	return &remoteBackupStore{target: target, dir: versionPath}, nil
+}
+
+// openRemoteTarget 未传入Password时使用配置中DPAPI加密保存的密码
+func (a *App) openRemoteTarget(remote BackupRemoteConfig) (utils.RemoteTarget, error) {
+	password := remote.Password
+	if password == "" && remote.ProtectedPassword != "" {
+		var err error
+		if password, err = unprotectConfigString(remote.ProtectedPassword); err != nil {
+			return nil, err
+		}
+	}
+	return utils.NewRemoteTarget(utils.RemoteConfig{
+		Type:     remote.Type,
+		URL:      remote.URL,
+		Bucket:   remote.Bucket,
+		Region:   remote.Region,
+		Prefix:   remote.Prefix,
+		Username: remote.Username,
+		Password: password,
+	})
+}
+
+// TestBackupTarget 检查备份目标是否可以写入，成功返回空字符串；
+// 远程目标写入并删除一个测试文件，Password为空时使用已保存的密码
+func (a *App) TestBackupTarget(config IncrementalBackupConfig) string {
+	if !backupRemoteEnabled(config) {
+		if config.BackupPath == "" || !utils.PathIsCanWriteFile(config.BackupPath, 0) {
+			return apierr.JSON(apierr.New(apierr.CodeIOFailure, "backup path can't write: %s", config.BackupPath))
+		}
 		return ""
 	}
-	listStr, _ := json.Marshal(list)
-	log.Println("GetWechatMessageListByTime:", list.Total)
 
-	return string(listStr)
+	remote := *config.Remote
+	if remote.Password == "" && remote.ProtectedPassword == "" {
+		var old IncrementalBackupConfig
+		if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &old); err == nil && old.Remote != nil {
+			remote.ProtectedPassword = old.Remote.ProtectedPassword
+		}
+	}
+	target, err := a.openRemoteTarget(remote)
+	if err != nil {
+		return apierr.JSON(apierr.Wrap(apierr.CodeInvalidParam, err))
+	}
+	if err := target.Test(); err != nil {
+		log.Println("TestBackupTarget failed:", err)
+		return apierr.JSON(apierr.Wrap(apierr.CodeIOFailure, err))
+	}
+	return ""
 }
 
-func (a *App) GetWechatMessageListByType(userName string, time int64, pageSize int, msgType string, direction string) string {
-	log.Println("GetWechatMessageListByType:", userName, pageSize, time, msgType, direction)
-	if len(userName) == 0 {
-		return "{\"Total\":0, \"Rows\":[]}"
+// VerifyBackup 按备份清单重新计算每个文件的哈希，repair为true时从源文件重新复制校验失败的文件
+func (a *App) VerifyBackup(backupPath string, repair bool) string {
+	var manifest BackupManifest
+	data, err := os.ReadFile(filepath.Join(backupPath, backupManifestName))
+	if os.IsNotExist(err) {
+		// 没有备份清单时按导出目录的manifest.json校验，导出目录没有源文件，无法修复
+		entries, exportErr := wechat.LoadExportManifest(backupPath)
+		if exportErr != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "read manifest"))
+		}
+		repair = false
+		manifest.Files = make([]BackupManifestEntry, 0, len(entries))
+		for _, entry := range entries {
+			manifest.Files = append(manifest.Files, BackupManifestEntry{BackupPath: filepath.FromSlash(entry.Path), FileSize: entry.Size, FileHash: entry.SHA256})
+		}
+	} else if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "read manifest"))
+	} else if err := json.Unmarshal(data, &manifest); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeInvalidParam, err, "parse manifest"))
 	}
-	dire := wechat.Message_Search_Forward
-	if direction == "backward" {
-		dire = wechat.Message_Search_Backward
-	} else if direction == "both" {
-		dire = wechat.Message_Search_Both
+
+	result := BackupVerificationResult{
+		TotalFiles:    len(manifest.Files),
+		FailedFiles:   make([]string, 0),
+		MissingFiles:  make([]string, 0),
+		RepairedFiles: make([]string, 0),
 	}
-	list, err := a.provider.WeChatGetMessageListByType(userName, time, pageSize, msgType, dire)
+
+	// 加密的备份使用配置中保存的口令校验
+	passphrase := ""
+	if manifest.Encryption != nil {
+		var config IncrementalBackupConfig
+		if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err == nil {
+			passphrase, _ = a.backupPassphrase(config)
+		}
+	}
+	archiveFiles, closeArchive, err := openBackupArchive(backupPath, manifest, passphrase)
 	if err != nil {
-		log.Println("WeChatGetMessageListByType failed:", err)
-		return ""
+		return apierr.JSON(backupArchiveError(err))
 	}
-	listStr, _ := json.Marshal(list)
-	log.Println("WeChatGetMessageListByType:", list.Total)
+	defer closeArchive()
 
-	return string(listStr)
+	for i, entry := range manifest.Files {
+		var hash string
+		var err error
+		backupFile := backupEntryFile(backupPath, manifest, entry)
+		if archiveFiles != nil {
+			hash, err = hashBackupArchiveFile(archiveFiles, entry.BackupPath)
+		} else {
+			hash, err = utils.CalculateFileHash(backupFile)
+		}
+		switch {
+		case err == nil && hash == entry.FileHash:
+			result.PassedFiles++
+		// 压缩包中的文件无法单独修复
+		case repair && archiveFiles == nil && a.repairBackupFile(entry, backupFile):
+			result.PassedFiles++
+			result.RepairedFiles = append(result.RepairedFiles, entry.BackupPath)
+		case os.IsNotExist(err):
+			result.MissingFiles = append(result.MissingFiles, entry.BackupPath)
+		default:
+			result.FailedFiles = append(result.FailedFiles, entry.BackupPath)
+		}
+
+		progress := BackupVerifyProgress{File: entry.BackupPath, Done: i + 1, Total: result.TotalFiles}
+		progressStr, _ := json.Marshal(progress)
+		eventsEmit(a.ctx, "verifyBackup", string(progressStr))
+	}
+
+	log.Printf("VerifyBackup %s: %d/%d passed, %d failed, %d missing, %d repaired", backupPath,
+		result.PassedFiles, result.TotalFiles, len(result.FailedFiles), len(result.MissingFiles), len(result.RepairedFiles))
+	resultStr, _ := json.Marshal(result)
+	verifiedPath := filepath.Join(backupPath, backupVerifiedName)
+	if result.PassedFiles == result.TotalFiles {
+		if err := os.WriteFile(verifiedPath, resultStr, 0644); err != nil {
+			log.Printf("Error writing %s: %v", verifiedPath, err)
+		}
+	} else {
+		os.Remove(verifiedPath)
+	}
+	return string(resultStr)
 }
 
-func (a *App) GetWechatMessageListByKeyWord(userName string, time int64, keyword string, msgType string, pageSize int) string {
-	log.Println("GetWechatMessageListByKeyWord:", userName, pageSize, time, msgType)
-	if len(userName) == 0 {
-		return "{\"Total\":0, \"Rows\":[]}"
+// VerifyBackupVersion 校验配置的备份目录下 account\version 这个备份版本，
+// version为备份目录名（时间戳），结果与VerifyBackup相同
+func (a *App) VerifyBackupVersion(account, version string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
 	}
-	list, err := a.provider.WeChatGetMessageListByKeyWord(userName, time, keyword, msgType, pageSize)
+	if account == "" || account != filepath.Base(account) || account == ".." || !isBackupVersionName(version) {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid backup version: %s\\%s", account, version))
+	}
+
+	backupPath := filepath.Join(config.BackupPath, account, version)
+	if _, err := os.Stat(filepath.Join(backupPath, backupManifestName)); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "%s", backupPath))
+	}
+
+	return a.VerifyBackup(backupPath, false)
+}
+
+// CompressBackup 将备份目录压缩为zip，备份清单作为第一个文件；
+// 写入后确认zip可以完整读取，deleteSource为true时再删除备份目录
+func (a *App) CompressBackup(backupPath, zipOutputPath string, deleteSource bool) string {
+	event := CompressBackupEvent{Status: wechat.Export_Status_Processing}
+	emit := func() {
+		eventStr, _ := json.Marshal(event)
+		eventsEmit(a.ctx, "compressBackup", string(eventStr))
+	}
+	fail := func(err error) string {
+		log.Println("CompressBackup failed:", err)
+		event.Status = wechat.Export_Status_Error
+		event.Error = err.Error()
+		emit()
+		return apierr.JSON(apierr.Wrap(apierr.CodeIOFailure, err))
+	}
+
+	files := make([]string, 0)
+	err := filepath.Walk(backupPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		event.OriginalSize += info.Size()
+		if info.Name() == backupManifestName && filepath.Dir(path) == filepath.Clean(backupPath) {
+			files = append([]string{path}, files...)
+		} else {
+			files = append(files, path)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("WeChatGetMessageListByKeyWord failed:", err)
-		return ""
+		return fail(err)
+	}
+	event.Total = len(files)
+
+	tmpPath := zipOutputPath + ".tmp"
+	if err := a.writeBackupZip(backupPath, tmpPath, files, func(name string) {
+		event.File = name
+		event.Done += 1
+		emit()
+	}); err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+
+	// 确认zip中的文件数量完整后再替换
+	reader, err := zip.OpenReader(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+	entries := len(reader.File)
+	reader.Close()
+	if entries != len(files) {
+		os.Remove(tmpPath)
+		return fail(fmt.Errorf("zip has %d entries, expect %d", entries, len(files)))
+	}
+
+	os.Remove(zipOutputPath)
+	if err := os.Rename(tmpPath, zipOutputPath); err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+
+	if info, err := os.Stat(zipOutputPath); err == nil {
+		event.CompressedSize = info.Size()
+	}
+	if event.OriginalSize > 0 {
+		event.CompressionRatio = float64(event.CompressedSize) / float64(event.OriginalSize)
+	}
+
+	if deleteSource {
+		if err := os.RemoveAll(backupPath); err != nil {
+			log.Printf("Error removing backup %s: %v", backupPath, err)
+		}
+	}
+
+	log.Printf("CompressBackup %s -> %s: %d files, %d -> %d bytes", backupPath, zipOutputPath,
+		event.Total, event.OriginalSize, event.CompressedSize)
+	event.Status = wechat.Export_Status_Completed
+	event.File = ""
+	emit()
+
+	eventStr, _ := json.Marshal(event)
+	return string(eventStr)
+}
+
+func (a *App) writeBackupZip(backupPath, zipPath string, files []string, onFile func(name string)) error {
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+
+	writer := zip.NewWriter(zipFile)
+	for _, path := range files {
+		relPath, err := filepath.Rel(backupPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+		if err := addFileToZip(writer, name, path); err != nil {
+			return err
+		}
+		onFile(name)
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return zipFile.Close()
+}
+
+func addFileToZip(writer *zip.Writer, name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// RestoreFromBackup 按备份清单将备份目录中的文件恢复到targetPath，保持相对路径；
+// conflictMode为overwrite、skip或rename（恢复为.restored后缀的文件），加密的备份需要passphrase
+func (a *App) RestoreFromBackup(backupPath, targetPath, conflictMode, passphrase string) string {
+	switch conflictMode {
+	case Restore_Conflict_Overwrite, Restore_Conflict_Skip, Restore_Conflict_Rename:
+	default:
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid conflict mode: %s", conflictMode))
+	}
+
+	data, err := os.ReadFile(filepath.Join(backupPath, backupManifestName))
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "read manifest"))
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeInvalidParam, err, "parse manifest"))
+	}
+
+	// 口令错误时在解密前返回
+	archiveFiles, closeArchive, err := openBackupArchive(backupPath, manifest, passphrase)
+	if err != nil {
+		return apierr.JSON(backupArchiveError(err))
+	}
+	defer closeArchive()
+
+	// 恢复前先检查清单中的路径都在备份目录内且文件存在
+	for _, entry := range manifest.Files {
+		relPath := filepath.Clean(entry.BackupPath)
+		if filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, ".."+string(os.PathSeparator)) {
+			return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "illegal path in manifest: %s", entry.BackupPath))
+		}
+		if archiveFiles != nil {
+			if _, ok := archiveFiles[entry.BackupPath]; !ok {
+				return apierr.JSON(apierr.New(apierr.CodeNotFound, "backup incomplete: %s not in archive", entry.BackupPath))
+			}
+		} else if _, err := os.Stat(backupEntryFile(backupPath, manifest, entry)); err != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "backup incomplete"))
+		}
+	}
+
+	result := RestoreResult{TotalFiles: len(manifest.Files), Failed: make([]string, 0)}
+	for _, entry := range manifest.Files {
+		relPath := filepath.Clean(entry.BackupPath)
+		dst := filepath.Join(targetPath, relPath)
+		if _, err := os.Stat(dst); err == nil {
+			if conflictMode == Restore_Conflict_Skip {
+				result.SkippedFiles++
+				continue
+			}
+			if conflictMode == Restore_Conflict_Rename {
+				dst += ".restored"
+			}
+		}
+
+		var err error
+		if archiveFiles != nil {
+			err = restoreBackupArchiveFile(archiveFiles[entry.BackupPath], dst)
+		} else {
+			err = restoreBackupFile(backupEntryFile(backupPath, manifest, entry), dst)
+		}
+		if err != nil {
+			log.Printf("restore %s: %v", relPath, err)
+			result.FailedFiles++
+			result.Failed = append(result.Failed, entry.BackupPath)
+			continue
+		}
+		result.RestoredFiles++
+	}
+
+	log.Printf("RestoreFromBackup %s -> %s: %d restored, %d skipped, %d failed", backupPath, targetPath,
+		result.RestoredFiles, result.SkippedFiles, result.FailedFiles)
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
+}
+
+// restoreBackupFile 先写入临时文件再重命名，避免目标文件只被覆盖一部分
+func restoreBackupFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpPath := dst + ".tmp"
+	if _, err := utils.CopyFile(src, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// openBackupArchive 备份清单指定了压缩包时打开压缩包，返回按包内路径索引的文件，未压缩时返回nil；
+// 加密的压缩包先校验口令，再解密到本地临时目录，关闭时删除
+func openBackupArchive(backupPath string, manifest BackupManifest, passphrase string) (map[string]*zip.File, func(), error) {
+	if manifest.Archive == "" {
+		return nil, func() {}, nil
+	}
+
+	archivePath := filepath.Join(backupPath, manifest.Archive)
+	cleanup := func() {}
+	if manifest.Encryption != nil {
+		if passphrase == "" {
+			return nil, nil, errBackupPassphraseRequired
+		}
+		key, err := manifest.Encryption.DeriveKey(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		tmpPath := filepath.Join(os.TempDir(), fmt.Sprintf("wechat_restore_%d.zip", time.Now().UnixNano()))
+		if err := utils.DecryptFile(archivePath, tmpPath, key); err != nil {
+			os.Remove(tmpPath)
+			return nil, nil, err
+		}
+		archivePath = tmpPath
+		cleanup = func() { os.Remove(tmpPath) }
+	}
+
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	files := make(map[string]*zip.File, len(reader.File))
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+	return files, func() {
+		reader.Close()
+		cleanup()
+	}, nil
+}
+
+func backupArchiveError(err error) error {
+	if errors.Is(err, utils.ErrWrongPassphrase) || errors.Is(err, errBackupPassphraseRequired) {
+		return apierr.Wrap(apierr.CodeInvalidParam, err)
+	}
+	return apierr.Wrapf(apierr.CodeIOFailure, err, "open archive")
+}
+
+func hashBackupArchiveFile(files map[string]*zip.File, name string) (string, error) {
+	f, ok := files[name]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// restoreBackupArchiveFile 与restoreBackupFile相同，从压缩包中解压
+func restoreBackupArchiveFile(f *zip.File, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// repairBackupFile 源文件未变化时重新复制，复制后再次校验
+func (a *App) repairBackupFile(entry BackupManifestEntry, backupFile string) bool {
+	if hash, err := utils.CalculateFileHash(entry.SourcePath); err != nil || hash != entry.FileHash {
+		log.Printf("repair %s: source changed or missing", entry.BackupPath)
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(backupFile), os.ModePerm); err != nil {
+		log.Printf("repair %s: %v", entry.BackupPath, err)
+		return false
+	}
+	if _, err := utils.CopyFile(entry.SourcePath, backupFile); err != nil {
+		log.Printf("repair %s: %v", entry.BackupPath, err)
+		return false
+	}
+
+	hash, err := utils.CalculateFileHash(backupFile)
+	return err == nil && hash == entry.FileHash
+}
+
+// GetBackupHistory 分页返回备份目录下所有账号的备份快照，最新的在前
+func (a *App) GetBackupHistory(pageIndex int, pageSize int) string {
+	list := BackupSnapshotList{Snapshots: make([]BackupSnapshot, 0)}
+
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		listStr, _ := json.Marshal(list)
+		return string(listStr)
+	}
+
+	// 备份目录结构为 BackupPath\<账号>\<时间戳>
+	snapshots := make([]BackupSnapshot, 0)
+	accounts, err := os.ReadDir(config.BackupPath)
+	if err != nil {
+		log.Println("ReadDir:", err)
+	}
+	for _, account := range accounts {
+		if !account.IsDir() {
+			continue
+		}
+		accountPath := filepath.Join(config.BackupPath, account.Name())
+		entries, err := os.ReadDir(accountPath)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			ts, err := strconv.ParseInt(entry.Name(), 10, 64)
+			if err != nil || !entry.IsDir() {
+				continue
+			}
+			snapshots = append(snapshots, readBackupSnapshot(account.Name(), ts, filepath.Join(accountPath, entry.Name())))
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Timestamp > snapshots[j].Timestamp })
+
+	list.Total = len(snapshots)
+	start := pageIndex * pageSize
+	if pageIndex >= 0 && pageSize > 0 && start < len(snapshots) {
+		end := start + pageSize
+		if end > len(snapshots) {
+			end = len(snapshots)
+		}
+		list.Snapshots = snapshots[start:end]
 	}
-	listStr, _ := json.Marshal(list)
-	log.Println("WeChatGetMessageListByKeyWord:", list.Total, list.KeyWord)
 
+	listStr, _ := json.Marshal(list)
 	return string(listStr)
 }
 
-func (a *App) GetWechatMessageDate(userName string) string {
-	log.Println("GetWechatMessageDate:", userName)
-	if len(userName) == 0 {
-		return "{\"Total\":0, \"Date\":[]}"
+// readBackupSnapshot 优先使用备份清单统计，没有清单的旧备份按目录统计
+func readBackupSnapshot(account string, ts int64, path string) BackupSnapshot {
+	snapshot := BackupSnapshot{Account: account, Timestamp: ts, Path: path}
+	if _, err := os.Stat(filepath.Join(path, backupVerifiedName)); err == nil {
+		snapshot.IsVerified = true
 	}
 
-	messageData, err := a.provider.WeChatGetMessageDate(userName)
-	if err != nil {
-		log.Println("GetWechatMessageDate:", err)
-		return ""
+	var manifest BackupManifest
+	if data, err := os.ReadFile(filepath.Join(path, backupManifestName)); err == nil && json.Unmarshal(data, &manifest) == nil {
+		snapshot.FileCount = len(manifest.Files)
+		for _, entry := range manifest.Files {
+			snapshot.TotalSize += entry.FileSize
+		}
+		return snapshot
 	}
 
-	messageDataStr, _ := json.Marshal(messageData)
-	log.Println("GetWechatMessageDate:", messageData.Total)
-
-	return string(messageDataStr)
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			snapshot.FileCount++
+			snapshot.TotalSize += info.Size()
+		}
+		return nil
+	})
+	return snapshot
 }
 
-func (a *App) setCurrentConfig() {
-	viper.Set(configDefaultUserKey, a.defaultUser)
-	viper.Set(configUsersKey, a.users)
-	viper.Set(configExportPathKey, a.FLoader.FilePrefix)
-	err := viper.SafeWriteConfig()
-	if err != nil {
-		log.Println(err)
-		err = viper.WriteConfig()
-		if err != nil {
-			log.Println(err)
+// GetIncrementalBackupVersions 返回配置的备份目录下account的所有备份版本，最新的在前；
+// 不是时间戳命名的目录和文件忽略
+func (a *App) GetIncrementalBackupVersions(account string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
+	}
+	if account == "" || account != filepath.Base(account) || account == ".." {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid account: %s", account))
+	}
+
+	versions := make([]BackupVersion, 0)
+	accountPath := filepath.Join(config.BackupPath, account)
+	entries, err := os.ReadDir(accountPath)
+	if err != nil && !os.IsNotExist(err) {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", accountPath))
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isBackupVersionName(entry.Name()) {
+			continue
 		}
+		versions = append(versions, readBackupVersion(filepath.Join(accountPath, entry.Name())))
 	}
-}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Timestamp > versions[j].Timestamp })
 
-type userList struct {
-	Users []string `json:"Users"`
+	versionsStr, _ := json.Marshal(versions)
+	return string(versionsStr)
 }
 
-func (a *App) GetWeChatUserList() string {
-
-	l := userList{}
-	l.Users = a.users
-
-	usersStr, _ := json.Marshal(l)
-	str := string(usersStr)
-	log.Println("users:", str)
-	return str
+func readBackupVersion(path string) BackupVersion {
+	name := filepath.Base(path)
+	ts, _ := strconv.ParseInt(name, 10, 64)
+	snapshot := readBackupSnapshot("", ts, path)
+	version := BackupVersion{
+		Version:   name,
+		Timestamp: ts,
+		FileCount: snapshot.FileCount,
+		TotalSize: snapshot.TotalSize,
+		Verified:  snapshot.IsVerified,
+		Path:      path,
+	}
+
+	var manifest BackupManifest
+	if data, err := os.ReadFile(filepath.Join(path, backupManifestName)); err == nil && json.Unmarshal(data, &manifest) == nil {
+		version.HasManifest = true
+		version.Encrypted = manifest.Encryption != nil
+		if manifest.Archive != "" {
+			if info, err := os.Stat(filepath.Join(path, manifest.Archive)); err == nil {
+				version.CompressedSize = info.Size()
+			}
+		}
+	}
+	return version
 }
 
-func (a *App) OpenFileOrExplorer(filePath string, explorer bool) string {
-	// if root, err := os.Getwd(); err == nil {
-	// 	filePath = root + filePath[1:]
-	// }
-	// log.Println("OpenFileOrExplorer:", filePath)
+// PruneOldBackups 删除backupRoot下以时间戳命名的旧备份目录，只保留最新的maxVersions个
+func (a *App) PruneOldBackups(backupRoot string, maxVersions int) string {
+	if maxVersions <= 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid maxVersions: %d", maxVersions))
+	}
 
-	path := a.FLoader.FilePrefix + filePath
-	err := utils.OpenFileOrExplorer(path, explorer)
+	result, err := pruneBackupVersions(backupRoot, maxVersions)
 	if err != nil {
-		return "{\"result\": \"OpenFileOrExplorer failed\", \"status\":\"failed\"}"
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", backupRoot))
 	}
 
-	return fmt.Sprintf("{\"result\": \"%s\", \"status\":\"OK\"}", "")
+	resultStr, _ := json.Marshal(result)
+	return string(resultStr)
 }
 
-func (a *App) GetWeChatRoomUserList(roomId string) string {
-	userlist, err := a.provider.WeChatGetChatRoomUserList(roomId)
-	if err != nil {
-		log.Println("WeChatGetChatRoomUserList:", err)
-		return ""
+// applyBackupRetention 每次备份后按MaxBackupVersions清理旧备份，通过backupRetention事件通知删除结果
+func (a *App) applyBackupRetention(backupRoot string, maxVersions int) {
+	if maxVersions <= 0 {
+		return
 	}
 
-	userListStr, _ := json.Marshal(userlist)
-
-	return string(userListStr)
-}
+	result, err := pruneBackupVersions(backupRoot, maxVersions)
+	if err != nil {
+		log.Printf("Error pruning backups %s: %v", backupRoot, err)
+		return
+	}
+	if len(result.Deleted) == 0 && len(result.Failed) == 0 && result.BlobsRemoved == 0 {
+		return
+	}
 
-func (a *App) GetAppVersion() string {
-	return appVersion
+	resultStr, _ := json.Marshal(result)
+	eventsEmit(a.ctx, "backupRetention", string(resultStr))
 }
 
-func (a *App) GetAppIsFirstStart() bool {
-	defer func() { a.firstStart = false }()
-	return a.firstStart
-}
+// GetBackupDiff 比较account的两个备份版本，每个版本的清单只记录该次新增和变化的文件，
+// 因此先按时间顺序合并到该版本为止的所有清单，再按相对导出目录的路径对应文件，大小或哈希不同的文件为Changed
+func (a *App) GetBackupDiff(account, versionA, versionB string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
+	}
+	if account == "" || account != filepath.Base(account) || account == ".." || !isBackupVersionName(versionA) || !isBackupVersionName(versionB) {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid backup version: %s\\%s, %s", account, versionA, versionB))
+	}
 
-func (a *App) GetWechatLocalAccountInfo() string {
-	infos := WeChatAccountInfos{}
-	infos.Info = make([]wechat.WeChatAccountInfo, 0)
-	infos.Total = 0
-	infos.CurrentAccount = a.defaultUser
-	for i := range a.users {
-		resPath := a.FLoader.FilePrefix + "\\User\\" + a.users[i]
-		if _, err := os.Stat(resPath); err != nil {
-			log.Println("GetWechatLocalAccountInfo:", resPath, err)
+	backupRoot := filepath.Join(config.BackupPath, account)
+	filesA, err := cumulativeBackupFiles(backupRoot, versionA)
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "version %s", versionA))
+	}
+	filesB, err := cumulativeBackupFiles(backupRoot, versionB)
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "version %s", versionB))
+	}
+
+	diff := BackupDiff{
+		Account:  account,
+		VersionA: versionA,
+		VersionB: versionB,
+		Added:    make([]BackupDiffEntry, 0),
+		Removed:  make([]BackupDiffEntry, 0),
+		Changed:  make([]BackupDiffEntry, 0),
+	}
+	for path, entry := range filesB {
+		diffEntry := BackupDiffEntry{Path: path, DataType: entry.DataType, SizeB: entry.FileSize, HashB: entry.FileHash}
+		old, ok := filesA[path]
+		if !ok {
+			diff.Added = append(diff.Added, diffEntry)
 			continue
 		}
-
-		prefixResPath := "\\User\\" + a.users[i]
-		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, a.users[i])
-		if err != nil {
-			log.Println("GetWechatLocalAccountInfo", err)
-			continue
+		delete(filesA, path)
+		if old.FileSize != entry.FileSize || old.FileHash != entry.FileHash {
+			diffEntry.SizeA = old.FileSize
+			diffEntry.HashA = old.FileHash
+			diff.Changed = append(diff.Changed, diffEntry)
 		}
-
-		infos.Info = append(infos.Info, *info)
-		infos.Total += 1
+	}
+	for path, entry := range filesA {
+		diff.Removed = append(diff.Removed, BackupDiffEntry{Path: path, DataType: entry.DataType, SizeA: entry.FileSize, HashA: entry.FileHash})
+	}
+	for _, entries := range [][]BackupDiffEntry{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
 	}
 
-	infoString, _ := json.Marshal(infos)
-	log.Println(string(infoString))
-
-	return string(infoString)
+	diffStr, _ := json.Marshal(diff)
+	return string(diffStr)
 }
 
-func (a *App) WechatSwitchAccount(account string) bool {
-	for i := range a.users {
-		if a.users[i] == account {
-			if a.provider != nil {
-				a.provider.WechatWechatDataProviderClose()
-				a.provider = nil
-			}
-			a.defaultUser = account
-			a.setCurrentConfig()
-			return true
+// cumulativeBackupFiles 按时间顺序合并backupRoot下到version为止的所有备份清单，
+// 返回该版本时备份中的全部文件，同一路径以较新的版本为准；没有清单的旧版本跳过
+func cumulativeBackupFiles(backupRoot, version string) (map[string]BackupManifestEntry, error) {
+	if _, err := readBackupManifest(filepath.Join(backupRoot, version)); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+	// 版本名为10位时间戳，按名称排序即按时间排序
+	versions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && isBackupVersionName(entry.Name()) && entry.Name() <= version {
+			versions = append(versions, entry.Name())
 		}
 	}
+	sort.Strings(versions)
 
-	return false
+	files := make(map[string]BackupManifestEntry)
+	for _, name := range versions {
+		manifest, err := readBackupManifest(filepath.Join(backupRoot, name))
+		if err != nil {
+			log.Printf("skip backup version without manifest %s: %v", name, err)
+			continue
+		}
+		for _, entry := range manifest.Files {
+			files[filepath.ToSlash(entry.BackupPath)] = entry
+		}
+	}
+	return files, nil
 }
 
-func (a *App) GetExportPathStat() string {
-	path := a.FLoader.FilePrefix
-	log.Println("utils.GetPathStat ++")
-	stat, err := utils.GetPathStat(path)
-	log.Println("utils.GetPathStat --")
+func readBackupManifest(backupPath string) (BackupManifest, error) {
+	var manifest BackupManifest
+	data, err := os.ReadFile(filepath.Join(backupPath, backupManifestName))
 	if err != nil {
-		log.Println("GetPathStat error:", path, err)
-		var msg ErrorMessage
-		msg.ErrorStr = fmt.Sprintf("%s:%v", path, err)
-		msgStr, _ := json.Marshal(msg)
-		return string(msgStr)
+		return manifest, err
 	}
-
-	statString, _ := json.Marshal(stat)
-
-	return string(statString)
-}
-
-func (a *App) ExportPathIsCanWrite() bool {
-	path := a.FLoader.FilePrefix
-	return utils.PathIsCanWriteFile(path)
-}
-
-func (a *App) OpenExportPath() {
-	path := a.FLoader.FilePrefix
-	runtime.BrowserOpenURL(a.ctx, path)
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
 }
 
-func (a *App) OpenDirectoryDialog() string {
-	dialogOptions := runtime.OpenDialogOptions{
-		Title: "选择导出路径",
+// DeleteBackupVersion 删除配置的备份目录下 account\\version 这个备份版本，只剩这一个版本时需要force；
+// 删除后清理不再被引用的内容寻址文件，部分文件删除失败时可以再次调用继续删除
+func (a *App) DeleteBackupVersion(account, version string, force bool) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
 	}
-	selectedDir, err := runtime.OpenDirectoryDialog(a.ctx, dialogOptions)
-	if err != nil {
-		log.Println("OpenDirectoryDialog:", err)
-		return ""
+	if account == "" || account != filepath.Base(account) || account == ".." || !isBackupVersionName(version) {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid backup version: %s\\%s", account, version))
+	}
+	// 备份进行中时可能正在写入该版本或引用其中的内容寻址文件
+	if atomic.LoadInt32(&a.exporting) > 0 {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "export or backup in progress"))
 	}
 
-	if selectedDir == "" {
-		log.Println("Cancel selectedDir")
-		return ""
+	backupRoot := filepath.Join(config.BackupPath, account)
+	backupPath := filepath.Join(backupRoot, version)
+	if _, err := os.Stat(backupPath); err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "%s", backupPath))
 	}
 
-	if selectedDir == a.FLoader.FilePrefix {
-		log.Println("same path No need SetFilePrefix")
-		return ""
+	if !force {
+		entries, err := os.ReadDir(backupRoot)
+		if err != nil {
+			return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", backupRoot))
+		}
+		count := 0
+		for _, entry := range entries {
+			if entry.IsDir() && isBackupVersionName(entry.Name()) {
+				count++
+			}
+		}
+		if count <= 1 {
+			return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "%s is the only backup version, use force to delete", version))
+		}
 	}
 
-	if !utils.PathIsCanWriteFile(selectedDir) {
-		log.Println("PathIsCanWriteFile:", selectedDir, "error")
-		return ""
+	result := DeleteBackupVersionResult{Account: account, Version: version}
+	size := backupDirSize(backupPath)
+	err := removeBackupVersion(backupPath)
+	result.FreedBytes = size - backupDirSize(backupPath)
+	if err != nil {
+		log.Printf("Error removing backup %s: %v", backupPath, err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", backupPath))
 	}
 
-	a.FLoader.SetFilePrefix(selectedDir)
-	log.Println("OpenDirectoryDialog:", selectedDir)
-	a.scanAccountByPath(selectedDir)
-	return selectedDir
+	if removed, freed, err := gcBackupBlobs(backupRoot); err != nil {
+		log.Printf("Skip backup blob gc %s: %v", backupRoot, err)
+	} else {
+		result.BlobsRemoved = removed
+		result.FreedBytes += freed
+	}
+
+	log.Printf("DeleteBackupVersion %s: blobs removed %d, freed %d bytes", backupPath, result.BlobsRemoved, result.FreedBytes)
+	resultStr, _ := json.Marshal(result)
+	eventsEmit(a.ctx, "backupVersionDeleted", string(resultStr))
+	return string(resultStr)
 }
 
-func (a *App) scanAccountByPath(path string) error {
-	infos := WeChatAccountInfos{}
-	infos.Info = make([]wechat.WeChatAccountInfo, 0)
-	infos.Total = 0
-	infos.CurrentAccount = ""
+// applyBackupQuota 账号的备份总大小超过maxBytes时从最旧的版本开始删除，不删除本次写入的版本，
+// 删除的版本记录到result中
+func applyBackupQuota(result *IncrementalBackupResult, maxBytes int64) {
+	if maxBytes <= 0 {
+		return
+	}
+	backupRoot := filepath.Dir(result.BackupPath)
+	current := filepath.Base(result.BackupPath)
 
-	userPath := path + "\\User\\"
-	if _, err := os.Stat(userPath); err != nil {
-		return err
+	for {
+		versions, total, err := backupRootUsage(backupRoot)
+		if err != nil {
+			log.Printf("Error reading backup usage %s: %v", backupRoot, err)
+			return
+		}
+		if total <= maxBytes || len(versions) == 0 || versions[0] == current {
+			if total > maxBytes {
+				log.Printf("backup %s still uses %d bytes over quota %d", backupRoot, total, maxBytes)
+			}
+			return
+		}
+
+		path := filepath.Join(backupRoot, versions[0])
+		if err := removeBackupVersion(path); err != nil {
+			log.Printf("Error evicting backup %s: %v", path, err)
+			return
+		}
+		result.EvictedVersions = append(result.EvictedVersions, versions[0])
+		if _, _, err := gcBackupBlobs(backupRoot); err != nil {
+			log.Printf("Skip backup blob gc %s: %v", backupRoot, err)
+		}
+		if _, after, err := backupRootUsage(backupRoot); err == nil {
+			result.EvictedBytes += total - after
+		}
+		log.Printf("backup quota: evicted %s", path)
 	}
+}
 
-	dirs, err := os.ReadDir(userPath)
+// backupRootUsage 按备份清单统计backupRoot下所有备份版本占用的空间，返回按时间从旧到新排列的版本；
+// 内容寻址的文件按哈希只计算一次，没有清单的旧备份按目录统计
+func backupRootUsage(backupRoot string) ([]string, int64, error) {
+	entries, err := os.ReadDir(backupRoot)
 	if err != nil {
-		log.Println("ReadDir", err)
-		return err
+		return nil, 0, err
 	}
 
-	for i := range dirs {
-		if !dirs[i].Type().IsDir() {
+	versions := make([]string, 0)
+	blobs := make(map[string]int64)
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() || !isBackupVersionName(entry.Name()) {
 			continue
 		}
-		log.Println("dirs[i].Name():", dirs[i].Name())
-		resPath := path + "\\User\\" + dirs[i].Name()
-		prefixResPath := "\\User\\" + dirs[i].Name()
-		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, dirs[i].Name())
+		versions = append(versions, entry.Name())
+		path := filepath.Join(backupRoot, entry.Name())
+		manifest, err := readBackupManifest(path)
 		if err != nil {
-			log.Println("GetWechatLocalAccountInfo", err)
+			total += backupDirSize(path)
 			continue
 		}
-
-		infos.Info = append(infos.Info, *info)
-		infos.Total += 1
-	}
-
-	users := make([]string, 0)
-	for i := 0; i < infos.Total; i++ {
-		users = append(users, infos.Info[i].AccountName)
-	}
-
-	a.users = users
-	found := false
-	for i := range a.users {
-		if a.defaultUser == a.users[i] {
-			found = true
+		switch {
+		case manifest.BlobStore != "":
+			for _, file := range manifest.Files {
+				blobs[file.FileHash] = file.FileSize
+			}
+		case manifest.Archive != "" && manifest.ArchiveSize > 0:
+			total += manifest.ArchiveSize
+		default:
+			for _, file := range manifest.Files {
+				total += file.FileSize
+			}
 		}
 	}
+	for _, size := range blobs {
+		total += size
+	}
+	sort.Strings(versions)
+	return versions, total, nil
+}
 
-	if !found {
-		a.defaultUser = ""
+// GetFileBackupHistory 返回account的备份版本中包含relativePath的版本，最新的在前；
+// relativePath为相对导出目录的路径，如 Msg\\Multi\\MSG0.db，不区分大小写和分隔符
+func (a *App) GetFileBackupHistory(account string, relativePath string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
 	}
-	if a.defaultUser == "" && len(a.users) > 0 {
-		a.defaultUser = a.users[0]
+	if account == "" || account != filepath.Base(account) || account == ".." || relativePath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid params: %s, %s", account, relativePath))
 	}
 
-	if len(a.users) > 0 {
-		a.setCurrentConfig()
+	backupRoot := filepath.Join(config.BackupPath, account)
+	history := make([]FileBackupVersion, 0)
+	entries, err := os.ReadDir(backupRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", backupRoot))
 	}
-
-	return nil
-}
-
-func (a *App) OepnLogFileExplorer() {
-	utils.OpenFileOrExplorer(".\\app.log", true)
+	for _, dir := range entries {
+		if !dir.IsDir() || !isBackupVersionName(dir.Name()) {
+			continue
+		}
+		manifest, err := readBackupManifest(filepath.Join(backupRoot, dir.Name()))
+		if err != nil {
+			continue
+		}
+		entry, ok := findBackupEntry(manifest, relativePath)
+		if !ok {
+			continue
+		}
+		ts, _ := strconv.ParseInt(dir.Name(), 10, 64)
+		history = append(history, FileBackupVersion{
+			Version:   dir.Name(),
+			Timestamp: ts,
+			FileSize:  entry.FileSize,
+			FileHash:  entry.FileHash,
+			Archived:  manifest.Archive != "",
+			Encrypted: manifest.Encryption != nil,
+		})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Timestamp > history[j].Timestamp })
+
+	historyStr, _ := json.Marshal(history)
+	return string(historyStr)
 }
 
-func (a *App) SaveFileDialog(file string, alisa string) string {
-	filePath := a.FLoader.FilePrefix + file
-	if _, err := os.Stat(filePath); err != nil {
-		log.Println("SaveFileDialog:", err)
-		return err.Error()
+// RestoreSingleFile 从account的version中恢复relativePath，destination为已存在的目录时恢复到该目录下同名文件，
+// 否则作为目标文件路径；恢复后按清单校验哈希，不一致时删除恢复的文件
+func (a *App) RestoreSingleFile(account, version, relativePath, destination string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
+	}
+	if account == "" || account != filepath.Base(account) || account == ".." || !isBackupVersionName(version) || relativePath == "" || destination == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid params: %s\\%s, %s", account, version, relativePath))
 	}
 
-	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
-		DefaultFilename: alisa,
-		Title:           "选择保存路径",
-	})
+	backupPath := filepath.Join(config.BackupPath, account, version)
+	manifest, err := readBackupManifest(backupPath)
 	if err != nil {
-		log.Println("SaveFileDialog:", err)
-		return err.Error()
+		return apierr.JSON(apierr.Wrapf(apierr.CodeNotFound, err, "read manifest"))
 	}
-
-	if savePath == "" {
-		return ""
+	entry, ok := findBackupEntry(manifest, relativePath)
+	if !ok {
+		return apierr.JSON(apierr.New(apierr.CodeNotFound, "%s not in version %s", relativePath, version))
 	}
 
-	dirPath := filepath.Dir(savePath)
-	if !utils.PathIsCanWriteFile(dirPath) {
-		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
-		log.Println(errStr)
-		return errStr
+	dst := destination
+	if info, err := os.Stat(destination); err == nil && info.IsDir() {
+		dst = filepath.Join(destination, filepath.Base(filepath.FromSlash(entry.BackupPath)))
 	}
 
-	_, err = utils.CopyFile(filePath, savePath)
+	passphrase := ""
+	if manifest.Encryption != nil {
+		passphrase, _ = a.backupPassphrase(config)
+	}
+	archiveFiles, closeArchive, err := openBackupArchive(backupPath, manifest, passphrase)
 	if err != nil {
-		log.Println("Error CopyFile", filePath, savePath, err)
-		return err.Error()
+		return apierr.JSON(backupArchiveError(err))
 	}
+	defer closeArchive()
 
-	return ""
-}
-
-func (a *App) GetSessionLastTime(userName string) string {
-	if a.provider == nil || userName == "" {
-		lastTime := &wechat.WeChatLastTime{}
-		lastTimeString, _ := json.Marshal(lastTime)
-		return string(lastTimeString)
+	if archiveFiles != nil {
+		f, ok := archiveFiles[entry.BackupPath]
+		if !ok {
+			return apierr.JSON(apierr.New(apierr.CodeNotFound, "backup incomplete: %s not in archive", entry.BackupPath))
+		}
+		err = restoreBackupArchiveFile(f, dst)
+	} else {
+		err = restoreBackupFile(backupEntryFile(backupPath, manifest, entry), dst)
+	}
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "restore %s", entry.BackupPath))
 	}
 
-	lastTime := a.provider.WeChatGetSessionLastTime(userName)
+	hash, err := utils.CalculateFileHash(dst)
+	if err != nil || (entry.FileHash != "" && hash != entry.FileHash) {
+		os.Remove(dst)
+		return apierr.JSON(apierr.New(apierr.CodeIOFailure, "restored %s does not match manifest hash", entry.BackupPath))
+	}
 
-	lastTimeString, _ := json.Marshal(lastTime)
+	log.Printf("RestoreSingleFile %s -> %s", filepath.Join(backupPath, entry.BackupPath), dst)
+	resultStr, _ := json.Marshal(RestoreSingleFileResult{Path: dst, FileSize: entry.FileSize, FileHash: hash})
+	return string(resultStr)
+}
 
-	return string(lastTimeString)
+// findBackupEntry 按相对路径查找清单中的文件，压缩包内路径以/分隔，其余以\\分隔，比较时统一处理
+func findBackupEntry(manifest BackupManifest, relativePath string) (BackupManifestEntry, bool) {
+	target := filepath.ToSlash(filepath.Clean(filepath.FromSlash(relativePath)))
+	for _, entry := range manifest.Files {
+		if strings.EqualFold(filepath.ToSlash(filepath.Clean(filepath.FromSlash(entry.BackupPath))), target) {
+			return entry, true
+		}
+	}
+	return BackupManifestEntry{}, false
 }
 
-func (a *App) SetSessionLastTime(userName string, stamp int64, messageId string) string {
-	if a.provider == nil {
-		return ""
+// StartBackupScrub 在后台按清单重新计算account所有备份版本中文件的哈希，检查备份盘上的数据是否损坏；
+// 按ScrubSamplePercent抽查，以后台优先级读取，进度和结果通过backupScrub事件发送，
+// 完成后记录到配置的LastScrubTime中
+func (a *App) StartBackupScrub(account string) string {
+	var config IncrementalBackupConfig
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err != nil || config.BackupPath == "" {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "backup path not configured"))
+	}
+	if account == "" || account != filepath.Base(account) || account == ".." {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid account: %s", account))
 	}
 
-	lastTime := &wechat.WeChatLastTime{
-		UserName:  userName,
-		Timestamp: stamp,
-		MessageId: messageId,
+	a.scrubLock.Lock()
+	if a.scrubJobs == nil {
+		a.scrubJobs = make(map[string]context.CancelFunc)
 	}
-	err := a.provider.WeChatSetSessionLastTime(lastTime)
-	if err != nil {
-		log.Println("WeChatSetSessionLastTime failed:", err.Error())
-		return err.Error()
+	if _, ok := a.scrubJobs[account]; ok {
+		a.scrubLock.Unlock()
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "scrub of %s in progress", account))
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.scrubJobs[account] = cancel
+	a.scrubLock.Unlock()
 
+	go func() {
+		defer func() {
+			a.scrubLock.Lock()
+			delete(a.scrubJobs, account)
+			a.scrubLock.Unlock()
+			cancel()
+		}()
+		a.scrubBackup(ctx, account, config)
+	}()
 	return ""
 }
 
-func (a *App) SetSessionBookMask(userName, tag, info string) string {
-	if a.provider == nil || userName == "" {
-		return "invaild params"
-	}
-	err := a.provider.WeChatSetSessionBookMask(userName, tag, info)
-	if err != nil {
-		log.Println("WeChatSetSessionBookMask failed:", err.Error())
-		return err.Error()
+// CancelBackupScrub 取消正在进行的巡检，已检查的结果仍通过backupScrub事件发送
+func (a *App) CancelBackupScrub(account string) {
+	a.scrubLock.Lock()
+	defer a.scrubLock.Unlock()
+	if cancel, ok := a.scrubJobs[account]; ok {
+		cancel()
 	}
-
-	return ""
 }
 
-func (a *App) DelSessionBookMask(markId string) string {
-	if a.provider == nil || markId == "" {
-		return "invaild params"
+func (a *App) scrubBackup(ctx context.Context, account string, config IncrementalBackupConfig) {
+	endBackground := utils.BeginBackgroundThread()
+	defer endBackground()
+
+	report := BackupScrubReport{
+		Account:   account,
+		Status:    wechat.Export_Status_Processing,
+		Corrupt:   make([]BackupScrubError, 0),
+		Skipped:   make([]string, 0),
+		StartTime: time.Now().Unix(),
 	}
+	var lastEmit time.Time
+	emit := func(force bool) {
+		if !force && time.Since(lastEmit) < backupScanProgressInterval {
+			return
+		}
+		lastEmit = time.Now()
+		reportStr, _ := json.Marshal(report)
+		eventsEmit(a.ctx, "backupScrub", string(reportStr))
+	}
+	defer func() {
+		report.EndTime = time.Now().Unix()
+		log.Printf("BackupScrub %s: %s, %d versions, %d checked, %d corrupt, %d skipped", account, report.Status,
+			report.Versions, report.Checked, len(report.Corrupt), len(report.Skipped))
+		emit(true)
+	}()
 
-	err := a.provider.WeChatDelSessionBookMask(markId)
+	backupRoot := filepath.Join(config.BackupPath, account)
+	versions, _, err := backupRootUsage(backupRoot)
 	if err != nil {
-		log.Println("WeChatDelSessionBookMask failed:", err.Error())
-		return err.Error()
+		report.Status = wechat.Export_Status_Error
+		report.Error = err.Error()
+		return
 	}
+	report.Versions = len(versions)
+	emit(true)
 
-	return ""
-}
+	passphrase, _ := a.backupPassphrase(config)
+	// 内容寻址的文件被多个版本引用，只检查一次
+	checkedBlobs := make(map[string]bool)
+	for _, version := range versions {
+		backupPath := filepath.Join(backupRoot, version)
+		manifest, err := readBackupManifest(backupPath)
+		if err != nil {
+			report.Skipped = append(report.Skipped, version)
+			continue
+		}
+		archiveFiles, closeArchive, err := openBackupArchive(backupPath, manifest, passphrase)
+		if err != nil {
+			log.Printf("BackupScrub %s: %v", backupPath, err)
+			report.Skipped = append(report.Skipped, version)
+			continue
+		}
 
-func (a *App) GetSessionBookMaskList(userName string) string {
-	if a.provider == nil || userName == "" {
-		return "invaild params"
-	}
-	markLIst, err := a.provider.WeChatGetSessionBookMaskList(userName)
-	if err != nil {
-		log.Println("WeChatGetSessionBookMaskList failed:", err.Error())
-		_list := &wechat.WeChatBookMarkList{}
-		_listString, _ := json.Marshal(_list)
-		return string(_listString)
+		for _, entry := range manifest.Files {
+			if ctx.Err() != nil {
+				closeArchive()
+				report.Status = Scrub_Status_Canceled
+				return
+			}
+			if config.ScrubSamplePercent > 0 && config.ScrubSamplePercent < 100 && rand.Intn(100) >= config.ScrubSamplePercent {
+				continue
+			}
+
+			backupFile := backupEntryFile(backupPath, manifest, entry)
+			if manifest.BlobStore != "" {
+				if checkedBlobs[backupFile] {
+					continue
+				}
+				checkedBlobs[backupFile] = true
+			}
+
+			var hash string
+			if archiveFiles != nil {
+				hash, err = hashBackupArchiveFile(archiveFiles, entry.BackupPath)
+			} else {
+				hash, err = utils.CalculateFileHash(backupFile)
+			}
+			report.Checked++
+			switch {
+			case err != nil:
+				report.Corrupt = append(report.Corrupt, BackupScrubError{Version: version, Path: entry.BackupPath, Error: err.Error()})
+			case hash != entry.FileHash:
+				report.Corrupt = append(report.Corrupt, BackupScrubError{Version: version, Path: entry.BackupPath, Error: "hash mismatch"})
+			}
+			emit(false)
+		}
+		closeArchive()
 	}
 
-	markLIstString, _ := json.Marshal(markLIst)
-	return string(markLIstString)
+	report.Status = wechat.Export_Status_Completed
+	if err := json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &config); err == nil {
+		if config.LastScrubTime == nil {
+			config.LastScrubTime = make(map[string]int64)
+		}
+		config.LastScrubTime[account] = time.Now().Unix()
+		a.SetIncrementalBackupConfig(config)
+	}
 }
 
-func (a *App) SelectedDirDialog(title string) string {
-	dialogOptions := runtime.OpenDialogOptions{
-		Title: title,
+// isBackupVersionName 备份目录名为scanExistingFiles创建时的10位unix时间戳
+func isBackupVersionName(name string) bool {
+	if len(name) != 10 {
+		return false
 	}
-	selectedDir, err := runtime.OpenDirectoryDialog(a.ctx, dialogOptions)
-	if err != nil {
-		log.Println("OpenDirectoryDialog:", err)
-		return ""
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
 	}
+	return true
+}
 
-	if selectedDir == "" {
-		return ""
+func pruneBackupVersions(backupRoot string, maxVersions int) (*PruneResult, error) {
+	entries, err := os.ReadDir(backupRoot)
+	if err != nil {
+		return nil, err
 	}
 
-	return selectedDir
-}
-
-func (a *App) ExportWeChatDataByUserName(userName, path string) string {
-	if a.provider == nil || userName == "" || path == "" {
-		return "invaild params" + userName
+	// 只处理scanExistingFiles创建的时间戳目录，位数相同时按名称排序即按时间排序
+	versions := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() && isBackupVersionName(entry.Name()) {
+			versions = append(versions, entry.Name())
+		}
 	}
+	sort.Strings(versions)
 
-	if !utils.PathIsCanWriteFile(path) {
-		log.Println("PathIsCanWriteFile: " + path)
-		return "PathIsCanWriteFile: " + path
+	result := &PruneResult{Deleted: make([]string, 0), Failed: make([]string, 0)}
+	for len(versions) > maxVersions {
+		path := filepath.Join(backupRoot, versions[0])
+		versions = versions[1:]
+
+		size := backupDirSize(path)
+		err := removeBackupVersion(path)
+		// 有文件被占用时已删除的部分同样计入释放的空间，目录保留到下次清理
+		result.FreedBytes += size - backupDirSize(path)
+		if err != nil {
+			log.Printf("Error removing backup %s: %v", path, err)
+			result.Failed = append(result.Failed, path)
+			continue
+		}
+		result.Deleted = append(result.Deleted, path)
 	}
+	result.Remaining = len(versions) + len(result.Failed)
 
-	exPath := path + "\\" + "wechatDataBackup_" + userName
-	if _, err := os.Stat(exPath); err != nil {
-		os.MkdirAll(exPath, os.ModePerm)
+	if removed, freed, err := gcBackupBlobs(backupRoot); err != nil {
+		log.Printf("Skip backup blob gc %s: %v", backupRoot, err)
 	} else {
-		return "path exist:" + exPath
+		result.BlobsRemoved = removed
+		result.FreedBytes += freed
 	}
 
-	log.Println("ExportWeChatDataByUserName:", userName, exPath)
-	err := a.provider.WeChatExportDataByUserName(userName, exPath)
-	if err != nil {
-		log.Println("WeChatExportDataByUserName failed:", err)
-		return "WeChatExportDataByUserName failed:" + err.Error()
+	log.Printf("PruneOldBackups %s: deleted %d, failed %d, blobs removed %d, freed %d bytes, remaining %d", backupRoot,
+		len(result.Deleted), len(result.Failed), result.BlobsRemoved, result.FreedBytes, result.Remaining)
+	return result, nil
+}
+
+// 内容寻址存储的目录，与备份版本目录同级，文件保存为 blobs\<哈希前2位>\<哈希>
+const backupBlobDir = "blobs"
+
+// 正在写入的文件，写完并计算出哈希后再移动到最终位置，gc时跳过
+const backupBlobTmpDir = "tmp"
+
+func isBackupBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
 	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
 
-	config := map[string]interface{}{
-		"exportpath": ".\\",
-		"userconfig": map[string]interface{}{
-			"defaultuser": a.defaultUser,
-			"users":       []string{a.defaultUser},
-		},
+func backupBlobPath(blobRoot, hash string) string {
+	return filepath.Join(blobRoot, hash[:2], hash)
+}
+
+// backupEntryFile 返回清单中未压缩的文件在磁盘上的位置
+func backupEntryFile(backupPath string, manifest BackupManifest, entry BackupManifestEntry) string {
+	if manifest.BlobStore != "" && isBackupBlobHash(entry.FileHash) {
+		blobRoot := filepath.Join(filepath.Dir(filepath.Clean(backupPath)), filepath.Base(manifest.BlobStore))
+		return backupBlobPath(blobRoot, entry.FileHash)
 	}
+	return filepath.Join(backupPath, filepath.Clean(entry.BackupPath))
+}
 
-	configJson, err := json.MarshalIndent(config, "", "	")
+// storeBackupBlob 把src保存到内容寻址存储，knownHash对应的文件已存在时不再复制；
+// 否则边复制边计算哈希，返回实际写入内容的哈希
+func storeBackupBlob(blobRoot, src, knownHash string) (hash string, copied bool, err error) {
+	srcInfo, err := os.Stat(src)
 	if err != nil {
-		log.Println("MarshalIndent:", err)
-		return "MarshalIndent:" + err.Error()
+		return "", false, err
+	}
+	if isBackupBlobHash(knownHash) {
+		if info, err := os.Stat(backupBlobPath(blobRoot, knownHash)); err == nil && info.Size() == srcInfo.Size() {
+			return knownHash, false, nil
+		}
 	}
 
-	configPath := exPath + "\\" + "config.json"
-	err = os.WriteFile(configPath, configJson, os.ModePerm)
-	if err != nil {
-		log.Println("WriteFile:", err)
-		return "WriteFile:" + err.Error()
+	tmpDir := filepath.Join(blobRoot, backupBlobTmpDir)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return "", false, err
 	}
+	tmpPath := filepath.Join(tmpDir, fmt.Sprintf("%d.tmp", time.Now().UnixNano()))
+	defer os.Remove(tmpPath)
 
-	exeSrcPath, err := os.Executable()
+	in, err := os.Open(src)
 	if err != nil {
-		log.Println("Executable:", exeSrcPath)
-		return "Executable:" + err.Error()
+		return "", false, err
 	}
-
-	exeDstPath := exPath + "\\" + "wechatDataBackup.exe"
-	log.Printf("Copy [%s] -> [%s]\n", exeSrcPath, exeDstPath)
-	_, err = utils.CopyFile(exeSrcPath, exeDstPath)
+	defer in.Close()
+	out, err := os.Create(tmpPath)
 	if err != nil {
-		log.Println("CopyFile:", err)
-		return "CopyFile:" + err.Error()
+		return "", false, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", false, err
 	}
-	return ""
-
-	return ""
-}
 
-func (a *App) GetAppIsShareData() bool {
-	if a.provider != nil {
-		return a.provider.IsShareData
+	hash = hex.EncodeToString(h.Sum(nil))
+	blobPath := backupBlobPath(blobRoot, hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		return hash, false, nil
 	}
-	return false
+	if err := os.MkdirAll(filepath.Dir(blobPath), os.ModePerm); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
 }
 
-// 增量导出并备份新增数据
-func (a *App) ExportWeChatDataWithIncrementalBackup(full bool, acountName string, enableBackup bool, backupPath string) {
-	if a.provider != nil {
-		a.provider.WechatWechatDataProviderClose()
-		a.provider = nil
+// gcBackupBlobs 删除不再被backupRoot下任何备份版本引用的内容寻址文件；
+// 有版本没有清单（旧备份或正在进行的备份）时无法确定引用关系，不做清理
+func gcBackupBlobs(backupRoot string) (int, int64, error) {
+	blobRoot := filepath.Join(backupRoot, backupBlobDir)
+	if _, err := os.Stat(blobRoot); err != nil {
+		return 0, 0, nil
 	}
 
-	progress := make(chan string)
-	go func() {
-		var pInfo *wechat.WeChatInfo
-		for i := range a.infoList.Info {
-			if a.infoList.Info[i].AcountName == acountName {
-				pInfo = &a.infoList.Info[i]
-				break
-			}
+	entries, err := os.ReadDir(backupRoot)
+	if err != nil {
+		return 0, 0, err
+	}
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() || !isBackupVersionName(entry.Name()) {
+			continue
 		}
-
-		if pInfo == nil {
-			close(progress)
-			runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", acountName))
-			return
+		data, err := os.ReadFile(filepath.Join(backupRoot, entry.Name(), backupManifestName))
+		if err != nil {
+			return 0, 0, fmt.Errorf("version %s: %v", entry.Name(), err)
+		}
+		var manifest BackupManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return 0, 0, fmt.Errorf("version %s: %v", entry.Name(), err)
+		}
+		if manifest.BlobStore == "" {
+			continue
 		}
+		for _, file := range manifest.Files {
+			referenced[file.FileHash] = true
+		}
+	}
 
-		prefixExportPath := a.FLoader.FilePrefix + "\\User\\"
-		_, err := os.Stat(prefixExportPath)
+	removed := 0
+	var freed int64
+	err = filepath.Walk(blobRoot, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			os.Mkdir(prefixExportPath, os.ModeDir)
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(blobRoot, backupBlobTmpDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if referenced[info.Name()] {
+			return nil
 		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing backup blob %s: %v", path, err)
+			return nil
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
 
-		expPath := prefixExportPath + pInfo.AcountName
-		
-		// 记录导出前的文件状态（用于检测新增数据）
-		var backupResult *IncrementalBackupResult
-		if enableBackup && !full {
-			backupResult = a.scanExistingFiles(expPath, backupPath)
+// removeBackupVersion 文件被杀毒软件或索引服务临时占用时删除会失败，稍后重试；
+// 备份清单最后删除，部分删除的版本仍保留清单，gc时其引用的内容寻址文件不会被删除，再次删除时可以继续
+func removeBackupVersion(path string) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
 		}
+		if err = removeBackupVersionFiles(path); err == nil {
+			return nil
+		}
+	}
+	return err
+}
 
-		// 执行原有的增量导出逻辑
-		_, err = os.Stat(expPath)
-		if err == nil {
-			if !full {
-				os.RemoveAll(expPath + "\\Msg")
-			} else {
-				os.RemoveAll(expPath)
-			}
+func removeBackupVersionFiles(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == backupManifestName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
 		}
+	}
+	return os.RemoveAll(path)
+}
 
-		_, err = os.Stat(expPath)
-		if err != nil {
-			os.Mkdir(expPath, os.ModeDir)
+func backupDirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
 		}
+		return nil
+	})
+	return size
+}
 
-		// 执行增量导出
-		go wechat.ExportWeChatAllData(*pInfo, expPath, progress)
+func (a *App) backupHistoryPath() string {
+	return fmt.Sprintf("%s\\backup_history.db", a.FLoader.FilePrefix)
+}
 
-		// 监听导出进度
-		for p := range progress {
-			log.Println(p)
-			runtime.EventsEmit(a.ctx, "exportData", p)
-		}
+// 旧版本保存备份记录的文件，加载时导入backup_history.db
+func (a *App) legacyBackupHistoryPath() string {
+	return fmt.Sprintf("%s\\backup_history.json", a.FLoader.FilePrefix)
+}
 
-		// 导出完成后，备份新增数据
-		if enableBackup && !full && backupResult != nil {
-			backupResult = a.backupNewData(expPath, backupResult)
-			
-			// 发送备份结果
-			resultJson, _ := json.Marshal(backupResult)
-			runtime.EventsEmit(a.ctx, "incrementalBackup", string(resultJson))
-		}
+func (a *App) openBackupHistoryDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", a.backupHistoryPath())
+	if err != nil {
+		return nil, err
+	}
 
-		// 导出完成后，执行新消息导出
-		log.Println("开始检查是否需要导出新消息，full=", full)
-		runtime.EventsEmit(a.ctx, "exportData", "{\"status\":\"processing\", \"result\":\"开始导出新消息\", \"progress\": 95}")
-		if !full {
-			log.Println("执行新消息导出，账号名=", pInfo.AcountName, "导出路径=", expPath)
-			newMessageResult := a.exportNewMessages(pInfo.AcountName, expPath)
-			if newMessageResult != nil {
-				log.Println("新消息导出完成，结果=", newMessageResult)
-				// 发送新消息导出结果
-				resultJson, _ := json.Marshal(newMessageResult)
-				runtime.EventsEmit(a.ctx, "newMessageExport", string(resultJson))
-			} else {
-				log.Println("新消息导出返回nil结果")
-			}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS BackupHistory (
+		FilePath TEXT PRIMARY KEY,
+		FileSize INTEGER,
+		ModifyTime INTEGER,
+		FileHash TEXT,
+		DataType TEXT,
+		BackupPath TEXT
+	);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadBackupHistory 从backup_history.db加载备份记录，每次备份开始时调用一次
+func (a *App) loadBackupHistory() {
+	a.backupHistoryLock.Lock()
+	defer a.backupHistoryLock.Unlock()
+	a.backupHistory = make(map[string]*NewDataRecord)
+	a.backupHistoryDirty = make(map[string]bool)
+
+	db, err := a.openBackupHistoryDB()
+	if err != nil {
+		log.Printf("Error opening backup history: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if data, err := os.ReadFile(a.legacyBackupHistoryPath()); err == nil {
+		var records []NewDataRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			log.Printf("Error parsing backup history: %v", err)
+		} else if err := writeBackupHistoryRecords(db, records); err != nil {
+			log.Printf("Error importing backup history: %v", err)
 		} else {
-			log.Println("跳过新消息导出，因为这是全量导出")
+			os.Remove(a.legacyBackupHistoryPath())
 		}
-		
-		// 发送导出完成事件，通知前端刷新消息列表
-		runtime.EventsEmit(a.ctx, "exportData", "{\"status\":\"completed\", \"result\":\"导出完成\", \"progress\": 100}")
-		runtime.EventsEmit(a.ctx, "refreshMessageList", "{\"action\":\"refresh\"}")
+	}
 
-		// 更新用户配置
-		a.defaultUser = pInfo.AcountName
-		hasUser := false
-		for _, user := range a.users {
-			if user == pInfo.AcountName {
-				hasUser = true
-				break
-			}
-		}
-		if !hasUser {
-			a.users = append(a.users, pInfo.AcountName)
-		}
-		a.setCurrentConfig()
-	}()
+	rows, err := db.Query("SELECT FilePath, FileSize, ModifyTime, FileHash, DataType, BackupPath FROM BackupHistory;")
+	if err != nil {
+		log.Printf("Error reading backup history: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record := &NewDataRecord{}
+		if err := rows.Scan(&record.FilePath, &record.FileSize, &record.ModifyTime, &record.FileHash, &record.DataType, &record.BackupPath); err != nil {
+			log.Printf("Error reading backup history: %v", err)
+			continue
+		}
+		a.backupHistory[record.FilePath] = record
+	}
 }
 
-// 扫描现有文件状态
-func (a *App) scanExistingFiles(expPath, backupPath string) *IncrementalBackupResult {
-	result := &IncrementalBackupResult{
-		NewDataRecords: make([]NewDataRecord, 0),
-		BackupPath:     backupPath,
-	}
+// 查找现有记录
+func (a *App) findExistingRecord(filePath string) *NewDataRecord {
+	a.backupHistoryLock.RLock()
+	defer a.backupHistoryLock.RUnlock()
+	return a.backupHistory[filePath]
+}
 
-	// 创建备份目录
-	backupDir := fmt.Sprintf("%s\\%s\\%d", backupPath, a.defaultUser, time.Now().Unix())
-	os.MkdirAll(backupDir, os.ModePerm)
-	result.BackupPath = backupDir
+// updateBackupHistory 记录已备份的文件，saveBackupHistory时写入磁盘
+func (a *App) updateBackupHistory(record NewDataRecord) {
+	a.backupHistoryLock.Lock()
+	defer a.backupHistoryLock.Unlock()
+	if a.backupHistory == nil {
+		a.backupHistory = make(map[string]*NewDataRecord)
+		a.backupHistoryDirty = make(map[string]bool)
+	}
+	a.backupHistory[record.FilePath] = &record
+	a.backupHistoryDirty[record.FilePath] = true
+}
 
-	// 扫描Msg目录（数据库文件）
-	msgPath := expPath + "\\Msg"
-	if _, err := os.Stat(msgPath); err == nil {
-		a.scanDirectoryForBackup(msgPath, backupDir, "database", result)
+// saveBackupHistory 只写入本次备份新增或修改的记录，在一个事务中提交
+func (a *App) saveBackupHistory() error {
+	a.backupHistoryLock.Lock()
+	records := make([]NewDataRecord, 0, len(a.backupHistoryDirty))
+	for filePath := range a.backupHistoryDirty {
+		records = append(records, *a.backupHistory[filePath])
+	}
+	a.backupHistoryDirty = make(map[string]bool)
+	a.backupHistoryLock.Unlock()
+	if len(records) == 0 {
+		return nil
 	}
 
-	// 扫描FileStorage目录（媒体文件）
-	fileStoragePath := expPath + "\\FileStorage"
-	if _, err := os.Stat(fileStoragePath); err == nil {
-		a.scanDirectoryForBackup(fileStoragePath, backupDir, "media", result)
+	db, err := a.openBackupHistoryDB()
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
-	return result
+	return writeBackupHistoryRecords(db, records)
 }
 
-// 扫描目录并记录文件信息
-func (a *App) scanDirectoryForBackup(srcPath, backupDir, dataType string, result *IncrementalBackupResult) {
-	err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+func writeBackupHistoryRecords(db *sql.DB, records []NewDataRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO BackupHistory (FilePath, FileSize, ModifyTime, FileHash, DataType, BackupPath) VALUES (?, ?, ?, ?, ?, ?);")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, record := range records {
+		if _, err := stmt.Exec(record.FilePath, record.FileSize, record.ModifyTime, record.FileHash, record.DataType, record.BackupPath); err != nil {
 			return err
 		}
+	}
 
-		if !info.IsDir() {
-			record := NewDataRecord{
-				FilePath:   path,
-				FileSize:   info.Size(),
-				ModifyTime: info.ModTime().Unix(),
-				DataType:   dataType,
-			}
-			
-			// 计算文件哈希
-			if hash, err := utils.CalculateFileHash(path); err == nil {
-				record.FileHash = hash
-			}
-			
-			result.NewDataRecords = append(result.NewDataRecords, record)
-			result.TotalFiles++
-		}
-		return nil
-	})
+	return tx.Commit()
+}
 
-	if err != nil {
-		log.Printf("Error scanning directory %s: %v", srcPath, err)
+// 设置增量备份配置
+func (a *App) SetIncrementalBackupConfig(config IncrementalBackupConfig) bool {
+	configPath := fmt.Sprintf("%s\\incremental_backup_config.json", a.FLoader.FilePrefix)
+
+	// 口令只以DPAPI加密后的形式保存，未传入新口令时沿用原来的口令
+	var old IncrementalBackupConfig
+	json.Unmarshal([]byte(a.GetIncrementalBackupConfig()), &old)
+	if config.Passphrase != "" {
+		protected, err := protectConfigString(config.Passphrase)
+		if err != nil {
+			log.Printf("Error protecting backup passphrase: %v", err)
+			return false
+		}
+		config.ProtectedPassphrase = protected
+		config.Passphrase = ""
+	} else if config.ProtectedPassphrase == "" {
+		config.ProtectedPassphrase = old.ProtectedPassphrase
 	}
-}
 
-// 备份新增数据
-func (a *App) backupNewData(expPath string, backupResult *IncrementalBackupResult) *IncrementalBackupResult {
-	log.Println("Starting incremental backup...")
-	
-	for i := range backupResult.NewDataRecords {
-		record := &backupResult.NewDataRecords[i]
-		
-		// 检查文件是否为新文件或已修改
-		if info, err := os.Stat(record.FilePath); err == nil {
-			// 检查文件是否已存在且未修改
-			existingRecord := a.findExistingRecord(record.FilePath)
-			if existingRecord != nil && 
-			   existingRecord.FileHash == record.FileHash && 
-			   existingRecord.FileSize == record.FileSize {
-				continue // 文件未变化，跳过备份
-			}
-			
-			// 更新文件信息
-			record.FileSize = info.Size()
-			record.ModifyTime = info.ModTime().Unix()
-			
-			// 计算相对路径
-			relPath, err := filepath.Rel(expPath, record.FilePath)
+	// 远程目标的密码同样只保存DPAPI加密后的形式
+	if config.Remote != nil {
+		remote := *config.Remote
+		if remote.Password != "" {
+			protected, err := protectConfigString(remote.Password)
 			if err != nil {
-				log.Printf("Error calculating relative path: %v", err)
-				continue
-			}
-			
-			// 确定备份目标路径
-			backupFilePath := filepath.Join(backupResult.BackupPath, relPath)
-			backupDir := filepath.Dir(backupFilePath)
-			
-			// 创建备份目录
-			if err := os.MkdirAll(backupDir, os.ModePerm); err != nil {
-				log.Printf("Error creating backup directory: %v", err)
-				continue
-			}
-			
-			// 复制文件到备份目录
-			if _, err := utils.CopyFile(record.FilePath, backupFilePath); err == nil {
-				record.BackupPath = backupFilePath
-				backupResult.BackupFiles++
-				backupResult.BackupSize += record.FileSize
-				log.Printf("Backed up: %s -> %s", record.FilePath, backupFilePath)
-			} else {
-				log.Printf("Error backing up file %s: %v", record.FilePath, err)
+				log.Printf("Error protecting remote password: %v", err)
+				return false
 			}
+			remote.ProtectedPassword = protected
+			remote.Password = ""
+		} else if remote.ProtectedPassword == "" && old.Remote != nil {
+			remote.ProtectedPassword = old.Remote.ProtectedPassword
 		}
+		config.Remote = &remote
 	}
-	
-	backupResult.NewFiles = backupResult.BackupFiles
-	log.Printf("Incremental backup completed: %d files backed up, %d bytes", 
-		backupResult.BackupFiles, backupResult.BackupSize)
-	
-	return backupResult
-}
-
-// 查找现有记录
-func (a *App) findExistingRecord(filePath string) *NewDataRecord {
-	// 这里可以从配置文件或数据库中查找现有记录
-	// 简化实现：从配置文件中读取
-	configPath := fmt.Sprintf("%s\\backup_history.json", a.FLoader.FilePrefix)
-	if data, err := os.ReadFile(configPath); err == nil {
-		var records []NewDataRecord
-		if err := json.Unmarshal(data, &records); err == nil {
-			for i := range records {
-				if records[i].FilePath == filePath {
-					return &records[i]
-				}
-			}
+	if config.Encrypt && config.ProtectedPassphrase == "" {
+		log.Println("Error saving backup config: encryption enabled without passphrase")
+		return false
+	}
+	for _, pattern := range append(append([]string{}, config.Include...), config.Exclude...) {
+		if !utils.ValidGlob(pattern) {
+			log.Println("Error saving backup config: invalid pattern", pattern)
+			return false
 		}
 	}
-	return nil
-}
 
-// 设置增量备份配置
-func (a *App) SetIncrementalBackupConfig(config IncrementalBackupConfig) bool {
-	configPath := fmt.Sprintf("%s\\incremental_backup_config.json", a.FLoader.FilePrefix)
 	configJson, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		log.Printf("Error marshaling backup config: %v", err)
@@ -1244,6 +6874,35 @@ func (a *App) SetIncrementalBackupConfig(config IncrementalBackupConfig) bool {
 	return true
 }
 
+// backupPassphrase 解密配置中保存的备份口令
+func (a *App) backupPassphrase(config IncrementalBackupConfig) (string, error) {
+	if config.ProtectedPassphrase == "" {
+		return "", errors.New("no backup passphrase")
+	}
+	return unprotectConfigString(config.ProtectedPassphrase)
+}
+
+// protectConfigString 使用DPAPI加密后以base64保存到配置中
+func protectConfigString(value string) (string, error) {
+	protected, err := utils.ProtectData([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(protected), nil
+}
+
+func unprotectConfigString(value string) (string, error) {
+	protected, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	plain, err := utils.UnprotectData(protected)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
 // 获取增量备份配置
 func (a *App) GetIncrementalBackupConfig() string {
 	configPath := fmt.Sprintf("%s\\incremental_backup_config.json", a.FLoader.FilePrefix)
@@ -1262,137 +6921,284 @@ func (a *App) GetIncrementalBackupConfig() string {
 	return string(configJson)
 }
 
-// 导出新消息（2025年10月16日之后的消息）
-func (a *App) exportNewMessages(accountName, expPath string) *NewMessageExportResult {
+// 导出config.StartTime之后的新消息，config由loadNewMessageExportConfig在导出前读取；
+// exportStart为导出数据库前的时间，记录为下次新消息导出的起点
+func (a *App) exportNewMessages(accountName, expPath string, config NewMessageExportConfig, exportStart int64) *NewMessageExportResult {
 	log.Println("Starting new message export...")
 	log.Println("账号名:", accountName, "导出路径:", expPath)
 	
-	// 使用配置的新消息开始时间
-	startTime := a.NewMessageStartTime
+	startTime := config.StartTime
 	
 	// 创建保存目录
 	saveTime := time.Now().Format("2006-01-02_15-04-05")
-	savePath := fmt.Sprintf(".\\save\\%s", saveTime)
+	savePath := filepath.Join(config.SavePath, saveTime)
 	log.Println("保存路径:", savePath)
 	if err := os.MkdirAll(savePath, os.ModePerm); err != nil {
 		log.Printf("Error creating save directory: %v", err)
 		return nil
 	}
 	
-	// 创建User目录用于备份FileStorage数据
-	userBackupPath := fmt.Sprintf("%s\\User\\%s", savePath, accountName)
-	log.Println("用户备份路径:", userBackupPath)
-	if err := os.MkdirAll(userBackupPath, os.ModePerm); err != nil {
-		log.Printf("Error creating user backup directory: %v", err)
-		return nil
-	}
-	
 	result := &NewMessageExportResult{
 		SavePath:         savePath,
-		UserBackupPath:   userBackupPath,
-		BackupFilesCount: 0,
 		ExportTime:       saveTime,
 		Contacts:         make([]ContactMessageData, 0),
 	}
 	
-	// 初始化数据提供者
-	if a.provider == nil {
-		log.Println("创建新的数据提供者...")
-		var err error
-		// 构建正确的prefix路径
-		prefixPath := "\\User\\" + accountName
-		a.provider, err = wechat.CreateWechatDataProvider(expPath, prefixPath)
-		if err != nil {
-			log.Printf("Error creating data provider: %v", err)
-			return nil
-		}
-		defer a.provider.WechatWechatDataProviderClose()
-		log.Println("数据提供者创建成功")
-	} else {
-		log.Println("使用现有数据提供者")
-	}
-	
-	// 获取所有联系人
-	log.Println("获取联系人列表...")
-	contactList, err := a.provider.WeChatGetContactList(0, 1000)
+	// 使用单独的数据提供者读取刚导出的数据，a.provider可能属于其他账号或已关闭
+	provider, err := wechat.CreateWechatDataProvider(expPath, "\\User\\"+accountName)
 	if err != nil {
-		log.Printf("Error getting contact list: %v", err)
+		log.Printf("Error creating data provider: %v", err)
 		return nil
 	}
-	log.Println("联系人列表获取成功，共", len(contactList.Users), "个联系人")
+	defer provider.WechatWechatDataProviderClose()
 	
-	log.Printf("Found %d contacts, processing new messages since %s", 
-		len(contactList.Users), time.Unix(startTime, 0).Format("2006-01-02 15:04:05"))
+	log.Printf("Processing new messages since %s", time.Unix(startTime, 0).Format("2006-01-02 15:04:05"))
 	
-	// 处理每个联系人的新消息
-	for _, contact := range contactList.Users {
-		contactData := a.processContactNewMessages(contact, startTime, savePath, userBackupPath)
+	// 包含媒体文件时，消息引用的媒体复制到 savePath\\media\\<UserName> 下，昵称可能重复
+	mediaRoot := filepath.Join(savePath, "media")
+
+	// 处理每个联系人的新消息，同一个联系人只处理一次
+	scanned := make(map[string]bool)
+	processContact := func(contact wechat.WeChatUserInfo) {
+		if contact.UserName == "" || scanned[contact.UserName] {
+			return
+		}
+		scanned[contact.UserName] = true
+		mediaBackupPath := ""
+		if config.IncludeMedia {
+			mediaBackupPath = filepath.Join(mediaRoot, a.sanitizeFileName(contact.UserName))
+		}
+		contactData := a.processContactNewMessages(provider, accountName, contact, config, savePath, mediaBackupPath)
 		if contactData != nil && contactData.MessageCount > 0 {
 			result.Contacts = append(result.Contacts, *contactData)
 			result.TotalMessages += contactData.MessageCount
 		}
 	}
+
+	// 分页处理联系人，每页处理完再读取下一页
+	log.Println("获取联系人列表...")
+	for pageIndex := 0; ; pageIndex++ {
+		contactList, err := provider.WeChatGetContactList(pageIndex, newMessageContactPageSize, "")
+		if err != nil {
+			log.Printf("Error getting contact list: %v", err)
+			return nil
+		}
+		for _, contact := range contactList.Users {
+			processContact(contact)
+		}
+		if contactList.Total < newMessageContactPageSize {
+			break
+		}
+	}
+
+	// 不在联系人表中的群聊等会话只出现在会话列表中
+	for pageIndex := 0; ; pageIndex++ {
+		sessionList, fetched, err := provider.WeChatGetSessionPage(pageIndex, newMessageContactPageSize)
+		if err != nil {
+			log.Printf("Error getting session list: %v", err)
+			break
+		}
+		for _, session := range sessionList.Rows {
+			contact := session.UserInfo
+			if contact.UserName == "" {
+				contact.UserName = session.UserName
+				contact.NickName = session.NickName
+				contact.IsGroup = session.IsGroup
+			}
+			processContact(contact)
+		}
+		if fetched < newMessageContactPageSize {
+			break
+		}
+	}
+	result.ScannedContacts = len(scanned)
+	log.Printf("共扫描 %d 个联系人，%d 个有新消息", result.ScannedContacts, len(result.Contacts))
 	
 	result.TotalContacts = len(result.Contacts)
 	
-	// 扫描JSON文件，收集所有出现过的文件路径
-	log.Println("开始扫描JSON文件，收集文件路径...")
-	referencedFiles := a.scanJSONFilesForReferencedPaths(savePath)
-	log.Printf("从JSON文件中收集到 %d 个文件路径", len(referencedFiles))
-	
-	// 备份FileStorage目录中JSON文件引用的文件
-	log.Println("开始备份JSON文件中引用的文件...")
-	fileStorageBackupCount := a.backupReferencedFiles(expPath, userBackupPath, referencedFiles)
-	log.Printf("FileStorage引用文件备份完成，共备份 %d 个文件", fileStorageBackupCount)
+	// 不按联系人分组时所有联系人的对话保存到同一个文件
+	if !config.GroupByContact && len(result.Contacts) > 0 {
+		messagesPath := filepath.Join(savePath, "messages.json")
+		for i := range result.Contacts {
+			result.Contacts[i].FilePath = messagesPath
+		}
+		jsonData, _ := json.MarshalIndent(result.Contacts, "", "  ")
+		if err := os.WriteFile(messagesPath, jsonData, os.ModePerm); err != nil {
+			log.Printf("Error writing %s: %v", messagesPath, err)
+			return nil
+		}
+	}
 	
-	// 统计备份的媒体文件数量
-	result.BackupFilesCount = a.countBackupFiles(userBackupPath)
+	// 统计复制的媒体文件数量
+	result.MediaFilesCount, result.MediaBytes = countMediaFiles(mediaRoot)
 	
-	log.Printf("New message export completed: %d contacts, %d total messages, %d backup files", 
-		result.TotalContacts, result.TotalMessages, result.BackupFilesCount)
+	log.Printf("New message export completed: %d contacts, %d total messages, %d media files", 
+		result.TotalContacts, result.TotalMessages, result.MediaFilesCount)
 	
-	// 导出完成后，更新新消息开始时间为当前时间
-	a.updateNewMessageStartTime()
+	// 下次从本次导出开始的时间继续，导出期间收到的消息在下次导出
+	a.recordNewMessageExportTime(accountName, exportStart)
 	
 	return result
 }
 
+// recordNewMessageExportTime 在配置的LastExportTime中记录account的导出时间，重新读取配置以免覆盖用户的StartTime
+func (a *App) recordNewMessageExportTime(accountName string, exportTime int64) {
+	var config NewMessageExportConfig
+	if err := json.Unmarshal([]byte(a.GetNewMessageExportConfig()), &config); err != nil {
+		log.Printf("Error parsing new message export config: %v", err)
+		return
+	}
+	if config.LastExportTime == nil {
+		config.LastExportTime = make(map[string]int64)
+	}
+	config.LastExportTime[accountName] = exportTime
+	if !a.SetNewMessageExportConfig(config) {
+		return
+	}
+	log.Printf("%s 新消息导出时间已更新为: %s", accountName, time.Unix(exportTime, 0).Format("2006-01-02 15:04:05"))
+}
+
+// loadNewMessageExportConfig 读取新消息导出配置，StartTime为账号上次成功导出新消息的时间；
+// 账号没有记录时使用配置的StartTime，也没有设置时返回错误，跳过本次新消息导出
+func (a *App) loadNewMessageExportConfig(accountName string) (NewMessageExportConfig, error) {
+	var config NewMessageExportConfig
+	if err := json.Unmarshal([]byte(a.GetNewMessageExportConfig()), &config); err != nil {
+		return config, err
+	}
+	if config.StartTime < 0 {
+		return config, fmt.Errorf("invalid startTime %d", config.StartTime)
+	}
+	if last := config.LastExportTime[accountName]; last > 0 {
+		config.StartTime = last
+	}
+	if config.StartTime == 0 {
+		return config, fmt.Errorf("%s has no previous new message export, set startTime for the first run", accountName)
+	}
+	if config.SavePath == "" {
+		config.SavePath = ".\\save"
+	}
+	return config, nil
+}
+
 // 处理单个联系人的新消息
-func (a *App) processContactNewMessages(contact wechat.WeChatUserInfo, startTime int64, savePath, userBackupPath string) *ContactMessageData {
-	// 获取该联系人的新消息 - 使用Backward方向获取大于startTime的消息
-	messages, err := a.provider.WeChatGetMessageListByTime(
-		contact.UserName, 
-		startTime, 
-		1000, // 每次获取1000条消息
-		wechat.Message_Search_Backward, // 改为Backward以获取大于startTime的消息
-	)
-	
+// 按联系人分组时每个联系人保存为单独的JSON，否则只返回整理后的对话，由调用者统一保存
+func (a *App) processContactNewMessages(provider *wechat.WechatDataProvider, accountName string, contact wechat.WeChatUserInfo, config NewMessageExportConfig, savePath, userBackupPath string) *ContactMessageData {
+	startTime := config.StartTime
+	rows, truncated, err := newMessagesSince(contact.UserName, startTime, func(cursor int64) (*wechat.WeChatMessageList, error) {
+		// Backward方向获取大于cursor的消息，按时间倒序返回
+		return provider.WeChatGetMessageListByTime(contact.UserName, cursor, newMessagePageSize, wechat.Message_Search_Backward)
+	})
 	if err != nil {
 		log.Printf("Error getting messages for %s: %v", contact.NickName, err)
 		return nil
 	}
+	if truncated {
+		log.Printf("警告: %s 的新消息未能全部读取，只导出了 %d 条", contact.NickName, len(rows))
+	}
 	
-	if messages.Total == 0 {
+	if len(rows) == 0 {
 		return nil
 	}
 	
+	instruction := fmt.Sprintf("%s 的新消息对话", contact.NickName)
+	var contactData *ContactMessageData
+	if !config.GroupByContact {
+		contactData = a.buildContactDialogue(provider, accountName, contact, rows, startTime, instruction, savePath, userBackupPath)
+	} else {
+		contactData, err = a.exportContactDialogue(provider, accountName, contact, rows, startTime, instruction, savePath, userBackupPath)
+		if err != nil {
+			log.Printf("Error saving messages for %s: %v", contact.NickName, err)
+			return nil
+		}
+	}
+	if contactData != nil {
+		contactData.Truncated = truncated
+	}
+	
+	return contactData
+}
+
+// 新消息导出时每次读取的消息数和联系人数
+const (
+	newMessagePageSize        = 1000
+	newMessageContactPageSize = 500
+)
+
+// newMessagesSince 通过fetch分页读取userName在startTime之后的所有消息，fetch返回时间大于cursor的最多newMessagePageSize条消息，按时间倒序；
+// 下一页从上一页最新消息的时间开始（含该秒），以免同一秒的消息被分页截断，重复的消息按id去重。
+// 第一页之后读取失败或某一页没有新消息时返回已读取的消息，truncated为true
+func newMessagesSince(userName string, startTime int64, fetch func(cursor int64) (*wechat.WeChatMessageList, error)) (rows []wechat.WeChatMessage, truncated bool, err error) {
+	seen := make(map[string]bool)
+	cursor := startTime
+	for {
+		page, err := fetch(cursor)
+		if err != nil {
+			if len(rows) == 0 {
+				return nil, false, err
+			}
+			log.Printf("Error getting messages for %s after %d: %v", userName, cursor, err)
+			return rows, true, nil
+		}
+		if page.Total == 0 {
+			return rows, false, nil
+		}
+
+		added := 0
+		for _, msg := range page.Rows {
+			key := fmt.Sprintf("%s_%d_%d", msg.MsgSvrId, msg.LocalId, msg.CreateTime)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			rows = append(rows, msg)
+			added++
+		}
+		if page.Total < newMessagePageSize {
+			return rows, false, nil
+		}
+		// 同一秒的消息超过一页时无法继续分页
+		if added == 0 {
+			return rows, true, nil
+		}
+		cursor = page.Rows[0].CreateTime - 1
+	}
+}
+
+// exportContactDialogue 将联系人的消息整理为对话并保存为JSON，没有可导出的消息时返回nil
+func (a *App) exportContactDialogue(provider *wechat.WechatDataProvider, accountName string, contact wechat.WeChatUserInfo, rows []wechat.WeChatMessage, startTime int64, instruction, savePath, userBackupPath string) (*ContactMessageData, error) {
+	contactData := a.buildContactDialogue(provider, accountName, contact, rows, startTime, instruction, savePath, userBackupPath)
+	if contactData == nil {
+		return nil, nil
+	}
+
+	// 保存到JSON文件
+	if err := a.saveContactMessagesToJSON(contactData); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Exported %d messages for %s", contactData.MessageCount, contact.NickName)
+	return contactData, nil
+}
+
+// buildContactDialogue 将联系人的消息整理为对话，没有可导出的消息时返回nil
+func (a *App) buildContactDialogue(provider *wechat.WechatDataProvider, accountName string, contact wechat.WeChatUserInfo, rows []wechat.WeChatMessage, startTime int64, instruction, savePath, userBackupPath string) *ContactMessageData {
 	// 构建对话数据
 	dialogueGroup := DialogueGroup{
-		Instruction: fmt.Sprintf("%s 的新消息对话", contact.NickName),
+		Instruction: instruction,
 		Dialogue:    make([]DialogueMessage, 0),
 	}
 	
 	// 先按时间升序排序，保证最新在最后
-	sort.SliceStable(messages.Rows, func(i, j int) bool { return messages.Rows[i].CreateTime < messages.Rows[j].CreateTime })
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].CreateTime < rows[j].CreateTime })
 
 	// 处理每条消息 - 按时间顺序排列，最新的消息在最后
-	for _, msg := range messages.Rows {
+	for _, msg := range rows {
 		// 跳过系统消息
 		if msg.Type == wechat.Wechat_Message_Type_System {
 			continue
 		}
 		
-		// 确保只处理2025-10-16之后的消息
+		// 确保只处理startTime之后的消息
 		if msg.CreateTime < startTime {
 			log.Printf("跳过旧消息: %s, 时间: %s, 开始时间: %s", 
 				contact.NickName, 
@@ -1405,14 +7211,14 @@ func (a *App) processContactNewMessages(contact wechat.WeChatUserInfo, startTime
 		var speaker string
 		if msg.IsSender == 1 {
 			// 自己发送的消息
-			speaker = a.provider.SelfInfo.NickName
+			speaker = provider.SelfInfo.NickName
 		} else {
 			// 别人发送的消息
 			if contact.IsGroup {
 				// 群聊消息，从UserInfo.UserName获取具体说话人信息
 				if msg.UserInfo.UserName != "" {
 					// 尝试从用户信息缓存中获取昵称
-					if userInfo, err := a.provider.WechatGetUserInfoByNameOnCache(msg.UserInfo.UserName); err == nil {
+					if userInfo, err := provider.WechatGetUserInfoByNameOnCache(msg.UserInfo.UserName); err == nil {
 						speaker = userInfo.NickName // 使用原始昵称，不使用备注
 					} else {
 						// 如果获取不到用户信息，使用UserInfo中的信息
@@ -1432,7 +7238,7 @@ func (a *App) processContactNewMessages(contact wechat.WeChatUserInfo, startTime
 		}
 		
 		// 处理消息内容并备份媒体文件
-		text := a.processMessageContentWithBackup(&msg, savePath, userBackupPath)
+		text := a.processMessageContentWithBackup(accountName, &msg, savePath, userBackupPath)
 		if text == "" {
 			continue
 		}
@@ -1452,41 +7258,175 @@ func (a *App) processContactNewMessages(contact wechat.WeChatUserInfo, startTime
 			log.Printf("私聊消息 - 联系人: %s, 识别出的说话人: %s, 内容: %s", 
 				contact.NickName, speaker, textPreview)
 		}
-		
-		dialogueMessage := DialogueMessage{
-			Index:   len(dialogueGroup.Dialogue) + 1, // 使用当前对话长度+1作为index
-			Speaker: speaker,
-			Text:    text,
-			Time:    msgTime,
+		
+		dialogueMessage := DialogueMessage{
+			Index:   len(dialogueGroup.Dialogue) + 1, // 使用当前对话长度+1作为index
+			Speaker: speaker,
+			Text:    text,
+			Time:    msgTime,
+		}
+		
+		dialogueGroup.Dialogue = append(dialogueGroup.Dialogue, dialogueMessage)
+	}
+	
+	if len(dialogueGroup.Dialogue) == 0 {
+		return nil
+	}
+	
+	// 创建联系人数据
+	return &ContactMessageData{
+		ContactName: contact.NickName,
+		MessageCount: len(dialogueGroup.Dialogue),
+		// 昵称可能重复，文件名加上UserName
+		FilePath:    fmt.Sprintf("%s\\%s_%s.json", savePath, a.sanitizeFileName(contact.NickName), a.sanitizeFileName(contact.UserName)),
+		Dialogue:    []DialogueGroup{dialogueGroup},
+	}
+}
+
+// 获取批量导出的并发数，未配置时使用默认值
+func (a *App) batchExportConcurrency() int {
+	var config NewMessageExportConfig
+	if err := json.Unmarshal([]byte(a.GetNewMessageExportConfig()), &config); err != nil || config.Concurrency <= 0 {
+		return defaultBatchWorkers
+	}
+	return config.Concurrency
+}
+
+// ExportAllContactsMessages 将所有联系人在[startTime, endTime]内的消息分别导出为JSON
+func (a *App) ExportAllContactsMessages(startTime, endTime int64, outputDir string) string {
+	if a.provider == nil {
+		return apierr.JSON(apierr.ErrProviderNotInit)
+	}
+	if startTime > endTime {
+		return apierr.JSON(apierr.New(apierr.CodeInvalidParam, "invalid range: startTime %d > endTime %d", startTime, endTime))
+	}
+
+	outputDir, err := filepath.Abs(outputDir)
+	if err == nil {
+		err = os.MkdirAll(outputDir, os.ModePerm)
+	}
+	if err != nil {
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", outputDir))
+	}
+	// 导出期间a.provider可能被重新打开，各worker使用开始时的数据提供者
+	provider, accountName := a.provider, a.defaultUser
+	userBackupPath := filepath.Join(outputDir, "User", provider.SelfInfo.UserName)
+
+	exportDone := a.beginExport()
+	defer exportDone()
+
+	contacts := make([]wechat.WeChatUserInfo, 0)
+	pageSize := 500
+	for pageIndex := 0; ; pageIndex++ {
+		list, err := provider.WeChatGetContactList(pageIndex, pageSize, "")
+		if err != nil {
+			log.Println("WeChatGetContactList failed:", err)
+			return apierr.JSON(apierr.Wrap(apierr.CodeDBFailure, err))
+		}
+		contacts = append(contacts, list.Users...)
+		if list.Total < pageSize {
+			break
 		}
-		
-		dialogueGroup.Dialogue = append(dialogueGroup.Dialogue, dialogueMessage)
 	}
-	
-	if len(dialogueGroup.Dialogue) == 0 {
-		return nil
+
+	result := &BatchExportResult{
+		OutputDir: outputDir,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Total:     len(contacts),
+		Contacts:  make([]ContactExportResult, len(contacts)),
 	}
-	
-	// 创建联系人数据
-	contactData := &ContactMessageData{
-		ContactName: contact.NickName,
-		MessageCount: len(dialogueGroup.Dialogue),
-		FilePath:    fmt.Sprintf("%s\\%s.json", savePath, a.sanitizeFileName(contact.NickName)),
-		Dialogue:    []DialogueGroup{dialogueGroup},
+
+	workers := a.batchExportConcurrency()
+	log.Printf("ExportAllContactsMessages: %d contacts, %d workers, %s", len(contacts), workers, outputDir)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	taskChan := make(chan int, len(contacts))
+	for i := range contacts {
+		taskChan <- i
 	}
-	
-	// 保存到JSON文件
-	if err := a.saveContactMessagesToJSON(contactData); err != nil {
-		log.Printf("Error saving messages for %s: %v", contact.NickName, err)
-		return nil
+	close(taskChan)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range taskChan {
+				contactResult := a.exportContactMessagesInRange(provider, accountName, contacts[index], startTime, endTime, outputDir, userBackupPath)
+
+				lock.Lock()
+				result.Contacts[index] = contactResult
+				done += 1
+				progress := BatchExportProgress{Contact: contactResult.Contact, Done: done, Total: result.Total}
+				lock.Unlock()
+
+				progressStr, _ := json.Marshal(progress)
+				eventsEmit(a.ctx, "batchExport", string(progressStr))
+			}
+		}()
 	}
-	
-	log.Printf("Exported %d messages for %s", contactData.MessageCount, contact.NickName)
-	return contactData
+	wg.Wait()
+
+	for _, contactResult := range result.Contacts {
+		if contactResult.Success {
+			result.Succeeded += 1
+		} else {
+			result.Failed += 1
+		}
+		result.TotalBytes += contactResult.Bytes
+	}
+
+	log.Printf("ExportAllContactsMessages done: %d succeeded, %d failed, %d bytes", result.Succeeded, result.Failed, result.TotalBytes)
+	resultStr, _ := json.Marshal(result)
+	eventsEmit(a.ctx, "batchExportResult", string(resultStr))
+
+	return string(resultStr)
+}
+
+// 导出单个联系人在时间范围内的消息，供批量导出使用
+func (a *App) exportContactMessagesInRange(provider *wechat.WechatDataProvider, accountName string, contact wechat.WeChatUserInfo, startTime, endTime int64, outputDir, userBackupPath string) ContactExportResult {
+	contactResult := ContactExportResult{
+		Contact:  contact.NickName,
+		UserName: contact.UserName,
+	}
+
+	rows := make([]wechat.WeChatMessage, 0)
+	pageSize := 1000
+	for pageIndex := 0; ; pageIndex++ {
+		list, err := provider.WeChatGetMessageListByDateRange(contact.UserName, startTime, endTime, pageIndex, pageSize)
+		if err != nil {
+			contactResult.Error = err.Error()
+			return contactResult
+		}
+		rows = append(rows, list.Rows...)
+		if list.Total < pageSize {
+			break
+		}
+	}
+
+	if len(rows) > 0 {
+		contactData, err := a.exportContactDialogue(provider, accountName, contact, rows, startTime,
+			fmt.Sprintf("%s 的消息对话", contact.NickName), outputDir, userBackupPath)
+		if err != nil {
+			contactResult.Error = err.Error()
+			return contactResult
+		}
+		if contactData != nil {
+			contactResult.MessageCount = contactData.MessageCount
+			if finfo, err := os.Stat(contactData.FilePath); err == nil {
+				contactResult.Bytes = finfo.Size()
+			}
+		}
+	}
+
+	contactResult.Success = true
+	return contactResult
 }
 
 // 处理消息内容并备份媒体文件（用于新消息导出）
-func (a *App) processMessageContentWithBackup(msg *wechat.WeChatMessage, savePath, userBackupPath string) string {
+func (a *App) processMessageContentWithBackup(accountName string, msg *wechat.WeChatMessage, savePath, userBackupPath string) string {
 	switch msg.Type {
 	case wechat.Wechat_Message_Type_Text:
 		return msg.Content
@@ -1499,30 +7439,20 @@ func (a *App) processMessageContentWithBackup(msg *wechat.WeChatMessage, savePat
 		log.Printf("处理图片消息 - ImagePath: %s, ThumbPath: %s", msg.ImagePath, msg.ThumbPath)
 		if msg.ImagePath != "" {
 			// 构建正确的图片路径
-			imagePath := a.buildCorrectMediaPath(msg.ImagePath, "Image")
+			imagePath := a.buildAccountMediaPath(accountName, msg.ImagePath, "Image")
 			log.Printf("图片路径构建结果: %s, 文件存在: %v", imagePath, a.fileExists(imagePath))
 			if imagePath != "" && a.fileExists(imagePath) {
-			// 备份图片文件
-			backupPath := a.backupMediaFile(imagePath, userBackupPath, "Image", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[图片] %s", backupPath)
-				}
-				return fmt.Sprintf("[图片] %s", imagePath)
+				return fmt.Sprintf("[图片] %s", a.mediaText(accountName, imagePath, savePath, userBackupPath, "Image"))
 			} else {
 				log.Printf("图片文件不存在，应该存在的路径: %s", imagePath)
 			}
 		} else if msg.ThumbPath != "" {
 			// 如果ImagePath为空，尝试使用ThumbPath
 			log.Printf("ImagePath为空，尝试使用ThumbPath: %s", msg.ThumbPath)
-			thumbPath := a.buildCorrectMediaPath(msg.ThumbPath, "Image")
+			thumbPath := a.buildAccountMediaPath(accountName, msg.ThumbPath, "Image")
 			log.Printf("缩略图路径构建结果: %s, 文件存在: %v", thumbPath, a.fileExists(thumbPath))
 			if thumbPath != "" && a.fileExists(thumbPath) {
-			// 备份图片文件
-			backupPath := a.backupMediaFile(thumbPath, userBackupPath, "Image", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[图片] %s", backupPath)
-				}
-				return fmt.Sprintf("[图片] %s", thumbPath)
+				return fmt.Sprintf("[图片] %s", a.mediaText(accountName, thumbPath, savePath, userBackupPath, "Image"))
 			} else {
 				log.Printf("缩略图文件不存在，应该存在的路径: %s", thumbPath)
 			}
@@ -1532,14 +7462,9 @@ func (a *App) processMessageContentWithBackup(msg *wechat.WeChatMessage, savePat
 	case wechat.Wechat_Message_Type_Video:
 		if msg.VideoPath != "" {
 			// 构建正确的视频路径
-			videoPath := a.buildCorrectMediaPath(msg.VideoPath, "Video")
+			videoPath := a.buildAccountMediaPath(accountName, msg.VideoPath, "Video")
 			if videoPath != "" && a.fileExists(videoPath) {
-			// 备份视频文件
-			backupPath := a.backupMediaFile(videoPath, userBackupPath, "Video", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[视频] %s", backupPath)
-				}
-				return fmt.Sprintf("[视频] %s", videoPath)
+				return fmt.Sprintf("[视频] %s", a.mediaText(accountName, videoPath, savePath, userBackupPath, "Video"))
 			}
 		}
 		return "[视频] 文件不存在"
@@ -1547,14 +7472,9 @@ func (a *App) processMessageContentWithBackup(msg *wechat.WeChatMessage, savePat
 	case wechat.Wechat_Message_Type_Voice:
 		if msg.VoicePath != "" {
 			// 构建正确的语音路径
-			voicePath := a.buildCorrectMediaPath(msg.VoicePath, "Voice")
+			voicePath := a.buildAccountMediaPath(accountName, msg.VoicePath, "Voice")
 			if voicePath != "" && a.fileExists(voicePath) {
-			// 备份语音文件
-			backupPath := a.backupMediaFile(voicePath, userBackupPath, "Voice", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[语音] %s", backupPath)
-				}
-				return fmt.Sprintf("[语音] %s", voicePath)
+				return fmt.Sprintf("%s %s", voiceLabel(msg), a.mediaText(accountName, voicePath, savePath, userBackupPath, "Voice"))
 			}
 		}
 		return "[语音] 文件不存在"
@@ -1572,7 +7492,7 @@ func (a *App) processMessageContentWithBackup(msg *wechat.WeChatMessage, savePat
 		return "[名片]"
 		
 	case wechat.Wechat_Message_Type_Misc:
-		return a.processMiscMessageWithBackup(msg, savePath, userBackupPath)
+		return a.processMiscMessageWithBackup(accountName, msg, savePath, userBackupPath)
 		
 	case wechat.Wechat_Message_Type_Voip:
 		// 语音视频消息
@@ -1618,7 +7538,7 @@ func (a *App) processMessageContent(msg *wechat.WeChatMessage, savePath string)
 			// 构建正确的语音路径
 			voicePath := a.buildCorrectMediaPath(msg.VoicePath, "Voice")
 			if voicePath != "" && a.fileExists(voicePath) {
-				return fmt.Sprintf("[语音] %s", voicePath)
+				return fmt.Sprintf("%s %s", voiceLabel(msg), voicePath)
 			}
 		}
 		return "[语音] 文件不存在"
@@ -1694,19 +7614,14 @@ func (a *App) getMiscMessageDescription(subType int) string {
 }
 
 // 处理杂项消息并备份媒体文件（用于新消息导出）
-func (a *App) processMiscMessageWithBackup(msg *wechat.WeChatMessage, savePath, userBackupPath string) string {
+func (a *App) processMiscMessageWithBackup(accountName string, msg *wechat.WeChatMessage, savePath, userBackupPath string) string {
 	switch msg.SubType {
 	case wechat.Wechat_Misc_Message_File:
 		if msg.FileInfo.FileName != "" {
 			// 构建正确的文件路径
-			filePath := a.buildCorrectMediaPath(msg.FileInfo.FilePath, "File")
+			filePath := a.buildAccountMediaPath(accountName, msg.FileInfo.FilePath, "File")
 			if filePath != "" && a.fileExists(filePath) {
-			// 备份文件
-			backupPath := a.backupMediaFile(filePath, userBackupPath, "File", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[文件] %s", backupPath)
-				}
-				return fmt.Sprintf("[文件] %s", filePath)
+				return fmt.Sprintf("[文件] %s", a.mediaText(accountName, filePath, savePath, userBackupPath, "File"))
 			}
 			return fmt.Sprintf("[文件] %s (文件不存在)", msg.FileInfo.FileName)
 		}
@@ -1720,71 +7635,42 @@ func (a *App) processMiscMessageWithBackup(msg *wechat.WeChatMessage, savePath,
 		
 	case wechat.Wechat_Misc_Message_ThirdVideo:
 		if msg.ThumbPath != "" {
-			thumbPath := a.buildCorrectMediaPath(msg.ThumbPath, "Thumb")
+			thumbPath := a.buildAccountMediaPath(accountName, msg.ThumbPath, "Thumb")
 			if thumbPath != "" && a.fileExists(thumbPath) {
-			// 备份缩略图
-			backupPath := a.backupMediaFile(thumbPath, userBackupPath, "Thumb", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[第三方视频] %s", backupPath)
-				}
-				return fmt.Sprintf("[第三方视频] %s", thumbPath)
+				return fmt.Sprintf("[第三方视频] %s", a.mediaText(accountName, thumbPath, savePath, userBackupPath, "Thumb"))
 			}
 		}
 		return "[第三方视频]"
 		
 	case wechat.Wechat_Misc_Message_CardLink:
 		if msg.ThumbPath != "" {
-			thumbPath := a.buildCorrectMediaPath(msg.ThumbPath, "Thumb")
+			thumbPath := a.buildAccountMediaPath(accountName, msg.ThumbPath, "Thumb")
 			if thumbPath != "" && a.fileExists(thumbPath) {
-			// 备份缩略图
-			backupPath := a.backupMediaFile(thumbPath, userBackupPath, "Thumb", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[链接卡片] %s", backupPath)
-				}
-				return fmt.Sprintf("[链接卡片] %s", thumbPath)
+				return fmt.Sprintf("[链接卡片] %s", a.mediaText(accountName, thumbPath, savePath, userBackupPath, "Thumb"))
 			}
 		}
 		return "[链接卡片]"
 		
 	case wechat.Wechat_Misc_Message_Applet, wechat.Wechat_Misc_Message_Applet2:
 		if msg.ThumbPath != "" {
-			thumbPath := a.buildCorrectMediaPath(msg.ThumbPath, "Thumb")
+			thumbPath := a.buildAccountMediaPath(accountName, msg.ThumbPath, "Thumb")
 			if thumbPath != "" && a.fileExists(thumbPath) {
-			// 备份缩略图
-			backupPath := a.backupMediaFile(thumbPath, userBackupPath, "Thumb", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[小程序] %s", backupPath)
-				}
-				return fmt.Sprintf("[小程序] %s", thumbPath)
+				return fmt.Sprintf("[小程序] %s", a.mediaText(accountName, thumbPath, savePath, userBackupPath, "Thumb"))
 			}
 		}
 		return "[小程序]"
 		
 	case wechat.Wechat_Misc_Message_Channels:
 		if msg.ThumbPath != "" {
-			thumbPath := a.buildCorrectMediaPath(msg.ThumbPath, "Thumb")
+			thumbPath := a.buildAccountMediaPath(accountName, msg.ThumbPath, "Thumb")
 			if thumbPath != "" && a.fileExists(thumbPath) {
-			// 备份缩略图
-			backupPath := a.backupMediaFile(thumbPath, userBackupPath, "Thumb", a.NewMessageStartTime)
-				if backupPath != "" {
-					return fmt.Sprintf("[视频号] %s", backupPath)
-				}
-				return fmt.Sprintf("[视频号] %s", thumbPath)
+				return fmt.Sprintf("[视频号] %s", a.mediaText(accountName, thumbPath, savePath, userBackupPath, "Thumb"))
 			}
 		}
 		return "[视频号]"
 		
 	case wechat.Wechat_Misc_Message_Refer:
-		// 引用消息 - 显示格式：[消息]speaker的内容，[引用消息]被引用的人的昵称：被引用的内容
-		if msg.ReferInfo.Content != "" {
-			referContent := msg.ReferInfo.Content
-			referDisplayName := msg.ReferInfo.Displayname
-			if referDisplayName == "" {
-				referDisplayName = "未知用户"
-			}
-			return fmt.Sprintf("[消息]%s，[引用消息]%s：%s", msg.Content, referDisplayName, referContent)
-		}
-		return fmt.Sprintf("[消息]%s，[引用消息]", msg.Content)
+		return formatQuotedMessage(msg)
 		
 	case wechat.Wechat_Misc_Message_Notice:
 		// 通知消息 - 显示消息内容
@@ -1857,16 +7743,7 @@ func (a *App) processMiscMessage(msg *wechat.WeChatMessage, savePath string) str
 		return "[视频号]"
 		
 	case wechat.Wechat_Misc_Message_Refer:
-		// 引用消息 - 显示格式：[消息]speaker的内容，[引用消息]被引用的人的昵称：被引用的内容
-		if msg.ReferInfo.Content != "" {
-			referContent := msg.ReferInfo.Content
-			referDisplayName := msg.ReferInfo.Displayname
-			if referDisplayName == "" {
-				referDisplayName = "未知用户"
-			}
-			return fmt.Sprintf("[消息]%s，[引用消息]%s：%s", msg.Content, referDisplayName, referContent)
-		}
-		return fmt.Sprintf("[消息]%s，[引用消息]", msg.Content)
+		return formatQuotedMessage(msg)
 		
 	case wechat.Wechat_Misc_Message_Notice:
 		// 通知消息 - 显示消息内容
@@ -1882,14 +7759,43 @@ func (a *App) processMiscMessage(msg *wechat.WeChatMessage, savePath string) str
 	}
 }
 
+// voiceLabel 有时长时显示为[语音 2s]，时长按秒四舍五入
+func voiceLabel(msg *wechat.WeChatMessage) string {
+	if msg.VoiceDurationMs <= 0 {
+		return "[语音]"
+	}
+	seconds := (msg.VoiceDurationMs + 500) / 1000
+	if seconds == 0 {
+		seconds = 1
+	}
+	return fmt.Sprintf("[语音 %ds]", seconds)
+}
+
+// formatQuotedMessage 引用消息显示格式：[Quote: 被引用的人的昵称: 被引用的内容]，换行后为回复的内容
+func formatQuotedMessage(msg *wechat.WeChatMessage) string {
+	if msg.QuotedMessage == nil {
+		return msg.Content
+	}
+	sender := msg.QuotedMessage.Sender
+	if sender == "" {
+		sender = "未知用户"
+	}
+	return fmt.Sprintf("[Quote: %s: %s]\n%s", sender, msg.QuotedMessage.Text, msg.Content)
+}
+
 // 构建正确的媒体文件路径
 func (a *App) buildCorrectMediaPath(originalPath, mediaType string) string {
+	return a.buildAccountMediaPath(a.defaultUser, originalPath, mediaType)
+}
+
+// buildAccountMediaPath 按accountName的导出目录构建媒体文件路径
+func (a *App) buildAccountMediaPath(accountName, originalPath, mediaType string) string {
 	if originalPath == "" {
 		return ""
 	}
 	
 	// 获取用户数据目录
-	userDataDir := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+	userDataDir := a.FLoader.FilePrefix + "\\User\\" + accountName
 	
 	// 根据媒体类型构建路径
 	var correctPath string
@@ -1899,7 +7805,7 @@ func (a *App) buildCorrectMediaPath(originalPath, mediaType string) string {
 	
 	// 调试日志：记录原始路径信息
 	log.Printf("媒体文件路径构建开始 - 原始路径: %s, 媒体类型: %s, 用户名: %s", 
-		originalPath, mediaType, a.defaultUser)
+		originalPath, mediaType, accountName)
 	
 	// 特殊处理：如果路径包含FileStorage，需要正确处理路径
 	if strings.Contains(normalizedPath, "FileStorage\\") {
@@ -1950,6 +7856,214 @@ func (a *App) buildCorrectMediaPath(originalPath, mediaType string) string {
 	return correctPath
 }
 
+// DedupeReport 重复的媒体文件，Duplicates每组第一个为保留的文件
+type DedupeReport struct {
+	DryRun         bool       `json:"dryRun"`
+	DuplicateSets  int        `json:"duplicateSets"`
+	WastedBytes    int64      `json:"wastedBytes"`
+	Duplicates     [][]string `json:"duplicates"`
+	Linked         int        `json:"linked"`
+	ReclaimedBytes int64      `json:"reclaimedBytes"`
+	Failed         []string   `json:"failed"`
+}
+
+// DeduplicateMediaFiles 查找账号FileStorage下内容相同的文件，dryRun为false时每组保留修改时间最早的文件，
+// 其余替换为指向它的硬链接；已经是同一文件的硬链接不再计为重复
+func (a *App) DeduplicateMediaFiles(userName string, dryRun bool) string {
+	log.Println("DeduplicateMediaFiles:", userName, dryRun)
+	emptyFields := map[string]interface{}{"duplicateSets": 0, "wastedBytes": 0, "duplicates": []interface{}{}}
+	if userName == "" || userName != filepath.Base(userName) {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "invalid userName: %s", userName), emptyFields)
+	}
+
+	storagePath := filepath.Join(a.FLoader.FilePrefix, "User", userName, "FileStorage")
+	if _, err := os.Stat(storagePath); err != nil {
+		return apierr.JSONWith(apierr.Wrapf(apierr.CodeNotFound, err, "%s", storagePath), emptyFields)
+	}
+
+	// 先按大小分组，只有大小相同的文件才需要计算哈希
+	type mediaFile struct {
+		path string
+		info os.FileInfo
+	}
+	bySize := make(map[int64][]mediaFile)
+	err := filepath.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println("filepath.Walk:", path, err)
+			return nil
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			bySize[info.Size()] = append(bySize[info.Size()], mediaFile{path: path, info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		return apierr.JSONWith(apierr.Wrapf(apierr.CodeIOFailure, err, "%s", storagePath), emptyFields)
+	}
+
+	report := DedupeReport{DryRun: dryRun, Duplicates: make([][]string, 0), Failed: make([]string, 0)}
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+
+		byHash := make(map[string][]mediaFile)
+		for _, file := range files {
+			hash, err := utils.CalculateFileHash(file.path)
+			if err != nil {
+				log.Println("CalculateFileHash:", file.path, err)
+				continue
+			}
+			byHash[hash] = append(byHash[hash], file)
+		}
+
+		for _, group := range byHash {
+			if len(group) < 2 {
+				continue
+			}
+			sort.Slice(group, func(i, j int) bool { return group[i].info.ModTime().Before(group[j].info.ModTime()) })
+			keep := group[0]
+
+			set := []string{keep.path}
+			for _, file := range group[1:] {
+				if os.SameFile(keep.info, file.info) {
+					continue
+				}
+				set = append(set, file.path)
+			}
+			if len(set) < 2 {
+				continue
+			}
+			report.DuplicateSets += 1
+			report.WastedBytes += size * int64(len(set)-1)
+			report.Duplicates = append(report.Duplicates, set)
+
+			if dryRun {
+				continue
+			}
+			for _, path := range set[1:] {
+				if err := replaceWithHardLink(keep.path, path); err != nil {
+					log.Println("replaceWithHardLink:", path, err)
+					report.Failed = append(report.Failed, path)
+					continue
+				}
+				report.Linked += 1
+				report.ReclaimedBytes += size
+			}
+		}
+	}
+
+	sort.Slice(report.Duplicates, func(i, j int) bool { return report.Duplicates[i][0] < report.Duplicates[j][0] })
+	log.Printf("DeduplicateMediaFiles %s: %d sets, %d wasted bytes, %d linked, %d reclaimed bytes\n",
+		userName, report.DuplicateSets, report.WastedBytes, report.Linked, report.ReclaimedBytes)
+	reportStr, _ := json.Marshal(report)
+	return string(reportStr)
+}
+
+// replaceWithHardLink 先在同目录创建硬链接再替换，失败时原文件保持不变
+func replaceWithHardLink(target, path string) error {
+	tmpPath := path + ".dedupe"
+	os.Remove(tmpPath)
+	if err := os.Link(target, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// 缺失的媒体文件，ExpectedPath为buildCorrectMediaPath解析出的路径
+type MissingMediaItem struct {
+	MsgSvrId     string `json:"msgSvrId"`
+	CreateTime   int64  `json:"createTime"`
+	Type         string `json:"type"`
+	ExpectedPath string `json:"expectedPath"`
+}
+
+type MissingMediaReport struct {
+	UserName      string             `json:"userName"`
+	TotalMessages int                `json:"totalMessages"`
+	MissingCount  int                `json:"missingCount"`
+	MissingItems  []MissingMediaItem `json:"missingItems"`
+	ReportPath    string             `json:"reportPath"`
+}
+
+// DetectMissingMediaFiles 检查会话中图片、视频、语音和文件消息对应的媒体文件是否存在，
+// 有缺失时同时保存到导出目录下的missing_media_<userName>.json
+func (a *App) DetectMissingMediaFiles(userName string) string {
+	log.Println("DetectMissingMediaFiles:", userName)
+	emptyFields := map[string]interface{}{"totalMessages": 0, "missingCount": 0, "missingItems": []interface{}{}}
+	if userName == "" {
+		return apierr.JSONWith(apierr.New(apierr.CodeInvalidParam, "empty userName"), emptyFields)
+	}
+	if a.provider == nil {
+		return apierr.JSONWith(apierr.ErrProviderNotInit, emptyFields)
+	}
+
+	report := MissingMediaReport{UserName: userName, MissingItems: make([]MissingMediaItem, 0)}
+	endTime := time.Now().Unix()
+	pageSize := 1000
+	for pageIndex := 0; ; pageIndex++ {
+		list, err := a.provider.WeChatGetMessageListByDateRange(userName, 0, endTime, pageIndex, pageSize)
+		if err != nil {
+			log.Println("WeChatGetMessageListByDateRange failed:", err)
+			return apierr.JSONWith(apierr.Wrap(apierr.CodeDBFailure, err), emptyFields)
+		}
+
+		for i := range list.Rows {
+			msg := &list.Rows[i]
+			mediaType, path := "", ""
+			switch {
+			case msg.Type == wechat.Wechat_Message_Type_Picture:
+				mediaType, path = "image", a.buildCorrectMediaPath(msg.ImagePath, "Image")
+			case msg.Type == wechat.Wechat_Message_Type_Video:
+				mediaType, path = "video", a.buildCorrectMediaPath(msg.VideoPath, "Video")
+			case msg.Type == wechat.Wechat_Message_Type_Voice:
+				mediaType, path = "voice", a.buildCorrectMediaPath(msg.VoicePath, "Voice")
+			case msg.Type == wechat.Wechat_Message_Type_Misc && msg.SubType == wechat.Wechat_Misc_Message_File:
+				mediaType, path = "file", a.buildCorrectMediaPath(msg.FileInfo.FilePath, "File")
+			default:
+				continue
+			}
+
+			report.TotalMessages += 1
+			if path != "" {
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+			}
+			report.MissingItems = append(report.MissingItems, MissingMediaItem{
+				MsgSvrId:     msg.MsgSvrId,
+				CreateTime:   msg.CreateTime,
+				Type:         mediaType,
+				ExpectedPath: path,
+			})
+		}
+
+		if list.Total < pageSize {
+			break
+		}
+	}
+	report.MissingCount = len(report.MissingItems)
+
+	if report.MissingCount > 0 {
+		reportPath := filepath.Join(a.FLoader.FilePrefix, "User", a.defaultUser, "missing_media_"+userName+".json")
+		if data, err := json.MarshalIndent(report, "", "  "); err == nil {
+			if err := os.WriteFile(reportPath, data, os.ModePerm); err != nil {
+				log.Println("WriteFile:", reportPath, err)
+			} else {
+				report.ReportPath = reportPath
+			}
+		}
+	}
+
+	log.Printf("DetectMissingMediaFiles %s: %d media messages, %d missing\n", userName, report.TotalMessages, report.MissingCount)
+	reportStr, _ := json.Marshal(report)
+	return string(reportStr)
+}
+
 // 检查文件是否存在
 func (a *App) fileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
@@ -1960,38 +8074,18 @@ func (a *App) fileExists(filePath string) bool {
 	return exists
 }
 
-// 备份媒体文件到指定目录，保持原有目录结构
-func (a *App) backupMediaFile(sourcePath, userBackupPath, mediaType string, startTime int64) string {
-	if sourcePath == "" || !a.fileExists(sourcePath) {
-		return ""
-	}
-	
-	// 检查文件修改时间是否在指定时间之后
-	if fileInfo, err := os.Stat(sourcePath); err == nil {
-		fileModTime := fileInfo.ModTime().Unix()
-		startTimeObj := time.Unix(startTime, 0)
-		fileModTimeObj := time.Unix(fileModTime, 0)
-		
-		// 如果文件修改时间早于开始时间，跳过备份
-		if fileModTimeObj.Before(startTimeObj) {
-			log.Printf("文件修改时间早于开始时间，跳过备份: %s (修改时间: %s, 开始时间: %s)", 
-				sourcePath, fileModTimeObj.Format("2006-01-02 15:04:05"), startTimeObj.Format("2006-01-02 15:04:05"))
-			return ""
-		}
-		
-		log.Printf("文件符合时间条件，准备备份: %s (修改时间: %s)", 
-			sourcePath, fileModTimeObj.Format("2006-01-02 15:04:05"))
-	} else {
-		log.Printf("无法获取文件信息: %s, %v", sourcePath, err)
+// 备份媒体文件到指定目录，保持原有目录结构；消息是新的但引用的文件可能较早，不按修改时间跳过
+func (a *App) backupMediaFile(accountName, sourcePath, userBackupPath, mediaType string) string {
+	// 配置为不包含媒体文件时userBackupPath为空
+	if userBackupPath == "" || sourcePath == "" || !a.fileExists(sourcePath) {
 		return ""
 	}
 	
-	// 获取源文件的相对路径（相对于User目录）
-	userDataDir := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser
+	// 获取源文件的相对路径（相对于User目录），不在账号目录下时按媒体类型保存
+	userDataDir := a.FLoader.FilePrefix + "\\User\\" + accountName
 	relPath, err := filepath.Rel(userDataDir, sourcePath)
-	if err != nil {
-		log.Printf("Error calculating relative path for %s: %v", sourcePath, err)
-		return ""
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		relPath = filepath.Join(mediaType, filepath.Base(sourcePath))
 	}
 	
 	// 构建备份目标路径
@@ -2020,6 +8114,47 @@ func (a *App) backupMediaFile(sourcePath, userBackupPath, mediaType string, star
 	return backupFilePath
 }
 
+// mediaText 消息文本中引用的媒体路径：包含媒体文件时为复制后相对savePath的路径，复制失败时为失败标记；
+// 不包含媒体文件时为源文件路径
+func (a *App) mediaText(accountName, sourcePath, savePath, userBackupPath, mediaType string) string {
+	if userBackupPath == "" {
+		return sourcePath
+	}
+	backupPath := a.backupMediaFile(accountName, sourcePath, userBackupPath, mediaType)
+	if backupPath == "" {
+		return "复制失败"
+	}
+	return mediaRefPath(savePath, backupPath)
+}
+
+// mediaRefPath 复制到savePath下的媒体文件在消息文本中使用相对savePath的路径，使保存目录可以整体移动
+func mediaRefPath(savePath, path string) string {
+	if path == "" || savePath == "" {
+		return path
+	}
+	rel, err := filepath.Rel(savePath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+// countMediaFiles 统计dir中的文件数和字节数，dir不存在时返回0
+func countMediaFiles(dir string) (int, int64) {
+	count, bytes := 0, int64(0)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			count++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return count, bytes
+}
+
 // 备份FileStorage目录中指定时间之后的新数据
 func (a *App) backupFileStorageNewData(expPath, userBackupPath string, startTime int64) int {
 	fileStoragePath := expPath + "\\FileStorage"
@@ -2146,133 +8281,6 @@ func (a *App) backupFileStorageNewData(expPath, userBackupPath string, startTime
 	return backupCount
 }
 
-// 扫描JSON文件，收集所有出现过的文件路径
-func (a *App) scanJSONFilesForReferencedPaths(savePath string) map[string]bool {
-	referencedFiles := make(map[string]bool)
-	
-	// 扫描save目录下的所有JSON文件
-	err := filepath.Walk(savePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		
-		// 只处理JSON文件
-		if !strings.HasSuffix(strings.ToLower(path), ".json") {
-			return nil
-		}
-		
-		// 读取JSON文件内容
-		content, err := os.ReadFile(path)
-		if err != nil {
-			log.Printf("读取JSON文件失败: %s, %v", path, err)
-			return nil
-		}
-		
-		// 解析JSON内容，提取文件路径
-		var messages []map[string]interface{}
-		if err := json.Unmarshal(content, &messages); err != nil {
-			log.Printf("解析JSON文件失败: %s, %v", path, err)
-			return nil
-		}
-		
-		// 遍历消息，提取文件路径
-		for _, msg := range messages {
-			if text, ok := msg["text"].(string); ok {
-				// 查找文件路径模式
-				filePaths := a.extractFilePathsFromText(text)
-				for _, filePath := range filePaths {
-					referencedFiles[filePath] = true
-				}
-			}
-		}
-		
-		return nil
-	})
-	
-	if err != nil {
-		log.Printf("扫描JSON文件时出错: %v", err)
-	}
-	
-	return referencedFiles
-}
-
-// 从文本中提取文件路径
-func (a *App) extractFilePathsFromText(text string) []string {
-	var filePaths []string
-	
-	// 匹配模式：save\路径 或 [图片] 路径 或 [视频] 路径 等
-	patterns := []string{
-		`save\\([^\\s\\]]+)`,           // save\路径
-		`\\[图片\\]\\s+([^\\s\\]]+)`,    // [图片] 路径
-		`\\[视频\\]\\s+([^\\s\\]]+)`,    // [视频] 路径
-		`\\[语音\\]\\s+([^\\s\\]]+)`,    // [语音] 路径
-		`\\[文件\\]\\s+([^\\s\\]]+)`,    // [文件] 路径
-		`\\[链接卡片\\]\\s+([^\\s\\]]+)`, // [链接卡片] 路径
-		`\\[小程序\\]\\s+([^\\s\\]]+)`,  // [小程序] 路径
-		`\\[视频号\\]\\s+([^\\s\\]]+)`,  // [视频号] 路径
-	}
-	
-	for _, pattern := range patterns {
-		re := regexp.MustCompile(pattern)
-		matches := re.FindAllStringSubmatch(text, -1)
-		for _, match := range matches {
-			if len(match) > 1 {
-				filePath := match[1]
-				// 清理路径，移除可能的引号等
-				filePath = strings.Trim(filePath, `"'`)
-				if filePath != "" {
-					filePaths = append(filePaths, filePath)
-				}
-			}
-		}
-	}
-	
-	return filePaths
-}
-
-// 备份JSON文件中引用的文件
-func (a *App) backupReferencedFiles(expPath, userBackupPath string, referencedFiles map[string]bool) int {
-	backupCount := 0
-	
-	for filePath := range referencedFiles {
-		// 构建完整的源文件路径
-		sourcePath := expPath + "\\" + filePath
-		
-		// 检查源文件是否存在
-		if _, err := os.Stat(sourcePath); err != nil {
-			log.Printf("引用文件不存在: %s", sourcePath)
-			continue
-		}
-		
-		// 构建备份目标路径
-		backupFilePath := filepath.Join(userBackupPath, filePath)
-		backupDir := filepath.Dir(backupFilePath)
-		
-		// 创建备份目录
-		if err := os.MkdirAll(backupDir, os.ModePerm); err != nil {
-			log.Printf("创建备份目录失败: %s, %v", backupDir, err)
-			continue
-		}
-		
-		// 检查文件是否已经备份过
-		if _, err := os.Stat(backupFilePath); err == nil {
-			log.Printf("文件已备份，跳过: %s", backupFilePath)
-			continue
-		}
-		
-		// 复制文件
-		if _, err := utils.CopyFile(sourcePath, backupFilePath); err != nil {
-			log.Printf("备份文件失败: %s -> %s, %v", sourcePath, backupFilePath, err)
-			continue
-		}
-		
-		backupCount++
-		log.Printf("成功备份引用文件: %s -> %s", sourcePath, backupFilePath)
-	}
-	
-	return backupCount
-}
-
 // 统计备份目录中的文件数量
 func (a *App) countBackupFiles(backupPath string) int {
 	count := 0
@@ -2427,14 +8435,18 @@ func (a *App) TestNewMessageExport(accountName string) string {
 	}
 	
 	// 执行新消息导出
-	result := a.exportNewMessages(accountName, expPath)
+	config, err := a.loadNewMessageExportConfig(accountName)
+	if err != nil {
+		return apierr.JSON(apierr.Wrap(apierr.CodeInvalidParam, err))
+	}
+	result := a.exportNewMessages(accountName, expPath, config, time.Now().Unix())
 	if result != nil {
 		resultJson, _ := json.Marshal(result)
 		log.Println("测试结果:", string(resultJson))
 		return string(resultJson)
 	} else {
 		log.Println("测试失败，返回nil")
-		return "{\"error\": \"测试失败，返回nil\"}"
+		return apierr.JSON(apierr.New(apierr.CodeInternal, "测试失败，返回nil"))
 	}
 }
 
@@ -2452,7 +8464,7 @@ func (a *App) TestMediaFileBackup(accountName string) string {
 	// 创建备份目录
 	if err := os.MkdirAll(userBackupPath, os.ModePerm); err != nil {
 		log.Printf("Error creating test backup directory: %v", err)
-		return fmt.Sprintf("{\"error\": \"创建测试备份目录失败: %v\"}", err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "创建测试备份目录失败"))
 	}
 	
 	// 测试备份功能
@@ -2466,7 +8478,7 @@ func (a *App) TestMediaFileBackup(accountName string) string {
 	backupResults := make(map[string]string)
 	for _, testFile := range testFiles {
 		sourcePath := expPath + "\\" + testFile
-		backupPath := a.backupMediaFile(sourcePath, userBackupPath, "Test", a.NewMessageStartTime)
+		backupPath := a.backupMediaFile(a.defaultUser, sourcePath, userBackupPath, "Test")
 		backupResults[testFile] = backupPath
 		log.Printf("测试备份 %s: %s", testFile, backupPath)
 	}
@@ -2582,7 +8594,7 @@ func (a *App) TestActualImageMessage(accountName string) string {
 	userBackupPath := ".\\save\\test\\User\\" + accountName
 	os.MkdirAll(userBackupPath, os.ModePerm)
 	
-	text := a.processMessageContentWithBackup(msg, savePath, userBackupPath)
+	text := a.processMessageContentWithBackup(a.defaultUser, msg, savePath, userBackupPath)
 	
 	result := map[string]interface{}{
 		"accountName":     accountName,
@@ -2614,7 +8626,7 @@ func (a *App) TestFileStorageNewDataBackup(accountName string) string {
 	// 创建备份目录
 	if err := os.MkdirAll(userBackupPath, os.ModePerm); err != nil {
 		log.Printf("Error creating test backup directory: %v", err)
-		return fmt.Sprintf("{\"error\": \"创建测试备份目录失败: %v\"}", err)
+		return apierr.JSON(apierr.Wrapf(apierr.CodeIOFailure, err, "创建测试备份目录失败"))
 	}
 	
 	// 使用配置的新消息开始时间
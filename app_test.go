@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wechatDataBackup/pkg/apierr"
+	"wechatDataBackup/pkg/wechat"
+)
+
+// recordEvents 替换eventsEmit，返回按顺序记录的事件名
+func recordEvents(t testing.TB) *[]string {
+	t.Helper()
+	events := make([]string, 0)
+	old := eventsEmit
+	eventsEmit = func(ctx context.Context, eventName string, optionalData ...interface{}) {
+		events = append(events, eventName)
+	}
+	t.Cleanup(func() { eventsEmit = old })
+	return &events
+}
+
+func countEvents(events []string, name string) int {
+	count := 0
+	for _, event := range events {
+		if event == name {
+			count++
+		}
+	}
+	return count
+}
+
+// newTestExportDir 在prefix\User\userName下创建只有联系人表的最小导出目录
+func newTestExportDir(t *testing.T, prefix, userName string) string {
+	t.Helper()
+	expPath := filepath.Join(prefix, "User", userName)
+	if err := os.MkdirAll(filepath.Join(expPath, "Msg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(expPath, "Msg", wechat.MicroMsgDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE Contact (UserName TEXT, Alias TEXT, ReMark TEXT, NickName TEXT, Reserved1 INT, Reserved2 INT, PYInitial TEXT, QuanPin TEXT, RemarkPYInitial TEXT, RemarkQuanPin TEXT);",
+		"CREATE TABLE ContactHeadImgUrl (usrName TEXT, smallHeadImgUrl TEXT, bigHeadImgUrl TEXT);",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO Contact VALUES (?, '', '', ?, 1, 1, '', '', '', '');", userName, "nick-"+userName); err != nil {
+		t.Fatal(err)
+	}
+	return expPath
+}
+
+func TestWeChatInitEmitsSelfInfoOnce(t *testing.T) {
+	prefix := t.TempDir()
+	newTestExportDir(t, prefix, "wxid_a")
+	newTestExportDir(t, prefix, "wxid_b")
+	events := recordEvents(t)
+
+	a := &App{ctx: context.Background(), FLoader: NewFileLoader(prefix), defaultUser: "wxid_a"}
+	t.Cleanup(func() {
+		if a.provider != nil {
+			a.provider.WechatWechatDataProviderClose()
+		}
+	})
+
+	a.WeChatInit()
+	a.WeChatInit()
+	if a.provider == nil {
+		t.Fatal("provider not created")
+	}
+	if got := countEvents(*events, "selfInfo"); got != 1 {
+		t.Errorf("selfInfo emitted %d times after two WeChatInit calls, want 1", got)
+	}
+
+	// 切换账号后重新打开并发送一次
+	a.defaultUser = "wxid_b"
+	a.WeChatInit()
+	if got := countEvents(*events, "selfInfo"); got != 2 {
+		t.Errorf("selfInfo emitted %d times after switching user, want 2", got)
+	}
+	if a.provider == nil || a.provider.SelfInfo.UserName != "wxid_b" {
+		t.Errorf("provider not switched to wxid_b")
+	}
+}
+
+// fakeMessagePages 按WeChatGetMessageListByTime的Backward方向返回msgs中时间大于cursor的消息
+func fakeMessagePages(msgs []wechat.WeChatMessage) func(cursor int64) (*wechat.WeChatMessageList, error) {
+	sorted := append([]wechat.WeChatMessage(nil), msgs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreateTime < sorted[j].CreateTime })
+	return func(cursor int64) (*wechat.WeChatMessageList, error) {
+		page := &wechat.WeChatMessageList{Rows: make([]wechat.WeChatMessage, 0)}
+		for _, msg := range sorted {
+			if msg.CreateTime > cursor && len(page.Rows) < newMessagePageSize {
+				page.Rows = append(page.Rows, msg)
+			}
+		}
+		for i, j := 0, len(page.Rows)-1; i < j; i, j = i+1, j-1 {
+			page.Rows[i], page.Rows[j] = page.Rows[j], page.Rows[i]
+		}
+		page.Total = len(page.Rows)
+		return page, nil
+	}
+}
+
+func testMessages(count int, perSecond int, startTime int64) []wechat.WeChatMessage {
+	msgs := make([]wechat.WeChatMessage, 0, count)
+	for i := 0; i < count; i++ {
+		msgs = append(msgs, wechat.WeChatMessage{
+			LocalId:    i + 1,
+			MsgSvrId:   fmt.Sprintf("%d", 100000+i),
+			CreateTime: startTime + int64(i/perSecond),
+		})
+	}
+	return msgs
+}
+
+func TestNewMessagesSince(t *testing.T) {
+	startTime := int64(1700000000)
+	// 同一秒有多条消息，分页边界会落在同一秒内
+	msgs := testMessages(2500, 3, startTime+1)
+	old := testMessages(10, 1, startTime-20)
+	for i := range old {
+		old[i].LocalId += 10000
+	}
+
+	rows, truncated, err := newMessagesSince("wxid_a", startTime, fakeMessagePages(append(old, msgs...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Error("truncated = true, want false")
+	}
+	if len(rows) != len(msgs) {
+		t.Fatalf("got %d messages, want %d", len(rows), len(msgs))
+	}
+	seen := make(map[int]bool)
+	for _, msg := range rows {
+		if msg.CreateTime <= startTime {
+			t.Errorf("message %d at %d is not after %d", msg.LocalId, msg.CreateTime, startTime)
+		}
+		if seen[msg.LocalId] {
+			t.Errorf("message %d returned twice", msg.LocalId)
+		}
+		seen[msg.LocalId] = true
+	}
+}
+
+func TestNewMessagesSinceSameSecondOverflow(t *testing.T) {
+	startTime := int64(1700000000)
+	// 同一秒的消息超过一页时无法继续分页
+	msgs := testMessages(newMessagePageSize+500, newMessagePageSize+500, startTime+1)
+
+	rows, truncated, err := newMessagesSince("wxid_a", startTime, fakeMessagePages(msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("truncated = false, want true")
+	}
+	if len(rows) != newMessagePageSize {
+		t.Errorf("got %d messages, want %d", len(rows), newMessagePageSize)
+	}
+}
+
+func TestNewMessagesSinceFetchError(t *testing.T) {
+	startTime := int64(1700000000)
+	fetchErr := errors.New("db closed")
+
+	_, _, err := newMessagesSince("wxid_a", startTime, func(cursor int64) (*wechat.WeChatMessageList, error) {
+		return nil, fetchErr
+	})
+	if !errors.Is(err, fetchErr) {
+		t.Errorf("first page error = %v, want %v", err, fetchErr)
+	}
+
+	// 第一页之后失败时返回已读取的消息
+	pages := fakeMessagePages(testMessages(2500, 1, startTime+1))
+	calls := 0
+	rows, truncated, err := newMessagesSince("wxid_a", startTime, func(cursor int64) (*wechat.WeChatMessageList, error) {
+		calls++
+		if calls > 1 {
+			return nil, fetchErr
+		}
+		return pages(cursor)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(rows) != newMessagePageSize {
+		t.Errorf("got %d messages, truncated %v; want %d, true", len(rows), truncated, newMessagePageSize)
+	}
+}
+
+// writeTestBackupVersion 在backupRoot下创建使用内容寻址存储的备份版本，files为备份路径到内容的映射
+func writeTestBackupVersion(t *testing.T, backupRoot, version string, files map[string]string) {
+	t.Helper()
+	manifest := BackupManifest{CreateTime: 1, BlobStore: backupBlobDir, Files: make([]BackupManifestEntry, 0)}
+	for path, content := range files {
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		blobPath := backupBlobPath(filepath.Join(backupRoot, backupBlobDir), hash)
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blobPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Files = append(manifest.Files, BackupManifestEntry{BackupPath: path, FileSize: int64(len(content)), FileHash: hash})
+	}
+	versionPath := filepath.Join(backupRoot, version)
+	if err := os.MkdirAll(filepath.Join(versionPath, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(versionPath, "logs", "backup.log"), []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(versionPath, backupManifestName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestBackupApp(t *testing.T, backupPath string) *App {
+	t.Helper()
+	prefix := t.TempDir()
+	data, _ := json.Marshal(IncrementalBackupConfig{BackupPath: backupPath})
+	if err := os.WriteFile(filepath.Join(prefix, "incremental_backup_config.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &App{ctx: context.Background(), FLoader: NewFileLoader(prefix)}
+}
+
+func TestDeleteBackupVersionRetryAfterPartialDelete(t *testing.T) {
+	backupPath := t.TempDir()
+	backupRoot := filepath.Join(backupPath, "wxid_a")
+	writeTestBackupVersion(t, backupRoot, "1700000000", map[string]string{"Msg/MicroMsg.db": "old", "Msg/Multi/MSG0.db": "shared"})
+	writeTestBackupVersion(t, backupRoot, "1700000100", map[string]string{"Msg/Multi/MSG0.db": "shared"})
+	events := recordEvents(t)
+	a := newTestBackupApp(t, backupPath)
+
+	// 上次删除在清单之前的文件删除后中断，只剩清单
+	if err := os.RemoveAll(filepath.Join(backupRoot, "1700000000", "logs")); err != nil {
+		t.Fatal(err)
+	}
+
+	var result DeleteBackupVersionResult
+	if err := json.Unmarshal([]byte(a.DeleteBackupVersion("wxid_a", "1700000000", false)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(backupRoot, "1700000000")); !os.IsNotExist(err) {
+		t.Errorf("version still exists after retry: %v", err)
+	}
+	if result.BlobsRemoved != 1 {
+		t.Errorf("BlobsRemoved = %d, want 1", result.BlobsRemoved)
+	}
+	oldHash := fmt.Sprintf("%x", sha256.Sum256([]byte("old")))
+	if _, err := os.Stat(backupBlobPath(filepath.Join(backupRoot, backupBlobDir), oldHash)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced blob not removed: %v", err)
+	}
+	sharedHash := fmt.Sprintf("%x", sha256.Sum256([]byte("shared")))
+	if _, err := os.Stat(backupBlobPath(filepath.Join(backupRoot, backupBlobDir), sharedHash)); err != nil {
+		t.Errorf("blob still referenced by 1700000100 removed: %v", err)
+	}
+	if got := countEvents(*events, "backupVersionDeleted"); got != 1 {
+		t.Errorf("backupVersionDeleted emitted %d times, want 1", got)
+	}
+
+	// 只剩一个版本时需要force
+	if err := apiErrorOf(a.DeleteBackupVersion("wxid_a", "1700000100", false)); err == nil {
+		t.Error("deleting the only version without force succeeded")
+	}
+	if err := apiErrorOf(a.DeleteBackupVersion("wxid_a", "1700000100", true)); err != nil {
+		t.Errorf("force delete failed: %v", err)
+	}
+}
+
+// apiErrorOf 返回App方法返回的apierr JSON中的错误，不是错误时返回nil
+func apiErrorOf(result string) error {
+	var e apierr.Error
+	if json.Unmarshal([]byte(result), &e) == nil && e.Code != "" {
+		return &e
+	}
+	return nil
+}
+
+// writeTestExportFiles 在导出目录下写入文件，files为相对导出目录的路径到内容的映射
+func writeTestExportFiles(t testing.TB, expPath string, modTime time.Time, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		full := filepath.Join(expPath, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(full, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runTestBackup 按导出后的流程扫描导出目录并备份
+func runTestBackup(a *App, expPath, backupPath string) *IncrementalBackupResult {
+	config := IncrementalBackupConfig{BackupPath: backupPath}
+	return a.backupNewData(expPath, a.scanExistingFiles(expPath, backupPath, config), config)
+}
+
+// backedUpFiles 返回备份结果中本次备份的文件相对导出目录的路径
+func backedUpFiles(t *testing.T, expPath string, result *IncrementalBackupResult) []string {
+	t.Helper()
+	files := make([]string, 0)
+	for _, record := range result.NewDataRecords {
+		if record.BackupPath == "" {
+			continue
+		}
+		rel, err := filepath.Rel(expPath, record.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestBackupChangedMsgDB(t *testing.T) {
+	backupPath := t.TempDir()
+	a := newTestBackupApp(t, backupPath)
+	a.defaultUser = "wxid_a"
+	expPath := filepath.Join(t.TempDir(), "wxid_a")
+	start := time.Unix(1700000000, 0)
+	writeTestExportFiles(t, expPath, start, map[string]string{
+		"Msg/MicroMsg.db":        "contacts v1",
+		"Msg/Multi/MSG0.db":      "messages v1",
+		"FileStorage/File/a.txt": "file",
+	})
+
+	first := runTestBackup(a, expPath, backupPath)
+	if first.Error != "" || first.BackupFiles != 3 {
+		t.Fatalf("first backup: %d files, error %q; want 3 files", first.BackupFiles, first.Error)
+	}
+
+	// 导出重新生成Msg目录，MicroMsg.db内容变化，MSG0.db内容不变只有修改时间变化
+	writeTestExportFiles(t, expPath, start.Add(time.Hour), map[string]string{
+		"Msg/MicroMsg.db":   "contacts v2",
+		"Msg/Multi/MSG0.db": "messages v1",
+	})
+
+	second := runTestBackup(a, expPath, backupPath)
+	if second.Error != "" {
+		t.Fatal(second.Error)
+	}
+	if got := backedUpFiles(t, expPath, second); len(got) != 1 || got[0] != "Msg/MicroMsg.db" {
+		t.Errorf("second backup files = %v, want [Msg/MicroMsg.db]", got)
+	}
+	if second.ModifiedFiles != 1 || second.NewFiles != 0 {
+		t.Errorf("second backup: %d modified, %d new; want 1, 0", second.ModifiedFiles, second.NewFiles)
+	}
+	data, err := os.ReadFile(filepath.Join(second.BackupPath, "Msg", "MicroMsg.db"))
+	if err != nil || string(data) != "contacts v2" {
+		t.Errorf("backed up MicroMsg.db = %q, %v; want %q", data, err, "contacts v2")
+	}
+}
+
+func TestBackupSkipsUnchangedFiles(t *testing.T) {
+	backupPath := t.TempDir()
+	a := newTestBackupApp(t, backupPath)
+	a.defaultUser = "wxid_a"
+	expPath := filepath.Join(t.TempDir(), "wxid_a")
+	writeTestExportFiles(t, expPath, time.Unix(1700000000, 0), map[string]string{
+		"Msg/MicroMsg.db":        "contacts",
+		"FileStorage/File/a.txt": "file",
+	})
+
+	if first := runTestBackup(a, expPath, backupPath); first.BackupFiles != 2 {
+		t.Fatalf("first backup: %d files, want 2", first.BackupFiles)
+	}
+
+	// 备份记录从磁盘重新加载后，未变化的文件不再备份
+	second := runTestBackup(a, expPath, backupPath)
+	if second.Error != "" {
+		t.Fatal(second.Error)
+	}
+	if second.TotalFiles != 2 || second.BackupFiles != 0 {
+		t.Errorf("second backup: %d scanned, %d backed up; want 2, 0", second.TotalFiles, second.BackupFiles)
+	}
+	if got := backedUpFiles(t, expPath, second); len(got) != 0 {
+		t.Errorf("second backup files = %v, want none", got)
+	}
+}
+
+// BenchmarkScanBackupFiles 比较全部计算哈希和沿用备份记录中哈希的扫描耗时
+// BenchmarkHashBackupRecords 比较单个worker和NumCPU个worker计算同一批文件哈希的耗时
+func BenchmarkHashBackupRecords(b *testing.B) {
+	recordEvents(b)
+	expPath := b.TempDir()
+	data := make([]byte, 256*1024)
+	files := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		data[0] = byte(i)
+		files[fmt.Sprintf("Msg/Multi/MSG%d.db", i)] = string(data)
+		files[fmt.Sprintf("FileStorage/File/%d.dat", i)] = string(data)
+	}
+	writeTestExportFiles(b, expPath, time.Unix(1700000000, 0), files)
+
+	records := make([]NewDataRecord, 0, len(files))
+	pending := make([]int, 0, len(files))
+	for name := range files {
+		pending = append(pending, len(records))
+		records = append(records, NewDataRecord{FilePath: filepath.Join(expPath, name)})
+	}
+
+	for _, workers := range []int{1, goruntime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			a := &App{ctx: context.Background()}
+			b.SetBytes(int64(len(files) * len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.hashBackupRecords(records, pending, &backupScanState{root: expPath}, workers)
+			}
+		})
+	}
+}
+
+func TestEmitExportEventRoundTrip(t *testing.T) {
+	payloads := make([]string, 0)
+	old := eventsEmit
+	eventsEmit = func(ctx context.Context, eventName string, optionalData ...interface{}) {
+		if eventName == "exportData" && len(optionalData) == 1 {
+			payloads = append(payloads, optionalData[0].(string))
+		}
+	}
+	t.Cleanup(func() { eventsEmit = old })
+
+	a := &App{ctx: context.Background()}
+	names := []string{`wxid_"quoted"`, `C:\User\wxid_a`, "wxid_\n\t</script>", "微信号\u2028", `{"status":"finish"}`}
+	events := make([]ExportEvent, 0, len(names))
+	for _, name := range names {
+		event := ExportEvent{
+			Account:   name,
+			Status:    wechat.Export_Status_Error,
+			Stage:     Export_Stage_NewMessage,
+			Result:    name + " error",
+			Progress:  42,
+			ErrorCode: Export_ErrorCode_NoSpace,
+		}
+		events = append(events, event)
+		a.emitExportEvent(event)
+	}
+
+	if len(payloads) != len(events) {
+		t.Fatalf("got %d exportData events, want %d", len(payloads), len(events))
+	}
+	for i, payload := range payloads {
+		var got ExportEvent
+		if err := json.Unmarshal([]byte(payload), &got); err != nil {
+			t.Errorf("event for %q is not valid JSON: %v: %s", names[i], err, payload)
+			continue
+		}
+		if got != events[i] {
+			t.Errorf("round trip of %q = %+v, want %+v", names[i], got, events[i])
+		}
+	}
+}
+
+func TestSetAppConfigUnknownUserLeavesExportPath(t *testing.T) {
+	oldPrefix, newPrefix := t.TempDir(), t.TempDir()
+	newTestExportDir(t, oldPrefix, "wxid_a")
+	newTestExportDir(t, newPrefix, "wxid_b")
+	a := &App{ctx: context.Background(), FLoader: NewFileLoader(oldPrefix), users: []string{"wxid_a"}, defaultUser: "wxid_a"}
+
+	config, _ := json.Marshal(map[string]string{"exportPath": newPrefix, "defaultUser": "wxid_a"})
+	err := apiErrorOf(a.SetAppConfig(string(config)))
+	if !errors.Is(err, apierr.ErrNotFound) {
+		t.Fatalf("SetAppConfig error = %v, want NOT_FOUND", err)
+	}
+	if a.FLoader.FilePrefix != oldPrefix || a.defaultUser != "wxid_a" {
+		t.Errorf("config applied after failed validation: exportPath %s, defaultUser %s", a.FLoader.FilePrefix, a.defaultUser)
+	}
+}
+
+func TestBuildExportManifestDoesNotBlockClose(t *testing.T) {
+	events := recordEvents(t)
+	a := &App{}
+	expPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(expPath, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a.buildExportManifest(expPath)
+	if n := atomic.LoadInt32(&a.exporting); n != 0 {
+		t.Errorf("exporting = %d during manifest building, want 0", n)
+	}
+	if a.beforeClose(context.Background()) {
+		t.Error("manifest building blocked window close")
+	}
+	a.manifestWG.Wait()
+	if got := countEvents(*events, "manifestBuilding"); got != 2 {
+		t.Errorf("manifestBuilding events = %d, want 2", got)
+	}
+}
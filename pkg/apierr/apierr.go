@@ -0,0 +1,91 @@
+package apierr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type Code string
+
+const (
+	CodeProviderNotInit Code = "PROVIDER_NOT_INIT"
+	CodeInvalidParam    Code = "INVALID_PARAM"
+	CodeIOFailure       Code = "IO_FAILURE"
+	CodeDBFailure       Code = "DB_FAILURE"
+	CodeNotFound        Code = "NOT_FOUND"
+	CodeInternal        Code = "INTERNAL"
+)
+
+// Error 带错误码的错误，前端根据error_code区分错误类型
+type Error struct {
+	Code    Code   `json:"error_code"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+var (
+	ErrProviderNotInit = &Error{Code: CodeProviderNotInit, Message: "provider not init"}
+	ErrInvalidParam    = &Error{Code: CodeInvalidParam, Message: "invalid param"}
+	ErrIOFailure       = &Error{Code: CodeIOFailure, Message: "io failure"}
+	ErrDBFailure       = &Error{Code: CodeDBFailure, Message: "database failure"}
+	ErrNotFound        = &Error{Code: CodeNotFound, Message: "not found"}
+	ErrInternal        = &Error{Code: CodeInternal, Message: "internal error"}
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is 错误码相同即认为是同一类错误，可以用errors.Is(err, apierr.ErrIOFailure)判断
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func New(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Wrap 为err附加错误码，err已经带错误码时保持原错误码，err为nil时只带错误码
+func Wrap(code Code, err error) *Error {
+	if err == nil {
+		return New(code, "%s", code)
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: code, Message: err.Error(), Err: err}
+}
+
+// Wrapf 为err附加错误码，并在错误信息前加上说明，err为nil时只使用说明
+func Wrapf(code Code, err error, format string, a ...interface{}) *Error {
+	if err == nil {
+		return New(code, format, a...)
+	}
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...) + ":" + err.Error(), Err: err}
+}
+
+// JSON 序列化为{"error_code":"...","message":"..."}，没有错误码的错误按INTERNAL处理
+func JSON(err error) string {
+	return JSONWith(err, nil)
+}
+
+// JSONWith 在错误信息之外附加fields，用于保留列表接口原有的空结果字段，如Total、Rows
+func JSONWith(err error, fields map[string]interface{}) string {
+	e := Wrap(CodeInternal, err)
+	obj := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj["error_code"] = e.Code
+	obj["message"] = e.Message
+
+	objStr, _ := json.Marshal(obj)
+	return string(objStr)
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 文件加密格式：文件头为magic和4字节随机nonce前缀，之后按1MB分块，
+// 每块为 标记(1) | 密文长度(4) | AES-256-GCM密文，nonce为前缀加8字节块序号，
+// 附加数据为块序号和标记，最后一块的标记为1，用于发现被截断的文件
+const (
+	encryptMagic     = "WDBENC01"
+	encryptChunkSize = 1 << 20
+	encryptKeyCheck  = "wechatDataBackup key check"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrEncryptedFile   = errors.New("invalid or truncated encrypted file")
+)
+
+// EncryptionInfo 保存在备份清单中的密钥派生参数和校验值，不包含口令和密钥
+type EncryptionInfo struct {
+	Algorithm string `json:"algorithm"`
+	KDF       string `json:"kdf"`
+	Salt      string `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+	KeyCheck  string `json:"keyCheck"`
+}
+
+// NewEncryptionKey 使用随机salt从口令派生密钥
+func NewEncryptionKey(passphrase string) ([]byte, *EncryptionInfo, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+
+	info := &EncryptionInfo{
+		Algorithm: "aes-256-gcm",
+		KDF:       "scrypt",
+		Salt:      hex.EncodeToString(salt),
+		N:         scryptN,
+		R:         scryptR,
+		P:         scryptP,
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, info.N, info.R, info.P, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.KeyCheck = encryptionKeyCheck(key)
+	return key, info, nil
+}
+
+// DeriveKey 按清单中的参数派生密钥，与校验值不一致时返回ErrWrongPassphrase
+func (info *EncryptionInfo) DeriveKey(passphrase string) ([]byte, error) {
+	if info.Algorithm != "aes-256-gcm" || info.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported encryption: %s/%s", info.Algorithm, info.KDF)
+	}
+	salt, err := hex.DecodeString(info.Salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, info.N, info.R, info.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(encryptionKeyCheck(key)), []byte(info.KeyCheck)) != 1 {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func encryptionKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encryptKeyCheck))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func chunkNonceAndAAD(prefix []byte, counter uint64, flag byte) ([]byte, []byte) {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, counter)
+	aad[8] = flag
+	return nonce, aad
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptFile 使用key加密src写入dst
+func EncryptFile(src, dst string, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	w.WriteString(encryptMagic)
+	w.Write(prefix)
+
+	// 预读下一块判断当前块是否为最后一块
+	buf := make([]byte, encryptChunkSize)
+	next := make([]byte, encryptChunkSize)
+	n, err := io.ReadFull(in, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	header := make([]byte, 5)
+	for counter := uint64(0); ; counter++ {
+		last := n < encryptChunkSize
+		m := 0
+		if !last {
+			m, err = io.ReadFull(in, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last = m == 0
+		}
+
+		flag := byte(0)
+		if last {
+			flag = 1
+		}
+		nonce, aad := chunkNonceAndAAD(prefix, counter, flag)
+		sealed := gcm.Seal(nil, nonce, buf[:n], aad)
+		header[0] = flag
+		binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+		w.Write(header)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			break
+		}
+		buf, next = next, buf
+		n = m
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// DecryptFile 解密EncryptFile生成的文件，任一块校验失败或文件被截断时返回错误
+func DecryptFile(src, dst string, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+
+	head := make([]byte, len(encryptMagic)+4)
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:len(encryptMagic)]) != encryptMagic {
+		return ErrEncryptedFile
+	}
+	prefix := head[len(encryptMagic):]
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	header := make([]byte, 5)
+	sealed := make([]byte, 0, encryptChunkSize+gcm.Overhead())
+	for counter := uint64(0); ; counter++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return ErrEncryptedFile
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if header[0] > 1 || size > uint32(encryptChunkSize+gcm.Overhead()) {
+			return ErrEncryptedFile
+		}
+		sealed = sealed[:size]
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return ErrEncryptedFile
+		}
+
+		nonce, aad := chunkNonceAndAAD(prefix, counter, header[0])
+		plain, err := gcm.Open(sealed[:0], nonce, sealed, aad)
+		if err != nil {
+			return ErrEncryptedFile
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if header[0] == 1 {
+			break
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return ErrEncryptedFile
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchGlob 判断相对路径name是否匹配pattern，\和/都作为路径分隔符，不区分大小写；
+// 除path.Match的语法外，单独的**段可以匹配零个或多个目录，
+// 如 FileStorage/Video/** 匹配该目录下的所有文件，**/*.mp4 匹配任意目录下的mp4文件
+func MatchGlob(pattern, name string) bool {
+	return matchGlobSegments(splitGlobPath(pattern), splitGlobPath(name))
+}
+
+// ValidGlob 检查pattern的语法
+func ValidGlob(pattern string) bool {
+	for _, seg := range splitGlobPath(pattern) {
+		if _, err := path.Match(seg, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func splitGlobPath(p string) []string {
+	p = strings.ToLower(strings.ReplaceAll(p, "\\", "/"))
+	segs := make([]string, 0)
+	for _, seg := range strings.Split(p, "/") {
+		if seg != "" && seg != "." {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// 连续的**等同于一个
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchGlobSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
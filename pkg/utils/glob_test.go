@@ -0,0 +1,43 @@
+package utils
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"FileStorage/Video/*", "FileStorage/Video/a.mp4", true},
+		{"FileStorage/Video/*", "FileStorage\\Video\\a.mp4", true},
+		{"FileStorage\\Video\\*", "FileStorage/Video/a.mp4", true},
+		{"FileStorage/Video/*", "FileStorage/Video/2024-01/a.mp4", false},
+		{"FileStorage/Video/**", "FileStorage\\Video\\2024-01\\a.mp4", true},
+		{"FileStorage/Video/**", "FileStorage/Image/a.jpg", false},
+		{"**/*.mp4", "a.mp4", true},
+		{"**/*.mp4", "FileStorage\\Video\\2024-01\\a.mp4", true},
+		{"**/*.mp4", "FileStorage/Video/a.jpg", false},
+		{"FileStorage/**/Thumb/*", "FileStorage/MsgAttach/abc/Thumb/1.dat", true},
+		{"FileStorage/**/Thumb/*", "FileStorage/Thumb/1.dat", true},
+		{"FileStorage/**/**/*.dat", "FileStorage/1.dat", true},
+		{"filestorage/video/*.MP4", "FileStorage/Video/A.mp4", true},
+		{"./Msg/*.db", "Msg/MicroMsg.db", true},
+		{"Msg/*.db", "Msg/Multi/MSG0.db", false},
+		{"**", "", true},
+		{"*", "", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidGlob(t *testing.T) {
+	if !ValidGlob("FileStorage/**/*.mp4") {
+		t.Error("ValidGlob(FileStorage/**/*.mp4) = false, want true")
+	}
+	if ValidGlob("FileStorage/[a-/*") {
+		t.Error("ValidGlob(FileStorage/[a-/*) = true, want false")
+	}
+}
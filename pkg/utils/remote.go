@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// 远程备份目标的类型
+const (
+	Remote_Type_WebDAV = "webdav"
+	Remote_Type_S3     = "s3"
+)
+
+// RemoteConfig 远程备份目标的连接参数，WebDAV时Username/Password为登录账号，
+// S3时为AccessKey/SecretKey，Bucket和Region只用于S3
+type RemoteConfig struct {
+	Type     string
+	URL      string
+	Bucket   string
+	Region   string
+	Prefix   string
+	Username string
+	Password string
+}
+
+// RemoteTarget 远程备份目标，name为相对Prefix的路径，以/分隔
+type RemoteTarget interface {
+	// Upload 上传本地文件，失败时按remoteRetryAttempts重试
+	Upload(localPath, name string, progress func(written, total int64)) error
+	// Put 上传内存中的数据
+	Put(name string, data []byte) error
+	// Test 写入并删除一个测试文件，确认连接和写权限
+	Test() error
+	// URL 返回name的完整地址，用于日志和备份记录
+	URL(name string) string
+}
+
+func NewRemoteTarget(config RemoteConfig) (RemoteTarget, error) {
+	switch config.Type {
+	case Remote_Type_WebDAV:
+		return newWebDAVTarget(config)
+	case Remote_Type_S3:
+		return newS3Target(config)
+	default:
+		return nil, fmt.Errorf("unsupported remote type: %s", config.Type)
+	}
+}
+
+// RemoteStatusError 远程服务返回的非预期状态码
+type RemoteStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *RemoteStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// checkRemoteResponse 状态码不在ok中时返回RemoteStatusError，并关闭resp.Body
+func checkRemoteResponse(resp *http.Response, ok ...int) error {
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	return &RemoteStatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+const remoteRetryAttempts = 3
+
+// remoteRetry 网络错误、5xx和429时重试，其余状态码直接返回
+func remoteRetry(op string, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= remoteRetryAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var statusErr *RemoteStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+		log.Printf("%s attempt %d failed: %v\n", op, attempt, err)
+		if attempt < remoteRetryAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+// joinRemotePath 拼接远程路径，\转换为/，去掉开头的/
+func joinRemotePath(parts ...string) string {
+	for i := range parts {
+		parts[i] = strings.ReplaceAll(parts[i], "\\", "/")
+	}
+	return strings.TrimPrefix(path.Join(parts...), "/")
+}
+
+const remoteTestName = ".wechatDataBackup_test"
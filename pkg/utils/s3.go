@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3兼容存储，使用path-style地址 endpoint/bucket/key 和SigV4签名；
+// 超过s3PartSize的文件分段上传，每段单独重试，失败的段重传时不会重传已完成的段
+const (
+	s3PartSize      = 16 << 20
+	s3DefaultRegion = "us-east-1"
+)
+
+type s3Target struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Target(config RemoteConfig) (*s3Target, error) {
+	endpoint, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", config.URL)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is empty")
+	}
+
+	region := config.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	return &s3Target{
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		region:    region,
+		prefix:    joinRemotePath(config.Prefix),
+		accessKey: config.Username,
+		secretKey: config.Password,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (t *s3Target) key(name string) string {
+	return joinRemotePath(t.prefix, name)
+}
+
+func (t *s3Target) URL(name string) string {
+	u := *t.endpoint
+	u.Path = "/" + joinRemotePath(t.endpoint.Path, t.bucket, t.key(name))
+	return u.String()
+}
+
+// s3Escape 按SigV4的要求编码，只保留非保留字符，keepSlash为true时不编码/
+func s3Escape(s string, keepSlash bool) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// do 发送签名后的请求，body为nil时签名空内容
+func (t *s3Target) do(method, name string, query url.Values, body []byte) (*http.Response, error) {
+	objectPath := "/" + joinRemotePath(t.endpoint.Path, t.bucket, t.key(name))
+	u := *t.endpoint
+	u.Path = objectPath
+	u.RawPath = s3Escape(objectPath, true)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHex := hex.EncodeToString(payloadHash[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHex)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.RawPath,
+		u.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHex,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+t.secretKey), date)
+	signingKey = hmacSHA256(signingKey, t.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+
+	return t.client.Do(req)
+}
+
+func (t *s3Target) Put(name string, data []byte) error {
+	return remoteRetry("PUT "+name, func() error {
+		resp, err := t.do(http.MethodPut, name, nil, data)
+		if err != nil {
+			return err
+		}
+		if err := checkRemoteResponse(resp, http.StatusOK); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+}
+
+func (t *s3Target) Upload(localPath, name string, progress func(written, total int64)) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	total := stat.Size()
+
+	if total <= s3PartSize {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		if err := t.Put(name, data); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(total, total)
+		}
+		return nil
+	}
+
+	uploadId, err := t.createMultipartUpload(name)
+	if err != nil {
+		return err
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	parts := make([]completedPart, 0)
+	buf := make([]byte, s3PartSize)
+	var written int64
+	for partNumber := 1; written < total; partNumber++ {
+		n, err := file.ReadAt(buf, written)
+		if err != nil && err != io.EOF {
+			t.abortMultipartUpload(name, uploadId)
+			return err
+		}
+
+		var etag string
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+		err = remoteRetry(fmt.Sprintf("PUT %s part %d", name, partNumber), func() error {
+			resp, err := t.do(http.MethodPut, name, query, buf[:n])
+			if err != nil {
+				return err
+			}
+			if err := checkRemoteResponse(resp, http.StatusOK); err != nil {
+				return err
+			}
+			resp.Body.Close()
+			etag = resp.Header.Get("ETag")
+			return nil
+		})
+		if err != nil {
+			t.abortMultipartUpload(name, uploadId)
+			return err
+		}
+
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+		written += int64(n)
+		if progress != nil {
+			progress(written, total)
+		}
+	}
+
+	complete, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	err = remoteRetry("complete "+name, func() error {
+		resp, err := t.do(http.MethodPost, name, url.Values{"uploadId": {uploadId}}, complete)
+		if err != nil {
+			return err
+		}
+		if err := checkRemoteResponse(resp, http.StatusOK); err != nil {
+			return err
+		}
+		// 合并失败时也可能返回200，错误在响应内容中
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(body, []byte("<Error>")) {
+			return &RemoteStatusError{Method: http.MethodPost, URL: t.URL(name), StatusCode: http.StatusInternalServerError, Body: string(body)}
+		}
+		return nil
+	})
+	if err != nil {
+		t.abortMultipartUpload(name, uploadId)
+	}
+	return err
+}
+
+func (t *s3Target) createMultipartUpload(name string) (string, error) {
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err := remoteRetry("create upload "+name, func() error {
+		resp, err := t.do(http.MethodPost, name, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		if err := checkRemoteResponse(resp, http.StatusOK); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return xml.NewDecoder(resp.Body).Decode(&result)
+	})
+	if err == nil && result.UploadId == "" {
+		err = fmt.Errorf("create upload %s: empty upload id", name)
+	}
+	return result.UploadId, err
+}
+
+func (t *s3Target) abortMultipartUpload(name, uploadId string) {
+	resp, err := t.do(http.MethodDelete, name, url.Values{"uploadId": {uploadId}}, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func (t *s3Target) Test() error {
+	if err := t.Put(remoteTestName, []byte("wechatDataBackup")); err != nil {
+		return err
+	}
+
+	resp, err := t.do(http.MethodDelete, remoteTestName, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkRemoteResponse(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
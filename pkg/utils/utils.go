@@ -6,17 +6,21 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"unsafe"
 
 	"github.com/pkg/browser"
 	"github.com/shirou/gopsutil/v3/disk"
 	"golang.org/x/net/html"
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -100,6 +104,11 @@ func GetPathStat(path string) (PathStat, error) {
 		return pathStat, err
 	}
 
+	// GetDiskFreeSpaceEx要求UNC路径以\\结尾，直接查询共享根目录
+	if IsUNCPath(absPath) {
+		absPath = filepath.VolumeName(absPath) + "\\"
+	}
+
 	stat, err := disk.Usage(absPath)
 	if err != nil {
 		return pathStat, err
@@ -114,21 +123,85 @@ func GetPathStat(path string) (PathStat, error) {
 	return pathStat, nil
 }
 
-func PathIsCanWriteFile(path string) bool {
+// PathIsCanWriteFile 检查目录是否可写，requiredBytes大于0时同时检查磁盘剩余空间是否足够
+func PathIsCanWriteFile(path string, requiredBytes int64) bool {
 
-	filepath := fmt.Sprintf("%s\\CanWrite.txt", path)
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
+	// path可能是以\\结尾的共享根目录，如\\nas\backup\，不能直接拼接
+	filePath := filepath.Join(path, "CanWrite.txt")
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
+		log.Println("PathIsCanWriteFile:", err)
 		return false
 	}
 
 	file.Close()
-	os.Remove(filepath)
+	os.Remove(filePath)
+
+	if requiredBytes > 0 {
+		stat, err := GetPathStat(path)
+		if err != nil {
+			log.Println("PathIsCanWriteFile GetPathStat:", err)
+			return false
+		}
+		if stat.Free < uint64(requiredBytes) {
+			log.Printf("PathIsCanWriteFile: %s free %d < required %d\n", path, stat.Free, requiredBytes)
+			return false
+		}
+	}
 
 	return true
 }
 
+// IsUNCPath 判断是否为\\server\share形式的网络路径
+func IsUNCPath(path string) bool {
+	if strings.HasPrefix(path, `\\?\UNC\`) {
+		return true
+	}
+	return strings.HasPrefix(path, `\\`) && !strings.HasPrefix(path, `\\?\`) && !strings.HasPrefix(path, `\\.\`)
+}
+
+// IsNetworkPath UNC路径或映射的网络驱动器返回true
+func IsNetworkPath(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if IsUNCPath(absPath) {
+		return true
+	}
+
+	root, err := windows.UTF16PtrFromString(filepath.VolumeName(absPath) + "\\")
+	if err != nil {
+		return false
+	}
+	return windows.GetDriveType(root) == windows.DRIVE_REMOTE
+}
+
 func CopyFile(src, dst string) (int64, error) {
+	return CopyFileWithProgress(src, dst, nil)
+}
+
+// 复制进度回调的间隔
+const copyProgressInterval = 1024 * 1024
+
+type copyProgressWriter struct {
+	written  int64
+	total    int64
+	next     int64
+	progress func(written, total int64)
+}
+
+func (w *copyProgressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.written >= w.next {
+		w.progress(w.written, w.total)
+		w.next = w.written + copyProgressInterval
+	}
+	return len(p), nil
+}
+
+// CopyFileWithProgress 与CopyFile相同，每复制1MB调用一次progress，结束时再调用一次；progress可以为nil
+func CopyFileWithProgress(src, dst string, progress func(written, total int64)) (int64, error) {
 	stat, err := os.Stat(src)
 	if err != nil {
 		return 0, err
@@ -148,10 +221,20 @@ func CopyFile(src, dst string) (int64, error) {
 	}
 	defer destFile.Close()
 
-	bytesWritten, err := io.Copy(destFile, sourceFile)
+	var reader io.Reader = sourceFile
+	var tracker *copyProgressWriter
+	if progress != nil {
+		tracker = &copyProgressWriter{total: stat.Size(), next: copyProgressInterval, progress: progress}
+		reader = io.TeeReader(sourceFile, tracker)
+	}
+
+	bytesWritten, err := io.Copy(destFile, reader)
 	if err != nil {
 		return bytesWritten, err
 	}
+	if tracker != nil {
+		progress(bytesWritten, tracker.total)
+	}
 
 	return bytesWritten, nil
 }
@@ -238,32 +321,81 @@ func Hash256Sum(data []byte) string {
 
 // 计算文件哈希值（SHA256）
 func CalculateFileHash(filePath string) (string, error) {
+	return calculateFileHash(filePath, sha256.New())
+}
+
+// 计算文件哈希值（MD5）
+func CalculateFileMD5(filePath string) (string, error) {
+	return calculateFileHash(filePath, md5.New())
+}
+
+// calculateFileHash 用h计算文件哈希，返回十六进制字符串
+func calculateFileHash(filePath string, h hash.Hash) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(h, file); err != nil {
 		return "", err
 	}
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// 计算文件哈希值（MD5）
-func CalculateFileMD5(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+// ProtectData 使用DPAPI加密，只有当前Windows用户可以解密
+func ProtectData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
 	}
-	defer file.Close()
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
+
+// UnprotectData 解密ProtectData加密的数据
+func UnprotectData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
+
+var procSetThreadPriority = windows.NewLazySystemDLL("kernel32.dll").NewProc("SetThreadPriority")
+
+const (
+	threadModeBackgroundBegin = 0x00010000
+	threadModeBackgroundEnd   = 0x00020000
+)
+
+// BeginBackgroundThread 将当前线程切换到后台模式，降低CPU和磁盘I/O优先级，只影响调用的goroutine；
+// goroutine在返回的函数调用前固定在当前线程上
+func BeginBackgroundThread() func() {
+	runtime.LockOSThread()
+	thread, _ := windows.GetCurrentThread()
+	if r, _, err := procSetThreadPriority.Call(uintptr(thread), threadModeBackgroundBegin); r == 0 {
+		log.Println("SetThreadPriority background begin:", err)
+		runtime.UnlockOSThread()
+		return func() {}
 	}
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return func() {
+		if r, _, err := procSetThreadPriority.Call(uintptr(thread), threadModeBackgroundEnd); r == 0 {
+			log.Println("SetThreadPriority background end:", err)
+		}
+		runtime.UnlockOSThread()
+	}
 }
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkCalculateFileHash 比较变化检测可用的几种哈希计算同一文件的速度
+func BenchmarkCalculateFileHash(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "data.bin")
+	data := make([]byte, 16<<20)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	algos := []struct {
+		name string
+		new  func() hash.Hash
+	}{
+		{"md5", md5.New},
+		{"sha1", sha1.New},
+		{"sha256", sha256.New},
+		{"xxhash", func() hash.Hash { return NewXXHash64() }},
+	}
+	for _, algo := range algos {
+		b.Run(algo.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := calculateFileHash(path, algo.new()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
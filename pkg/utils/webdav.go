@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// webDAVTarget 通过PUT上传文件，MKCOL逐级创建目录；
+// WebDAV没有通用的分段上传，大文件失败时整体重试
+type webDAVTarget struct {
+	base     *url.URL
+	prefix   string
+	username string
+	password string
+	client   *http.Client
+
+	// 已确认存在的目录
+	dirs  map[string]bool
+	dirMu sync.Mutex
+}
+
+func newWebDAVTarget(config RemoteConfig) (*webDAVTarget, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webdav url: %s", config.URL)
+	}
+
+	return &webDAVTarget{
+		base:     base,
+		prefix:   joinRemotePath(config.Prefix),
+		username: config.Username,
+		password: config.Password,
+		client:   &http.Client{},
+		dirs:     make(map[string]bool),
+	}, nil
+}
+
+func (t *webDAVTarget) URL(name string) string {
+	u := *t.base
+	u.User = nil
+	u.Path = "/" + joinRemotePath(t.base.Path, t.prefix, name)
+	return u.String()
+}
+
+func (t *webDAVTarget) do(method, name string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, t.URL(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return t.client.Do(req)
+}
+
+// mkdirAll 从Prefix开始逐级创建dir，405表示目录已存在
+func (t *webDAVTarget) mkdirAll(dir string) error {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+
+	current := ""
+	for _, seg := range strings.Split(joinRemotePath(t.prefix, dir), "/") {
+		if seg == "" {
+			continue
+		}
+		current = joinRemotePath(current, seg)
+		if t.dirs[current] {
+			continue
+		}
+
+		// 目录地址以/结尾，prefix已包含在current中
+		err := remoteRetry("MKCOL "+current, func() error {
+			u := *t.base
+			u.User = nil
+			u.Path = "/" + joinRemotePath(t.base.Path, current) + "/"
+			req, err := http.NewRequest("MKCOL", u.String(), nil)
+			if err != nil {
+				return err
+			}
+			if t.username != "" {
+				req.SetBasicAuth(t.username, t.password)
+			}
+			resp, err := t.client.Do(req)
+			if err != nil {
+				return err
+			}
+			if err := checkRemoteResponse(resp, http.StatusCreated, http.StatusMethodNotAllowed, http.StatusOK); err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		t.dirs[current] = true
+	}
+	return nil
+}
+
+func (t *webDAVTarget) Upload(localPath, name string, progress func(written, total int64)) error {
+	if err := t.mkdirAll(path.Dir(joinRemotePath(name))); err != nil {
+		return err
+	}
+
+	return remoteRetry("PUT "+name, func() error {
+		file, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		var body io.Reader = file
+		if progress != nil {
+			body = io.TeeReader(file, &copyProgressWriter{total: stat.Size(), next: copyProgressInterval, progress: progress})
+		}
+		resp, err := t.do(http.MethodPut, name, body, stat.Size())
+		if err != nil {
+			return err
+		}
+		if err := checkRemoteResponse(resp, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if progress != nil {
+			progress(stat.Size(), stat.Size())
+		}
+		return nil
+	})
+}
+
+func (t *webDAVTarget) Put(name string, data []byte) error {
+	if err := t.mkdirAll(path.Dir(joinRemotePath(name))); err != nil {
+		return err
+	}
+
+	return remoteRetry("PUT "+name, func() error {
+		resp, err := t.do(http.MethodPut, name, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		if err := checkRemoteResponse(resp, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+}
+
+func (t *webDAVTarget) Test() error {
+	if err := t.Put(remoteTestName, []byte("wechatDataBackup")); err != nil {
+		return err
+	}
+
+	resp, err := t.do(http.MethodDelete, remoteTestName, nil, 0)
+	if err != nil {
+		return err
+	}
+	if err := checkRemoteResponse(resp, http.StatusOK, http.StatusNoContent, http.StatusNotFound); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
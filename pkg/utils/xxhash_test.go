@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestXXHash64KnownVectors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", "ef46db3751d8e999"},
+		{"a", "d24ec4f1a98c6e5b"},
+		{"abc", "44bc2cf5ad770999"},
+		{"Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+	}
+	for _, tt := range tests {
+		h := NewXXHash64()
+		h.Write([]byte(tt.input))
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("XXH64(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestXXHash64ChunkedWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100)
+	whole := NewXXHash64()
+	whole.Write(data)
+
+	// 分块写入时跨越32字节的stripe边界
+	chunked := NewXXHash64()
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		chunked.Write(data[i:end])
+	}
+	if whole.Sum64() != chunked.Sum64() {
+		t.Errorf("chunked sum %x, want %x", chunked.Sum64(), whole.Sum64())
+	}
+
+	whole.Reset()
+	if got := hex.EncodeToString(whole.Sum(nil)); got != "ef46db3751d8e999" {
+		t.Errorf("sum after Reset = %s, want empty input hash", got)
+	}
+}
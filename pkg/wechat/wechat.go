@@ -3,14 +3,13 @@ package wechat
 import (
 	"bufio"
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
 	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -36,6 +35,8 @@ type WeChatInfo struct {
 	DllBaseAddr uintptr
 	DllBaseSize uint32
 	DBKey       string
+	// 数据目录格式，3.x为3，4.0为4
+	DataVersion int
 }
 
 type WeChatInfoList struct {
@@ -64,41 +65,223 @@ func GetWeChatAllInfo() *WeChatInfoList {
 	return list
 }
 
-func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string) {
+// ExportOptions 选择导出的数据类型，未导出的媒体文件对应的消息记录仍然保留
+type ExportOptions struct {
+	DataBase bool `json:"databases"`
+	Image    bool `json:"images"`
+	Video    bool `json:"videos"`
+	Voice    bool `json:"voice"`
+	File     bool `json:"files"`
+	// 自定义表情，保存在FileStorage\\CustomEmotion下，与视频和文件在同一阶段复制
+	Emoji bool `json:"emoji"`
+	// 图片、视频和文件复制的并发数
+	Workers int `json:"workers"`
+	// 数据库解密的并发数，解密占用CPU较多，默认单线程
+	DBWorkers int `json:"dbWorkers"`
+	// 增量导出时除大小和修改时间外，再比较哈希判断文件是否变化
+	VerifyHash bool `json:"verifyHash"`
+	// 导出为zip，ArchivePath由调用方指定
+	Archive     bool   `json:"archive"`
+	ArchivePath string `json:"-"`
+	// 图片、视频和文件复制的限速，单位MB/s，0为不限速
+	ThrottleMBps int `json:"throttleMBps"`
+	// 复制媒体文件时将进程切换为后台模式，降低磁盘I/O优先级
+	IdlePriority bool `json:"idlePriority"`
+	// 导出到网络路径时单个文件的最大尝试次数，0使用默认值
+	CopyAttempts int `json:"copyAttempts"`
+	// 存在上次中断的断点时是否继续，未设置时自动继续
+	Resume *bool `json:"resume,omitempty"`
+	// 全量导出时将原导出目录保留为快照，不直接删除
+	KeepSnapshot bool `json:"keepSnapshot"`
+	// 每个账号保留的快照数量，0使用默认值
+	SnapshotRetention int `json:"snapshotRetention"`
+}
+
+func DefaultExportOptions() ExportOptions {
+	return ExportOptions{
+		DataBase:  true,
+		Image:     true,
+		Video:     true,
+		Voice:     true,
+		File:      true,
+		Emoji:     true,
+		Workers:   defaultExportWorkers,
+		DBWorkers: defaultExportDBWorkers,
+	}
+}
+
+const (
+	defaultExportWorkers   = 4
+	defaultExportDBWorkers = 1
+)
+
+type exportTask struct {
+	src  string
+	dst  string
+	size int64
+}
+
+func ExportWeChatAllData(info WeChatInfo, expPath string, options ExportOptions, progress chan<- ExportProgress) (*ExportReport, error) {
 	defer close(progress)
+	report := newExportReport()
+	if info.DataVersion == WeChat_Data_Version4 {
+		progress <- ExportProgress{Status: Export_Status_Error, Result: ErrUnsupportedDataVersion.Error()}
+		return report, ErrUnsupportedDataVersion
+	}
 	fileInfo, err := os.Stat(info.FilePath)
 	if err != nil || !fileInfo.IsDir() {
-		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", info.FilePath)
-		return
+		progress <- ExportProgress{Status: Export_Status_Error, Result: fmt.Sprintf("%s error", info.FilePath)}
+		return report, fmt.Errorf("%s error", info.FilePath)
 	}
-	if !exportWeChatDateBase(info, expPath, progress) {
-		return
+	if options.Workers <= 0 {
+		options.Workers = defaultExportWorkers
+	}
+	if options.DBWorkers <= 0 {
+		options.DBWorkers = defaultExportDBWorkers
+	}
+	// 换算为本次导出实际的尝试次数，本地路径为1
+	options.CopyAttempts = exportCopyAttempts(expPath, options)
+	log.Println("export copy attempts:", options.CopyAttempts)
+
+	// 图片、视频和文件直接写入zip，数据库、语音和头像导出到expPath后再写入
+	var archive *exportArchive
+	if options.ArchivePath != "" {
+		archive, err = newExportArchive(options.ArchivePath)
+		if err != nil {
+			progress <- ExportProgress{Status: Export_Status_Error, Result: fmt.Sprintf("%v", err)}
+			return report, err
+		}
+		defer archive.close()
+	}
+
+	// 按选中的阶段平分总进度，头像始终导出
+	stages := make([]string, 0)
+	if options.DataBase {
+		stages = append(stages, Export_Stage_DataBase)
+	}
+	if options.Image {
+		stages = append(stages, Export_Stage_Dat)
+	}
+	if options.Video || options.File || options.Emoji {
+		stages = append(stages, Export_Stage_VideoFile)
+	}
+	if options.Voice {
+		stages = append(stages, Export_Stage_Voice)
+	}
+	stages = append(stages, Export_Stage_HeadImage)
+
+	// 导出到目录时记录断点，中断后再次导出跳过已完成的阶段；导出为zip时每次重新写入
+	var checkpoint *ExportCheckpoint
+	if archive == nil {
+		checkpoint, err = LoadExportCheckpoint(expPath)
+		if err != nil || !checkpoint.Matches(info) {
+			checkpoint = NewExportCheckpoint(info, expPath, false)
+		}
+		checkpoint.Save()
 	}
 
-	exportWeChatBat(info, expPath, progress)
-	exportWeChatVideoAndFile(info, expPath, progress)
-	exportWeChatVoice(info, expPath, progress)
-	exportWeChatHeadImage(info, expPath, progress)
+	// 磁盘写满后立即停止导出，只发送一次错误，由调用方保留导出前的数据
+	guard := newExportSpaceGuard(expPath)
+	diskFull := func(stage string) error {
+		err := guard.error()
+		if err != nil {
+			progress <- ExportProgress{Status: Export_Status_Error, Stage: stage, Result: err.Error()}
+		}
+		return err
+	}
+
+	laterStages := func(rest []string) func() int64 {
+		return func() int64 { return estimateStagesBytes(info, expPath, options, rest) }
+	}
+
+	step := 100 / len(stages)
+	for i, stage := range stages {
+		start, end := i*step+1, (i+1)*step
+		if i == len(stages)-1 {
+			end = 100
+		}
+
+		// 阶段开始前还没有当前阶段的进度，当前阶段也按预计写入的字节数计算
+		guard.setLater(laterStages(stages[i:]))
+		guard.check(0)
+		if err := diskFull(stage); err != nil {
+			return report, err
+		}
+		guard.setLater(laterStages(stages[i+1:]))
+		if checkpoint.stageDone(stage) {
+			log.Println("export stage already done:", stage)
+			progress <- ExportProgress{Status: Export_Status_Processing, Stage: stage, Result: "export stage resumed from checkpoint", Progress: end}
+			continue
+		}
+
+		stageStart := time.Now()
+		switch stage {
+		case Export_Stage_DataBase:
+			if !exportWeChatDateBase(info, expPath, options.CopyAttempts, options.DBWorkers, guard, checkpoint, start, end, report, progress) {
+				report.addStageDuration(stage, time.Since(stageStart))
+				if err := diskFull(stage); err != nil {
+					return report, err
+				}
+				return report, errors.New("export WeChat DateBase failed")
+			}
+		case Export_Stage_Dat, Export_Stage_VideoFile:
+			endIdle := func() {}
+			if options.IdlePriority {
+				endIdle = beginIdlePriority()
+			}
+			if stage == Export_Stage_Dat {
+				exportWeChatBat(info, expPath, options, archive, guard, start, end, report, progress)
+			} else {
+				exportWeChatVideoAndFile(info, expPath, options, archive, guard, start, end, report, progress)
+			}
+			endIdle()
+		case Export_Stage_Voice:
+			exportWeChatVoice(info, expPath, guard, start, end, report, progress)
+		case Export_Stage_HeadImage:
+			exportWeChatHeadImage(info, expPath, start, end, progress)
+		}
+		report.addStageDuration(stage, time.Since(stageStart))
+		if err := diskFull(stage); err != nil {
+			return report, err
+		}
+		checkpoint.finishStage(stage)
+	}
+
+	if archive != nil {
+		progress <- ExportProgress{Status: Export_Status_Processing, Stage: Export_Stage_Archive, Result: "export WeChat archive", Progress: 100}
+		archiveStart := time.Now()
+		if err := archive.addDir(expPath); err != nil {
+			if guard.failWrite(err, 0) {
+				err = guard.error()
+			}
+			progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_Archive, Result: fmt.Sprintf("%v", err)}
+			return report, err
+		}
+		if err := archive.close(); err != nil {
+			progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_Archive, Result: fmt.Sprintf("%v", err)}
+			return report, err
+		}
+		report.addStageDuration(Export_Stage_Archive, time.Since(archiveStart))
+	}
+
+	checkpoint.Remove()
+	return report, nil
 }
 
-func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image\", \"progress\": 81}"
+func exportWeChatHeadImage(info WeChatInfo, expPath string, start, end int, progress chan<- ExportProgress) {
+	tracker := newExportTracker(Export_Stage_HeadImage, start, end, 0, 0)
+	progress <- tracker.event(Export_Status_Processing, "export WeChat Head Image")
 
 	headImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage", expPath)
 	if _, err := os.Stat(headImgPath); err != nil {
 		if err := os.MkdirAll(headImgPath, 0644); err != nil {
 			log.Printf("MkdirAll %s failed: %v\n", headImgPath, err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err)
+			progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_HeadImage, Result: fmt.Sprintf("%v error", err)}
 			return
 		}
 	}
 
-	handleNumber := int64(0)
-	fileNumber := int64(0)
-
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
 	MSGChan := make(chan wechatHeadImgMSG, 100)
 	go func() {
 		for {
@@ -116,12 +299,14 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 			}
 			defer db.Close()
 
+			fileNumber := int64(0)
 			err = db.QueryRow("select count(*) from ContactHeadImg1;").Scan(&fileNumber)
 			if err != nil {
 				log.Println("select count(*) failed", err)
 				break
 			}
 			log.Println("ContactHeadImg1 fileNumber", fileNumber)
+			tracker.setTotal(fileNumber, 0)
 			rows, err := db.Query("select ifnull(usrName,'') as usrName, ifnull(smallHeadBuf,'') as smallHeadBuf from ContactHeadImg1;")
 			if err != nil {
 				log.Printf("Query failed: %v\n", err)
@@ -164,72 +349,50 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 					}
 					break
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				tracker.fileDone(0)
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat Head Image report progress end")
-				return
-			default:
-				if fileNumber != 0 {
-					filePercent := float64(handleNumber) / float64(fileNumber)
-					totalPercent := 81 + (filePercent * (100 - 81))
-					totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Head Image doing\", \"progress\": %d}", int(totalPercent))
-					progress <- totalPercentStr
-				}
-				time.Sleep(time.Second)
-			}
-		}
-	}()
-
+	stopReport := tracker.report(progress, "export WeChat Head Image doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image end\", \"progress\": 100}"
+	stopReport()
+	log.Println("WeChat Head Image report progress end")
+	progress <- tracker.finish("export WeChat Head Image end")
 }
 
-func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat voice start\", \"progress\": 61}"
-
+func exportWeChatVoice(info WeChatInfo, expPath string, guard *exportSpaceGuard, start, end int, report *ExportReport, progress chan<- ExportProgress) {
 	voicePath := fmt.Sprintf("%s\\FileStorage\\Voice", expPath)
-	if _, err := os.Stat(voicePath); err != nil {
-		if err := os.MkdirAll(voicePath, 0644); err != nil {
-			log.Printf("MkdirAll %s failed: %v\n", voicePath, err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err)
-			return
-		}
-	}
 
-	handleNumber := int64(0)
 	fileNumber := int64(0)
-	index := 0
-	for {
+	fileSize := int64(0)
+	for index := 0; ; index++ {
 		mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", expPath, index)
-		_, err := os.Stat(mediaMSGDB)
+		finfo, err := os.Stat(mediaMSGDB)
 		if err != nil {
 			break
 		}
-		index += 1
 		fileNumber += 1
+		fileSize += finfo.Size()
+	}
+
+	tracker := newExportTracker(Export_Stage_Voice, start, end, fileNumber, fileSize)
+	progress <- tracker.event(Export_Status_Processing, "export WeChat voice start")
+
+	if _, err := os.Stat(voicePath); err != nil {
+		if err := os.MkdirAll(voicePath, 0644); err != nil {
+			log.Printf("MkdirAll %s failed: %v\n", voicePath, err)
+			progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_Voice, Result: fmt.Sprintf("%v error", err)}
+			return
+		}
 	}
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	index = -1
 	MSGChan := make(chan wechatMediaMSG, 100)
 	go func() {
-		for {
-			index += 1
+		for index := 0; !guard.stopped(); index++ {
 			mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", expPath, index)
-			_, err := os.Stat(mediaMSGDB)
+			finfo, err := os.Stat(mediaMSGDB)
 			if err != nil {
 				break
 			}
@@ -257,7 +420,7 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 
 				MSGChan <- msg
 			}
-			atomic.AddInt64(&handleNumber, 1)
+			tracker.fileDone(finfo.Size())
 		}
 		close(MSGChan)
 	}()
@@ -267,6 +430,9 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 		go func() {
 			defer wg.Done()
 			for msg := range MSGChan {
+				if guard.stopped() {
+					continue
+				}
 				mp3Path := fmt.Sprintf("%s\\%d.mp3", voicePath, msg.MsgSvrID)
 				_, err := os.Stat(mp3Path)
 				if err == nil {
@@ -276,54 +442,57 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 				err = silkToMp3(msg.Buf[:], mp3Path)
 				if err != nil {
 					log.Printf("silkToMp3 %s failed: %v\n", mp3Path, err)
+					if guard.failWrite(err, tracker.remaining()) {
+						continue
+					}
+					report.add(Export_Stage_Voice, mp3Path, err)
 				}
+				guard.check(tracker.remaining())
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat voice report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 61 + (filePercent * (80 - 61))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat voice doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
-
+	stopReport := tracker.report(progress, "export WeChat voice doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat voice end\", \"progress\": 80}"
+	stopReport()
+	log.Println("WeChat voice report progress end")
+	progress <- tracker.finish("export WeChat voice end")
 }
 
-func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Video and File start\", , \"progress\": 41}"
-	videoRootPath := info.FilePath + "\\FileStorage\\Video"
-	fileRootPath := info.FilePath + "\\FileStorage\\File"
-	cacheRootPath := info.FilePath + "\\FileStorage\\Cache"
+// videoFileRootPaths 返回视频和文件阶段按options需要复制的源目录，Cache中的缩略图总是复制
+func videoFileRootPaths(info WeChatInfo, options ExportOptions) []string {
+	rootPaths := make([]string, 0)
+	if options.Video {
+		rootPaths = append(rootPaths, weChatMediaRoot(info, "Video"))
+	}
+	if options.File {
+		rootPaths = append(rootPaths, weChatMediaRoot(info, "File"))
+	}
+	if options.Emoji {
+		rootPaths = append(rootPaths, weChatMediaRoot(info, "CustomEmotion"))
+	}
+	return append(rootPaths, weChatMediaRoot(info, "Cache"))
+}
 
-	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath}
+func exportWeChatVideoAndFile(info WeChatInfo, expPath string, options ExportOptions, archive *exportArchive, guard *exportSpaceGuard, start, end int, report *ExportReport, progress chan<- ExportProgress) {
+	rootPaths := videoFileRootPaths(info, options)
 
-	handleNumber := int64(0)
 	fileNumber := int64(0)
+	fileSize := int64(0)
 	for _, path := range rootPaths {
-		fileNumber += getPathFileNumber(path, "")
+		number, size := getPathFileStat(path, "")
+		fileNumber += number
+		fileSize += size
 	}
-	log.Println("VideoAndFile ", fileNumber)
+	log.Println("VideoAndFile ", fileNumber, fileSize)
+
+	tracker := newExportTracker(Export_Stage_VideoFile, start, end, fileNumber, fileSize)
+	throttle := newExportThrottle(options.ThrottleMBps)
+	tracker.rateLimit = throttle.bytesPerSecond()
+	progress <- tracker.event(Export_Status_Processing, "export WeChat Video and File start")
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 100)
+	taskChan := make(chan exportTask, 100)
 	go func() {
 		for _, rootPath := range rootPaths {
 			log.Println(rootPath)
@@ -335,16 +504,18 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 					log.Printf("filepath.Walk：%v\n", err)
 					return err
 				}
+				if guard.stopped() {
+					return filepath.SkipAll
+				}
 
 				if !finfo.IsDir() {
-					expFile := expPath + path[len(info.FilePath):]
+					expFile := weChatMediaExportPath(info, expPath, path)
 					_, err := os.Stat(filepath.Dir(expFile))
-					if err != nil {
+					if err != nil && archive == nil {
 						os.MkdirAll(filepath.Dir(expFile), 0644)
 					}
 
-					task := [2]string{path, expFile}
-					taskChan <- task
+					taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size()}
 					return nil
 				}
 
@@ -352,71 +523,80 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 			})
 			if err != nil {
 				log.Println("filepath.Walk:", err)
-				progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+				report.add(Export_Stage_VideoFile, rootPath, err)
 			}
 		}
 		close(taskChan)
 	}()
 
-	for i := 1; i < 30; i++ {
+	for i := 0; i < options.Workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				_, err := os.Stat(task[1])
-				if err == nil {
-					atomic.AddInt64(&handleNumber, 1)
+				if guard.stopped() {
+					continue
+				}
+				if archive != nil {
+					throttle.wait(task.size)
+					if err := archive.addFile(task.dst[len(expPath):], task.src); err != nil {
+						log.Println("archive.addFile:", err)
+						if guard.failWrite(err, tracker.remaining()) {
+							continue
+						}
+						report.add(Export_Stage_VideoFile, task.src, err)
+					}
+					tracker.fileDone(task.size)
+					guard.check(tracker.remaining())
+					continue
+				}
+				if mediaFileUnchanged(task.src, task.dst, task.size, options.VerifyHash) {
+					tracker.fileSkipped(task.size)
 					continue
 				}
-				_, err = copyFile(task[0], task[1])
+				_, err := copyFileRetry(task.src, task.dst, throttle, options.CopyAttempts)
 				if err != nil {
-					log.Println("DecryptDat:", err)
-					progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"copyFile %v\"}", err)
+					log.Println("copyFile:", err)
+					if guard.failWrite(err, tracker.remaining()) {
+						continue
+					}
+					report.add(Export_Stage_VideoFile, task.src, err)
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				tracker.fileDone(task.size)
+				guard.check(tracker.remaining())
 			}
 		}()
 	}
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat Video and File report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 41 + (filePercent * (60 - 41))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Video and File doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+
+	stopReport := tracker.report(progress, "export WeChat Video and File doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Video and File end\", \"progress\": 60}"
+	stopReport()
+	report.addCopyStat(tracker)
+	log.Println("WeChat Video and File report progress end")
+	progress <- tracker.finish("export WeChat Video and File end")
 }
 
-func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Dat start\", \"progress\": 21}"
-	datRootPath := info.FilePath + "\\FileStorage\\MsgAttach"
+func exportWeChatBat(info WeChatInfo, expPath string, options ExportOptions, archive *exportArchive, guard *exportSpaceGuard, start, end int, report *ExportReport, progress chan<- ExportProgress) {
+	datRootPath := weChatMediaRoot(info, "MsgAttach")
 	// 图片文件实际在MsgAttach的Image子目录中，解码后保存到FileStorage/Image
 	rootPaths := []string{datRootPath}
 
-	handleNumber := int64(0)
 	fileNumber := int64(0)
+	fileSize := int64(0)
 	for i := range rootPaths {
-		fileNumber += getPathFileNumber(rootPaths[i], ".dat")
+		number, size := getPathFileStat(rootPaths[i], ".dat")
+		fileNumber += number
+		fileSize += size
 	}
-	log.Println("DatFileNumber ", fileNumber)
+	log.Println("DatFileNumber ", fileNumber, fileSize)
+
+	tracker := newExportTracker(Export_Stage_Dat, start, end, fileNumber, fileSize)
+	throttle := newExportThrottle(options.ThrottleMBps)
+	tracker.rateLimit = throttle.bytesPerSecond()
+	progress <- tracker.event(Export_Status_Processing, "export WeChat Dat start")
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 100)
+	taskChan := make(chan exportTask, 100)
 	go func() {
 		for i := range rootPaths {
 			if _, err := os.Stat(rootPaths[i]); err != nil {
@@ -428,19 +608,20 @@ func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
 					log.Printf("filepath.Walk：%v\n", err)
 					return err
 				}
+				if guard.stopped() {
+					return filepath.SkipAll
+				}
 
 				if !finfo.IsDir() && strings.HasSuffix(path, ".dat") {
 					// 确定输出路径：保持MsgAttach结构
-					relativePath := strings.TrimPrefix(path, info.FilePath)
-					expFile := expPath + relativePath
-										
+					expFile := weChatMediaExportPath(info, expPath, path)
+
 					_, err := os.Stat(filepath.Dir(expFile))
-					if err != nil {
+					if err != nil && archive == nil {
 						os.MkdirAll(filepath.Dir(expFile), 0644)
 					}
 
-					task := [2]string{path, expFile}
-					taskChan <- task
+					taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size()}
 					return nil
 				}
 
@@ -449,77 +630,89 @@ func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
 
 			if err != nil {
 				log.Println("filepath.Walk:", err)
-				progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+				report.add(Export_Stage_Dat, rootPaths[i], err)
 			}
 		}
 		close(taskChan)
 	}()
 
-	for i := 1; i < 30; i++ {
+	for i := 0; i < options.Workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				_, err := os.Stat(task[1])
-				if err == nil {
-					atomic.AddInt64(&handleNumber, 1)
+				if guard.stopped() {
 					continue
 				}
-				err = DecryptDat(task[0], task[1])
+				if archive != nil {
+					throttle.wait(task.size)
+					if err := archive.addDat(task.dst[len(expPath):], task.src); err != nil {
+						log.Println("archive.addDat:", err)
+						if guard.failWrite(err, tracker.remaining()) {
+							continue
+						}
+						report.add(Export_Stage_Dat, task.src, err)
+					}
+					tracker.fileDone(task.size)
+					guard.check(tracker.remaining())
+					continue
+				}
+				// 解码后的文件扩展名由文件头决定，内容与源文件不同，不做哈希比较
+				if outPath, err := decryptDatOutPath(task.src, task.dst); err == nil && mediaFileUnchanged(task.src, outPath, task.size, false) {
+					tracker.fileSkipped(task.size)
+					continue
+				}
+				// 图片文件较小，解码前按整个文件预留
+				throttle.wait(task.size)
+				err := retryExportWrite(options.CopyAttempts, func() error {
+					return DecryptDat(task.src, task.dst)
+				})
 				if err != nil {
 					log.Println("DecryptDat:", err)
-					progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"DecryptDat %v\"}", err)
+					if guard.failWrite(err, tracker.remaining()) {
+						continue
+					}
+					report.add(Export_Stage_Dat, task.src, err)
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				tracker.fileDone(task.size)
+				guard.check(tracker.remaining())
 			}
 		}()
 	}
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat Dat report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 21 + (filePercent * (40 - 21))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Dat doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+
+	stopReport := tracker.report(progress, "export WeChat Dat doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Dat end\", \"progress\": 40}"
+	stopReport()
+	report.addCopyStat(tracker)
+	log.Println("WeChat Dat report progress end")
+	progress <- tracker.finish("export WeChat Dat end")
 }
 
-func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- string) bool {
-
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase start\", \"progress\": 1}"
+func exportWeChatDateBase(info WeChatInfo, expPath string, attempts, workers int, guard *exportSpaceGuard, checkpoint *ExportCheckpoint, start, end int, report *ExportReport, progress chan<- ExportProgress) bool {
+	dbRootPath := weChatDBRoot(info)
+	fileNumber, fileSize := getPathFileStat(dbRootPath, ".db")
+	tracker := newExportTracker(Export_Stage_DataBase, start, end, fileNumber, fileSize)
+	progress <- tracker.event(Export_Status_Processing, "export WeChat DateBase start")
 
 	dbKey, err := hex.DecodeString(info.DBKey)
 	if err != nil {
 		log.Println("DecodeString:", err)
-		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+		progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_DataBase, Result: fmt.Sprintf("%v", err)}
 		return false
 	}
 
-	handleNumber := int64(0)
-	fileNumber := getPathFileNumber(info.FilePath+"\\Msg", ".db")
+	keyFailed := int32(0)
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 20)
+	taskChan := make(chan exportTask, 20)
 	go func() {
-		err = filepath.Walk(info.FilePath+"\\Msg", func(path string, finfo os.FileInfo, err error) error {
+		err := filepath.Walk(dbRootPath, func(path string, finfo os.FileInfo, err error) error {
 			if err != nil {
 				log.Printf("filepath.Walk：%v\n", err)
 				return err
 			}
+			if guard.stopped() {
+				return filepath.SkipAll
+			}
 			if !finfo.IsDir() && strings.HasSuffix(path, ".db") {
 				expFile := expPath + path[len(info.FilePath):]
 				_, err := os.Stat(filepath.Dir(expFile))
@@ -527,59 +720,72 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 					os.MkdirAll(filepath.Dir(expFile), 0644)
 				}
 
-				task := [2]string{path, expFile}
-				taskChan <- task
+				taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size()}
 			}
 
 			return nil
 		})
 		if err != nil {
 			log.Println("filepath.Walk:", err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+			report.add(Export_Stage_DataBase, dbRootPath, err)
 		}
 		close(taskChan)
 	}()
 
-	for i := 1; i < 20; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				if filepath.Base(task[0]) == "xInfo.db" {
-					copyFile(task[0], task[1])
+				if guard.stopped() {
+					continue
+				}
+				if checkpoint.dbDone(task.src) {
+					if _, err := os.Stat(task.dst); err == nil {
+						tracker.fileSkipped(task.size)
+						continue
+					}
+				}
+				if filepath.Base(task.src) == "xInfo.db" {
+					if _, err := copyFileRetry(task.src, task.dst, nil, attempts); err != nil {
+						log.Println("copyFile:", err)
+						report.add(Export_Stage_DataBase, task.src, err)
+					}
 				} else {
-					err = DecryptDataBase(task[0], dbKey, task[1])
+					err := retryExportWrite(attempts, func() error {
+						return DecryptDataBase(task.src, dbKey, task.dst)
+					})
 					if err != nil {
 						log.Println("DecryptDataBase:", err)
-						progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s %v\"}", task[0], err)
+						if guard.failWrite(err, tracker.remaining()) {
+							continue
+						}
+						report.add(Export_Stage_DataBase, task.src, err)
+						if errors.Is(err, errIncorrectPassword) {
+							atomic.StoreInt32(&keyFailed, 1)
+						}
+					} else {
+						checkpoint.finishDB(task.src)
 					}
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				tracker.fileDone(task.size)
+				guard.check(tracker.remaining())
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat DateBase report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 1 + (filePercent * (20 - 1))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat DateBase doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+	stopReport := tracker.report(progress, "export WeChat DateBase doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase end\", \"progress\": 20}"
+	stopReport()
+	log.Println("WeChat DateBase report progress end")
+	if guard.stopped() {
+		return false
+	}
+	if atomic.LoadInt32(&keyFailed) != 0 {
+		progress <- ExportProgress{Status: Export_Status_Error, Stage: Export_Stage_DataBase, Result: "export WeChat DateBase failed: incorrect key"}
+		return false
+	}
+	progress <- tracker.finish("export WeChat DateBase end")
 	return true
 }
 
@@ -600,7 +806,15 @@ func GetWeChatInfo() (list *WeChatInfoList) {
 			continue
 		}
 		info := WeChatInfo{}
+		if name == weChatV4ProcessName {
+			if getWeChatInfoV4(p, &info) {
+				list.Info = append(list.Info, info)
+				list.Total += 1
+			}
+			continue
+		}
 		if name == "WeChat.exe" {
+			info.DataVersion = WeChat_Data_Version3
 			info.ProcessID = uint32(p.Pid)
 			info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
 			log.Println("ProcessID", info.ProcessID)
@@ -712,6 +926,11 @@ func Is64BitProcess(pid uint32) (bool, error) {
 }
 
 func GetWeChatKey(info *WeChatInfo) string {
+	if info.DataVersion == WeChat_Data_Version4 {
+		log.Println("GetWeChatKey:", ErrUnsupportedDataVersion)
+		return ""
+	}
+
 	mediaDB := info.FilePath + "\\Msg\\Media.db"
 	if _, err := os.Stat(mediaDB); err != nil {
 		log.Printf("open db %s error: %v", mediaDB, err)
@@ -798,6 +1017,10 @@ func findDBKeyPtr(buffer []byte, is64Bits bool) [][]byte {
 }
 
 func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error) {
+	return findDBkeyWith(handle, path, keys, dbCipherV3)
+}
+
+func findDBkeyWith(handle windows.Handle, path string, keys [][]byte, c dbCipher) (string, error) {
 	var keyAddrPtr uint64
 	addrBuffer := make([]byte, 0x08)
 	for _, key := range keys {
@@ -817,7 +1040,7 @@ func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error
 			// fmt.Println("Error ReadProcessMemory:", err)
 			continue
 		}
-		if checkDataBaseKey(path, keyBuffer) {
+		if checkDataBaseKeyWith(path, keyBuffer, c) {
 			return hex.EncodeToString(keyBuffer), nil
 		}
 	}
@@ -826,6 +1049,10 @@ func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error
 }
 
 func checkDataBaseKey(path string, password []byte) bool {
+	return checkDataBaseKeyWith(path, password, dbCipherV3)
+}
+
+func checkDataBaseKeyWith(path string, password []byte, c dbCipher) bool {
 	fp, err := os.Open(path)
 	if err != nil {
 		return false
@@ -842,19 +1069,8 @@ func checkDataBaseKey(path string, password []byte) bool {
 		return false
 	}
 
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
-
-	page1 := buffer[16:defaultPageSize]
-
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
-
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
-
-	return hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12])
+	_, ok := c.checkPage1(buffer, password)
+	return ok
 }
 
 func (info WeChatInfo) String() string {
@@ -898,7 +1114,7 @@ func silkToMp3(amrBuf []byte, mp3Path string) error {
 
 	of, err := os.Create(mp3Path)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer of.Close()
 
@@ -916,9 +1132,10 @@ func silkToMp3(amrBuf []byte, mp3Path string) error {
 	return nil
 }
 
-func getPathFileNumber(targetPath string, fileSuffix string) int64 {
+func getPathFileStat(targetPath string, fileSuffix string) (int64, int64) {
 
 	number := int64(0)
+	size := int64(0)
 	err := filepath.Walk(targetPath, func(path string, finfo os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("filepath.Walk：%v\n", err)
@@ -926,6 +1143,7 @@ func getPathFileNumber(targetPath string, fileSuffix string) int64 {
 		}
 		if !finfo.IsDir() && strings.HasSuffix(path, fileSuffix) {
 			number += 1
+			size += finfo.Size()
 		}
 
 		return nil
@@ -934,11 +1152,178 @@ func getPathFileNumber(targetPath string, fileSuffix string) int64 {
 		log.Println("filepath.Walk:", err)
 	}
 
-	return number
+	return number, size
+}
+
+// ExportStageEstimate 单个阶段预计复制和跳过的文件
+type ExportStageEstimate struct {
+	Stage        string `json:"stage"`
+	FilesTotal   int64  `json:"filesTotal"`
+	BytesTotal   int64  `json:"bytesTotal"`
+	FilesToCopy  int64  `json:"filesToCopy"`
+	BytesToCopy  int64  `json:"bytesToCopy"`
+	FilesSkipped int64  `json:"filesSkipped"`
+	BytesSkipped int64  `json:"bytesSkipped"`
+}
+
+type ExportEstimate struct {
+	Full         bool                  `json:"full"`
+	Stages       []ExportStageEstimate `json:"stages"`
+	FilesToCopy  int64                 `json:"filesToCopy"`
+	BytesToCopy  int64                 `json:"bytesToCopy"`
+	FilesSkipped int64                 `json:"filesSkipped"`
+	BytesSkipped int64                 `json:"bytesSkipped"`
+}
+
+// EstimateExport 按增量复制的规则比较源目录和已有的导出目录，统计将要复制的文件，不写入任何文件；
+// 数据库每次都重新解密，语音从数据库中导出，不在统计范围内
+func EstimateExport(info WeChatInfo, expPath string, full bool, options ExportOptions) *ExportEstimate {
+	estimate := &ExportEstimate{Full: full, Stages: make([]ExportStageEstimate, 0)}
+
+	if options.DataBase {
+		stage := ExportStageEstimate{Stage: Export_Stage_DataBase}
+		stage.FilesTotal, stage.BytesTotal = getPathFileStat(weChatDBRoot(info), ".db")
+		stage.FilesToCopy, stage.BytesToCopy = stage.FilesTotal, stage.BytesTotal
+		estimate.Stages = append(estimate.Stages, stage)
+	}
+	if options.Image {
+		stage := estimateExportStage(Export_Stage_Dat, info, expPath, full, []string{weChatMediaRoot(info, "MsgAttach")}, ".dat",
+			func(src, dst string, size int64) bool {
+				outPath, err := decryptDatOutPath(src, dst)
+				return err == nil && mediaFileUnchanged(src, outPath, size, false)
+			})
+		estimate.Stages = append(estimate.Stages, stage)
+	}
+	if options.Video || options.File || options.Emoji {
+		stage := estimateExportStage(Export_Stage_VideoFile, info, expPath, full, videoFileRootPaths(info, options), "",
+			func(src, dst string, size int64) bool {
+				return mediaFileUnchanged(src, dst, size, options.VerifyHash)
+			})
+		estimate.Stages = append(estimate.Stages, stage)
+	}
+
+	for _, stage := range estimate.Stages {
+		estimate.FilesToCopy += stage.FilesToCopy
+		estimate.BytesToCopy += stage.BytesToCopy
+		estimate.FilesSkipped += stage.FilesSkipped
+		estimate.BytesSkipped += stage.BytesSkipped
+	}
+
+	return estimate
+}
+
+// estimateStagesBytes 按增量复制的规则统计stages中还需要写入的字节数，语音和头像不在统计范围内
+func estimateStagesBytes(info WeChatInfo, expPath string, options ExportOptions, stages []string) int64 {
+	if len(stages) == 0 {
+		return 0
+	}
+	var bytes int64
+	for _, stage := range EstimateExport(info, expPath, false, options).Stages {
+		for _, name := range stages {
+			if stage.Stage == name {
+				bytes += stage.BytesToCopy
+			}
+		}
+	}
+	return bytes
+}
+
+// estimateExportStage 全量导出时所有文件都会复制，增量导出时用unchanged判断是否跳过
+func estimateExportStage(name string, info WeChatInfo, expPath string, full bool, rootPaths []string, fileSuffix string, unchanged func(src, dst string, size int64) bool) ExportStageEstimate {
+	stage := ExportStageEstimate{Stage: name}
+	for _, rootPath := range rootPaths {
+		if _, err := os.Stat(rootPath); err != nil {
+			continue
+		}
+		err := filepath.Walk(rootPath, func(path string, finfo os.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("filepath.Walk：%v\n", err)
+				return err
+			}
+			if finfo.IsDir() || !strings.HasSuffix(path, fileSuffix) {
+				return nil
+			}
+
+			stage.FilesTotal += 1
+			stage.BytesTotal += finfo.Size()
+			if !full && unchanged(path, weChatMediaExportPath(info, expPath, path), finfo.Size()) {
+				stage.FilesSkipped += 1
+				stage.BytesSkipped += finfo.Size()
+			} else {
+				stage.FilesToCopy += 1
+				stage.BytesToCopy += finfo.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("filepath.Walk:", err)
+		}
+	}
+
+	return stage
+}
+
+// ExportChanges 源数据目录中since之后修改过的文件，只比较修改时间，不读取文件内容
+type ExportChanges struct {
+	NewImages   int64    `json:"newImages"`
+	NewVideos   int64    `json:"newVideos"`
+	NewFiles    int64    `json:"newFiles"`
+	ModifiedDBs []string `json:"modifiedDBs"`
+	Bytes       int64    `json:"bytes"`
+	// 超过deadline时停止遍历，结果只包含已遍历的部分
+	Partial bool `json:"partial"`
+}
+
+// CollectChangesSince 统计since之后修改的数据库、图片、视频和文件，ModifiedDBs为相对数据库目录的路径
+func CollectChangesSince(info WeChatInfo, since time.Time, deadline time.Time) *ExportChanges {
+	changes := &ExportChanges{ModifiedDBs: make([]string, 0)}
+
+	walk := func(rootPath string, fileSuffix string, onChanged func(path string, size int64)) {
+		if changes.Partial {
+			return
+		}
+		if _, err := os.Stat(rootPath); err != nil {
+			return
+		}
+		err := filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				changes.Partial = true
+				return filepath.SkipAll
+			}
+			if d.IsDir() || !strings.HasSuffix(path, fileSuffix) {
+				return nil
+			}
+			finfo, err := d.Info()
+			if err != nil || !finfo.ModTime().After(since) {
+				return nil
+			}
+			changes.Bytes += finfo.Size()
+			onChanged(path, finfo.Size())
+			return nil
+		})
+		if err != nil {
+			log.Println("filepath.WalkDir:", err)
+		}
+	}
+
+	dbRoot := weChatDBRoot(info)
+	walk(dbRoot, ".db", func(path string, size int64) {
+		if rel, err := filepath.Rel(dbRoot, path); err == nil {
+			changes.ModifiedDBs = append(changes.ModifiedDBs, rel)
+		}
+	})
+	walk(weChatMediaRoot(info, "MsgAttach"), ".dat", func(string, int64) { changes.NewImages++ })
+	walk(weChatMediaRoot(info, "Video"), "", func(string, int64) { changes.NewVideos++ })
+	walk(weChatMediaRoot(info, "File"), "", func(string, int64) { changes.NewFiles++ })
+
+	return changes
 }
 
 func ExportWeChatHeadImage(exportPath string) {
-	progress := make(chan string)
+	progress := make(chan ExportProgress)
 	info := WeChatInfo{}
 
 	miscDBPath := fmt.Sprintf("%s\\Msg\\Misc.db", exportPath)
@@ -955,7 +1340,7 @@ func ExportWeChatHeadImage(exportPath string) {
 	}
 
 	go func() {
-		exportWeChatHeadImage(info, exportPath, progress)
+		exportWeChatHeadImage(info, exportPath, 1, 100, progress)
 		close(progress)
 	}()
 
@@ -6,7 +6,9 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 )
@@ -17,7 +19,44 @@ const (
 	defaultPageSize = 4096
 )
 
+var errIncorrectPassword = errors.New("incorrect password")
+
+// dbCipher 数据库的加密参数，每页末尾保留reserve字节，依次为16字节IV和hmacSize字节HMAC
+type dbCipher struct {
+	iter     int
+	hash     func() hash.Hash
+	reserve  int
+	hmacSize int
+}
+
+var (
+	// 3.x 使用 SQLCipher 3 的默认参数
+	dbCipherV3 = dbCipher{iter: defaultIter, hash: sha1.New, reserve: 48, hmacSize: sha1.Size}
+)
+
 func DecryptDataBase(path string, password []byte, expPath string) error {
+	return decryptDataBase(path, password, expPath, dbCipherV3)
+}
+
+// checkPage1 校验第一页的HMAC，返回页数据的解密密钥
+func (c dbCipher) checkPage1(buffer []byte, password []byte) ([]byte, bool) {
+	salt := buffer[:16]
+	key := pbkdf2HMACHash(c.hash, password, salt, c.iter, keySize)
+
+	page1 := buffer[16:defaultPageSize]
+	macOffset := len(page1) - c.reserve + 16
+
+	macSalt := xorBytes(salt, 0x3a)
+	macKey := pbkdf2HMACHash(c.hash, key, macSalt, 2, keySize)
+
+	hashMac := hmac.New(c.hash, macKey)
+	hashMac.Write(page1[:macOffset])
+	hashMac.Write([]byte{1, 0, 0, 0})
+
+	return key, hmac.Equal(hashMac.Sum(nil), page1[macOffset:macOffset+c.hmacSize])
+}
+
+func decryptDataBase(path string, password []byte, expPath string, c dbCipher) error {
 	sqliteFileHeader := []byte("SQLite format 3")
 	sqliteFileHeader = append(sqliteFileHeader, byte(0))
 
@@ -37,20 +76,9 @@ func DecryptDataBase(path string, password []byte, expPath string) error {
 		return fmt.Errorf("read failed")
 	}
 
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
-
-	page1 := buffer[16:defaultPageSize]
-
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
-
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
-
-	if !hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12]) {
-		return fmt.Errorf("incorrect password")
+	key, ok := c.checkPage1(buffer, password)
+	if !ok {
+		return errIncorrectPassword
 	}
 
 	outFilePath := expPath
@@ -71,16 +99,16 @@ func DecryptDataBase(path string, password []byte, expPath string) error {
 		return err
 	}
 
-	page1 = buffer[16:defaultPageSize]
-	iv := page1[len(page1)-48 : len(page1)-32]
+	page1 := buffer[16:defaultPageSize]
+	iv := page1[len(page1)-c.reserve : len(page1)-c.reserve+16]
 	stream := cipher.NewCBCDecrypter(block, iv)
-	decrypted := make([]byte, len(page1)-48)
-	stream.CryptBlocks(decrypted, page1[:len(page1)-48])
+	decrypted := make([]byte, len(page1)-c.reserve)
+	stream.CryptBlocks(decrypted, page1[:len(page1)-c.reserve])
 	_, err = outFile.Write(decrypted)
 	if err != nil {
 		return err
 	}
-	_, err = outFile.Write(page1[len(page1)-48:])
+	_, err = outFile.Write(page1[len(page1)-c.reserve:])
 	if err != nil {
 		return err
 	}
@@ -96,15 +124,15 @@ func DecryptDataBase(path string, password []byte, expPath string) error {
 			return fmt.Errorf("read data to short %d", n)
 		}
 
-		iv := buffer[len(buffer)-48 : len(buffer)-32]
+		iv := buffer[len(buffer)-c.reserve : len(buffer)-c.reserve+16]
 		stream := cipher.NewCBCDecrypter(block, iv)
-		decrypted := make([]byte, len(buffer)-48)
-		stream.CryptBlocks(decrypted, buffer[:len(buffer)-48])
+		decrypted := make([]byte, len(buffer)-c.reserve)
+		stream.CryptBlocks(decrypted, buffer[:len(buffer)-c.reserve])
 		_, err = outFile.Write(decrypted)
 		if err != nil {
 			return err
 		}
-		_, err = outFile.Write(buffer[len(buffer)-48:])
+		_, err = outFile.Write(buffer[len(buffer)-c.reserve:])
 		if err != nil {
 			return err
 		}
@@ -114,15 +142,20 @@ func DecryptDataBase(path string, password []byte, expPath string) error {
 }
 
 func pbkdf2HMAC(password, salt []byte, iter, keyLen int) []byte {
+	return pbkdf2HMACHash(sha1.New, password, salt, iter, keyLen)
+}
+
+func pbkdf2HMACHash(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	hashSize := h().Size()
 	dk := make([]byte, keyLen)
-	loop := (keyLen + sha1.Size - 1) / sha1.Size
+	loop := (keyLen + hashSize - 1) / hashSize
 	key := make([]byte, 0, len(salt)+4)
-	u := make([]byte, sha1.Size)
+	u := make([]byte, hashSize)
 	for i := 1; i <= loop; i++ {
 		key = key[:0]
 		key = append(key, salt...)
 		key = append(key, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
-		hmac := hmac.New(sha1.New, password)
+		hmac := hmac.New(h, password)
 		hmac.Write(key)
 		digest := hmac.Sum(nil)
 		copy(u, digest)
@@ -134,7 +167,7 @@ func pbkdf2HMAC(password, salt []byte, iter, keyLen int) []byte {
 				u[k] ^= di
 			}
 		}
-		copy(dk[(i-1)*sha1.Size:], u)
+		copy(dk[(i-1)*hashSize:], u)
 	}
 	return dk
 }
@@ -1,17 +1,23 @@
 package wechat
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	sync "sync"
+	"sync/atomic"
 	"time"
 	"wechatDataBackup/pkg/utils"
 
@@ -62,6 +68,17 @@ const (
 	Wechat_System_Message_Notice2 = 8000
 )
 
+// 合并转发的聊天记录中嵌套的聊天记录
+const Wechat_Forward_Item_Record = 17
+
+// 嵌套聊天记录的最大展开层数
+const forwardedRecordMaxDepth = 5
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrInvalidAttachType WeChatGetMessageAttachmentList的attachType不是image、video、voice、file
+var ErrInvalidAttachType = errors.New("invalid attachType")
+
 type Message_Search_Direction int
 
 const (
@@ -70,6 +87,22 @@ const (
 	Message_Search_Both
 )
 
+const (
+	Contact_Filter_Group        = "group"
+	Contact_Filter_Individual   = "individual"
+	Contact_Filter_Subscription = "subscription"
+)
+
+const (
+	Session_Sort_Time  = "time"
+	Session_Sort_Name  = "name"
+	Session_Sort_Count = "count"
+
+	Session_Filter_Group      = "group"
+	Session_Filter_Individual = "individual"
+	Session_Filter_Unread     = "unread"
+)
+
 type WeChatUserInfo struct {
 	UserName        string `json:"UserName"`
 	Alias           string `json:"Alias"`
@@ -82,17 +115,20 @@ type WeChatUserInfo struct {
 }
 
 type WeChatSession struct {
-	UserName string         `json:"UserName"`
-	NickName string         `json:"NickName"`
-	Content  string         `json:"Content"`
-	UserInfo WeChatUserInfo `json:"UserInfo"`
-	Time     uint64         `json:"Time"`
-	IsGroup  bool           `json:"IsGroup"`
+	UserName           string         `json:"UserName"`
+	NickName           string         `json:"NickName"`
+	Content            string         `json:"Content"`
+	UserInfo           WeChatUserInfo `json:"UserInfo"`
+	Time               uint64         `json:"Time"`
+	IsGroup            bool           `json:"IsGroup"`
+	LastMessagePreview string         `json:"LastMessagePreview"`
 }
 
 type WeChatSessionList struct {
-	Total int             `json:"Total"`
-	Rows  []WeChatSession `json:"Rows"`
+	Total      int             `json:"Total"`
+	Rows       []WeChatSession `json:"Rows"`
+	SortBy     string          `json:"SortBy"`
+	FilterType string          `json:"FilterType"`
 }
 
 type FileInfo struct {
@@ -117,6 +153,13 @@ type ReferInfo struct {
 	Content     string `json:"Content"`
 }
 
+// WeChatQuotedMessage 引用消息中被引用的原消息，Type为原消息的类型
+type WeChatQuotedMessage struct {
+	Sender string `json:"Sender"`
+	Text   string `json:"Text"`
+	Type   int    `json:"Type"`
+}
+
 type PayInfo struct {
 	Type      int
 	Memo      string
@@ -153,49 +196,157 @@ type LocationInfo struct {
 }
 
 type WeChatMessage struct {
-	LocalId         int            `json:"LocalId"`
-	MsgSvrId        string         `json:"MsgSvrId"`
-	Type            int            `json:"type"`
-	SubType         int            `json:"SubType"`
-	IsSender        int            `json:"IsSender"`
-	CreateTime      int64          `json:"createTime"`
-	Talker          string         `json:"talker"`
-	Content         string         `json:"content"`
-	ThumbPath       string         `json:"ThumbPath"`
-	ImagePath       string         `json:"ImagePath"`
-	VideoPath       string         `json:"VideoPath"`
-	FileInfo        FileInfo       `json:"fileInfo"`
-	EmojiPath       string         `json:"EmojiPath"`
-	VoicePath       string         `json:"VoicePath"`
-	IsChatRoom      bool           `json:"isChatRoom"`
-	UserInfo        WeChatUserInfo `json:"userInfo"`
-	LinkInfo        LinkInfo       `json:"LinkInfo"`
-	ReferInfo       ReferInfo      `json:"ReferInfo"`
-	PayInfo         PayInfo        `json:"PayInfo"`
-	VoipInfo        VoipInfo       `json:"VoipInfo"`
-	VisitInfo       WeChatUserInfo `json:"VisitInfo"`
-	ChannelsInfo    ChannelsInfo   `json:"ChannelsInfo"`
-	MusicInfo       MusicInfo      `json:"MusicInfo"`
-	LocationInfo    LocationInfo   `json:"LocationInfo"`
+	LocalId         int                  `json:"LocalId"`
+	MsgSvrId        string               `json:"MsgSvrId"`
+	Type            int                  `json:"type"`
+	SubType         int                  `json:"SubType"`
+	IsSender        int                  `json:"IsSender"`
+	CreateTime      int64                `json:"createTime"`
+	Talker          string               `json:"talker"`
+	Content         string               `json:"content"`
+	ThumbPath       string               `json:"ThumbPath"`
+	ImagePath       string               `json:"ImagePath"`
+	VideoPath       string               `json:"VideoPath"`
+	FileInfo        FileInfo             `json:"fileInfo"`
+	EmojiPath       string               `json:"EmojiPath"`
+	VoicePath       string               `json:"VoicePath"`
+	VoiceDurationMs int                  `json:"VoiceDurationMs"`
+	IsChatRoom      bool                 `json:"isChatRoom"`
+	UserInfo        WeChatUserInfo       `json:"userInfo"`
+	LinkInfo        LinkInfo             `json:"LinkInfo"`
+	ReferInfo       ReferInfo            `json:"ReferInfo"`
+	QuotedMessage   *WeChatQuotedMessage `json:"QuotedMessage,omitempty"`
+	PayInfo         PayInfo              `json:"PayInfo"`
+	VoipInfo        VoipInfo             `json:"VoipInfo"`
+	VisitInfo       WeChatUserInfo       `json:"VisitInfo"`
+	ChannelsInfo    ChannelsInfo         `json:"ChannelsInfo"`
+	MusicInfo       MusicInfo            `json:"MusicInfo"`
+	LocationInfo    LocationInfo         `json:"LocationInfo"`
 	compressContent []byte
 	bytesExtra      []byte
 }
 
+type WeChatAttachment struct {
+	MessageID  string `json:"MessageID"`
+	CreateTime int64  `json:"CreateTime"`
+	MediaPath  string `json:"MediaPath"`
+	ThumbPath  string `json:"ThumbPath"`
+	FileSize   int64  `json:"FileSize"`
+	FileName   string `json:"FileName"`
+	IsSender   int    `json:"IsSender"`
+}
+
+type WeChatAttachmentList struct {
+	AttachType       string             `json:"AttachType"`
+	Total            int                `json:"Total"`
+	TotalAttachments int                `json:"TotalAttachments"`
+	Rows             []WeChatAttachment `json:"Rows"`
+}
+
+// WeChatForwardedItem 合并转发的聊天记录中的一条，Type为dataitem的datatype，嵌套的聊天记录展开到Items
+type WeChatForwardedItem struct {
+	Sender     string                `json:"Sender"`
+	NickName   string                `json:"NickName"`
+	CreateTime int64                 `json:"CreateTime"`
+	Content    string                `json:"Content"`
+	Type       int                   `json:"Type"`
+	Items      []WeChatForwardedItem `json:"Items,omitempty"`
+}
+
+type WeChatForwardedMessageList struct {
+	MsgSvrId string                `json:"MsgSvrId"`
+	Title    string                `json:"Title"`
+	Total    int                   `json:"Total"`
+	Items    []WeChatForwardedItem `json:"Items"`
+}
+
 type WeChatMessageList struct {
-	MsgType string          `json:"MsgType"`
-	KeyWord string          `json:"KeyWord"`
-	Total   int             `json:"Total"`
-	Rows    []WeChatMessage `json:"Rows"`
+	MsgType      string          `json:"MsgType"`
+	KeyWord      string          `json:"KeyWord"`
+	Total        int             `json:"Total"`
+	Rows         []WeChatMessage `json:"Rows"`
+	NextCursor   string          `json:"NextCursor"`
+	PrevCursor   string          `json:"PrevCursor"`
+	TotalInRange int             `json:"TotalInRange"`
+}
+
+type WeChatRegexMessage struct {
+	WeChatMessage
+	HighlightedContent string `json:"HighlightedContent"`
+}
+
+type WeChatRegexSearchList struct {
+	Pattern     string               `json:"Pattern"`
+	Total       int                  `json:"Total"`
+	Rows        []WeChatRegexMessage `json:"Rows"`
+	TruncatedAt int                  `json:"TruncatedAt"`
 }
 
 type WeChatMessageDate struct {
-	Date  []string `json:"Date"`
-	Total int      `json:"Total"`
+	Date        []string `json:"Date"`
+	Total       int      `json:"Total"`
+	Granularity string   `json:"Granularity"`
+}
+
+const (
+	Message_Date_Granularity_Day   = "day"
+	Message_Date_Granularity_Hour  = "hour"
+	Message_Date_Granularity_Month = "month"
+)
+
+// 各粒度对应的strftime格式，依次为"2006-01-02"、"2006-01-02 15"、"2006-01"
+var messageDateFormats = map[string]string{
+	Message_Date_Granularity_Day:   "%Y-%m-%d",
+	Message_Date_Granularity_Hour:  "%Y-%m-%d %H",
+	Message_Date_Granularity_Month: "%Y-%m",
+}
+
+// MessageDateFormat 返回granularity对应的strftime格式，为空时按天
+func MessageDateFormat(granularity string) (string, bool) {
+	if granularity == "" {
+		granularity = Message_Date_Granularity_Day
+	}
+	dateFormat, ok := messageDateFormats[granularity]
+	return dateFormat, ok
 }
 
 type WeChatUserList struct {
-	Users []WeChatUserInfo `json:"Users"`
-	Total int              `json:"Total"`
+	Users       []WeChatUserInfo `json:"Users"`
+	Total       int              `json:"Total"`
+	FilterTotal int              `json:"FilterTotal"`
+}
+
+const (
+	Room_Member_Event_Join   = "join"
+	Room_Member_Event_Leave  = "leave"
+	Room_Member_Event_Invite = "invite"
+)
+
+type RoomMemberEvent struct {
+	UserName  string `json:"UserName"`
+	NickName  string `json:"NickName"`
+	EventType string `json:"EventType"`
+	Timestamp int64  `json:"Timestamp"`
+}
+
+type WeChatRoomMemberHistory struct {
+	RoomId string            `json:"RoomId"`
+	Events []RoomMemberEvent `json:"Events"`
+	Total  int               `json:"Total"`
+}
+
+type GroupMemberStat struct {
+	UserName     string  `json:"UserName"`
+	NickName     string  `json:"NickName"`
+	MessageCount int     `json:"MessageCount"`
+	Percentage   float64 `json:"Percentage"`
+}
+
+type WeChatGroupSenderStats struct {
+	RoomId        string            `json:"RoomId"`
+	TotalMessages int               `json:"TotalMessages"`
+	MemberCount   int               `json:"MemberCount"`
+	Members       []GroupMemberStat `json:"Members"`
 }
 
 type WeChatContact struct {
@@ -219,6 +370,17 @@ type WeChatAccountInfo struct {
 	SmallHeadImgUrl string `json:"SmallHeadImgUrl"`
 	BigHeadImgUrl   string `json:"BigHeadImgUrl"`
 	LocalHeadImgUrl string `json:"LocalHeadImgUrl"`
+	// 会话列表中最新一条消息的时间
+	LastSyncTime int64 `json:"LastSyncTime"`
+	// 只在按消息数排序时统计
+	MessageCount int64 `json:"MessageCount"`
+}
+
+// WeChatSessionPreview 会话最后一条消息的时间和预览文本
+type WeChatSessionPreview struct {
+	UserName  string `json:"UserName"`
+	Timestamp int64  `json:"Timestamp"`
+	Preview   string `json:"Preview"`
 }
 
 type WeChatLastTime struct {
@@ -233,6 +395,9 @@ type WeChatBookMark struct {
 	Info   string `json:"Info"`
 }
 
+// 书签列表默认的每页数量
+const Default_BookMark_PageSize = 50
+
 type WeChatBookMarkList struct {
 	Marks []WeChatBookMark `json:"Marks"`
 	Total int              `json:"Total"`
@@ -254,6 +419,13 @@ type WechatDataProvider struct {
 	msgDBs        []*wechatMsgDB
 	userInfoMap   map[string]WeChatUserInfo
 	userInfoMtx   sync.Mutex
+	readOnly      bool
+	// 语音原始数据所在的MediaMSG数据库，首次读取语音时打开
+	mediaMSGDBs  []*sql.DB
+	mediaMSGOnce sync.Once
+	// 按消息数排序会话时使用的各会话消息数，JSON对象，首次使用时统计
+	sessionCounts     string
+	sessionCountsOnce sync.Once
 
 	SelfInfo    *WeChatUserInfo
 	ContactList *WeChatContactList
@@ -266,12 +438,23 @@ const (
 	UserDataDB      = "UserData.db"
 )
 
+const wechatMsgColumns = "localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra"
+
 type byTime []*wechatMsgDB
 
 func (a byTime) Len() int           { return len(a) }
 func (a byTime) Less(i, j int) bool { return a[i].startTime > a[j].startTime }
 func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
+// msgDBsOldestFirst msgDBs按byTime从新到旧排列，返回从旧到新的副本
+func (P *WechatDataProvider) msgDBsOldestFirst() []*wechatMsgDB {
+	msgDBs := make([]*wechatMsgDB, len(P.msgDBs))
+	for i, msgDB := range P.msgDBs {
+		msgDBs[len(P.msgDBs)-1-i] = msgDB
+	}
+	return msgDBs
+}
+
 type byName []WeChatContact
 
 func (c byName) Len() int { return len(c) }
@@ -294,20 +477,34 @@ func (c byName) Less(i, j int) bool {
 func (c byName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
 
 func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProvider, error) {
+	return createWechatDataProvider(resPath, prefixRes, filepath.Base(resPath), false)
+}
+
+// CreateWechatDataProviderReadOnly 以只读方式打开导出快照等不允许修改的数据，快照目录名不是账号名，由userName指定
+func CreateWechatDataProviderReadOnly(resPath string, prefixRes string, userName string) (*WechatDataProvider, error) {
+	return createWechatDataProvider(resPath, prefixRes, userName, true)
+}
+
+// ResPath 返回打开的数据目录，打开快照时为快照目录
+func (P *WechatDataProvider) ResPath() string {
+	return P.resPath
+}
+
+func createWechatDataProvider(resPath string, prefixRes string, userName string, readOnly bool) (*WechatDataProvider, error) {
 	provider := &WechatDataProvider{}
 	provider.resPath = resPath
 	provider.prefixResPath = prefixRes
+	provider.readOnly = readOnly
 	provider.msgDBs = make([]*wechatMsgDB, 0)
 	log.Printf("CreateWechatDataProvider - resPath: %s", resPath)
 	log.Printf("CreateWechatDataProvider - prefixRes: %s", prefixRes)
 
-	userName := filepath.Base(resPath)
 	MicroMsgDBPath := resPath + "\\Msg\\" + MicroMsgDB
 	if _, err := os.Stat(MicroMsgDBPath); err != nil {
 		log.Println("CreateWechatDataProvider failed", MicroMsgDBPath, err)
 		return provider, err
 	}
-	microMsg, err := sql.Open("sqlite3", MicroMsgDBPath)
+	microMsg, err := openSqlite(MicroMsgDBPath, readOnly)
 	if err != nil {
 		log.Printf("open db %s error: %v", MicroMsgDBPath, err)
 		return provider, err
@@ -316,14 +513,19 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	var openIMContact *sql.DB
 	OpenIMContactDBPath := resPath + "\\Msg\\" + OpenIMContactDB
 	if _, err := os.Stat(OpenIMContactDBPath); err == nil {
-		openIMContact, err = sql.Open("sqlite3", OpenIMContactDBPath)
+		openIMContact, err = openSqlite(OpenIMContactDBPath, readOnly)
 		if err != nil {
 			log.Printf("open db %s error: %v", OpenIMContactDBPath, err)
 		}
 	}
 
 	UserDataDBPath := resPath + "\\Msg\\" + UserDataDB
-	userData := openUserDataDB(UserDataDBPath)
+	var userData *sql.DB
+	if readOnly {
+		userData, err = openSqlite(UserDataDBPath, true)
+	} else {
+		userData = openUserDataDB(UserDataDBPath)
+	}
 	if userData == nil {
 		log.Printf("open db %s error: %v", UserDataDBPath, err)
 		return provider, err
@@ -332,7 +534,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", provider.resPath)
 	if _, err := os.Stat(msgDBPath); err == nil {
 		log.Println("msgDBPath", msgDBPath)
-		msgDB, err := wechatOpenMsgDB(msgDBPath)
+		msgDB, err := wechatOpenMsgDB(msgDBPath, readOnly)
 		if err != nil {
 			log.Printf("open db %s error: %v", msgDBPath, err)
 		} else {
@@ -350,7 +552,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 			break
 		}
 
-		msgDB, err := wechatOpenMsgDB(msgDBPath)
+		msgDB, err := wechatOpenMsgDB(msgDBPath, readOnly)
 		if err != nil {
 			log.Printf("open db %s error: %v", msgDBPath, err)
 			index += 1
@@ -414,6 +616,13 @@ func (P *WechatDataProvider) WechatWechatDataProviderClose() {
 			log.Println("db close:", err)
 		}
 	}
+
+	for _, db := range P.mediaMSGDBs {
+		err := db.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
 	log.Println("WechatWechatDataProviderClose:", P.resPath)
 }
 
@@ -497,22 +706,69 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	return info, nil
 }
 
-func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (*WeChatSessionList, error) {
-	List := &WeChatSessionList{}
+// WeChatGetSessionList 按sortBy排序、filterType过滤分页查询会话，排序和过滤都在SQL中完成，
+// sortBy为空时按微信中的会话顺序
+func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int, sortBy string, filterType string) (*WeChatSessionList, error) {
+	List, _, err := P.weChatGetSessionList(pageIndex, pageSize, sortBy, filterType, true)
+	return List, err
+}
+
+// WeChatGetSessionPage 按默认顺序读取一页会话，不生成最后一条消息预览；
+// 同时返回本页从数据库读取的行数，包括没有联系人信息而跳过的会话，小于pageSize时已读完
+func (P *WechatDataProvider) WeChatGetSessionPage(pageIndex int, pageSize int) (*WeChatSessionList, int, error) {
+	return P.weChatGetSessionList(pageIndex, pageSize, "", "", false)
+}
+
+func (P *WechatDataProvider) weChatGetSessionList(pageIndex int, pageSize int, sortBy string, filterType string, preview bool) (*WeChatSessionList, int, error) {
+	List := &WeChatSessionList{SortBy: sortBy, FilterType: filterType}
 	List.Rows = make([]WeChatSession, 0)
 
-	querySql := fmt.Sprintf("select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc limit %d, %d;", pageIndex*pageSize, pageSize)
-	dbRows, err := P.microMsg.Query(querySql)
+	where := "ifnull(strContent,'')!=''"
+	switch filterType {
+	case "":
+	case Session_Filter_Group:
+		where += " and strUsrName like '%@chatroom'"
+	case Session_Filter_Individual:
+		where += " and strUsrName not like '%@chatroom' and strUsrName not like 'gh\\_%' escape '\\'"
+	case Session_Filter_Unread:
+		where += " and nUnReadCount>0"
+	default:
+		return List, 0, fmt.Errorf("unknown session filter: %s", filterType)
+	}
+
+	args := make([]interface{}, 0)
+	from := "Session"
+	orderBy := "nOrder desc"
+	switch sortBy {
+	case "":
+	case Session_Sort_Time:
+		orderBy = "nTime desc"
+	case Session_Sort_Name:
+		orderBy = "ifnull(nullif(strNickName,''),strUsrName) asc"
+	case Session_Sort_Count:
+		// 消息分布在多个MSG数据库中，把统计结果作为JSON参数在MicroMsg中关联
+		from = "Session left join json_each(?) as counts on counts.key=Session.strUsrName"
+		args = append(args, P.weChatGetSessionCounts())
+		orderBy = "ifnull(counts.value,0) desc, nOrder desc"
+	default:
+		return List, 0, fmt.Errorf("unknown session sort: %s", sortBy)
+	}
+	args = append(args, pageIndex*pageSize, pageSize)
+
+	querySql := fmt.Sprintf("select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from %s where %s order by %s limit ?, ?;", from, where, orderBy)
+	dbRows, err := P.microMsg.Query(querySql, args...)
 	if err != nil {
 		log.Println(err)
-		return List, err
+		return List, 0, err
 	}
 	defer dbRows.Close()
 
+	fetched := 0
 	var strUsrName, strNickName, strContent string
 	var nTime uint64
 	var nMsgType int
 	for dbRows.Next() {
+		fetched += 1
 		var session WeChatSession
 		err = dbRows.Scan(&strUsrName, &strNickName, &strContent, &nMsgType, &nTime)
 		if err != nil {
@@ -535,28 +791,46 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 			continue
 		}
 		session.UserInfo = *info
+		if preview {
+			session.LastMessagePreview = P.WeChatGetSessionLastMessagePreview(strUsrName).Preview
+		}
 		List.Rows = append(List.Rows, session)
 		List.Total += 1
 	}
 
-	return List, nil
+	return List, fetched, nil
 }
 
-func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int) (*WeChatUserList, error) {
+func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int, filter string) (*WeChatUserList, error) {
 	List := &WeChatUserList{}
 	List.Users = make([]WeChatUserInfo, 0)
 
-	if P.ContactList.Total <= pageIndex*pageSize {
+	if filter != "" && filter != Contact_Filter_Group && filter != Contact_Filter_Individual && filter != Contact_Filter_Subscription {
+		return List, fmt.Errorf("unknown contact filter: %s", filter)
+	}
+
+	contacts := P.ContactList.Users
+	if filter != "" {
+		contacts = make([]WeChatContact, 0)
+		for _, contact := range P.ContactList.Users {
+			if weChatContactFilter(contact.UserName, filter) {
+				contacts = append(contacts, contact)
+			}
+		}
+	}
+	List.FilterTotal = len(contacts)
+
+	if len(contacts) <= pageIndex*pageSize {
 		return List, nil
 	}
 	end := (pageIndex * pageSize) + pageSize
-	if end > P.ContactList.Total {
-		end = P.ContactList.Total
+	if end > len(contacts) {
+		end = len(contacts)
 	}
 
-	log.Printf("P.ContactList.Total %d, start %d, end %d", P.ContactList.Total, pageIndex*pageSize, end)
+	log.Printf("P.ContactList.Total %d, filter [%s] %d, start %d, end %d", P.ContactList.Total, filter, len(contacts), pageIndex*pageSize, end)
 	var info WeChatUserInfo
-	for _, contact := range P.ContactList.Users[pageIndex*pageSize : end] {
+	for _, contact := range contacts[pageIndex*pageSize : end] {
 		info = contact.WeChatUserInfo
 		List.Users = append(List.Users, info)
 		List.Total += 1
@@ -565,6 +839,86 @@ func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int) (
 	return List, nil
 }
 
+// WeChatGetContactByKeyword 按昵称、备注、微信号模糊搜索联系人，ASCII不区分大小写
+func (P *WechatDataProvider) WeChatGetContactByKeyword(keyword string, pageSize, pageIndex int) (*WeChatUserList, error) {
+	List := &WeChatUserList{}
+	List.Users = make([]WeChatUserInfo, 0)
+	if keyword == "" || pageSize <= 0 || pageIndex < 0 {
+		return List, nil
+	}
+
+	conn, err := P.microMsg.Conn(context.Background())
+	if err != nil {
+		log.Println("microMsg.Conn failed:", err)
+		return List, err
+	}
+	defer conn.Close()
+
+	// PRAGMA只对当前连接生效
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA case_sensitive_like = 0;"); err != nil {
+		log.Println("PRAGMA case_sensitive_like failed:", err)
+		return List, err
+	}
+
+	escaper := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	pattern := "%" + escaper.Replace(keyword) + "%"
+	where := "Reserved1=1 And Reserved2=1 And (NickName LIKE ? ESCAPE '\\' OR Remark LIKE ? ESCAPE '\\' OR UserName LIKE ? ESCAPE '\\')"
+
+	countSql := "select COUNT(*) from Contact Where " + where + ";"
+	err = conn.QueryRowContext(context.Background(), countSql, pattern, pattern, pattern).Scan(&List.FilterTotal)
+	if err != nil {
+		log.Println("count contact failed:", err)
+		return List, err
+	}
+
+	querySql := "select ifnull(UserName,'') as UserName from Contact Where " + where + " order by ifnull(RemarkQuanPin,''), ifnull(QuanPin,'') limit ? offset ?;"
+	rows, err := conn.QueryContext(context.Background(), querySql, pattern, pattern, pattern, pageSize, pageIndex*pageSize)
+	if err != nil {
+		log.Println("query contact failed:", err)
+		return List, err
+	}
+	defer rows.Close()
+
+	userNames := make([]string, 0)
+	for rows.Next() {
+		var UserName string
+		if err := rows.Scan(&UserName); err != nil {
+			log.Println(err)
+			continue
+		}
+		userNames = append(userNames, UserName)
+	}
+	rows.Close()
+
+	for _, userName := range userNames {
+		info, err := P.WechatGetUserInfoByNameOnCache(userName)
+		if err != nil {
+			log.Printf("WechatGetUserInfoByName %s failed\n", userName)
+			continue
+		}
+		List.Users = append(List.Users, *info)
+		List.Total += 1
+	}
+
+	return List, nil
+}
+
+// weChatContactFilter 群聊以@chatroom结尾，公众号以gh_开头，其余为个人
+func weChatContactFilter(userName string, filter string) bool {
+	isGroup := strings.HasSuffix(userName, "@chatroom")
+	isSubscription := strings.HasPrefix(userName, "gh_")
+	switch filter {
+	case Contact_Filter_Group:
+		return isGroup
+	case Contact_Filter_Subscription:
+		return isSubscription
+	case Contact_Filter_Individual:
+		return !isGroup && !isSubscription
+	default:
+		return true
+	}
+}
+
 func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time int64, pageSize int, direction Message_Search_Direction) (*WeChatMessageList, error) {
 
 	List := &WeChatMessageList{}
@@ -619,9 +973,583 @@ func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time in
 		log.Printf("Backward selectTime %d, selectpageSize %d\n", selectTime, selectpageSize)
 	}
 
+	wechatMessageListSetCursor(List)
+	return List, nil
+}
+
+// WeChatGetMessageListByCursor 按NextCursor（更早的消息）或PrevCursor（更新的消息）返回的游标分页，
+// cursor为空时从最新的消息开始，Rows总是按时间从新到旧排列
+func (P *WechatDataProvider) WeChatGetMessageListByCursor(userName string, cursor string, pageSize int) (*WeChatMessageList, error) {
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+	if pageSize <= 0 {
+		return List, nil
+	}
+
+	direction := Message_Search_Forward
+	createTime, msgSvrId := time.Now().Unix()+1, int64(0)
+	if cursor != "" {
+		var err error
+		direction, createTime, msgSvrId, err = wechatDecodeMessageCursor(cursor)
+		if err != nil {
+			log.Println("wechatDecodeMessageCursor failed:", err)
+			return List, err
+		}
+	}
+
+	querySql := "select " + wechatMsgColumns + " from MSG Where StrTalker=? And (CreateTime<? Or (CreateTime=? And MsgSvrID<?)) order by CreateTime desc, MsgSvrID desc limit ?;"
+	if direction == Message_Search_Backward {
+		querySql = "select * from (select " + wechatMsgColumns + " from MSG Where StrTalker=? And (CreateTime>? Or (CreateTime=? And MsgSvrID>?)) order by CreateTime asc, MsgSvrID asc limit ?) AS SubQuery order by CreateTime desc, MsgSvrID desc;"
+	}
+
+	msgDBs := P.msgDBs
+	if direction == Message_Search_Backward {
+		msgDBs = P.msgDBsOldestFirst()
+	}
+	for _, msgDB := range msgDBs {
+		if direction == Message_Search_Forward && msgDB.startTime > createTime {
+			continue
+		}
+		if direction == Message_Search_Backward && msgDB.endTime < createTime {
+			continue
+		}
+
+		selectList := &WeChatMessageList{}
+		selectList.Rows = make([]WeChatMessage, 0)
+		rows, err := msgDB.db.Query(querySql, userName, createTime, createTime, msgSvrId, pageSize-List.Total)
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+		err = P.wechatMessageRowsHandle(rows, selectList)
+		rows.Close()
+		if err != nil {
+			return List, err
+		}
+
+		if direction == Message_Search_Backward {
+			List.Rows = append(selectList.Rows, List.Rows...)
+		} else {
+			List.Rows = append(List.Rows, selectList.Rows...)
+		}
+		List.Total += selectList.Total
+		if List.Total >= pageSize {
+			break
+		}
+	}
+
+	wechatMessageListSetCursor(List)
+	return List, nil
+}
+
+// WeChatGetMessageListByDateRange 按CreateTime升序分页返回[startTime, endTime]内的消息，
+// TotalInRange为范围内的消息总数
+func (P *WechatDataProvider) WeChatGetMessageListByDateRange(userName string, startTime, endTime int64, pageIndex, pageSize int) (*WeChatMessageList, error) {
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+	if startTime > endTime {
+		return List, fmt.Errorf("invalid range: startTime %d > endTime %d", startTime, endTime)
+	}
+	if pageIndex < 0 || pageSize <= 0 {
+		return List, fmt.Errorf("invalid page: pageIndex %d, pageSize %d", pageIndex, pageSize)
+	}
+
+	countSql := "select COUNT(*) from MSG Where StrTalker=? And CreateTime>=? And CreateTime<=?;"
+	querySql := "select " + wechatMsgColumns + " from MSG Where StrTalker=? And CreateTime>=? And CreateTime<=? order by CreateTime asc, Sequence asc limit ? offset ?;"
+	offset := pageIndex * pageSize
+
+	for _, msgDB := range P.msgDBsOldestFirst() {
+		if msgDB.endTime < startTime || msgDB.startTime > endTime {
+			continue
+		}
+
+		count := 0
+		err := msgDB.db.QueryRow(countSql, userName, startTime, endTime).Scan(&count)
+		if err != nil {
+			log.Printf("%s count failed %v\n", msgDB.path, err)
+			continue
+		}
+		List.TotalInRange += count
+
+		if List.Total >= pageSize {
+			continue
+		}
+		if offset >= count {
+			offset -= count
+			continue
+		}
+
+		rows, err := msgDB.db.Query(querySql, userName, startTime, endTime, pageSize-List.Total, offset)
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+		err = P.wechatMessageRowsHandle(rows, List)
+		rows.Close()
+		if err != nil {
+			return List, err
+		}
+		offset = 0
+	}
+
+	wechatMessageListSetCursor(List)
+	return List, nil
+}
+
+// WeChatGetMessageListBySender 返回userName会话中senderUserName发送的消息，按CreateTime升序分页，
+// senderUserName为"me"时表示自己，TotalInRange为该发送者的消息总数。
+// 群消息的发送者保存在BytesExtra中，需要逐条解析后再按localId取出当前页
+func (P *WechatDataProvider) WeChatGetMessageListBySender(userName, senderUserName string, pageIndex, pageSize int) (*WeChatMessageList, error) {
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+	if pageIndex < 0 || pageSize <= 0 {
+		return List, fmt.Errorf("invalid page: pageIndex %d, pageSize %d", pageIndex, pageSize)
+	}
+
+	if senderUserName == "me" {
+		senderUserName = P.SelfInfo.UserName
+	}
+	isSender := 0
+	if senderUserName == P.SelfInfo.UserName {
+		isSender = 1
+	}
+	isChatRoom := strings.HasSuffix(userName, "@chatroom")
+	if isSender == 0 && !isChatRoom && senderUserName != userName {
+		return List, nil
+	}
+
+	countSql := "select COUNT(*) from MSG Where StrTalker=? And IsSender=?;"
+	querySql := "select " + wechatMsgColumns + " from MSG Where StrTalker=? And IsSender=? order by CreateTime asc, Sequence asc limit ? offset ?;"
+	offset := pageIndex * pageSize
+
+	for _, msgDB := range P.msgDBsOldestFirst() {
+		var ids []int
+		count := 0
+		if isSender == 0 && isChatRoom {
+			ids = weChatGroupSenderMessageIds(msgDB, userName, senderUserName)
+			count = len(ids)
+		} else {
+			err := msgDB.db.QueryRow(countSql, userName, isSender).Scan(&count)
+			if err != nil {
+				log.Printf("%s count failed %v\n", msgDB.path, err)
+				continue
+			}
+		}
+		List.TotalInRange += count
+
+		if List.Total >= pageSize {
+			continue
+		}
+		if offset >= count {
+			offset -= count
+			continue
+		}
+
+		var rows *sql.Rows
+		var err error
+		if ids != nil {
+			end := offset + pageSize - List.Total
+			if end > len(ids) {
+				end = len(ids)
+			}
+			page := ids[offset:end]
+			args := make([]interface{}, len(page))
+			for j := range page {
+				args[j] = page[j]
+			}
+			pageSql := "select " + wechatMsgColumns + " from MSG Where localId in (?" + strings.Repeat(",?", len(page)-1) + ") order by CreateTime asc, Sequence asc;"
+			rows, err = msgDB.db.Query(pageSql, args...)
+		} else {
+			rows, err = msgDB.db.Query(querySql, userName, isSender, pageSize-List.Total, offset)
+		}
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+		err = P.wechatMessageRowsHandle(rows, List)
+		rows.Close()
+		if err != nil {
+			return List, err
+		}
+		offset = 0
+	}
+
+	wechatMessageListSetCursor(List)
+	return List, nil
+}
+
+// weChatGroupSenderMessageIds 返回群聊roomId中sender发送的消息localId，按CreateTime升序
+func weChatGroupSenderMessageIds(msgDB *wechatMsgDB, roomId, sender string) []int {
+	ids := make([]int, 0)
+	querySql := "select localId, ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker=? And IsSender=0 order by CreateTime asc, Sequence asc;"
+	rows, err := msgDB.db.Query(querySql, roomId)
+	if err != nil {
+		log.Printf("%s failed %v\n", msgDB.path, err)
+		return ids
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var localId int
+		var bytesExtra []byte
+		if err := rows.Scan(&localId, &bytesExtra); err != nil {
+			log.Println("rows.Scan failed", err)
+			continue
+		}
+
+		var extra MessageBytesExtra
+		if err := proto.Unmarshal(bytesExtra, &extra); err != nil {
+			continue
+		}
+		for _, ext := range extra.Message2 {
+			if ext.Field1 == 1 {
+				if ext.Field2 == sender {
+					ids = append(ids, localId)
+				}
+				break
+			}
+		}
+	}
+
+	return ids
+}
+
+// WeChatGetMessageAttachmentList 按时间从新到旧分页返回会话中的图片、视频、语音或文件，
+// attachType为image、video、voice、file，TotalAttachments为该类型的总数
+func (P *WechatDataProvider) WeChatGetMessageAttachmentList(userName string, attachType string, pageIndex, pageSize int) (*WeChatAttachmentList, error) {
+	List := &WeChatAttachmentList{AttachType: attachType}
+	List.Rows = make([]WeChatAttachment, 0)
+	if pageIndex < 0 || pageSize <= 0 {
+		return List, fmt.Errorf("invalid page: pageIndex %d, pageSize %d", pageIndex, pageSize)
+	}
+
+	condition := ""
+	switch attachType {
+	case "image":
+		condition = fmt.Sprintf("Type=%d", Wechat_Message_Type_Picture)
+	case "video":
+		condition = fmt.Sprintf("Type=%d", Wechat_Message_Type_Video)
+	case "voice":
+		condition = fmt.Sprintf("Type=%d", Wechat_Message_Type_Voice)
+	case "file":
+		condition = fmt.Sprintf("Type=%d And SubType=%d", Wechat_Message_Type_Misc, Wechat_Misc_Message_File)
+	default:
+		return List, fmt.Errorf("%w: %s", ErrInvalidAttachType, attachType)
+	}
+
+	countSql := "select COUNT(*) from MSG Where StrTalker=? And " + condition + ";"
+	querySql := "select " + wechatMsgColumns + " from MSG Where StrTalker=? And " + condition + " order by CreateTime desc, Sequence desc limit ? offset ?;"
+	offset := pageIndex * pageSize
+
+	messages := &WeChatMessageList{}
+	messages.Rows = make([]WeChatMessage, 0)
+	for _, msgDB := range P.msgDBs {
+		count := 0
+		err := msgDB.db.QueryRow(countSql, userName).Scan(&count)
+		if err != nil {
+			log.Printf("%s count failed %v\n", msgDB.path, err)
+			continue
+		}
+		List.TotalAttachments += count
+
+		if messages.Total >= pageSize {
+			continue
+		}
+		if offset >= count {
+			offset -= count
+			continue
+		}
+
+		rows, err := msgDB.db.Query(querySql, userName, pageSize-messages.Total, offset)
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+		err = P.wechatMessageRowsHandle(rows, messages)
+		rows.Close()
+		if err != nil {
+			return List, err
+		}
+		offset = 0
+	}
+
+	topDir := filepath.Dir(filepath.Dir(P.resPath))
+	for _, msg := range messages.Rows {
+		attach := WeChatAttachment{
+			MessageID:  msg.MsgSvrId,
+			CreateTime: msg.CreateTime,
+			ThumbPath:  msg.ThumbPath,
+			IsSender:   msg.IsSender,
+		}
+		switch msg.Type {
+		case Wechat_Message_Type_Picture:
+			attach.MediaPath = msg.ImagePath
+		case Wechat_Message_Type_Video:
+			attach.MediaPath = msg.VideoPath
+		case Wechat_Message_Type_Voice:
+			attach.MediaPath = msg.VoicePath
+		case Wechat_Message_Type_Misc:
+			attach.MediaPath = msg.FileInfo.FilePath
+			attach.FileName = msg.FileInfo.FileName
+			attach.FileSize, _ = strconv.ParseInt(msg.FileInfo.FileSize, 10, 64)
+		}
+		if attach.FileName == "" && attach.MediaPath != "" {
+			attach.FileName = filepath.Base(attach.MediaPath)
+		}
+		if attach.FileSize == 0 && attach.MediaPath != "" {
+			if info, err := os.Stat(topDir + attach.MediaPath); err == nil {
+				attach.FileSize = info.Size()
+			}
+		}
+		List.Rows = append(List.Rows, attach)
+		List.Total += 1
+	}
+
+	return List, nil
+}
+
+// WeChatGetForwardedMessages 展开合并转发消息中的聊天记录，嵌套的聊天记录最多展开forwardedRecordMaxDepth层
+func (P *WechatDataProvider) WeChatGetForwardedMessages(msgSvrId string) (*WeChatForwardedMessageList, error) {
+	List := &WeChatForwardedMessageList{MsgSvrId: msgSvrId}
+	List.Items = make([]WeChatForwardedItem, 0)
+	svrId, err := strconv.ParseInt(msgSvrId, 10, 64)
+	if err != nil {
+		return List, fmt.Errorf("invalid msgSvrId %s: %v", msgSvrId, err)
+	}
+
+	var Type, SubType int
+	var CompressContent []byte
+	found := false
+	for _, msgDB := range P.msgDBs {
+		err := msgDB.db.QueryRow("select Type, SubType, ifnull(CompressContent,'') from MSG Where MsgSvrID=?;", svrId).Scan(&Type, &SubType, &CompressContent)
+		if err == nil {
+			found = true
+			break
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("%s query %s failed %v\n", msgDB.path, msgSvrId, err)
+		}
+	}
+	if !found {
+		return List, fmt.Errorf("%w: %s", ErrMessageNotFound, msgSvrId)
+	}
+	if Type != Wechat_Message_Type_Misc || SubType != Wechat_Misc_Message_ForwardMessage {
+		return List, fmt.Errorf("message %s is not a forwarded chat record", msgSvrId)
+	}
+
+	unCompressContent := make([]byte, len(CompressContent)*10)
+	ulen, err := lz4.UncompressBlock(CompressContent, unCompressContent)
+	if err != nil || ulen == 0 {
+		return List, fmt.Errorf("UncompressBlock %s failed: %v", msgSvrId, err)
+	}
+	compMsg := etree.NewDocument()
+	if err := compMsg.ReadFromBytes(unCompressContent[:ulen-1]); err != nil {
+		return List, err
+	}
+	root := NewxmlDocument(compMsg)
+	List.Title = root.FindElementValue("/msg/appmsg/title")
+
+	// recorditem中是转义后的recordinfo文档
+	recordDoc := etree.NewDocument()
+	if err := recordDoc.ReadFromString(root.FindElementValue("/msg/appmsg/recorditem")); err != nil {
+		return List, err
+	}
+	if recordInfo := recordDoc.FindElement("/recordinfo"); recordInfo != nil {
+		List.Items = weChatParseForwardedRecord(recordInfo, 1)
+	}
+	List.Total = len(List.Items)
+
 	return List, nil
 }
 
+// weChatParseForwardedRecord 解析recordinfo下的dataitem，depth超过forwardedRecordMaxDepth后不再展开
+func weChatParseForwardedRecord(recordInfo *etree.Element, depth int) []WeChatForwardedItem {
+	items := make([]WeChatForwardedItem, 0)
+	for _, dataItem := range recordInfo.FindElements("./datalist/dataitem") {
+		item := WeChatForwardedItem{}
+		item.Type, _ = strconv.Atoi(dataItem.SelectAttrValue("datatype", "0"))
+		item.NickName = forwardedElementText(dataItem, "./sourcename")
+		item.Sender = forwardedElementText(dataItem, "./dataitemsource/realchatname")
+		if item.Sender == "" {
+			item.Sender = forwardedElementText(dataItem, "./dataitemsource/fromusr")
+		}
+		item.CreateTime, _ = strconv.ParseInt(forwardedElementText(dataItem, "./srcMsgCreateTime"), 10, 64)
+		if item.CreateTime == 0 {
+			if t, err := time.ParseInLocation("2006-1-2 15:04", forwardedElementText(dataItem, "./sourcetime"), time.Local); err == nil {
+				item.CreateTime = t.Unix()
+			}
+		}
+		item.Content = forwardedElementText(dataItem, "./datadesc")
+		if item.Content == "" {
+			item.Content = forwardedElementText(dataItem, "./datatitle")
+		}
+
+		if item.Type == Wechat_Forward_Item_Record && depth < forwardedRecordMaxDepth {
+			// 嵌套的聊天记录可能是子元素，也可能是转义后的文本
+			nested := dataItem.FindElement("./recordxml/recordinfo")
+			if nested == nil {
+				nestedDoc := etree.NewDocument()
+				if err := nestedDoc.ReadFromString(forwardedElementText(dataItem, "./recordxml")); err == nil {
+					nested = nestedDoc.FindElement("/recordinfo")
+				}
+			}
+			if nested != nil {
+				item.Items = weChatParseForwardedRecord(nested, depth+1)
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func forwardedElementText(e *etree.Element, path string) string {
+	if item := e.FindElement(path); item != nil {
+		return strings.TrimSpace(item.Text())
+	}
+	return ""
+}
+
+// WeChatSearchMessageListByRegex 按游标遍历userName的全部文本消息，返回匹配re的消息，
+// 结果数达到limit时停止并设置TruncatedAt
+func (P *WechatDataProvider) WeChatSearchMessageListByRegex(userName string, re *regexp.Regexp, limit int) (*WeChatRegexSearchList, error) {
+	List := &WeChatRegexSearchList{}
+	List.Pattern = re.String()
+	List.Rows = make([]WeChatRegexMessage, 0)
+
+	cursor := ""
+	for {
+		selectList, err := P.WeChatGetMessageListByCursor(userName, cursor, 600)
+		if err != nil {
+			return List, err
+		}
+		if selectList.Total == 0 {
+			break
+		}
+
+		for i := range selectList.Rows {
+			msg := &selectList.Rows[i]
+			if msg.Type != Wechat_Message_Type_Text || !re.MatchString(msg.Content) {
+				continue
+			}
+
+			if List.Total >= limit {
+				List.TruncatedAt = limit
+				return List, nil
+			}
+			List.Rows = append(List.Rows, WeChatRegexMessage{
+				WeChatMessage:      *msg,
+				HighlightedContent: weChatHighlightMatches(re, msg.Content),
+			})
+			List.Total += 1
+		}
+
+		cursor = selectList.NextCursor
+	}
+
+	return List, nil
+}
+
+// weChatHighlightMatches 转义HTML后用<mark>标记匹配的内容
+func weChatHighlightMatches(re *regexp.Regexp, content string) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(content, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		builder.WriteString(html.EscapeString(content[last:loc[0]]))
+		builder.WriteString("<mark>")
+		builder.WriteString(html.EscapeString(content[loc[0]:loc[1]]))
+		builder.WriteString("</mark>")
+		last = loc[1]
+	}
+	builder.WriteString(html.EscapeString(content[last:]))
+
+	return builder.String()
+}
+
+// WechatMessageCursorByTime 返回从time开始（包含time）按direction翻页的游标，
+// 供WeChatGetMessageListByCursor从指定时间开始遍历
+func WechatMessageCursorByTime(time int64, direction Message_Search_Direction) string {
+	if direction == Message_Search_Backward {
+		return wechatEncodeMessageCursor(Message_Search_Backward, time, "0")
+	}
+	return wechatEncodeMessageCursor(Message_Search_Forward, time+1, "0")
+}
+
+// WeChatGetMessageCountByTime 统计从time开始按direction方向的消息数，Forward为更早的消息
+func (P *WechatDataProvider) WeChatGetMessageCountByTime(userName string, time int64, direction Message_Search_Direction) (int, error) {
+	countSql := "select COUNT(*) from MSG Where StrTalker=? And CreateTime<=?;"
+	if direction == Message_Search_Backward {
+		countSql = "select COUNT(*) from MSG Where StrTalker=? And CreateTime>=?;"
+	}
+
+	total := 0
+	for _, msgDB := range P.msgDBs {
+		if direction == Message_Search_Forward && msgDB.startTime > time {
+			continue
+		}
+		if direction == Message_Search_Backward && msgDB.endTime < time {
+			continue
+		}
+
+		count := 0
+		if err := msgDB.db.QueryRow(countSql, userName, time).Scan(&count); err != nil {
+			log.Printf("%s count failed %v\n", msgDB.path, err)
+			return total, err
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+func wechatMessageListSetCursor(List *WeChatMessageList) {
+	List.NextCursor = ""
+	List.PrevCursor = ""
+	if len(List.Rows) == 0 {
+		return
+	}
+
+	first := List.Rows[0]
+	last := List.Rows[len(List.Rows)-1]
+	List.PrevCursor = wechatEncodeMessageCursor(Message_Search_Backward, first.CreateTime, first.MsgSvrId)
+	List.NextCursor = wechatEncodeMessageCursor(Message_Search_Forward, last.CreateTime, last.MsgSvrId)
+}
+
+func wechatEncodeMessageCursor(direction Message_Search_Direction, createTime int64, msgSvrId string) string {
+	raw := fmt.Sprintf("%d:%d:%s", direction, createTime, msgSvrId)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func wechatDecodeMessageCursor(cursor string) (Message_Search_Direction, int64, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Message_Search_Forward, 0, 0, err
+	}
+
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return Message_Search_Forward, 0, 0, errors.New("invalid cursor " + cursor)
+	}
+
+	direction, err := strconv.Atoi(parts[0])
+	if err != nil || (direction != int(Message_Search_Forward) && direction != int(Message_Search_Backward)) {
+		return Message_Search_Forward, 0, 0, errors.New("invalid cursor direction " + cursor)
+	}
+	createTime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Message_Search_Forward, 0, 0, err
+	}
+	msgSvrId, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return Message_Search_Forward, 0, 0, err
+	}
+
+	return Message_Search_Direction(direction), createTime, msgSvrId, nil
+}
+
 func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time int64, pageSize int, direction Message_Search_Direction) (*WeChatMessageList, error) {
 	List := &WeChatMessageList{}
 	List.Rows = make([]WeChatMessage, 0)
@@ -644,6 +1572,58 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 		return List, nil
 	}
 	defer rows.Close()
+
+	err = P.wechatMessageRowsHandle(rows, List)
+	return List, err
+}
+
+// weChatGetMessageListByTypes 在SQL中按Type过滤，当前数据库没有匹配的消息时继续查找下一个数据库
+func (P *WechatDataProvider) weChatGetMessageListByTypes(userName string, time int64, pageSize int, direction Message_Search_Direction, types []int) (*WeChatMessageList, error) {
+	if len(types) == 0 {
+		return P.weChatGetMessageListByTime(userName, time, pageSize, direction)
+	}
+
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(types)), ",")
+	querySql := fmt.Sprintf("select "+wechatMsgColumns+" from MSG Where StrTalker=? And CreateTime<=? And Type IN (%s) order by Sequence desc limit ?;", placeholders)
+	if direction == Message_Search_Backward {
+		querySql = fmt.Sprintf("select "+wechatMsgColumns+" from ( select localId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent, CompressContent, BytesExtra FROM MSG Where StrTalker=? And CreateTime>? And Type IN (%s) order by Sequence asc limit ?) AS SubQuery order by Sequence desc;", placeholders)
+	}
+
+	for {
+		index := P.wechatFindDBIndex(userName, time, direction)
+		if index == -1 {
+			return List, nil
+		}
+
+		args := []interface{}{userName, time}
+		for _, t := range types {
+			args = append(args, t)
+		}
+		args = append(args, pageSize)
+
+		rows, err := P.msgDBs[index].db.Query(querySql, args...)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			return List, nil
+		}
+		err = P.wechatMessageRowsHandle(rows, List)
+		rows.Close()
+		if err != nil || List.Total > 0 {
+			return List, err
+		}
+
+		if direction == Message_Search_Backward {
+			time = P.msgDBs[index].endTime
+		} else {
+			time = P.msgDBs[index].startTime - 1
+		}
+	}
+}
+
+func (P *WechatDataProvider) wechatMessageRowsHandle(rows *sql.Rows, List *WeChatMessageList) error {
 	var localId, Type, SubType, IsSender int
 	var MsgSvrID, CreateTime int64
 	var StrTalker, StrContent string
@@ -651,11 +1631,11 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 
 	for rows.Next() {
 		message := WeChatMessage{}
-		err = rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
+		err := rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
 			&StrTalker, &StrContent, &CompressContent, &BytesExtra)
 		if err != nil {
 			log.Println("rows.Scan failed", err)
-			return List, err
+			return err
 		}
 
 		message.LocalId = localId
@@ -678,19 +1658,26 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 		P.wechatMessageVoipHandle(&message)
 		P.wechatMessageVisitHandke(&message)
 		P.wechatMessageLocationHandke(&message)
+		P.wechatMessageVoiceHandle(&message)
 		List.Rows = append(List.Rows, message)
 		List.Total += 1
 	}
 
 	if err := rows.Err(); err != nil {
 		log.Println("rows.Scan failed", err)
-		return List, err
+		return err
 	}
 
-	return List, nil
+	return nil
 }
 
 func (P *WechatDataProvider) WeChatGetMessageListByKeyWord(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, error) {
+	// 已建立搜索索引时使用FTS5查询，避免逐条比较全部消息
+	if List, ok := P.weChatGetMessageListBySearchIndex(userName, time, keyWord, msgType, pageSize); ok {
+		log.Printf("search index %s [%s]: %d\n", userName, keyWord, List.Total)
+		return List, nil
+	}
+
 	List := &WeChatMessageList{}
 	List.Rows = make([]WeChatMessage, 0)
 	List.KeyWord = keyWord
@@ -740,14 +1727,16 @@ func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time in
 	selectpageSize := 30
 	needSize := pageSize
 
-	if msgType != "" {
+	types := parseWeChatMessageTypes(msgType)
+	sqlTypes := weChatMessageTypesSQLTypes(types)
+	if len(types) > 0 {
 		selectpageSize = 600
 	}
 	if direction == Message_Search_Both {
 		needSize = pageSize / 2
 	}
 	for direction == Message_Search_Forward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Forward)
+		selectList, err := P.weChatGetMessageListByTypes(userName, selectTime, selectpageSize, Message_Search_Forward, sqlTypes)
 		if err != nil {
 			return List, err
 		}
@@ -757,7 +1746,7 @@ func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time in
 		}
 
 		for i, _ := range selectList.Rows {
-			if weChatMessageTypeFilter(&selectList.Rows[i], msgType) {
+			if weChatMessageTypesFilter(&selectList.Rows[i], types) {
 				List.Rows = append(List.Rows, selectList.Rows[i])
 				List.Total += 1
 				needSize -= 1
@@ -778,7 +1767,7 @@ func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time in
 		needSize = pageSize / 2
 	}
 	for direction == Message_Search_Backward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Backward)
+		selectList, err := P.weChatGetMessageListByTypes(userName, selectTime, selectpageSize, Message_Search_Backward, sqlTypes)
 		if err != nil {
 			return List, err
 		}
@@ -790,7 +1779,7 @@ func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time in
 		tmpTotal := 0
 		tmpRows := make([]WeChatMessage, 0)
 		for i := selectList.Total - 1; i >= 0; i-- {
-			if weChatMessageTypeFilter(&selectList.Rows[i], msgType) {
+			if weChatMessageTypesFilter(&selectList.Rows[i], types) {
 				tmpRows = append([]WeChatMessage{selectList.Rows[i]}, tmpRows...)
 				tmpTotal += 1
 				needSize -= 1
@@ -813,10 +1802,20 @@ func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time in
 	return List, nil
 }
 
-func (P *WechatDataProvider) WeChatGetMessageDate(userName string) (*WeChatMessageDate, error) {
+// WeChatGetMessageDate 返回有消息的日期列表，granularity为空时按天
+func (P *WechatDataProvider) WeChatGetMessageDate(userName string, granularity string) (*WeChatMessageDate, error) {
+	dateFormat, ok := MessageDateFormat(granularity)
+	if !ok {
+		return nil, fmt.Errorf("invalid granularity: %s", granularity)
+	}
+	if granularity == "" {
+		granularity = Message_Date_Granularity_Day
+	}
+
 	messageData := &WeChatMessageDate{}
 	messageData.Date = make([]string, 0)
 	messageData.Total = 0
+	messageData.Granularity = granularity
 
 	_time := time.Now().Unix()
 
@@ -827,10 +1826,9 @@ func (P *WechatDataProvider) WeChatGetMessageDate(userName string) (*WeChatMessa
 			return messageData, nil
 		}
 
-		sqlFormat := " SELECT DISTINCT strftime('%%Y-%%m-%%d', datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker='%s' order by CreateTime desc;"
-		querySql := fmt.Sprintf(sqlFormat, userName)
+		querySql := " SELECT DISTINCT strftime(?, datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker=? order by CreateTime desc;"
 
-		rows, err := P.msgDBs[index].db.Query(querySql)
+		rows, err := P.msgDBs[index].db.Query(querySql, dateFormat, userName)
 		if err != nil {
 			log.Printf("%s failed %v\n", querySql, err)
 			return messageData, nil
@@ -879,18 +1877,169 @@ func (P *WechatDataProvider) WeChatGetChatRoomUserList(chatroom string) (*WeChat
 		return nil, err
 	}
 
-	userNameArray := strings.Split(userNameListStr, "^G")
-	log.Println("userNameArray:", userNameArray)
-
-	for _, userName := range userNameArray {
-		pinfo, err := P.WechatGetUserInfoByNameOnCache(userName)
-		if err == nil {
-			userList.Users = append(userList.Users, *pinfo)
-			userList.Total += 1
+	userNameArray := strings.Split(userNameListStr, "^G")
+	log.Println("userNameArray:", userNameArray)
+
+	for _, userName := range userNameArray {
+		pinfo, err := P.WechatGetUserInfoByNameOnCache(userName)
+		if err == nil {
+			userList.Users = append(userList.Users, *pinfo)
+			userList.Total += 1
+		}
+	}
+
+	return userList, nil
+}
+
+// 群成员变动的系统消息，名字为引号中的显示名称
+var roomMemberEventPatterns = []struct {
+	re        *regexp.Regexp
+	eventType string
+}{
+	{regexp.MustCompile(`^"?.*?"?邀请"(.+)"加入了群聊`), Room_Member_Event_Invite},
+	{regexp.MustCompile(`^"(.+)"通过扫描.*二维码加入群聊`), Room_Member_Event_Join},
+	{regexp.MustCompile(`^"(.+)"加入了群聊`), Room_Member_Event_Join},
+	{regexp.MustCompile(`^.*将"(.+)"移出了群聊`), Room_Member_Event_Leave},
+	{regexp.MustCompile(`^"(.+)"(?:已)?退出了?群聊`), Room_Member_Event_Leave},
+}
+
+// WeChatGetChatRoomMemberHistory 从群聊的系统消息中解析成员的加入、邀请和退出记录
+func (P *WechatDataProvider) WeChatGetChatRoomMemberHistory(roomId string) (*WeChatRoomMemberHistory, error) {
+	history := &WeChatRoomMemberHistory{}
+	history.RoomId = roomId
+	history.Events = make([]RoomMemberEvent, 0)
+	if !strings.HasSuffix(roomId, "@chatroom") {
+		return history, fmt.Errorf("%s is not chatroom", roomId)
+	}
+
+	// 系统消息中只有显示名称，先用当前群成员，再用联系人匹配微信号
+	nameMap := make(map[string]string)
+	for _, contact := range P.ContactList.Users {
+		if contact.NickName != "" {
+			nameMap[contact.NickName] = contact.UserName
+		}
+		if contact.ReMark != "" {
+			nameMap[contact.ReMark] = contact.UserName
+		}
+	}
+	if userList, err := P.WeChatGetChatRoomUserList(roomId); err == nil {
+		for _, user := range userList.Users {
+			if user.NickName != "" {
+				nameMap[user.NickName] = user.UserName
+			}
+			if user.ReMark != "" {
+				nameMap[user.ReMark] = user.UserName
+			}
+		}
+	}
+
+	querySql := "select CreateTime, ifnull(StrContent,'') as StrContent from MSG Where StrTalker=? And Type=? order by CreateTime asc;"
+	// msgDBs按时间倒序，从最早的开始
+	for i := len(P.msgDBs) - 1; i >= 0; i-- {
+		rows, err := P.msgDBs[i].db.Query(querySql, roomId, Wechat_Message_Type_System)
+		if err != nil {
+			log.Printf("%s failed %v\n", P.msgDBs[i].path, err)
+			continue
+		}
+
+		for rows.Next() {
+			var createTime int64
+			var content string
+			if err := rows.Scan(&createTime, &content); err != nil {
+				log.Println("rows.Scan failed", err)
+				continue
+			}
+
+			content = systemMsgParse(Wechat_Message_Type_System, content)
+			for _, pattern := range roomMemberEventPatterns {
+				match := pattern.re.FindStringSubmatch(content)
+				if match == nil {
+					continue
+				}
+
+				// 一次邀请多人时名字用、分隔
+				for _, nickName := range strings.Split(match[1], "、") {
+					nickName = strings.Trim(nickName, "\"")
+					if nickName == "" {
+						continue
+					}
+					history.Events = append(history.Events, RoomMemberEvent{
+						UserName:  nameMap[nickName],
+						NickName:  nickName,
+						EventType: pattern.eventType,
+						Timestamp: createTime,
+					})
+					history.Total += 1
+				}
+				break
+			}
+		}
+		rows.Close()
+	}
+
+	return history, nil
+}
+
+// WeChatGetGroupMessageSenderStats 统计群聊中每个成员发送的消息数，不包含自己发送的消息。
+// 群消息的发送者保存在BytesExtra中，无法直接在SQL中分组，逐条解析后统计
+func (P *WechatDataProvider) WeChatGetGroupMessageSenderStats(roomId string) (*WeChatGroupSenderStats, error) {
+	stats := &WeChatGroupSenderStats{}
+	stats.RoomId = roomId
+	stats.Members = make([]GroupMemberStat, 0)
+	if !strings.HasSuffix(roomId, "@chatroom") {
+		return stats, fmt.Errorf("%s is not chatroom", roomId)
+	}
+
+	counts := make(map[string]int)
+	querySql := "select ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker=? And IsSender=0;"
+	for _, msgDB := range P.msgDBs {
+		rows, err := msgDB.db.Query(querySql, roomId)
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+
+		for rows.Next() {
+			var bytesExtra []byte
+			if err := rows.Scan(&bytesExtra); err != nil {
+				log.Println("rows.Scan failed", err)
+				continue
+			}
+
+			var extra MessageBytesExtra
+			if err := proto.Unmarshal(bytesExtra, &extra); err != nil {
+				continue
+			}
+			for _, ext := range extra.Message2 {
+				if ext.Field1 == 1 && ext.Field2 != "" {
+					counts[ext.Field2] += 1
+					stats.TotalMessages += 1
+					break
+				}
+			}
+		}
+		rows.Close()
+	}
+
+	for userName, count := range counts {
+		stat := GroupMemberStat{UserName: userName, MessageCount: count}
+		if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+			stat.NickName = info.NickName
 		}
+		if stats.TotalMessages > 0 {
+			stat.Percentage = float64(count) * 100 / float64(stats.TotalMessages)
+		}
+		stats.Members = append(stats.Members, stat)
 	}
+	sort.Slice(stats.Members, func(i, j int) bool {
+		if stats.Members[i].MessageCount != stats.Members[j].MessageCount {
+			return stats.Members[i].MessageCount > stats.Members[j].MessageCount
+		}
+		return stats.Members[i].UserName < stats.Members[j].UserName
+	})
+	stats.MemberCount = len(stats.Members)
 
-	return userList, nil
+	return stats, nil
 }
 
 func (info WeChatUserInfo) String() string {
@@ -1051,6 +2200,34 @@ func (P *WechatDataProvider) wechatMessageExtraHandle(msg *WeChatMessage) {
 	}
 }
 
+type VoiceMsg struct {
+	XMLName  xml.Name `xml:"msg"`
+	VoiceMsg struct {
+		VoiceLength int `xml:"voicelength,attr"`
+	} `xml:"voicemsg"`
+}
+
+// wechatMessageVoiceHandle 从<voicemsg>的voicelength属性解析语音时长，单位毫秒
+func (P *WechatDataProvider) wechatMessageVoiceHandle(msg *WeChatMessage) {
+	if msg.Type != Wechat_Message_Type_Voice {
+		return
+	}
+
+	// 群聊中的内容可能带有发送者前缀，从<msg开始解析
+	content := msg.Content
+	if index := strings.Index(content, "<msg"); index > 0 {
+		content = content[index:]
+	}
+
+	voiceMsg := VoiceMsg{}
+	if err := xml.Unmarshal([]byte(content), &voiceMsg); err != nil {
+		log.Println("xml.Unmarshal failed: ", err, msg.Content)
+		return
+	}
+
+	msg.VoiceDurationMs = voiceMsg.VoiceMsg.VoiceLength
+}
+
 type EmojiMsg struct {
 	XMLName xml.Name `xml:"msg"`
 	Emoji   Emoji    `xml:"emoji"`
@@ -1079,6 +2256,25 @@ func (P *WechatDataProvider) wechatMessageEmojiHandle(msg *WeChatMessage) {
 	msg.EmojiPath = emojiMsg.Emoji.CdnURL
 }
 
+// weChatQuotedText 被引用的图片、语音等消息的content是xml，只显示类型
+func weChatQuotedText(msgType int, content string) string {
+	switch msgType {
+	case Wechat_Message_Type_Picture:
+		return "[图片]"
+	case Wechat_Message_Type_Voice:
+		return "[语音]"
+	case Wechat_Message_Type_Video:
+		return "[视频]"
+	case Wechat_Message_Type_Emoji:
+		return "[表情包]"
+	case Wechat_Message_Type_Location:
+		return "[位置]"
+	case Wechat_Message_Type_Visit_Card:
+		return "[名片]"
+	}
+	return content
+}
+
 type xmlDocument struct {
 	*etree.Document
 }
@@ -1146,6 +2342,11 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 			msg.ReferInfo.Content = root.FindElementValue("/msg/appmsg/title")
 			msg.ReferInfo.SubType, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/type"))
 		}
+		msg.QuotedMessage = &WeChatQuotedMessage{
+			Sender: msg.ReferInfo.Displayname,
+			Text:   weChatQuotedText(msg.ReferInfo.Type, msg.ReferInfo.Content),
+			Type:   msg.ReferInfo.Type,
+		}
 	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Transfer {
 		msg.PayInfo.Type, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/wcpayinfo/paysubtype"))
 		msg.PayInfo.Feedesc = root.FindElementValue("/msg/appmsg/wcpayinfo/feedesc")
@@ -1379,10 +2580,98 @@ func weChatMessageTypeFilter(msg *WeChatMessage, msgType string) bool {
 	}
 }
 
-func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
+// parseWeChatMessageTypes 解析逗号分隔的消息类型，为空或"all"时不过滤
+func parseWeChatMessageTypes(msgType string) []string {
+	types := make([]string, 0)
+	for _, token := range strings.Split(msgType, ",") {
+		token = strings.TrimSpace(token)
+		if token == "all" {
+			return nil
+		}
+		if token != "" {
+			types = append(types, token)
+		}
+	}
+
+	return types
+}
+
+// parseWeChatMessageTypeNumber 解析数字类型 "Type" 或 "Type:SubType"，SubType为-1表示不限制
+func parseWeChatMessageTypeNumber(token string) (int, int, bool) {
+	typeStr, subTypeStr, hasSubType := strings.Cut(token, ":")
+	msgType, err := strconv.Atoi(typeStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !hasSubType {
+		return msgType, -1, true
+	}
+	subType, err := strconv.Atoi(subTypeStr)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return msgType, subType, true
+}
+
+func weChatMessageTypesFilter(msg *WeChatMessage, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+
+	for _, token := range types {
+		if msgType, subType, ok := parseWeChatMessageTypeNumber(token); ok {
+			if msg.Type == msgType && (subType == -1 || msg.SubType == subType) {
+				return true
+			}
+			continue
+		}
+		if weChatMessageTypeFilter(msg, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weChatMessageTypesSQLTypes 返回可以在SQL中过滤的Type列表，含有无法映射的类型时返回nil
+func weChatMessageTypesSQLTypes(types []string) []int {
+	sqlTypes := make([]int, 0)
+	for _, token := range types {
+		if msgType, _, ok := parseWeChatMessageTypeNumber(token); ok {
+			sqlTypes = append(sqlTypes, msgType)
+			continue
+		}
+		switch token {
+		case "文件", "链接":
+			sqlTypes = append(sqlTypes, Wechat_Message_Type_Misc)
+		case "图片与视频":
+			sqlTypes = append(sqlTypes, Wechat_Message_Type_Picture, Wechat_Message_Type_Video)
+		case "语音":
+			sqlTypes = append(sqlTypes, Wechat_Message_Type_Voice)
+		case "通话":
+			sqlTypes = append(sqlTypes, Wechat_Message_Type_Voip)
+		default:
+			return nil
+		}
+	}
+
+	return sqlTypes
+}
+
+// openSqlite readOnly时以mode=ro打开，数据库不存在时不创建，写入返回错误
+func openSqlite(path string, readOnly bool) (*sql.DB, error) {
+	if !readOnly {
+		return sql.Open("sqlite3", path)
+	}
+	uriPath := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(path))
+	return sql.Open("sqlite3", "file:"+uriPath+"?mode=ro")
+}
+
+func wechatOpenMsgDB(path string, readOnly bool) (*wechatMsgDB, error) {
 	msgDB := wechatMsgDB{}
 
-	db, err := sql.Open("sqlite3", path)
+	db, err := openSqlite(path, readOnly)
 	if err != nil {
 		log.Printf("open db %s error: %v", path, err)
 		return nil, err
@@ -1522,6 +2811,11 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info.SmallHeadImgUrl = smallHeadImgUrl
 	info.BigHeadImgUrl = bigHeadImgUrl
 
+	// Session表记录了每个会话最后一条消息的时间，取最大值作为最近同步的时间
+	if err := microMsg.QueryRow("select ifnull(max(nTime),0) from Session;").Scan(&info.LastSyncTime); err != nil {
+		log.Println("select Session nTime failed:", err)
+	}
+
 	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", resPath, accountName)
 	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", prefixRes, accountName)
 	if _, err = os.Stat(localHeadImgPath); err == nil {
@@ -1531,6 +2825,37 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	return info, nil
 }
 
+// WechatGetAccountMessageCount 统计导出目录下所有MSG数据库中的消息数
+func WechatGetAccountMessageCount(resPath string) int64 {
+	paths := []string{fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", resPath)}
+	for index := 0; ; index++ {
+		msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG%d.db", resPath, index)
+		if _, err := os.Stat(msgDBPath); err != nil {
+			break
+		}
+		paths = append(paths, msgDBPath)
+	}
+
+	var total int64
+	for _, msgDBPath := range paths {
+		if _, err := os.Stat(msgDBPath); err != nil {
+			continue
+		}
+		db, err := openSqlite(msgDBPath, true)
+		if err != nil {
+			log.Printf("open db %s error: %v", msgDBPath, err)
+			continue
+		}
+		var count int64
+		if err := db.QueryRow("select COUNT(*) from MSG;").Scan(&count); err != nil {
+			log.Printf("%s count failed %v\n", msgDBPath, err)
+		}
+		db.Close()
+		total += count
+	}
+	return total
+}
+
 func systemMsgParse(msgType int, content string) string {
 	// 处理系统消息和通知消息
 	if msgType == Wechat_Message_Type_System {
@@ -1630,6 +2955,86 @@ func openUserDataDB(path string) *sql.DB {
 	return db
 }
 
+// 会话预览文本的最大长度
+const sessionPreviewMaxRunes = 60
+
+// WeChatGetSessionLastMessagePreview 查询会话最后一条消息的时间和预览，
+// 文本消息取前60个字符，其他消息显示为[图片]、[视频]等
+func (P *WechatDataProvider) WeChatGetSessionLastMessagePreview(userName string) *WeChatSessionPreview {
+	preview := &WeChatSessionPreview{UserName: userName}
+
+	// msgDBs按时间从新到旧排序，第一个有结果的数据库中就是最后一条消息
+	querySql := "select CreateTime, Type, ifnull(SubType,0), ifnull(StrContent,'') from MSG where StrTalker=? order by CreateTime desc, Sequence desc limit 1;"
+	for _, msgDB := range P.msgDBs {
+		var msgType, subType int
+		var content string
+		err := msgDB.db.QueryRow(querySql, userName).Scan(&preview.Timestamp, &msgType, &subType, &content)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s failed %v\n", msgDB.path, err)
+			continue
+		}
+		preview.Preview = weChatPreviewText(msgType, subType, content)
+		break
+	}
+
+	return preview
+}
+
+func weChatPreviewText(msgType, subType int, content string) string {
+	switch msgType {
+	case Wechat_Message_Type_Text, Wechat_Message_Type_System:
+		text := []rune(strings.TrimSpace(systemMsgParse(msgType, content)))
+		if len(text) > sessionPreviewMaxRunes {
+			return string(text[:sessionPreviewMaxRunes])
+		}
+		return string(text)
+	case Wechat_Message_Type_Misc:
+		return weChatMiscPreviewText(subType)
+	case Wechat_Message_Type_Voip:
+		return "[通话]"
+	}
+	if text := weChatQuotedText(msgType, content); text != content {
+		return text
+	}
+	return "[消息]"
+}
+
+// weChatMiscPreviewText 按SubType区分文件、小程序、引用等消息，内容在CompressContent中，只显示类型
+func weChatMiscPreviewText(subType int) string {
+	switch subType {
+	case Wechat_Misc_Message_File:
+		return "[文件]"
+	case Wechat_Misc_Message_Music, Wechat_Misc_Message_TingListen:
+		return "[音乐]"
+	case Wechat_Misc_Message_ThirdVideo:
+		return "[第三方视频]"
+	case Wechat_Misc_Message_CustomEmoji, Wechat_Misc_Message_ShareEmoji:
+		return "[表情包]"
+	case Wechat_Misc_Message_ForwardMessage:
+		return "[聊天记录]"
+	case Wechat_Misc_Message_Applet, Wechat_Misc_Message_Applet2:
+		return "[小程序]"
+	case Wechat_Misc_Message_Channels:
+		return "[视频号]"
+	case Wechat_Misc_Message_Refer:
+		return "[引用]"
+	case Wechat_Misc_Message_Live, Wechat_Misc_Message_Live2:
+		return "[直播]"
+	case Wechat_Misc_Message_Game:
+		return "[游戏]"
+	case Wechat_Misc_Message_Notice:
+		return "[通知消息]"
+	case Wechat_Misc_Message_Transfer:
+		return "[转账]"
+	case Wechat_Misc_Message_RedPacket:
+		return "[红包]"
+	}
+	return "[链接]"
+}
+
 func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLastTime {
 	lastTime := &WeChatLastTime{}
 	if P.userData == nil {
@@ -1723,15 +3128,29 @@ func (P *WechatDataProvider) WeChatDelSessionBookMask(markId string) error {
 	return nil
 }
 
-func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string) (*WeChatBookMarkList, error) {
+// WeChatGetSessionBookMaskList 按添加顺序分页返回userName的书签，Total为书签总数；
+// pageIndex小于0时为0，pageSize不大于0时为Default_BookMark_PageSize
+func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string, pageIndex int, pageSize int) (*WeChatBookMarkList, error) {
 	markList := &WeChatBookMarkList{}
 	markList.Marks = make([]WeChatBookMark, 0)
 	markList.Total = 0
+	if pageIndex < 0 {
+		pageIndex = 0
+	}
+	if pageSize <= 0 {
+		pageSize = Default_BookMark_PageSize
+	}
+
+	err := P.userData.QueryRow("select COUNT(*) from bookMark where userName=?;", userName).Scan(&markList.Total)
+	if err != nil {
+		log.Println("select DB bookMark count failed:", err)
+		return markList, err
+	}
 
-	querySql := fmt.Sprintf("select markId, tag, info from bookMark where userName='%s';", userName)
-	log.Println("querySql:", querySql)
+	querySql := "select ifnull(markId,''), ifnull(tag,''), ifnull(info,'') from bookMark where userName=? order by rowid limit ? offset ?;"
+	log.Println("querySql:", querySql, userName, pageIndex, pageSize)
 
-	rows, err := P.userData.Query(querySql)
+	rows, err := P.userData.Query(querySql, userName, pageSize, pageIndex*pageSize)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
 		return markList, err
@@ -1747,7 +3166,6 @@ func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string) (*WeC
 		}
 
 		markList.Marks = append(markList.Marks, WeChatBookMark{MarkId: markId, Tag: tag, Info: info})
-		markList.Total += 1
 	}
 
 	if err := rows.Err(); err != nil {
@@ -1758,24 +3176,232 @@ func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string) (*WeC
 	return markList, nil
 }
 
+// WeChatGetSessionBookMaskByTag 按添加顺序返回userName中标签为tag的书签，tag为空时返回未设置标签的书签
+func (P *WechatDataProvider) WeChatGetSessionBookMaskByTag(userName, tag string) (*WeChatBookMarkList, error) {
+	markList := &WeChatBookMarkList{}
+	markList.Marks = make([]WeChatBookMark, 0)
+	markList.Total = 0
+
+	querySql := "select ifnull(markId,''), ifnull(tag,''), ifnull(info,'') from bookMark where userName=? and ifnull(tag, '')=? order by rowid;"
+	log.Println("querySql:", querySql, userName, tag)
+
+	rows, err := P.userData.Query(querySql, userName, tag)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return markList, err
+	}
+	defer rows.Close()
+
+	var markId, markTag, info string
+	for rows.Next() {
+		err = rows.Scan(&markId, &markTag, &info)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return markList, err
+		}
+
+		markList.Marks = append(markList.Marks, WeChatBookMark{MarkId: markId, Tag: markTag, Info: info})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("rows.Scan failed", err)
+		return markList, err
+	}
+
+	markList.Total = len(markList.Marks)
+	return markList, nil
+}
+
+// WeChatGetAllBookmarkTags 返回userName的书签中用到的标签，去重后按名称排序，不包含空标签
+func (P *WechatDataProvider) WeChatGetAllBookmarkTags(userName string) ([]string, error) {
+	tags := make([]string, 0)
+
+	querySql := "select distinct tag from bookMark where userName=? and ifnull(tag, '')<>'' order by tag;"
+	rows, err := P.userData.Query(querySql, userName)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return tags, err
+	}
+	defer rows.Close()
+
+	var tag string
+	for rows.Next() {
+		if err := rows.Scan(&tag); err != nil {
+			log.Println("rows.Scan failed", err)
+			return tags, err
+		}
+		tags = append(tags, tag)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("rows.Scan failed", err)
+		return tags, err
+	}
+
+	return tags, nil
+}
+
+const (
+	User_Export_Stage_DataBase = "database"
+	User_Export_Stage_File     = "file"
+)
+
+// UserExportProgress 单个会话导出的进度
+type UserExportProgress struct {
+	Stage          string `json:"stage"`
+	MessagesCopied int64  `json:"messagesCopied"`
+	MediaTotal     int64  `json:"mediaTotal"`
+	MediaCopied    int64  `json:"mediaCopied"`
+	BytesCopied    int64  `json:"bytesCopied"`
+}
+
+// userExportStat 统计单个会话导出的进度，复制文件的协程并发更新
+type userExportStat struct {
+	lock        sync.Mutex
+	stage       string
+	messages    int64
+	mediaTotal  int64
+	mediaCopied int64
+	bytesCopied int64
+}
+
+func (s *userExportStat) setStage(stage string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stage = stage
+}
+
+func (s *userExportStat) progress() UserExportProgress {
+	s.lock.Lock()
+	stage := s.stage
+	s.lock.Unlock()
+	return UserExportProgress{
+		Stage:          stage,
+		MessagesCopied: atomic.LoadInt64(&s.messages),
+		MediaTotal:     atomic.LoadInt64(&s.mediaTotal),
+		MediaCopied:    atomic.LoadInt64(&s.mediaCopied),
+		BytesCopied:    atomic.LoadInt64(&s.bytesCopied),
+	}
+}
+
+// report 每秒发送一次进度，返回的函数用于停止上报
+func (s *userExportStat) report(progress chan<- UserExportProgress) func() {
+	var wg sync.WaitGroup
+	quitChan := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quitChan:
+				return
+			case <-ticker.C:
+				progress <- s.progress()
+			}
+		}
+	}()
+
+	return func() {
+		close(quitChan)
+		wg.Wait()
+	}
+}
+
 func (P *WechatDataProvider) WeChatExportDataByUserName(userName, exportPath string) error {
+	return P.WeChatExportDataByUserNameWithProgress(context.Background(), userName, exportPath, nil)
+}
+
+// WeChatExportDataByUserNameWithProgress 导出userName的会话数据，progress不为nil时每秒发送一次进度，
+// 结束时再发送最终进度；ctx取消后停止复制文件并返回ctx.Err()
+func (P *WechatDataProvider) WeChatExportDataByUserNameWithProgress(ctx context.Context, userName, exportPath string, progress chan<- UserExportProgress) error {
+	return P.WeChatExportDataByUserNamesWithProgress(ctx, []string{userName}, exportPath, progress)
+}
+
+// WeChatExportDataByUserNamesWithProgress 将多个会话导出到同一个目录，多个会话引用的同一媒体文件只复制一次
+func (P *WechatDataProvider) WeChatExportDataByUserNamesWithProgress(ctx context.Context, userNames []string, exportPath string, progress chan<- UserExportProgress) error {
+	if len(userNames) == 0 {
+		return errors.New("no userName")
+	}
+
+	stat := &userExportStat{stage: User_Export_Stage_DataBase}
+	stop := func() {}
+	if progress != nil {
+		stop = stat.report(progress)
+	}
+	defer func() {
+		stop()
+		if progress != nil {
+			progress <- stat.progress()
+		}
+	}()
 
-	err := P.WeChatExportDBByUserName(userName, exportPath)
+	err := P.WeChatExportDBByUserNames(userNames, exportPath)
 	if err != nil {
-		log.Println("WeChatExportDBByUserName:", err)
+		log.Println("WeChatExportDBByUserNames:", err)
+		return err
+	}
+	for _, userName := range userNames {
+		atomic.AddInt64(&stat.messages, P.weChatGetMessageCount(userName))
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	err = P.WeChatExportFileByUserName(userName, exportPath)
+	stat.setStage(User_Export_Stage_File)
+	err = P.weChatExportFileByUserNames(ctx, userNames, exportPath, stat)
 	if err != nil {
-		log.Println("WeChatExportFileByUserName:", err)
+		log.Println("WeChatExportFileByUserNames:", err)
 		return err
 	}
-	log.Println("WeChatExportDataByUserName done")
+	log.Println("WeChatExportDataByUserNames done", userNames)
 	return nil
 }
 
+// weChatGetSessionCounts 统计所有会话的消息数，返回 {"userName": count} 格式的JSON
+func (P *WechatDataProvider) weChatGetSessionCounts() string {
+	P.sessionCountsOnce.Do(func() {
+		counts := make(map[string]int64)
+		for _, msgDB := range P.msgDBs {
+			rows, err := msgDB.db.Query("select StrTalker, COUNT(*) from MSG group by StrTalker;")
+			if err != nil {
+				log.Printf("%s count failed %v\n", msgDB.path, err)
+				continue
+			}
+			for rows.Next() {
+				var talker string
+				var count int64
+				if err := rows.Scan(&talker, &count); err == nil {
+					counts[talker] += count
+				}
+			}
+			rows.Close()
+		}
+		countsJson, _ := json.Marshal(counts)
+		P.sessionCounts = string(countsJson)
+	})
+	return P.sessionCounts
+}
+
+func (P *WechatDataProvider) weChatGetMessageCount(userName string) int64 {
+	var total int64
+	for _, msgDB := range P.msgDBs {
+		var count int64
+		if err := msgDB.db.QueryRow("select COUNT(*) from MSG Where StrTalker=?;", userName).Scan(&count); err != nil {
+			log.Printf("%s count failed %v\n", msgDB.path, err)
+			continue
+		}
+		total += count
+	}
+	return total
+}
+
 func (P *WechatDataProvider) WeChatExportDBByUserName(userName, exportPath string) error {
+	return P.WeChatExportDBByUserNames([]string{userName}, exportPath)
+}
+
+func (P *WechatDataProvider) WeChatExportDBByUserNames(userNames []string, exportPath string) error {
 	msgPath := fmt.Sprintf("%s\\User\\%s\\Msg", exportPath, P.SelfInfo.UserName)
 	multiPath := fmt.Sprintf("%s\\Multi", msgPath)
 	if _, err := os.Stat(multiPath); err != nil {
@@ -1785,34 +3411,34 @@ func (P *WechatDataProvider) WeChatExportDBByUserName(userName, exportPath strin
 		}
 	}
 
-	err := P.weChatExportMicroMsgDBByUserName(userName, msgPath)
+	err := P.weChatExportMicroMsgDBByUserNames(userNames, msgPath)
 	if err != nil {
-		log.Println("weChatExportMicroMsgDBByUserName failed:", err)
+		log.Println("weChatExportMicroMsgDBByUserNames failed:", err)
 		return err
 	}
 
-	err = P.weChatExportMsgDBByUserName(userName, multiPath)
+	err = P.weChatExportMsgDBByUserNames(userNames, multiPath)
 	if err != nil {
-		log.Println("weChatExportMsgDBByUserName failed:", err)
+		log.Println("weChatExportMsgDBByUserNames failed:", err)
 		return err
 	}
 
-	err = P.weChatExportUserDataDBByUserName(userName, msgPath)
+	err = P.weChatExportUserDataDBByUserNames(userNames, msgPath)
 	if err != nil {
-		log.Println("weChatExportUserDataDBByUserName failed:", err)
+		log.Println("weChatExportUserDataDBByUserNames failed:", err)
 		return err
 	}
 
-	err = P.weChatExportOpenIMContactDBByUserName(userName, msgPath)
+	err = P.weChatExportOpenIMContactDBByUserNames(userNames, msgPath)
 	if err != nil {
-		log.Println("weChatExportOpenIMContactDBByUserName failed:", err)
+		log.Println("weChatExportOpenIMContactDBByUserNames failed:", err)
 		return err
 	}
 
 	return nil
 }
 
-func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPath string) error {
+func (P *WechatDataProvider) weChatExportMicroMsgDBByUserNames(userNames []string, exportPath string) error {
 	exMicroMsgDBPath := exportPath + "\\" + MicroMsgDB
 	if _, err := os.Stat(exMicroMsgDBPath); err == nil {
 		log.Println("exist", exMicroMsgDBPath)
@@ -1827,9 +3453,13 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 	defer exMicroMsgDB.Close()
 
 	tables := []string{"Contact", "ContactHeadImgUrl", "Session"}
-	IsGroup := false
-	if strings.HasSuffix(userName, "@chatroom") {
-		IsGroup = true
+	groups := make([]string, 0)
+	for _, userName := range userNames {
+		if strings.HasSuffix(userName, "@chatroom") {
+			groups = append(groups, userName)
+		}
+	}
+	if len(groups) > 0 {
 		tables = append(tables, "ChatRoom", "ChatRoomInfo")
 	}
 
@@ -1857,50 +3487,52 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 		return nil
 	}
 
-	err = copyContactData([]string{userName, P.SelfInfo.UserName})
+	err = copyContactData(append([]string{P.SelfInfo.UserName}, userNames...))
 	if err != nil {
 		log.Println("copyContactData:", err)
 		return err
 	}
 
 	columns := "strUsrName, nOrder, nUnReadCount, parentRef, Reserved0, Reserved1, strNickName, nStatus, nIsSend, strContent, nMsgType, nMsgLocalID, nMsgStatus, nTime, editContent, othersAtMe, Reserved2, Reserved3, Reserved4, Reserved5, bytesXml"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "Session", columns, "strUsrName", []string{userName})
+	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "Session", columns, "strUsrName", userNames)
 	if err != nil {
 		log.Println("wechatCopyTableData Session:", err)
 		return err
 	}
 
-	if !IsGroup {
+	if len(groups) == 0 {
 		return nil
 	}
 
-	uList, err := P.WeChatGetChatRoomUserList(userName)
-	if err != nil {
-		log.Println("WeChatGetChatRoomUserList failed:", err)
-		return err
-	}
+	for _, group := range groups {
+		uList, err := P.WeChatGetChatRoomUserList(group)
+		if err != nil {
+			log.Println("WeChatGetChatRoomUserList failed:", err)
+			return err
+		}
 
-	userNames := make([]string, 0, 100)
-	for i := range uList.Users {
-		userNames = append(userNames, uList.Users[i].UserName)
-		if len(userNames) >= 100 || i == len(uList.Users)-1 {
-			err = copyContactData(userNames)
-			if err != nil {
-				log.Println("copyContactData:", err)
+		members := make([]string, 0, 100)
+		for i := range uList.Users {
+			members = append(members, uList.Users[i].UserName)
+			if len(members) >= 100 || i == len(uList.Users)-1 {
+				err = copyContactData(members)
+				if err != nil {
+					log.Println("copyContactData:", err)
+				}
+				members = members[:0]
 			}
-			userNames = userNames[:0]
 		}
 	}
 
 	columns = "ChatRoomName, UserNameList, DisplayNameList, ChatRoomFlag, Owner, IsShowName, SelfDisplayName, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, RoomData, Reserved7, Reserved8"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoom", columns, "ChatRoomName", []string{userName})
+	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoom", columns, "ChatRoomName", groups)
 	if err != nil {
 		log.Println("wechatCopyTableData ChatRoom:", err)
 		return err
 	}
 
 	columns = "ChatRoomName, Announcement, InfoVersion, AnnouncementEditor, AnnouncementPublishTime, ChatRoomStatus, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, Reserved7, Reserved8"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoomInfo", columns, "ChatRoomName", []string{userName})
+	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoomInfo", columns, "ChatRoomName", groups)
 	if err != nil {
 		log.Println("wechatCopyTableData ChatRoom:", err)
 		return err
@@ -1909,7 +3541,7 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 	return nil
 }
 
-func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath string) error {
+func (P *WechatDataProvider) weChatExportMsgDBByUserNames(userNames []string, exportPath string) error {
 	exMsgDBPath := exportPath + "\\" + "MSG.db"
 	if _, err := os.Stat(exMsgDBPath); err == nil {
 		log.Println("exist", exMsgDBPath)
@@ -1936,7 +3568,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 
 	columns := "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
 	for _, msgDB := range P.msgDBs {
-		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", []string{userName})
+		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", userNames)
 		if err != nil {
 			log.Println("wechatCopyTableData MSG:", err)
 			return err
@@ -1945,7 +3577,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 
 	columns = "UsrName"
 	for _, msgDB := range P.msgDBs {
-		err = wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", []string{userName})
+		err = wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", userNames)
 		if err != nil {
 			continue
 		}
@@ -1955,7 +3587,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 	return nil
 }
 
-func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPath string) error {
+func (P *WechatDataProvider) weChatExportUserDataDBByUserNames(userNames []string, exportPath string) error {
 	exUserDataDBPath := exportPath + "\\" + UserDataDB
 	if _, err := os.Stat(exUserDataDBPath); err == nil {
 		log.Println("exist", exUserDataDBPath)
@@ -1977,14 +3609,14 @@ func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPa
 	}
 
 	columns := "localId,userName,timestamp,messageId,Reserved0,Reserved1,Reserved2,Reserved3"
-	err = wechatCopyTableData(exUserDataDB, P.userData, "lastTime", columns, "userName", []string{userName})
+	err = wechatCopyTableData(exUserDataDB, P.userData, "lastTime", columns, "userName", userNames)
 	if err != nil {
 		log.Println("wechatCopyTableData lastTime:", err)
 		return err
 	}
 
 	columns = "localId, userName, markId, tag, info, Reserved0, Reserved1, Reserved2, Reserved3"
-	err = wechatCopyTableData(exUserDataDB, P.userData, "bookMark", columns, "userName", []string{userName})
+	err = wechatCopyTableData(exUserDataDB, P.userData, "bookMark", columns, "userName", userNames)
 	if err != nil {
 		log.Println("wechatCopyTableData bookMark:", err)
 		return err
@@ -1993,16 +3625,17 @@ func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPa
 	return nil
 }
 
-func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exportPath string) error {
-	hasOpenIM := false
-	IsGroup := false
-	if strings.HasSuffix(userName, "@openim") {
-		hasOpenIM = true
-	}
+func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserNames(userNames []string, exportPath string) error {
+	openIMUsers := make([]string, 0)
+	for _, userName := range userNames {
+		if strings.HasSuffix(userName, "@openim") {
+			openIMUsers = append(openIMUsers, userName)
+			continue
+		}
+		if !strings.HasSuffix(userName, "@chatroom") {
+			continue
+		}
 
-	userNames := make([]string, 0)
-	if strings.HasSuffix(userName, "@chatroom") {
-		IsGroup = true
 		uList, err := P.WeChatGetChatRoomUserList(userName)
 		if err != nil {
 			log.Println("WeChatGetChatRoomUserList failed:", err)
@@ -2010,13 +3643,12 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 		}
 		for i := range uList.Users {
 			if strings.HasSuffix(uList.Users[i].UserName, "@openim") {
-				userNames = append(userNames, uList.Users[i].UserName)
-				hasOpenIM = true
+				openIMUsers = append(openIMUsers, uList.Users[i].UserName)
 			}
 		}
 	}
 
-	if !hasOpenIM || P.openIMContact == nil {
+	if len(openIMUsers) == 0 || P.openIMContact == nil {
 		log.Println("not Open Im")
 		return nil
 	}
@@ -2052,17 +3684,13 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 		return nil
 	}
 
-	if !IsGroup {
-		return copyContactData([]string{userName})
-	}
-
 	chunkSize := 100
-	for i := 0; i < len(userNames); i += chunkSize {
+	for i := 0; i < len(openIMUsers); i += chunkSize {
 		end := i + chunkSize
-		if end > len(userNames) {
-			end = len(userNames)
+		if end > len(openIMUsers) {
+			end = len(openIMUsers)
 		}
-		err = copyContactData(userNames[i:end])
+		err = copyContactData(openIMUsers[i:end])
 		if err != nil {
 			return err
 		}
@@ -2169,18 +3797,24 @@ func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField st
 }
 
 func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath string) error {
+	return P.weChatExportFileByUserNames(context.Background(), []string{userName}, exportPath, &userExportStat{})
+}
+
+func (P *WechatDataProvider) weChatExportFileByUserNames(ctx context.Context, userNames []string, exportPath string, stat *userExportStat) error {
 
 	topDir := filepath.Dir(P.resPath)
 	topDir = filepath.Dir(topDir)
 	pageSize := 600
-	_time := time.Now().Unix()
 	taskChan := make(chan [2]string, 100)
 	var wg sync.WaitGroup
 
+	// 多个会话引用同一个文件时只复制一次
+	sent := make(map[string]bool)
 	taskSend := func(topDir, path, exportPath string, taskChan chan [2]string) {
-		if path == "" {
+		if path == "" || sent[path] {
 			return
 		}
+		sent[path] = true
 		srcFile := topDir + path
 		if _, err := os.Stat(srcFile); err != nil {
 			// log.Println("no exist:", srcFile)
@@ -2194,6 +3828,7 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 		}
 
 		task := [2]string{srcFile, dstFile}
+		atomic.AddInt64(&stat.mediaTotal, 1)
 		taskChan <- task
 	}
 
@@ -2202,85 +3837,97 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
+				// 取消后只取出剩余任务，不再复制
+				if ctx.Err() != nil {
+					continue
+				}
 				// log.Println("copy: ", task[0], task[1])
-				utils.CopyFile(task[0], task[1])
+				size, err := utils.CopyFile(task[0], task[1])
+				if err == nil {
+					atomic.AddInt64(&stat.mediaCopied, 1)
+					atomic.AddInt64(&stat.bytesCopied, size)
+				}
 			}
 		}()
 	}
 
-	for {
-		mlist, err := P.WeChatGetMessageListByTime(userName, _time, pageSize, Message_Search_Forward)
-		if err != nil {
-			return err
-		}
+	taskSend(topDir, P.SelfInfo.LocalHeadImgUrl, exportPath, taskChan)
+	for _, userName := range userNames {
+		_time := time.Now().Unix()
+		for ctx.Err() == nil {
+			mlist, err := P.WeChatGetMessageListByTime(userName, _time, pageSize, Message_Search_Forward)
+			if err != nil {
+				close(taskChan)
+				wg.Wait()
+				return err
+			}
 
-		paths := make([]string, 0)
-		for _, m := range mlist.Rows {
-			switch m.Type {
-			case Wechat_Message_Type_Picture:
-				paths = append(paths, m.ThumbPath, m.ImagePath)
-			case Wechat_Message_Type_Voice:
-				paths = append(paths, m.VoicePath)
-			case Wechat_Message_Type_Visit_Card:
-				paths = append(paths, m.VisitInfo.LocalHeadImgUrl)
-			case Wechat_Message_Type_Video:
-				paths = append(paths, m.ThumbPath, m.VideoPath)
-			case Wechat_Message_Type_Location:
-				paths = append(paths, m.LocationInfo.ThumbPath)
-			case Wechat_Message_Type_Misc:
-				switch m.SubType {
-				case Wechat_Misc_Message_Music:
-					paths = append(paths, m.MusicInfo.ThumbPath)
-				case Wechat_Misc_Message_ThirdVideo:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_CardLink:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_File:
-					paths = append(paths, m.FileInfo.FilePath)
-				case Wechat_Misc_Message_Applet:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_Applet2:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_Channels:
-					paths = append(paths, m.ChannelsInfo.ThumbPath)
-				case Wechat_Misc_Message_Live:
-					paths = append(paths, m.ChannelsInfo.ThumbPath)
-				case Wechat_Misc_Message_Game:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_TingListen:
-					paths = append(paths, m.MusicInfo.ThumbPath)
+			paths := make([]string, 0)
+			for _, m := range mlist.Rows {
+				switch m.Type {
+				case Wechat_Message_Type_Picture:
+					paths = append(paths, m.ThumbPath, m.ImagePath)
+				case Wechat_Message_Type_Voice:
+					paths = append(paths, m.VoicePath)
+				case Wechat_Message_Type_Visit_Card:
+					paths = append(paths, m.VisitInfo.LocalHeadImgUrl)
+				case Wechat_Message_Type_Video:
+					paths = append(paths, m.ThumbPath, m.VideoPath)
+				case Wechat_Message_Type_Location:
+					paths = append(paths, m.LocationInfo.ThumbPath)
+				case Wechat_Message_Type_Misc:
+					switch m.SubType {
+					case Wechat_Misc_Message_Music:
+						paths = append(paths, m.MusicInfo.ThumbPath)
+					case Wechat_Misc_Message_ThirdVideo:
+						paths = append(paths, m.ThumbPath)
+					case Wechat_Misc_Message_CardLink:
+						paths = append(paths, m.ThumbPath)
+					case Wechat_Misc_Message_File:
+						paths = append(paths, m.FileInfo.FilePath)
+					case Wechat_Misc_Message_Applet:
+						paths = append(paths, m.ThumbPath)
+					case Wechat_Misc_Message_Applet2:
+						paths = append(paths, m.ThumbPath)
+					case Wechat_Misc_Message_Channels:
+						paths = append(paths, m.ChannelsInfo.ThumbPath)
+					case Wechat_Misc_Message_Live:
+						paths = append(paths, m.ChannelsInfo.ThumbPath)
+					case Wechat_Misc_Message_Game:
+						paths = append(paths, m.ThumbPath)
+					case Wechat_Misc_Message_TingListen:
+						paths = append(paths, m.MusicInfo.ThumbPath)
+					}
 				}
 			}
-		}
 
-		for _, path := range paths {
-			taskSend(topDir, path, exportPath, taskChan)
-		}
+			for _, path := range paths {
+				taskSend(topDir, path, exportPath, taskChan)
+			}
 
-		if mlist.Total < pageSize {
-			break
+			if mlist.Total < pageSize {
+				break
+			}
+			_time = mlist.Rows[mlist.Total-1].CreateTime - 1
 		}
-		_time = mlist.Rows[mlist.Total-1].CreateTime - 1
-	}
-	log.Println("message file done")
-	//copy HeadImage
-	taskSend(topDir, P.SelfInfo.LocalHeadImgUrl, exportPath, taskChan)
-	info, err := P.WechatGetUserInfoByNameOnCache(userName)
-	if err == nil {
-		taskSend(topDir, info.LocalHeadImgUrl, exportPath, taskChan)
-	}
-
-	if strings.HasSuffix(userName, "@chatroom") {
-		uList, err := P.WeChatGetChatRoomUserList(userName)
+		//copy HeadImage
+		info, err := P.WechatGetUserInfoByNameOnCache(userName)
 		if err == nil {
-			for _, user := range uList.Users {
-				taskSend(topDir, user.LocalHeadImgUrl, exportPath, taskChan)
+			taskSend(topDir, info.LocalHeadImgUrl, exportPath, taskChan)
+		}
+
+		if strings.HasSuffix(userName, "@chatroom") {
+			uList, err := P.WeChatGetChatRoomUserList(userName)
+			if err == nil {
+				for _, user := range uList.Users {
+					taskSend(topDir, user.LocalHeadImgUrl, exportPath, taskChan)
+				}
 			}
 		}
 	}
-	log.Println("HeadImage file done")
+	log.Println("message and HeadImage file done")
 	close(taskChan)
 	wg.Wait()
 
-	return nil
+	return ctx.Err()
 }
@@ -0,0 +1,124 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func newBookMarkTestProvider(t *testing.T) *WechatDataProvider {
+	t.Helper()
+	db := openUserDataDB(filepath.Join(t.TempDir(), "UserData.db"))
+	if db == nil {
+		t.Fatal("openUserDataDB failed")
+	}
+	t.Cleanup(func() { db.Close() })
+	return &WechatDataProvider{userData: db}
+}
+
+func TestWeChatGetSessionBookMaskListPage(t *testing.T) {
+	P := newBookMarkTestProvider(t)
+	for i := 0; i < 120; i++ {
+		if err := P.WeChatSetSessionBookMask("wxid_a", "", fmt.Sprintf("mark-%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 旧版本写入的书签tag为NULL，不能让所在的页查询失败
+	if _, err := P.userData.Exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, NULL, ?);", "wxid_a", "null-tag", "untagged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := P.WeChatSetSessionBookMask("wxid_b", "", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pageIndex int
+		count     int
+		first     string
+	}{
+		{0, 50, "mark-000"},
+		{1, 50, "mark-050"},
+		{2, 21, "mark-100"},
+		{3, 0, ""},
+	}
+	for _, tt := range tests {
+		list, err := P.WeChatGetSessionBookMaskList("wxid_a", tt.pageIndex, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != 121 {
+			t.Errorf("page %d: Total = %d, want 121", tt.pageIndex, list.Total)
+		}
+		if len(list.Marks) != tt.count {
+			t.Errorf("page %d: got %d marks, want %d", tt.pageIndex, len(list.Marks), tt.count)
+			continue
+		}
+		if tt.count > 0 && list.Marks[0].Info != tt.first {
+			t.Errorf("page %d: first mark %q, want %q", tt.pageIndex, list.Marks[0].Info, tt.first)
+		}
+		if tt.pageIndex == 2 {
+			last := list.Marks[len(list.Marks)-1]
+			if last.Info != "untagged" || last.Tag != "" {
+				t.Errorf("page 2: last mark = %+v, want untagged with empty tag", last)
+			}
+		}
+	}
+}
+
+func TestWeChatGetSessionBookMaskByTagNullTag(t *testing.T) {
+	P := newBookMarkTestProvider(t)
+	// 旧版本写入的书签没有tag列的值
+	if _, err := P.userData.Exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, NULL, ?);", "wxid_a", "1", "untagged"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := P.userData.Exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, ?, ?);", "wxid_a", "2", "work", "tagged"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := P.WeChatGetSessionBookMaskByTag("wxid_a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || list.Marks[0].Info != "untagged" || list.Marks[0].Tag != "" {
+		t.Errorf("untagged marks = %+v, want only %q with empty tag", list.Marks, "untagged")
+	}
+
+	list, err = P.WeChatGetSessionBookMaskByTag("wxid_a", "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || list.Marks[0].Info != "tagged" {
+		t.Errorf("work marks = %+v, want only %q", list.Marks, "tagged")
+	}
+}
+
+func TestWeChatPreviewTextMisc(t *testing.T) {
+	cases := []struct {
+		subType int
+		want    string
+	}{
+		{Wechat_Misc_Message_File, "[文件]"},
+		{Wechat_Misc_Message_Applet, "[小程序]"},
+		{Wechat_Misc_Message_Applet2, "[小程序]"},
+		{Wechat_Misc_Message_Refer, "[引用]"},
+		{Wechat_Misc_Message_ForwardMessage, "[聊天记录]"},
+		{Wechat_Misc_Message_Transfer, "[转账]"},
+		{Wechat_Misc_Message_CardLink, "[链接]"},
+	}
+	for _, c := range cases {
+		if got := weChatPreviewText(Wechat_Message_Type_Misc, c.subType, ""); got != c.want {
+			t.Errorf("weChatPreviewText(Misc, %d) = %q, want %q", c.subType, got, c.want)
+		}
+	}
+}
+
+func TestWeChatGetMessageAttachmentListInvalidType(t *testing.T) {
+	P := &WechatDataProvider{}
+	if _, err := P.WeChatGetMessageAttachmentList("wxid_a", "sticker", 0, 10); !errors.Is(err, ErrInvalidAttachType) {
+		t.Errorf("err = %v, want ErrInvalidAttachType", err)
+	}
+	if _, err := P.WeChatGetMessageAttachmentList("wxid_a", "image", 0, 10); err != nil {
+		t.Errorf("image: err = %v, want nil", err)
+	}
+}
@@ -0,0 +1,220 @@
+package wechat
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zip通用标志位，文件名使用UTF-8编码
+const zipFlagUTF8 = 0x800
+
+// exportArchive 导出时直接将文件写入zip，zip.Writer不支持并发，写入时加锁
+type exportArchive struct {
+	lock   sync.Mutex
+	file   *os.File
+	buffer *bufio.Writer
+	writer *zip.Writer
+	closed bool
+}
+
+func newExportArchive(path string) (*exportArchive, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bufio.NewWriterSize(file, 1024*1024)
+	return &exportArchive{file: file, buffer: buffer, writer: zip.NewWriter(buffer)}, nil
+}
+
+// create 需要在持有锁时调用，文件大小超过4GB时archive/zip自动使用Zip64
+func (a *exportArchive) create(name string, modTime time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     strings.ReplaceAll(strings.TrimLeft(name, "\\/"), "\\", "/"),
+		Method:   zip.Store,
+		Modified: modTime,
+		Flags:    zipFlagUTF8,
+	}
+	// 图片、视频等媒体文件已经压缩过，只压缩数据库
+	if strings.HasSuffix(header.Name, ".db") {
+		header.Method = zip.Deflate
+	}
+
+	return a.writer.CreateHeader(header)
+}
+
+func (a *exportArchive) addFile(name string, src string) error {
+	finfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	w, err := a.create(name, finfo.ModTime())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, sourceFile)
+
+	return err
+}
+
+// addDat 解码dat图片后写入zip，文件扩展名与DecryptDat一致
+func (a *exportArchive) addDat(name string, src string) error {
+	finfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	var preTenBts = make([]byte, 10)
+	_, _ = sourceFile.Read(preTenBts)
+	decodeByte, ext, err := findDecodeByte(preTenBts)
+	if err != nil {
+		return err
+	}
+	_, _ = sourceFile.Seek(0, 0)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	w, err := a.create(datOutFileWithExt(name, ext), finfo.ModTime())
+	if err != nil {
+		return err
+	}
+
+	var rBts = make([]byte, 32*1024)
+	for {
+		n, err := sourceFile.Read(rBts)
+		for i := 0; i < n; i++ {
+			rBts[i] ^= decodeByte
+		}
+		if n > 0 {
+			if _, err := w.Write(rBts[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// addDir 将root下的所有文件按相对路径写入zip
+func (a *exportArchive) addDir(root string) error {
+	return filepath.Walk(root, func(path string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("filepath.Walk：%v\n", err)
+			return err
+		}
+		if finfo.IsDir() {
+			return nil
+		}
+
+		return a.addFile(path[len(root):], path)
+	})
+}
+
+func (a *exportArchive) close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	// zip.Writer.Close 不会刷新底层的bufio.Writer
+	err := a.writer.Close()
+	if err == nil {
+		err = a.buffer.Flush()
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ExtractExportArchive 将导出的zip解压到destPath，拒绝写到destPath之外的文件
+func ExtractExportArchive(archivePath string, destPath string) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	root, err := filepath.Abs(destPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range reader.File {
+		target := filepath.Join(root, filepath.FromSlash(file.Name))
+		if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path in archive: %s", file.Name)
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := extractArchiveFile(file, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractArchiveFile(file *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, file.Modified, file.Modified)
+}
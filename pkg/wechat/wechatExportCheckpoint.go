@@ -0,0 +1,147 @@
+package wechat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ExportCheckpointName 导出过程中写在临时导出目录中的断点文件，导出成功后删除
+const ExportCheckpointName = "export_checkpoint.json"
+
+// ExportCheckpoint 记录已完成的导出阶段和数据库，导出中断后再次导出时跳过；
+// 账号、数据目录或密钥变化后断点失效
+type ExportCheckpoint struct {
+	Account  string `json:"account"`
+	FilePath string `json:"filePath"`
+	KeyHash  string `json:"keyHash"`
+	Full     bool   `json:"full"`
+	// 已完成的导出阶段
+	Stages []string `json:"stages"`
+	// 已解密完成的数据库源路径
+	DBDone []string `json:"dbDone"`
+	// 增量导出时从原导出目录移入临时目录的条目，放弃断点时需要移回
+	Moved      []string `json:"moved"`
+	UpdateTime int64    `json:"updateTime"`
+
+	path string
+	lock sync.Mutex
+}
+
+func exportKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewExportCheckpoint(info WeChatInfo, expPath string, full bool) *ExportCheckpoint {
+	return &ExportCheckpoint{
+		Account:  info.AcountName,
+		FilePath: info.FilePath,
+		KeyHash:  exportKeyHash(info.DBKey),
+		Full:     full,
+		Stages:   make([]string, 0),
+		DBDone:   make([]string, 0),
+		Moved:    make([]string, 0),
+		path:     filepath.Join(expPath, ExportCheckpointName),
+	}
+}
+
+// LoadExportCheckpoint 读取expPath中的断点文件
+func LoadExportCheckpoint(expPath string) (*ExportCheckpoint, error) {
+	path := filepath.Join(expPath, ExportCheckpointName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &ExportCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	checkpoint.path = path
+	return checkpoint, nil
+}
+
+// Matches 断点由同一账号、同一数据目录和同一密钥生成时返回true
+func (c *ExportCheckpoint) Matches(info WeChatInfo) bool {
+	return c != nil && c.Account == info.AcountName && c.FilePath == info.FilePath && c.KeyHash == exportKeyHash(info.DBKey)
+}
+
+func (c *ExportCheckpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.UpdateTime = time.Now().Unix()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再替换，避免中断时断点文件不完整
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+func (c *ExportCheckpoint) Remove() {
+	if c == nil {
+		return
+	}
+	os.Remove(c.path)
+}
+
+func (c *ExportCheckpoint) stageDone(stage string) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ExportCheckpoint) finishStage(stage string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.Stages = append(c.Stages, stage)
+	c.lock.Unlock()
+	c.Save()
+}
+
+func (c *ExportCheckpoint) dbDone(src string) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.DBDone {
+		if s == src {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ExportCheckpoint) finishDB(src string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.DBDone = append(c.DBDone, src)
+	c.lock.Unlock()
+	c.Save()
+}
@@ -0,0 +1,531 @@
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	Merge_Stage_Message  = "mergeMessage"
+	Merge_Stage_Contact  = "mergeContact"
+	Merge_Stage_UserData = "mergeUserData"
+	Merge_Stage_File     = "mergeFile"
+)
+
+// 合并报告保存在目标账号目录下
+const MergeReportName = "merge_report.json"
+
+// 合并消息时复制的MSG列，localId由目标数据库重新生成
+const mergeMsgColumns = "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
+
+type MergeConflict struct {
+	Stage   string `json:"stage"`
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	SrcSize int64  `json:"srcSize,omitempty"`
+	DstSize int64  `json:"dstSize,omitempty"`
+}
+
+// MergeReport 合并结果，两边都有但内容不同的文件保留目标目录中的版本并记录在Conflicts中
+type MergeReport struct {
+	MergeTime       int64           `json:"mergeTime"`
+	SrcPath         string          `json:"srcPath"`
+	DstPath         string          `json:"dstPath"`
+	MessagesAdded   int64           `json:"messagesAdded"`
+	MessagesSkipped int64           `json:"messagesSkipped"`
+	MessageDBs      []string        `json:"messageDBs,omitempty"`
+	ContactsAdded   int64           `json:"contactsAdded"`
+	BookmarksAdded  int64           `json:"bookmarksAdded"`
+	LastTimeUpdated int64           `json:"lastTimeUpdated"`
+	FilesAdded      int64           `json:"filesAdded"`
+	FilesSkipped    int64           `json:"filesSkipped"`
+	Conflicts       []MergeConflict `json:"conflicts"`
+}
+
+func (r *MergeReport) conflict(stage, path, reason string) {
+	r.Conflicts = append(r.Conflicts, MergeConflict{Stage: stage, Path: path, Reason: reason})
+}
+
+// MergeExports 将srcPath账号导出目录合并到dstPath：
+// 消息按MsgSvrID去重（MsgSvrID为0时按会话、时间和Sequence），新增的消息按时间写入目标目录中对应的MSG<n>.db，
+// 保持各数据库的时间范围不重叠；
+// 联系人、会话、书签和阅读位置取两边的并集，阅读位置保留较新的一个；
+// FileStorage只复制目标目录中没有的文件，大小和哈希都相同的文件只保留一份；返回前关闭progress
+func MergeExports(srcPath, dstPath string, progress chan<- ExportProgress) (*MergeReport, error) {
+	report := &MergeReport{
+		MergeTime: time.Now().Unix(),
+		SrcPath:   srcPath,
+		DstPath:   dstPath,
+		Conflicts: make([]MergeConflict, 0),
+	}
+	if progress != nil {
+		defer close(progress)
+	}
+	for _, path := range []string{srcPath, dstPath} {
+		if _, err := os.Stat(filepath.Join(path, "Msg", MicroMsgDB)); err != nil {
+			return report, fmt.Errorf("%s is not an export directory: %v", path, err)
+		}
+	}
+
+	emit := func(stage string, percent int, result string) {
+		if progress != nil {
+			progress <- ExportProgress{Status: Export_Status_Processing, Stage: stage, Progress: percent, Result: result}
+		}
+	}
+
+	emit(Merge_Stage_Message, 0, "merge message")
+	if err := mergeExportMessages(srcPath, dstPath, report); err != nil {
+		return report, err
+	}
+
+	emit(Merge_Stage_Contact, 40, "merge contact")
+	mergeExportContacts(srcPath, dstPath, report)
+
+	emit(Merge_Stage_UserData, 45, "merge bookmark")
+	mergeExportUserData(srcPath, dstPath, report)
+
+	tracker := newExportTracker(Merge_Stage_File, 50, 99, 0, 0)
+	var stop func()
+	if progress != nil {
+		stop = tracker.report(progress, "merge file")
+	}
+	mergeExportFiles(srcPath, dstPath, tracker, report)
+	if stop != nil {
+		stop()
+	}
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dstPath, MergeReportName), reportJson, os.ModePerm)
+	}
+	if err != nil {
+		log.Println("write merge report failed:", err)
+	}
+
+	return report, nil
+}
+
+// exportMsgDBPaths 返回账号目录下的MSG.db和MSG<n>.db，以及下一个可用的序号
+func exportMsgDBPaths(path string) ([]string, int) {
+	multiPath := filepath.Join(path, "Msg", "Multi")
+	paths := make([]string, 0)
+	if _, err := os.Stat(filepath.Join(multiPath, "MSG.db")); err == nil {
+		paths = append(paths, filepath.Join(multiPath, "MSG.db"))
+	}
+
+	index := 0
+	for {
+		msgDBPath := filepath.Join(multiPath, fmt.Sprintf("MSG%d.db", index))
+		if _, err := os.Stat(msgDBPath); err != nil {
+			break
+		}
+		paths = append(paths, msgDBPath)
+		index += 1
+	}
+
+	return paths, index
+}
+
+func mergeMsgKey(msgSvrId int64, talker string, createTime, sequence int64) string {
+	if msgSvrId != 0 {
+		return fmt.Sprintf("%d", msgSvrId)
+	}
+	return fmt.Sprintf("%s:%d:%d", talker, createTime, sequence)
+}
+
+// mergeTargetDB 合并消息时的目标数据库，startTime为合并前最早的消息时间
+type mergeTargetDB struct {
+	path      string
+	db        *sql.DB
+	startTime int64
+	added     int64
+	tx        *sql.Tx
+	stmt      *sql.Stmt
+}
+
+// mergeTargetFor 返回保存createTime消息的数据库：最后一个startTime不晚于createTime的数据库，
+// 早于所有数据库时为最早的数据库，targets按startTime升序
+func mergeTargetFor(targets []*mergeTargetDB, createTime int64) *mergeTargetDB {
+	target := targets[0]
+	for _, t := range targets[1:] {
+		if t.startTime > createTime {
+			break
+		}
+		target = t
+	}
+	return target
+}
+
+func mergeExportMessages(srcPath, dstPath string, report *MergeReport) error {
+	dstDBs, nextIndex := exportMsgDBPaths(dstPath)
+	srcDBs, _ := exportMsgDBPaths(srcPath)
+	if len(srcDBs) == 0 {
+		return nil
+	}
+
+	// 目标目录已有的消息和各数据库的时间范围
+	exists := make(map[string]bool)
+	targets := make([]*mergeTargetDB, 0, len(dstDBs))
+	defer func() {
+		for _, t := range targets {
+			t.db.Close()
+		}
+	}()
+	for _, path := range dstDBs {
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return err
+		}
+		target := &mergeTargetDB{path: path, db: db}
+		targets = append(targets, target)
+		if err := db.QueryRow("select ifnull(min(CreateTime),0) from MSG;").Scan(&target.startTime); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		rows, err := db.Query("select MsgSvrID, ifnull(StrTalker,''), CreateTime, Sequence from MSG;")
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for rows.Next() {
+			var msgSvrId, createTime, sequence int64
+			var talker string
+			if err := rows.Scan(&msgSvrId, &talker, &createTime, &sequence); err == nil {
+				exists[mergeMsgKey(msgSvrId, talker, createTime, sequence)] = true
+			}
+		}
+		rows.Close()
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].startTime < targets[j].startTime })
+
+	// 目标目录没有消息数据库时新建一个
+	newDBPath := ""
+	if len(targets) == 0 {
+		newDBPath = filepath.Join(dstPath, "Msg", "Multi", fmt.Sprintf("MSG%d.db", nextIndex))
+		if err := os.MkdirAll(filepath.Dir(newDBPath), os.ModePerm); err != nil {
+			return err
+		}
+		newDB, err := sql.Open("sqlite3", newDBPath)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, &mergeTargetDB{path: newDBPath, db: newDB})
+		srcDB, err := sql.Open("sqlite3", srcDBs[0])
+		if err != nil {
+			return err
+		}
+		err = wechatCopyDBTables(newDB, srcDB, []string{"MSG", "Name2ID"})
+		srcDB.Close()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if report.MessagesAdded == 0 {
+				newDB.Close()
+				os.Remove(newDBPath)
+			}
+		}()
+	}
+
+	columnList := strings.Split(mergeMsgColumns, ",")
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columnList)), ", ")
+	insertSql := fmt.Sprintf("INSERT INTO MSG (%s) VALUES (%s)", mergeMsgColumns, placeholders)
+
+	for _, path := range srcDBs {
+		srcDB, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return err
+		}
+
+		err = mergeMsgDB(srcDB, targets, insertSql, len(columnList), exists, report)
+		if err == nil {
+			for _, t := range targets {
+				if err = mergeName2ID(srcDB, t.db); err != nil {
+					break
+				}
+			}
+		}
+		srcDB.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	for _, t := range targets {
+		if t.added > 0 {
+			report.MessageDBs = append(report.MessageDBs, t.path[len(dstPath):])
+		}
+	}
+	log.Printf("merge message: added %d, skipped %d\n", report.MessagesAdded, report.MessagesSkipped)
+	return nil
+}
+
+// mergeMsgDB 将srcDB中目标目录没有的消息按时间写入targets，每个目标数据库使用一个事务
+func mergeMsgDB(srcDB *sql.DB, targets []*mergeTargetDB, insertSql string, columns int, exists map[string]bool, report *MergeReport) error {
+	rows, err := srcDB.Query("select " + mergeMsgColumns + " from MSG;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rollback := func() {
+		for _, t := range targets {
+			if t.tx != nil {
+				t.stmt.Close()
+				t.tx.Rollback()
+				t.tx, t.stmt = nil, nil
+			}
+		}
+	}
+	for _, t := range targets {
+		if t.tx, err = t.db.Begin(); err == nil {
+			if t.stmt, err = t.tx.Prepare(insertSql); err != nil {
+				t.tx.Rollback()
+				t.tx = nil
+			}
+		}
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	added := make(map[*mergeTargetDB]int64)
+	for rows.Next() {
+		values := make([]interface{}, columns)
+		valuePtrs := make([]interface{}, columns)
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			rollback()
+			return err
+		}
+
+		// MsgSvrID、CreateTime、Sequence、StrTalker分别是第2、6、7、13列
+		msgSvrId, _ := values[1].(int64)
+		createTime, _ := values[5].(int64)
+		sequence, _ := values[6].(int64)
+		talker := ""
+		switch v := values[12].(type) {
+		case string:
+			talker = v
+		case []byte:
+			talker = string(v)
+		}
+		key := mergeMsgKey(msgSvrId, talker, createTime, sequence)
+		if exists[key] {
+			report.MessagesSkipped += 1
+			continue
+		}
+
+		target := mergeTargetFor(targets, createTime)
+		if _, err := target.stmt.Exec(values...); err != nil {
+			rollback()
+			return err
+		}
+		exists[key] = true
+		added[target] += 1
+	}
+	if err := rows.Err(); err != nil {
+		rollback()
+		return err
+	}
+
+	for _, t := range targets {
+		t.stmt.Close()
+		err := t.tx.Commit()
+		t.tx, t.stmt = nil, nil
+		if err != nil {
+			rollback()
+			return err
+		}
+		t.added += added[t]
+		report.MessagesAdded += added[t]
+	}
+	return nil
+}
+
+func mergeName2ID(srcDB, dstDB *sql.DB) error {
+	rows, err := srcDB.Query("select UsrName from Name2ID;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var usrName string
+		if err := rows.Scan(&usrName); err != nil {
+			continue
+		}
+		if _, err := dstDB.Exec("INSERT OR IGNORE INTO Name2ID (UsrName) VALUES (?);", usrName); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// mergeExportContacts 补充目标目录中没有的联系人、头像地址、会话和群信息
+func mergeExportContacts(srcPath, dstPath string, report *MergeReport) {
+	dst, err := sql.Open("sqlite3", filepath.Join(dstPath, "Msg", MicroMsgDB))
+	if err != nil {
+		report.conflict(Merge_Stage_Contact, MicroMsgDB, err.Error())
+		return
+	}
+	defer dst.Close()
+
+	attachSql := fmt.Sprintf("ATTACH DATABASE '%s' AS src;", strings.ReplaceAll(filepath.Join(srcPath, "Msg", MicroMsgDB), "'", "''"))
+	conn, err := dst.Conn(context.Background())
+	if err != nil {
+		report.conflict(Merge_Stage_Contact, MicroMsgDB, err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), attachSql); err != nil {
+		report.conflict(Merge_Stage_Contact, MicroMsgDB, err.Error())
+		return
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE src;")
+
+	for _, table := range []string{"Contact", "ContactHeadImgUrl", "Session", "ChatRoom", "ChatRoomInfo"} {
+		result, err := conn.ExecContext(context.Background(), fmt.Sprintf("INSERT OR IGNORE INTO main.%s SELECT * FROM src.%s;", table, table))
+		if err != nil {
+			log.Printf("merge %s failed: %v\n", table, err)
+			report.conflict(Merge_Stage_Contact, MicroMsgDB+":"+table, err.Error())
+			continue
+		}
+		if table == "Contact" {
+			report.ContactsAdded, _ = result.RowsAffected()
+		}
+	}
+}
+
+// mergeExportUserData 合并书签，阅读位置保留时间较新的记录
+func mergeExportUserData(srcPath, dstPath string, report *MergeReport) {
+	srcDBPath := filepath.Join(srcPath, "Msg", UserDataDB)
+	if _, err := os.Stat(srcDBPath); err != nil {
+		return
+	}
+	src, err := sql.Open("sqlite3", srcDBPath)
+	if err != nil {
+		report.conflict(Merge_Stage_UserData, UserDataDB, err.Error())
+		return
+	}
+	defer src.Close()
+	dst := openUserDataDB(filepath.Join(dstPath, "Msg", UserDataDB))
+	if dst == nil {
+		report.conflict(Merge_Stage_UserData, UserDataDB, "open failed")
+		return
+	}
+	defer dst.Close()
+
+	rows, err := src.Query("select ifnull(userName,''), ifnull(markId,''), ifnull(tag,''), ifnull(info,'') from bookMark;")
+	if err == nil {
+		for rows.Next() {
+			var userName, markId, tag, info string
+			if err := rows.Scan(&userName, &markId, &tag, &info); err != nil {
+				continue
+			}
+			result, err := dst.Exec("INSERT INTO bookMark (userName, markId, tag, info) SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM bookMark WHERE userName=? AND markId=?);",
+				userName, markId, tag, info, userName, markId)
+			if err != nil {
+				report.conflict(Merge_Stage_UserData, "bookMark:"+markId, err.Error())
+				continue
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				report.BookmarksAdded += n
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = src.Query("select ifnull(userName,''), ifnull(timestamp,0), ifnull(messageId,'') from lastTime;")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userName, messageId string
+		var timestamp int64
+		if err := rows.Scan(&userName, &timestamp, &messageId); err != nil {
+			continue
+		}
+
+		var dstTimestamp int64
+		err := dst.QueryRow("select ifnull(timestamp,0) from lastTime where userName=?;", userName).Scan(&dstTimestamp)
+		if err == sql.ErrNoRows {
+			_, err = dst.Exec("INSERT INTO lastTime (userName, timestamp, messageId) VALUES (?, ?, ?);", userName, timestamp, messageId)
+		} else if err == nil && timestamp > dstTimestamp {
+			_, err = dst.Exec("UPDATE lastTime SET timestamp=?, messageId=? WHERE userName=?;", timestamp, messageId, userName)
+		} else {
+			continue
+		}
+		if err != nil {
+			report.conflict(Merge_Stage_UserData, "lastTime:"+userName, err.Error())
+			continue
+		}
+		report.LastTimeUpdated += 1
+	}
+}
+
+// mergeExportFiles 复制目标目录中没有的FileStorage文件，同名文件大小或哈希不同时保留目标文件并记录冲突
+func mergeExportFiles(srcPath, dstPath string, tracker *exportTracker, report *MergeReport) {
+	srcRoot := filepath.Join(srcPath, "FileStorage")
+	files := make([]string, 0)
+	var totalSize int64
+	filepath.Walk(srcRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			totalSize += info.Size()
+		}
+		return nil
+	})
+	tracker.setTotal(int64(len(files)), totalSize)
+
+	for _, src := range files {
+		relPath := src[len(srcPath):]
+		dst := dstPath + relPath
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+
+		dstInfo, err := os.Stat(dst)
+		if err != nil {
+			os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+			if _, err := copyFile(src, dst); err != nil {
+				report.conflict(Merge_Stage_File, relPath, err.Error())
+			} else {
+				report.FilesAdded += 1
+			}
+			tracker.fileDone(srcInfo.Size())
+			continue
+		}
+
+		if dstInfo.Size() != srcInfo.Size() {
+			report.Conflicts = append(report.Conflicts, MergeConflict{Stage: Merge_Stage_File, Path: relPath, Reason: "size differs", SrcSize: srcInfo.Size(), DstSize: dstInfo.Size()})
+			tracker.fileSkipped(srcInfo.Size())
+			continue
+		}
+
+		srcHash, err1 := utils.CalculateFileHash(src)
+		dstHash, err2 := utils.CalculateFileHash(dst)
+		if err1 != nil || err2 != nil || srcHash != dstHash {
+			report.Conflicts = append(report.Conflicts, MergeConflict{Stage: Merge_Stage_File, Path: relPath, Reason: "hash differs", SrcSize: srcInfo.Size(), DstSize: dstInfo.Size()})
+		} else {
+			report.FilesSkipped += 1
+		}
+		tracker.fileSkipped(srcInfo.Size())
+	}
+	log.Printf("merge file: added %d, skipped %d, conflicts %d\n", report.FilesAdded, report.FilesSkipped, len(report.Conflicts))
+}
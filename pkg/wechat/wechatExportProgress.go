@@ -0,0 +1,264 @@
+package wechat
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	Export_Status_Processing = "processing"
+	Export_Status_Error      = "error"
+	Export_Status_Completed  = "completed"
+)
+
+const (
+	Export_Stage_DataBase  = "database"
+	Export_Stage_Dat       = "dat"
+	Export_Stage_VideoFile = "videoAndFile"
+	Export_Stage_Voice     = "voice"
+	Export_Stage_HeadImage = "headImage"
+	Export_Stage_Archive   = "archive"
+)
+
+type ExportProgress struct {
+	// 批量导出时标记所属账号
+	Account    string `json:"account,omitempty"`
+	Status     string `json:"status"`
+	Stage      string `json:"stage"`
+	Result     string `json:"result"`
+	Progress   int    `json:"progress"`
+	FilesDone  int64  `json:"filesDone"`
+	FilesTotal int64  `json:"filesTotal"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
+	// 增量导出时未变化而跳过的文件，已计入FilesDone/BytesDone
+	FilesSkipped int64 `json:"filesSkipped"`
+	BytesSkipped int64 `json:"bytesSkipped"`
+	ETA          int64 `json:"eta"`
+}
+
+// exportTracker 统计一个导出阶段的文件数和字节数，并换算为总进度百分比
+type exportTracker struct {
+	stage      string
+	start      int
+	end        int
+	filesTotal int64
+	bytesTotal int64
+	filesDone  int64
+	bytesDone  int64
+	filesSkip  int64
+	bytesSkip  int64
+	startTime  time.Time
+	// 限速导出时的字节速率上限，估算剩余时间时不超过该速率
+	rateLimit float64
+}
+
+func newExportTracker(stage string, start, end int, filesTotal, bytesTotal int64) *exportTracker {
+	return &exportTracker{
+		stage:      stage,
+		start:      start,
+		end:        end,
+		filesTotal: filesTotal,
+		bytesTotal: bytesTotal,
+		startTime:  time.Now(),
+	}
+}
+
+func (t *exportTracker) fileDone(size int64) {
+	atomic.AddInt64(&t.filesDone, 1)
+	atomic.AddInt64(&t.bytesDone, size)
+}
+
+func (t *exportTracker) fileSkipped(size int64) {
+	atomic.AddInt64(&t.filesSkip, 1)
+	atomic.AddInt64(&t.bytesSkip, size)
+	t.fileDone(size)
+}
+
+func (t *exportTracker) setTotal(filesTotal, bytesTotal int64) {
+	atomic.StoreInt64(&t.filesTotal, filesTotal)
+	atomic.StoreInt64(&t.bytesTotal, bytesTotal)
+}
+
+// remaining 当前阶段还未处理的字节数
+func (t *exportTracker) remaining() int64 {
+	return atomic.LoadInt64(&t.bytesTotal) - atomic.LoadInt64(&t.bytesDone)
+}
+
+func (t *exportTracker) event(status, result string) ExportProgress {
+	p := ExportProgress{
+		Status:     status,
+		Stage:      t.stage,
+		Result:     result,
+		FilesDone:  atomic.LoadInt64(&t.filesDone),
+		FilesTotal: atomic.LoadInt64(&t.filesTotal),
+		BytesDone:  atomic.LoadInt64(&t.bytesDone),
+		BytesTotal: atomic.LoadInt64(&t.bytesTotal),
+	}
+	p.FilesSkipped = atomic.LoadInt64(&t.filesSkip)
+	p.BytesSkipped = atomic.LoadInt64(&t.bytesSkip)
+
+	// 优先按字节计算进度，没有字节信息时按文件数计算
+	done, total := p.BytesDone, p.BytesTotal
+	if total <= 0 {
+		done, total = p.FilesDone, p.FilesTotal
+	}
+
+	percent := float64(0)
+	if total > 0 {
+		percent = float64(done) / float64(total)
+		if percent > 1 {
+			percent = 1
+		}
+	}
+	p.Progress = t.start + int(percent*float64(t.end-t.start))
+
+	elapsed := time.Since(t.startTime).Seconds()
+	if done > 0 && total > done && elapsed > 0 {
+		rate := float64(done) / elapsed
+		if t.rateLimit > 0 && p.BytesTotal > 0 && rate > t.rateLimit {
+			rate = t.rateLimit
+		}
+		p.ETA = int64(float64(total-done) / rate)
+	}
+
+	return p
+}
+
+func (t *exportTracker) finish(result string) ExportProgress {
+	p := t.event(Export_Status_Processing, result)
+	p.Progress = t.end
+	p.ETA = 0
+	return p
+}
+
+// report 每秒发送一次进度，返回的函数用于停止上报
+func (t *exportTracker) report(progress chan<- ExportProgress, result string) func() {
+	var wg sync.WaitGroup
+	quitChan := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quitChan:
+				return
+			case <-ticker.C:
+				progress <- t.event(Export_Status_Processing, result)
+			}
+		}
+	}()
+
+	return func() {
+		close(quitChan)
+		wg.Wait()
+	}
+}
+
+type ExportFileError struct {
+	Stage string `json:"stage"`
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// ExportStageStat 单个导出阶段的耗时和文件统计
+type ExportStageStat struct {
+	Stage        string `json:"stage"`
+	Duration     int64  `json:"durationMs"`
+	FilesCopied  int64  `json:"filesCopied"`
+	BytesCopied  int64  `json:"bytesCopied"`
+	FilesSkipped int64  `json:"filesSkipped"`
+	BytesSkipped int64  `json:"bytesSkipped"`
+}
+
+// ExportReport 汇总导出过程中单个文件的错误，单个文件失败不中断导出
+type ExportReport struct {
+	Errors       []ExportFileError `json:"errors"`
+	Total        int               `json:"total"`
+	FilesCopied  int64             `json:"filesCopied"`
+	BytesCopied  int64             `json:"bytesCopied"`
+	FilesSkipped int64             `json:"filesSkipped"`
+	BytesSkipped int64             `json:"bytesSkipped"`
+	Stages       []ExportStageStat `json:"stages"`
+	lock         sync.Mutex
+}
+
+func newExportReport() *ExportReport {
+	return &ExportReport{Errors: make([]ExportFileError, 0), Stages: make([]ExportStageStat, 0)}
+}
+
+// stageStat 需要在持有锁时调用
+func (r *ExportReport) stageStat(stage string) *ExportStageStat {
+	for i := range r.Stages {
+		if r.Stages[i].Stage == stage {
+			return &r.Stages[i]
+		}
+	}
+	r.Stages = append(r.Stages, ExportStageStat{Stage: stage})
+	return &r.Stages[len(r.Stages)-1]
+}
+
+func (r *ExportReport) addStageDuration(stage string, duration time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stageStat(stage).Duration += duration.Milliseconds()
+}
+
+func (r *ExportReport) add(stage, path string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Errors = append(r.Errors, ExportFileError{Stage: stage, Path: path, Error: err.Error()})
+	r.Total += 1
+}
+
+// addCopyStat 累计一个复制阶段的复制和跳过数量
+func (r *ExportReport) addCopyStat(t *exportTracker) {
+	p := t.event(Export_Status_Processing, "")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.FilesCopied += p.FilesDone - p.FilesSkipped
+	r.BytesCopied += p.BytesDone - p.BytesSkipped
+	r.FilesSkipped += p.FilesSkipped
+	r.BytesSkipped += p.BytesSkipped
+
+	stat := r.stageStat(t.stage)
+	stat.FilesCopied += p.FilesDone - p.FilesSkipped
+	stat.BytesCopied += p.BytesDone - p.BytesSkipped
+	stat.FilesSkipped += p.FilesSkipped
+	stat.BytesSkipped += p.BytesSkipped
+}
+
+// mediaFileUnchanged 目标文件大小相同且修改时间不早于源文件时认为未变化，
+// checkHash为true时再比较文件内容的哈希
+func mediaFileUnchanged(src, dst string, srcSize int64, checkHash bool) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil || dstInfo.IsDir() {
+		return false
+	}
+	if dstInfo.Size() != srcSize || dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return false
+	}
+	if !checkHash {
+		return true
+	}
+
+	srcHash, err := utils.CalculateFileHash(src)
+	if err != nil {
+		return false
+	}
+	dstHash, err := utils.CalculateFileHash(dst)
+	if err != nil {
+		return false
+	}
+
+	return srcHash == dstHash
+}
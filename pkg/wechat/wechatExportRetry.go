@@ -0,0 +1,89 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	// 导出到网络路径时单个文件默认的最大尝试次数
+	defaultNetworkCopyAttempts = 3
+	exportRetryBaseDelay       = time.Second
+	exportRetryMaxDelay        = 30 * time.Second
+)
+
+// exportCopyAttempts 目标为UNC路径或网络驱动器时按options.CopyAttempts重试，未设置时使用默认值；本地路径只尝试一次
+func exportCopyAttempts(expPath string, options ExportOptions) int {
+	if !utils.IsNetworkPath(expPath) {
+		return 1
+	}
+	if options.CopyAttempts > 0 {
+		return options.CopyAttempts
+	}
+	return defaultNetworkCopyAttempts
+}
+
+// exportRetryable 磁盘已满、密钥错误和源文件不存在重试也不会成功
+func exportRetryable(err error) bool {
+	return !isDiskFullError(err) && !errors.Is(err, errIncorrectPassword) && !errors.Is(err, os.ErrNotExist)
+}
+
+// retryExportWrite 写入失败时按指数退避重试，最终失败的错误中带上尝试次数
+func retryExportWrite(attempts int, write func() error) error {
+	delay := exportRetryBaseDelay
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = write()
+		if err == nil || !exportRetryable(err) {
+			return err
+		}
+		if attempt == attempts {
+			break
+		}
+
+		log.Printf("export write failed (attempt %d/%d), retry in %v: %v\n", attempt, attempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > exportRetryMaxDelay {
+			delay = exportRetryMaxDelay
+		}
+	}
+
+	if attempts > 1 {
+		return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+	}
+	return err
+}
+
+// copyFileRetry 复制并在写入后校验目标文件大小，attempts大于1时失败重试
+func copyFileRetry(src, dst string, throttle *exportThrottle, attempts int) (int64, error) {
+	if attempts <= 1 {
+		return copyFileThrottled(src, dst, throttle)
+	}
+
+	var written int64
+	err := retryExportWrite(attempts, func() error {
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		written, err = copyFileThrottled(src, dst, throttle)
+		if err != nil {
+			return err
+		}
+		dstInfo, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		if dstInfo.Size() != srcInfo.Size() {
+			return fmt.Errorf("size mismatch: %s is %d bytes, expected %d", dst, dstInfo.Size(), srcInfo.Size())
+		}
+		return nil
+	})
+
+	return written, err
+}
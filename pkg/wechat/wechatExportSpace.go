@@ -0,0 +1,147 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"wechatDataBackup/pkg/utils"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// 导出目标磁盘至少保留的剩余空间，避免把系统盘写满
+	exportSpaceReserve = 500 * 1024 * 1024
+	// 复制过程中重新检查剩余空间的间隔
+	exportSpaceCheckInterval = 2 * time.Second
+)
+
+// DiskFullError 导出过程中磁盘空间不足，Required为完成整个导出还需要释放的字节数
+type DiskFullError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+	Err       error
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("disk full: %s needs %d more bytes, %d bytes available", e.Path, e.Required, e.Available)
+}
+
+func (e *DiskFullError) Unwrap() error {
+	return e.Err
+}
+
+// isDiskFullError 判断写入失败是否由磁盘已满引起
+func isDiskFullError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, windows.ERROR_DISK_FULL) ||
+		errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
+
+// exportSpaceGuard 监控导出目录所在磁盘的剩余空间，空间不足或写入返回磁盘已满时停止整个导出，
+// 之后的文件直接跳过，只记录一次错误
+type exportSpaceGuard struct {
+	path      string
+	reserve   uint64
+	stop      int32
+	lock      sync.Mutex
+	lastCheck time.Time
+	err       *DiskFullError
+	// later 返回当前阶段之后的阶段还需要写入的字节数，只在空间不足时计算
+	later func() int64
+}
+
+func newExportSpaceGuard(path string) *exportSpaceGuard {
+	return &exportSpaceGuard{path: path, reserve: exportSpaceReserve}
+}
+
+func (g *exportSpaceGuard) setLater(later func() int64) {
+	g.lock.Lock()
+	g.later = later
+	g.lock.Unlock()
+}
+
+func (g *exportSpaceGuard) stopped() bool {
+	return atomic.LoadInt32(&g.stop) != 0
+}
+
+// check 距上次检查超过exportSpaceCheckInterval时重新获取剩余空间，低于预留空间时停止导出；
+// remaining为当前阶段还需要写入的字节数，返回是否已停止
+func (g *exportSpaceGuard) check(remaining int64) bool {
+	if g.stopped() {
+		return true
+	}
+
+	g.lock.Lock()
+	if time.Since(g.lastCheck) < exportSpaceCheckInterval {
+		g.lock.Unlock()
+		return false
+	}
+	g.lastCheck = time.Now()
+	g.lock.Unlock()
+
+	stat, err := utils.GetPathStat(g.path)
+	if err != nil {
+		log.Println("GetPathStat:", err)
+		return false
+	}
+	if stat.Free >= g.reserve {
+		return false
+	}
+
+	g.fail(stat.Free, remaining, errors.New("free space below reserve"))
+	return true
+}
+
+// failWrite 写入错误是磁盘已满时停止导出并返回true，调用方不再单独记录该错误
+func (g *exportSpaceGuard) failWrite(err error, remaining int64) bool {
+	if !isDiskFullError(err) {
+		return false
+	}
+
+	free := uint64(0)
+	if stat, err := utils.GetPathStat(g.path); err == nil {
+		free = stat.Free
+	}
+	g.fail(free, remaining, err)
+	return true
+}
+
+func (g *exportSpaceGuard) fail(free uint64, remaining int64, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err != nil {
+		return
+	}
+
+	// 还需要的空间包括当前阶段剩余的和之后各阶段预计写入的字节数
+	if g.later != nil {
+		remaining += g.later()
+	}
+	required := g.reserve
+	if remaining > 0 {
+		required += uint64(remaining)
+	}
+	if required > free {
+		required -= free
+	} else {
+		required = 0
+	}
+	g.err = &DiskFullError{Path: g.path, Required: required, Available: free, Err: err}
+	atomic.StoreInt32(&g.stop, 1)
+	log.Println("export stopped:", g.err, err)
+}
+
+// error 返回导出停止的原因，未停止时返回nil
+func (g *exportSpaceGuard) error() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err == nil {
+		return nil
+	}
+	return g.err
+}
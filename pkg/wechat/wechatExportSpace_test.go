@@ -0,0 +1,23 @@
+package wechat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExportSpaceGuardRequiredIncludesLaterStages(t *testing.T) {
+	g := newExportSpaceGuard(t.TempDir())
+	g.setLater(func() int64 { return 3000 })
+	g.fail(1000, 500, errors.New("disk full"))
+
+	var diskFull *DiskFullError
+	if !errors.As(g.error(), &diskFull) {
+		t.Fatalf("error = %v, want *DiskFullError", g.error())
+	}
+	if want := g.reserve + 500 + 3000 - 1000; diskFull.Required != want {
+		t.Errorf("Required = %d, want %d", diskFull.Required, want)
+	}
+	if !g.stopped() {
+		t.Error("guard not stopped after fail")
+	}
+}
@@ -0,0 +1,109 @@
+package wechat
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// exportThrottle 令牌桶限速，按字节预留令牌，令牌不足时等待到令牌补足
+type exportThrottle struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newExportThrottle mbps<=0时不限速，返回nil
+func newExportThrottle(mbps int) *exportThrottle {
+	if mbps <= 0 {
+		return nil
+	}
+	rate := float64(mbps) * 1024 * 1024
+	// 允许一秒的突发，避免小文件也要逐个等待
+	return &exportThrottle{rate: rate, burst: rate, tokens: rate, last: time.Now()}
+}
+
+func (t *exportThrottle) wait(n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	delay := time.Duration(0)
+	if t.tokens < 0 {
+		delay = time.Duration(-t.tokens / t.rate * float64(time.Second))
+	}
+	t.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// bytesPerSecond 未限速时返回0
+func (t *exportThrottle) bytesPerSecond() float64 {
+	if t == nil {
+		return 0
+	}
+	return t.rate
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *exportThrottle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.wait(int64(n))
+	return n, err
+}
+
+// copyFileThrottled 与copyFile相同，throttle不为nil时按throttle限速读取
+func copyFileThrottled(src, dst string, throttle *exportThrottle) (int64, error) {
+	if throttle == nil {
+		return copyFile(src, dst)
+	}
+
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer destFile.Close()
+
+	return io.Copy(destFile, &throttledReader{r: sourceFile, t: throttle})
+}
+
+// beginIdlePriority 将进程切换到后台模式，降低CPU和磁盘I/O优先级，返回的函数用于恢复
+func beginIdlePriority() func() {
+	process := windows.CurrentProcess()
+	if err := windows.SetPriorityClass(process, windows.PROCESS_MODE_BACKGROUND_BEGIN); err != nil {
+		log.Println("SetPriorityClass background begin:", err)
+		return func() {}
+	}
+
+	return func() {
+		if err := windows.SetPriorityClass(process, windows.PROCESS_MODE_BACKGROUND_END); err != nil {
+			log.Println("SetPriorityClass background end:", err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package wechat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wechatDataBackup/pkg/utils"
+)
+
+// 校验报告保存在账号导出目录下
+const ExportVerifyReportName = "verify_report.json"
+
+// 每次校验最多抽查的媒体文件数
+const exportVerifyMediaSample = 200
+
+type ExportVerifySummary struct {
+	OK           bool `json:"ok"`
+	DBTotal      int  `json:"dbTotal"`
+	DBFailed     int  `json:"dbFailed"`
+	MediaTotal   int  `json:"mediaTotal"`
+	MediaSampled int  `json:"mediaSampled"`
+	MediaFailed  int  `json:"mediaFailed"`
+}
+
+type DBVerifyResult struct {
+	Path      string `json:"path"`
+	Integrity string `json:"integrity"`
+	Tables    int    `json:"tables"`
+	Rows      int64  `json:"rows"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+type MediaVerifyError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type ExportVerifyReport struct {
+	VerifyTime  int64               `json:"verifyTime"`
+	Summary     ExportVerifySummary `json:"summary"`
+	Databases   []DBVerifyResult    `json:"databases"`
+	MediaErrors []MediaVerifyError  `json:"mediaErrors"`
+}
+
+// VerifyExport 检查导出目录中的数据库是否完整，并抽查媒体文件是否可读且非空，
+// 结果写入导出目录下的verify_report.json
+func VerifyExport(expPath string) (*ExportVerifyReport, error) {
+	if _, err := os.Stat(expPath); err != nil {
+		return nil, err
+	}
+
+	report := &ExportVerifyReport{
+		VerifyTime:  time.Now().Unix(),
+		Databases:   make([]DBVerifyResult, 0),
+		MediaErrors: make([]MediaVerifyError, 0),
+	}
+
+	filepath.Walk(filepath.Join(expPath, "Msg"), func(path string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("filepath.Walk：%v\n", err)
+			return nil
+		}
+		if finfo.IsDir() || !strings.HasSuffix(finfo.Name(), ".db") {
+			return nil
+		}
+
+		result := verifyExportDB(path)
+		result.Path = path[len(expPath):]
+		report.Databases = append(report.Databases, result)
+		report.Summary.DBTotal += 1
+		if !result.OK {
+			report.Summary.DBFailed += 1
+		}
+		return nil
+	})
+
+	media := make([]string, 0)
+	filepath.Walk(filepath.Join(expPath, "FileStorage"), func(path string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !finfo.IsDir() {
+			media = append(media, path)
+		}
+		return nil
+	})
+	report.Summary.MediaTotal = len(media)
+
+	// 均匀抽查，避免只检查到同一个目录
+	step := 1
+	if len(media) > exportVerifyMediaSample {
+		step = len(media) / exportVerifyMediaSample
+	}
+	for i := 0; i < len(media) && report.Summary.MediaSampled < exportVerifyMediaSample; i += step {
+		report.Summary.MediaSampled += 1
+		if err := verifyExportMedia(media[i]); err != nil {
+			report.Summary.MediaFailed += 1
+			report.MediaErrors = append(report.MediaErrors, MediaVerifyError{Path: media[i][len(expPath):], Error: err.Error()})
+		}
+	}
+
+	report.Summary.OK = report.Summary.DBTotal > 0 && report.Summary.DBFailed == 0 && report.Summary.MediaFailed == 0
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, err
+	}
+
+	return report, os.WriteFile(filepath.Join(expPath, ExportVerifyReportName), reportJson, os.ModePerm)
+}
+
+func verifyExportDB(path string) DBVerifyResult {
+	result := DBVerifyResult{}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer db.Close()
+
+	if err := db.QueryRow("PRAGMA integrity_check;").Scan(&result.Integrity); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if result.Integrity != "ok" {
+		result.Error = "integrity check failed"
+		return result
+	}
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table';")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+
+	result.Tables = len(tables)
+	if result.Tables == 0 {
+		result.Error = "no tables"
+		return result
+	}
+
+	for _, table := range tables {
+		var count int64
+		querySql := fmt.Sprintf("SELECT COUNT(*) FROM \"%s\";", strings.ReplaceAll(table, "\"", "\"\""))
+		if err := db.QueryRow(querySql).Scan(&count); err != nil {
+			result.Error = fmt.Sprintf("%s: %v", table, err)
+			return result
+		}
+		result.Rows += count
+	}
+
+	result.OK = true
+	return result
+}
+
+func verifyExportMedia(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var buf = make([]byte, 1)
+	if _, err := file.Read(buf); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("empty file")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// 导出完成后生成的文件清单，保存在账号导出目录下，用于移动或分享后校验导出是否完整
+const ExportManifestName = "manifest.json"
+
+type ExportManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ErrManifestCanceled 生成清单期间开始了新的导出，导出目录可能被替换
+var ErrManifestCanceled = errors.New("manifest build canceled")
+
+// BuildExportManifest 计算导出目录下每个文件的sha256并写入manifest.json，
+// 清单本身和每次校验都会重写的verify_report.json不在清单中；canceled返回true时停止并返回ErrManifestCanceled
+func BuildExportManifest(expPath string, canceled func() bool) ([]ExportManifestEntry, error) {
+	entries := make([]ExportManifestEntry, 0)
+	err := filepath.Walk(expPath, func(path string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if canceled != nil && canceled() {
+			return ErrManifestCanceled
+		}
+		if finfo.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(expPath, path)
+		if err != nil {
+			return err
+		}
+		if rel == ExportManifestName || rel == ExportManifestName+".tmp" || rel == ExportVerifyReportName {
+			return nil
+		}
+
+		hash, err := utils.CalculateFileHash(path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ExportManifestEntry{Path: filepath.ToSlash(rel), Size: finfo.Size(), SHA256: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if canceled != nil && canceled() {
+		return nil, ErrManifestCanceled
+	}
+	manifestPath := filepath.Join(expPath, ExportManifestName)
+	if err := os.WriteFile(manifestPath+".tmp", data, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(manifestPath+".tmp", manifestPath); err != nil {
+		os.Remove(manifestPath + ".tmp")
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LoadExportManifest 读取导出目录下的manifest.json
+func LoadExportManifest(expPath string) ([]ExportManifestEntry, error) {
+	data, err := os.ReadFile(filepath.Join(expPath, ExportManifestName))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ExportManifestEntry, 0)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
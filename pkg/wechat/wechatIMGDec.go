@@ -86,15 +86,7 @@ func DecryptDat(inFile string, outFile string) error {
 	}
 
 	// 根据检测到的图片格式修改输出文件扩展名
-	outFileWithExt := outFile
-	if ext != "" {
-		// 移除原来的扩展名并添加正确的扩展名
-		if strings.HasSuffix(outFile, ".dat") {
-			outFileWithExt = strings.TrimSuffix(outFile, ".dat") + ext
-		} else {
-			outFileWithExt = outFile + ext
-		}
-	}
+	outFileWithExt := datOutFileWithExt(outFile, ext)
 
 	distFile, er := os.Create(outFileWithExt)
 	if er != nil {
@@ -125,6 +117,36 @@ func DecryptDat(inFile string, outFile string) error {
 	return nil
 }
 
+func datOutFileWithExt(outFile string, ext string) string {
+	if ext == "" {
+		return outFile
+	}
+
+	// 移除原来的扩展名并添加正确的扩展名
+	if strings.HasSuffix(outFile, ".dat") {
+		return strings.TrimSuffix(outFile, ".dat") + ext
+	}
+	return outFile + ext
+}
+
+// decryptDatOutPath 读取dat文件头，返回DecryptDat实际写入的文件路径
+func decryptDatOutPath(inFile string, outFile string) (string, error) {
+	sourceFile, err := os.Open(inFile)
+	if err != nil {
+		return "", err
+	}
+	defer sourceFile.Close()
+
+	var preTenBts = make([]byte, 10)
+	_, _ = sourceFile.Read(preTenBts)
+	_, ext, err := findDecodeByte(preTenBts)
+	if err != nil {
+		return "", err
+	}
+
+	return datOutFileWithExt(outFile, ext), nil
+}
+
 func handlerOne(info os.FileInfo, dir string, outputDir string) {
 	if info.IsDir() || filepath.Ext(info.Name()) != ".dat" {
 		return
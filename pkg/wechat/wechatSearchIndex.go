@@ -0,0 +1,223 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	msgSearchIndexTable = "MsgSearchIndex"
+	// 记录每个会话建立索引时的最大localId，用于判断索引是否包含之后导出的消息
+	msgSearchIndexInfoTable = "MsgSearchIndexInfo"
+	// trigram分词只能匹配不少于3个字符的关键字，更短的关键字仍然逐条比较
+	msgSearchIndexMinKeyWord = 3
+	msgSearchIndexBatchSize  = 500
+)
+
+// ErrSearchIndexUnsupported 编译时没有启用FTS5（需要sqlite_fts5编译标签）
+var ErrSearchIndexUnsupported = errors.New("sqlite build does not support fts5")
+
+// MessageSearchIndexSummary 重建搜索索引的进度和结果
+type MessageSearchIndexSummary struct {
+	UserName string `json:"userName"`
+	DBDone   int    `json:"dbDone"`
+	DBTotal  int    `json:"dbTotal"`
+	Messages int64  `json:"messages"`
+	Duration int64  `json:"durationMs"`
+}
+
+func (P *WechatDataProvider) RebuildMessageSearchIndex(userName string) error {
+	_, err := P.RebuildMessageSearchIndexWithProgress(userName, nil)
+	return err
+}
+
+// RebuildMessageSearchIndexWithProgress 在每个MSG数据库中为userName的消息建立FTS5索引，
+// 索引内容与weChatMessageContains比较的文本一致，每处理完一个数据库发送一次进度
+func (P *WechatDataProvider) RebuildMessageSearchIndexWithProgress(userName string, progress chan<- MessageSearchIndexSummary) (*MessageSearchIndexSummary, error) {
+	startTime := time.Now()
+	summary := &MessageSearchIndexSummary{UserName: userName, DBTotal: len(P.msgDBs)}
+	for _, msgDB := range P.msgDBs {
+		count, err := P.rebuildMsgDBSearchIndex(msgDB, userName)
+		if err != nil {
+			log.Printf("rebuild search index %s failed: %v\n", msgDB.path, err)
+			return summary, err
+		}
+		summary.Messages += count
+		summary.DBDone += 1
+		summary.Duration = time.Since(startTime).Milliseconds()
+		if progress != nil {
+			progress <- *summary
+		}
+	}
+
+	log.Printf("RebuildMessageSearchIndex %s: %d messages in %d ms\n", userName, summary.Messages, summary.Duration)
+	return summary, nil
+}
+
+func (P *WechatDataProvider) rebuildMsgDBSearchIndex(msgDB *wechatMsgDB, userName string) (int64, error) {
+	_, err := msgDB.db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + msgSearchIndexTable +
+		" USING fts5(MsgSvrID UNINDEXED, Content, CreateTime UNINDEXED, StrTalker UNINDEXED, tokenize='trigram');")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			return 0, ErrSearchIndexUnsupported
+		}
+		return 0, err
+	}
+	_, err = msgDB.db.Exec("CREATE TABLE IF NOT EXISTS " + msgSearchIndexInfoTable +
+		"(StrTalker TEXT PRIMARY KEY, MaxLocalId INTEGER, BuildTime INTEGER);")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := msgDB.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM "+msgSearchIndexTable+" WHERE StrTalker=?;", userName); err != nil {
+		return 0, err
+	}
+	insert, err := tx.Prepare("INSERT INTO " + msgSearchIndexTable + "(rowid, MsgSvrID, Content, CreateTime, StrTalker) VALUES (?, ?, ?, ?, ?);")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	// 按localId分批读取，消息内容经过与查询时相同的解析后写入索引
+	count := int64(0)
+	maxLocalId := 0
+	querySql := "select " + wechatMsgColumns + " from MSG Where StrTalker=? And localId>? order by localId asc limit ?;"
+	for {
+		rows, err := tx.Query(querySql, userName, maxLocalId, msgSearchIndexBatchSize)
+		if err != nil {
+			return count, err
+		}
+		List := &WeChatMessageList{Rows: make([]WeChatMessage, 0)}
+		err = P.wechatMessageRowsHandle(rows, List)
+		rows.Close()
+		if err != nil {
+			return count, err
+		}
+		if List.Total == 0 {
+			break
+		}
+
+		for i := range List.Rows {
+			msg := &List.Rows[i]
+			maxLocalId = msg.LocalId
+			text := weChatMessageSearchText(msg)
+			if text == "" {
+				continue
+			}
+			if _, err := insert.Exec(msg.LocalId, msg.MsgSvrId, text, msg.CreateTime, userName); err != nil {
+				return count, err
+			}
+			count += 1
+		}
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO "+msgSearchIndexInfoTable+"(StrTalker, MaxLocalId, BuildTime) VALUES (?, ?, ?);",
+		userName, maxLocalId, time.Now().Unix())
+	if err != nil {
+		return count, err
+	}
+
+	return count, tx.Commit()
+}
+
+// weChatMessageSearchText 返回weChatMessageContains会比较的文本
+func weChatMessageSearchText(msg *WeChatMessage) string {
+	switch msg.Type {
+	case Wechat_Message_Type_Text:
+		return msg.Content
+	case Wechat_Message_Type_Location:
+		return msg.LocationInfo.Label + "\n" + msg.LocationInfo.PoiName
+	case Wechat_Message_Type_Misc:
+		switch msg.SubType {
+		case Wechat_Misc_Message_CardLink, Wechat_Misc_Message_ThirdVideo, Wechat_Misc_Message_Applet, Wechat_Misc_Message_Applet2:
+			return msg.LinkInfo.Title + "\n" + msg.LinkInfo.Description
+		case Wechat_Misc_Message_Refer:
+			return msg.Content
+		case Wechat_Misc_Message_File:
+			return msg.FileInfo.FileName
+		}
+	}
+	return ""
+}
+
+// msgDBSearchIndexReady 数据库中没有userName的消息，或索引包含了userName的全部消息时返回true
+func msgDBSearchIndexReady(msgDB *wechatMsgDB, userName string) bool {
+	maxLocalId := 0
+	err := msgDB.db.QueryRow("select ifnull(max(localId),0) from MSG Where StrTalker=?;", userName).Scan(&maxLocalId)
+	if err != nil {
+		return false
+	}
+	if maxLocalId == 0 {
+		return true
+	}
+
+	indexLocalId := 0
+	err = msgDB.db.QueryRow("select MaxLocalId from "+msgSearchIndexInfoTable+" Where StrTalker=?;", userName).Scan(&indexLocalId)
+	if err != nil {
+		return false
+	}
+
+	return indexLocalId >= maxLocalId
+}
+
+// weChatGetMessageListBySearchIndex 使用FTS5索引查找关键字，任一数据库的索引缺失或过期时返回false，由调用方逐条比较
+func (P *WechatDataProvider) weChatGetMessageListBySearchIndex(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, bool) {
+	if utf8.RuneCountInString(keyWord) < msgSearchIndexMinKeyWord {
+		return nil, false
+	}
+
+	index := P.wechatFindDBIndex(userName, time, Message_Search_Forward)
+	if index == -1 {
+		return nil, false
+	}
+	for _, msgDB := range P.msgDBs[index:] {
+		if !msgDBSearchIndexReady(msgDB, userName) {
+			return nil, false
+		}
+	}
+
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+	List.KeyWord = keyWord
+	List.MsgType = msgType
+
+	match := fmt.Sprintf("\"%s\"", strings.ReplaceAll(keyWord, "\"", "\"\""))
+	querySql := "select " + wechatMsgColumns + " from MSG Where localId in (select rowid from " + msgSearchIndexTable +
+		" Where " + msgSearchIndexTable + " MATCH ? And StrTalker=?) And CreateTime<=? order by Sequence desc;"
+	for _, msgDB := range P.msgDBs[index:] {
+		rows, err := msgDB.db.Query(querySql, match, userName, time)
+		if err != nil {
+			log.Printf("%s search index failed %v\n", msgDB.path, err)
+			return nil, false
+		}
+		rawList := &WeChatMessageList{Rows: make([]WeChatMessage, 0)}
+		err = P.wechatMessageRowsHandle(rows, rawList)
+		rows.Close()
+		if err != nil {
+			return nil, false
+		}
+
+		// trigram匹配不区分大小写，再按原来的规则确认一次
+		for i := range rawList.Rows {
+			if weChatMessageTypeFilter(&rawList.Rows[i], msgType) && weChatMessageContains(&rawList.Rows[i], keyWord) {
+				List.Rows = append(List.Rows, rawList.Rows[i])
+				List.Total += 1
+				if List.Total >= pageSize {
+					return List, true
+				}
+			}
+		}
+	}
+
+	return List, true
+}
@@ -0,0 +1,158 @@
+package wechat
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	WeChat_Data_Version3 = 3
+	WeChat_Data_Version4 = 4
+)
+
+const (
+	weChatV4ProcessName = "Weixin.exe"
+	weChatV4DllName     = "Weixin.dll"
+	// 4.0的数据库都在db_storage下
+	weChatV4DBRoot = "db_storage"
+)
+
+// weChatDBRoot 返回源数据库目录
+func weChatDBRoot(info WeChatInfo) string {
+	return info.FilePath + "\\Msg"
+}
+
+// weChatMediaRoot 返回FileStorage子目录name在源数据目录中的位置
+func weChatMediaRoot(info WeChatInfo, name string) string {
+	return info.FilePath + "\\FileStorage\\" + name
+}
+
+// weChatMediaExportPath 将源媒体文件路径转换为导出路径
+func weChatMediaExportPath(info WeChatInfo, expPath string, path string) string {
+	return expPath + path[len(info.FilePath):]
+}
+
+// getWeChatInfoV4 通过Weixin.exe打开的db_storage下的文件确定数据目录，
+// 数据目录为xwechat_files\<账号>
+func getWeChatInfoV4(p *process.Process, info *WeChatInfo) bool {
+	info.DataVersion = WeChat_Data_Version4
+	info.ProcessID = uint32(p.Pid)
+	info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
+	log.Println("ProcessID", info.ProcessID, "WeChat 4.0")
+
+	files, err := p.OpenFiles()
+	if err != nil {
+		log.Println("OpenFiles failed")
+		return false
+	}
+
+	sep := "\\" + weChatV4DBRoot + "\\"
+	for _, f := range files {
+		if index := strings.Index(f.Path, sep); index != -1 && strings.HasSuffix(f.Path, ".db") {
+			info.FilePath = f.Path[:index]
+			info.AcountName = filepath.Base(info.FilePath)
+			break
+		}
+	}
+	if len(info.FilePath) == 0 {
+		log.Println("wechat not log in")
+		return false
+	}
+
+	baseAddr, baseSize, version, err := getModuleVersion(info.ProcessID, weChatV4DllName)
+	if err != nil {
+		log.Println("getModuleVersion failed", err)
+		return false
+	}
+	info.DllBaseAddr = baseAddr
+	info.DllBaseSize = baseSize
+	info.Version = version
+
+	return true
+}
+
+// getModuleVersion 返回进程中模块的基址、大小和文件版本
+func getModuleVersion(pid uint32, moduleName string) (uintptr, uint32, string, error) {
+	hModuleSnap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, pid)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer windows.CloseHandle(hModuleSnap)
+
+	var me32 windows.ModuleEntry32
+	me32.Size = uint32(windows.SizeofModuleEntry32)
+
+	for err = windows.Module32First(hModuleSnap, &me32); err == nil; err = windows.Module32Next(hModuleSnap, &me32) {
+		if windows.UTF16ToString(me32.Module[:]) != moduleName {
+			continue
+		}
+
+		var zero windows.Handle
+		driverPath := windows.UTF16ToString(me32.ExePath[:])
+		infoSize, err := windows.GetFileVersionInfoSize(driverPath, &zero)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		versionInfo := make([]byte, infoSize)
+		if err = windows.GetFileVersionInfo(driverPath, 0, infoSize, unsafe.Pointer(&versionInfo[0])); err != nil {
+			return 0, 0, "", err
+		}
+		var fixedInfo *windows.VS_FIXEDFILEINFO
+		fixedInfoLen := uint32(unsafe.Sizeof(*fixedInfo))
+		err = windows.VerQueryValue(unsafe.Pointer(&versionInfo[0]), `\`, (unsafe.Pointer)(&fixedInfo), &fixedInfoLen)
+		if err != nil {
+			return 0, 0, "", err
+		}
+
+		version := fmt.Sprintf("%d.%d.%d.%d",
+			(fixedInfo.FileVersionMS>>16)&0xff,
+			(fixedInfo.FileVersionMS>>0)&0xff,
+			(fixedInfo.FileVersionLS>>16)&0xff,
+			(fixedInfo.FileVersionLS>>0)&0xff)
+		return me32.ModBaseAddr, me32.ModBaseSize, version, nil
+	}
+
+	return 0, 0, "", errors.New(moduleName + " not found")
+}
+
+// ErrInvalidKey 手动输入的密钥与数据库不匹配
+var ErrInvalidKey = errors.New("key invalid")
+
+// ErrUnsupportedDataVersion 4.0的数据库和媒体目录与3.x不同，查看器只能读取3.x的结构，
+// 目前只识别4.0账号并提示不支持，不导出其数据
+var ErrUnsupportedDataVersion = errors.New("WeChat 4.0 data export is not supported")
+
+// GetWeChatInfoFromDir 根据微信数据目录和已知的密钥构造账号信息，不需要微信进程；
+// 有db_storage目录的4.0数据目录返回ErrUnsupportedDataVersion
+func GetWeChatInfoFromDir(dataDir string, key string) (*WeChatInfo, error) {
+	dataDir = strings.TrimRight(dataDir, "\\/")
+	info := &WeChatInfo{FilePath: dataDir, AcountName: filepath.Base(dataDir), DataVersion: WeChat_Data_Version3}
+
+	if _, err := os.Stat(dataDir + "\\" + weChatV4DBRoot); err == nil {
+		return nil, fmt.Errorf("%s: %w", dataDir, ErrUnsupportedDataVersion)
+	}
+	keyDB := dataDir + "\\Msg\\Media.db"
+	if _, err := os.Stat(keyDB); err != nil {
+		return nil, fmt.Errorf("%s is not a WeChat data directory: %v", dataDir, err)
+	}
+
+	password, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(password) != keySize {
+		return nil, fmt.Errorf("%w: need %d hex characters", ErrInvalidKey, keySize*2)
+	}
+	if !checkDataBaseKey(keyDB, password) {
+		return nil, fmt.Errorf("%w for %s", ErrInvalidKey, keyDB)
+	}
+	info.DBKey = hex.EncodeToString(password)
+
+	return info, nil
+}
@@ -0,0 +1,100 @@
+package wechat
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	Voice_Converter_FFmpeg = "ffmpeg"
+	Voice_Converter_Silk   = "silk"
+)
+
+// ConvertVoiceToMp3 将silk或amr语音文件转换为mp3，返回使用的转换器
+func ConvertVoiceToMp3(src, dst string) (string, error) {
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	return ConvertVoiceDataToMp3(buf, dst)
+}
+
+// ConvertVoiceDataToMp3 优先使用PATH中的ffmpeg转换，ffmpeg不存在或转换失败时，
+// silk格式的语音使用内置的silk解码器
+func ConvertVoiceDataToMp3(buf []byte, dst string) (string, error) {
+	var ffmpegErr error
+	if ffmpeg, err := exec.LookPath("ffmpeg"); err == nil {
+		if ffmpegErr = ffmpegToMp3(ffmpeg, buf, dst); ffmpegErr == nil {
+			return Voice_Converter_FFmpeg, nil
+		}
+		log.Println("ffmpeg convert failed:", dst, ffmpegErr)
+	}
+
+	if !isSilkVoice(buf) {
+		if ffmpegErr != nil {
+			return "", ffmpegErr
+		}
+		return "", errors.New("ffmpeg not found, only silk voice can be converted")
+	}
+	if err := silkToMp3(buf, dst); err != nil {
+		return "", err
+	}
+	return Voice_Converter_Silk, nil
+}
+
+// isSilkVoice 微信的silk语音在标准的#!SILK_V3文件头前多一个0x02字节
+func isSilkVoice(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte("#!SILK")) || bytes.HasPrefix(buf, []byte("\x02#!SILK"))
+}
+
+func ffmpegToMp3(ffmpeg string, buf []byte, dst string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpeg, "-y", "-loglevel", "error", "-i", "pipe:0", "-f", "mp3", dst)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stderr = &stderr
+	// 不弹出控制台窗口
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	if err := cmd.Run(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// WeChatGetVoiceData 从导出目录的MediaMSG数据库中读取语音的原始数据
+func (P *WechatDataProvider) WeChatGetVoiceData(msgSvrId string) ([]byte, error) {
+	P.mediaMSGOnce.Do(func() {
+		for index := 0; ; index++ {
+			mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", P.resPath, index)
+			if _, err := os.Stat(mediaMSGDB); err != nil {
+				break
+			}
+			db, err := openSqlite(mediaMSGDB, P.readOnly)
+			if err != nil {
+				log.Printf("open %s failed: %v\n", mediaMSGDB, err)
+				continue
+			}
+			P.mediaMSGDBs = append(P.mediaMSGDBs, db)
+		}
+	})
+
+	for _, db := range P.mediaMSGDBs {
+		var buf []byte
+		err := db.QueryRow("select Buf from Media where Reserved0=?;", msgSvrId).Scan(&buf)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	return nil, ErrMessageNotFound
+}
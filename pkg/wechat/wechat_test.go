@@ -0,0 +1,53 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportVideoAndFileEmojiOption(t *testing.T) {
+	src := t.TempDir()
+	emoji := filepath.Join(src, "FileStorage", "CustomEmotion", "ab", "e1")
+	video := filepath.Join(src, "FileStorage", "Video", "2024-01", "v.mp4")
+	for _, name := range []string{emoji, video} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := WeChatInfo{FilePath: src}
+
+	export := func(emojiOn bool) string {
+		exp := t.TempDir()
+		options := DefaultExportOptions()
+		options.Emoji = emojiOn
+		options.Workers = 1
+		progress := make(chan ExportProgress)
+		done := make(chan struct{})
+		go func() {
+			for range progress {
+			}
+			close(done)
+		}()
+		exportWeChatVideoAndFile(info, exp, options, nil, newExportSpaceGuard(exp), 0, 100, newExportReport(), progress)
+		close(progress)
+		<-done
+		return exp
+	}
+
+	exp := export(false)
+	if _, err := os.Stat(weChatMediaExportPath(info, exp, video)); err != nil {
+		t.Errorf("video not exported: %v", err)
+	}
+	if _, err := os.Stat(weChatMediaExportPath(info, exp, emoji)); !os.IsNotExist(err) {
+		t.Errorf("emoji exported with emoji:false, stat err = %v", err)
+	}
+
+	exp = export(true)
+	if _, err := os.Stat(weChatMediaExportPath(info, exp, emoji)); err != nil {
+		t.Errorf("emoji not exported with emoji:true: %v", err)
+	}
+}